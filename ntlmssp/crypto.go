@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rc4"
 	"encoding/binary"
 	"fmt"
 	"github/izouxv/smbapi/smb/encoder"
@@ -135,3 +136,14 @@ func NTLMv2Verify(serverChallenge, clientChallengeStructurePadded []byte, passwo
 
 	// return ComputeResponseNTLMv2Check(nthash, w.Bytes(), tail)
 }
+
+// RC4K encrypts or decrypts data with key, it recovers the ExportedSessionKey from EncryptedRandomSessionKey.
+func RC4K(key, data []byte) []byte {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out
+}
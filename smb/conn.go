@@ -80,6 +80,9 @@ func (s *session) Recv(rw *bufio.ReadWriter) (data []byte, ver string, err error
 		return data, string(protID), nil
 	case ProtocolSmb:
 		return data, string(protID), nil
+	case ProtocolSmb2Transform:
+		//the caller decrypts it, only it knows the keys
+		return data, string(protID), nil
 	}
 }
 
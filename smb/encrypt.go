@@ -0,0 +1,132 @@
+package smb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+)
+
+const ProtocolSmb2Transform = "\xFDSMB"
+
+// TransformHeader wraps an encrypted message or compound.
+type TransformHeader struct {
+	ProtocolID          []byte `smb:"fixed:4"`
+	Signature           []byte `smb:"fixed:16"` //the AEAD tag
+	Nonce               []byte `smb:"fixed:16"`
+	OriginalMessageSize uint32
+	Reserved            uint16
+	Flags               uint16 //EncryptionAlgorithm before 3.1.1, 1 means encrypted with the session cipher either way
+	SessionId           uint64
+}
+
+const kTransformHeaderSize = 52
+
+const SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED uint16 = 0x0001
+
+// canEncrypt tells if the client and the server agreed on a cipher.
+func (s *SessionS) canEncrypt() bool {
+	return s.dialect >= DialectSmb_3_0 && s.cipherId != 0
+}
+
+// newAead returns the AEAD of the session cipher.
+func (s *SessionS) newAead(key []byte) (cipher.AEAD, error) {
+	switch s.cipherId {
+	case SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES256_CCM:
+		return NewAesCcm(key, 11, 16)
+	case SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES256_GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, ErrEncryption
+}
+
+// encryptMessage wraps the response buf in a transform header.
+func (s *SessionS) encryptMessage(buf []byte) ([]byte, error) {
+	aead, err := s.newAead(s.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	header := TransformHeader{
+		ProtocolID:          []byte(ProtocolSmb2Transform),
+		Signature:           make([]byte, 16),
+		Nonce:               make([]byte, 16),
+		OriginalMessageSize: uint32(len(buf)),
+		Flags:               SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED,
+		SessionId:           s.sessionID,
+	}
+	//a nonce is never used twice with the key, the counter makes it unique
+	binary.LittleEndian.PutUint64(header.Nonce, atomic.AddUint64(&s.encryptNonce, 1))
+	copy(header.Nonce[8:aead.NonceSize()], s.noncePrefix)
+	hdr, err := encoder.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, header.Nonce[:aead.NonceSize()], buf, hdr[20:])
+	n := len(buf)
+	copy(hdr[4:20], sealed[n:])
+	return append(hdr, sealed[:n]...), nil
+}
+
+// decryptMessage opens an encrypted request, the connection is dropped when it fails.
+func (s *SessionS) decryptMessage(msg []byte) ([]byte, error) {
+	if len(msg) < kTransformHeaderSize+64 || !s.canEncrypt() {
+		return nil, ErrEncryption
+	}
+	var header TransformHeader
+	if err := encoder.Unmarshal(msg[:kTransformHeaderSize], &header); err != nil {
+		return nil, err
+	}
+	if header.SessionId != s.sessionID || header.Flags != SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED ||
+		int(header.OriginalMessageSize) != len(msg)-kTransformHeaderSize {
+		return nil, ErrEncryption
+	}
+	aead, err := s.newAead(s.DecryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte(nil), msg[kTransformHeaderSize:]...), header.Signature...)
+	plain, err := aead.Open(nil, header.Nonce[:aead.NonceSize()], sealed, msg[20:kTransformHeaderSize])
+	if err != nil {
+		logx.Warnf("decrypt, SessionId: %v, err: %v", header.SessionId, err)
+		return nil, ErrEncryption
+	}
+	return plain, nil
+}
+
+// encryptResponse tells if the responses to a request must be encrypted.
+func (s *SessionS) encryptResponse(encrypted bool) bool {
+	return encrypted || (s.EncryptData && s.canEncrypt())
+}
+
+// checkEncryption refuses a plain request the session or the share wants encrypted.
+func (s *SessionS) checkEncryption(msg []byte, encrypted bool) Status {
+	if encrypted {
+		return StatusOk
+	}
+	switch Command(binary.LittleEndian.Uint16(msg[12:])) {
+	case CommandNegotiate, CommandSessionSetup:
+		return StatusOk
+	}
+	if s.EncryptData && s.canEncrypt() {
+		return STATUS_ACCESS_DENIED
+	}
+	if tree := s.GetTree(binary.LittleEndian.Uint32(msg[36:])); tree != nil && tree.anchor.EncryptData {
+		return STATUS_ACCESS_DENIED
+	}
+	return StatusOk
+}
+
+func newNoncePrefix() []byte {
+	prefix := make([]byte, 4)
+	cryptorand.Read(prefix)
+	return prefix
+}
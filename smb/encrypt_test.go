@@ -0,0 +1,86 @@
+package smb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EncryptMessage(t *testing.T) {
+	msg := make([]byte, 100)
+	copy(msg, ProtocolSmb2)
+	for _, item := range []struct {
+		cipherId uint16
+		keySize  int
+	}{
+		{SMB2_ENCRYPTION_AES128_CCM, 16},
+		{SMB2_ENCRYPTION_AES128_GCM, 16},
+		{SMB2_ENCRYPTION_AES256_CCM, 32},
+		{SMB2_ENCRYPTION_AES256_GCM, 32},
+	} {
+		key := make([]byte, item.keySize)
+		key[0] = byte(item.cipherId)
+		session := &SessionS{cipherId: item.cipherId, EncryptionKey: key, DecryptionKey: key, noncePrefix: newNoncePrefix()}
+		session.dialect = DialectSmb_3_1_1
+		session.sessionID = 7
+
+		buf, err := session.encryptMessage(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, ProtocolSmb2Transform, string(buf[:4]))
+		assert.Equal(t, kTransformHeaderSize+len(msg), len(buf))
+		plain, err := session.decryptMessage(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, plain)
+
+		//the nonce never repeats
+		buf2, _ := session.encryptMessage(msg)
+		assert.NotEqual(t, buf[20:36], buf2[20:36])
+
+		//the header is authenticated too
+		buf[44] ^= 1
+		_, err = session.decryptMessage(buf)
+		assert.NotNil(t, err)
+	}
+}
+
+func Test_CheckEncryption(t *testing.T) {
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_3_0_2
+	msg := make([]byte, 64)
+	msg[12] = byte(CommandRead)
+	assert.Equal(t, StatusOk, session.checkEncryption(msg, false))
+
+	anchor := NewAnchor("secret", "/tmp")
+	anchor.EncryptData = true
+	tree := session.TreeConnect(anchor)
+	msg[36] = byte(tree.id)
+	msg[37] = byte(tree.id >> 8)
+	msg[38] = byte(tree.id >> 16)
+	msg[39] = byte(tree.id >> 24)
+	assert.Equal(t, STATUS_ACCESS_DENIED, session.checkEncryption(msg, false))
+	assert.Equal(t, StatusOk, session.checkEncryption(msg, true))
+
+	session.cipherId = SMB2_ENCRYPTION_AES128_CCM
+	session.EncryptData = true
+	msg[12] = byte(CommandSessionSetup)
+	assert.Equal(t, StatusOk, session.checkEncryption(msg, false))
+	assert.True(t, session.encryptResponse(false))
+}
+
+func Test_EncryptNotification(t *testing.T) {
+	key := make([]byte, 16)
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_3_1_1
+	session.cipherId, session.EncryptionKey, session.noncePrefix = SMB2_ENCRYPTION_AES128_GCM, key, newNoncePrefix()
+	session.out = make(chan []byte, 2)
+	msg := make([]byte, 64)
+	copy(msg, ProtocolSmb2)
+
+	//a break about an open of an encrypted share is encrypted, even when the session is not
+	anchor := NewAnchor("secret", "/tmp")
+	anchor.EncryptData = true
+	session.sendNotification(msg, session.TreeConnect(anchor))
+	assert.Equal(t, ProtocolSmb2Transform, string((<-session.out)[:4]))
+	session.sendNotification(msg, session.TreeConnect(NewAnchor("public", "/tmp")))
+	assert.Equal(t, msg, <-session.out)
+}
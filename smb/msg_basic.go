@@ -44,6 +44,36 @@ const (
 	STATUS_FILE_CLOSED              Status = 0xC0000128
 	STATUS_UNSUCCESSFUL             Status = 0xC0000001
 	STATUS_END_OF_FILE              Status = 0xC0000011
+	STATUS_CANCELLED                Status = 0xC0000120
+	STATUS_NOTIFY_CLEANUP           Status = 0x0000010B
+	STATUS_NOTIFY_ENUM_DIR          Status = 0x0000010C
+	STATUS_INVALID_DEVICE_REQUEST   Status = 0xC0000010
+	STATUS_FILE_LOCK_CONFLICT       Status = 0xC0000054
+	STATUS_LOCK_NOT_GRANTED         Status = 0xC0000055
+	STATUS_RANGE_NOT_LOCKED         Status = 0xC000007E
+	STATUS_INVALID_LOCK_RANGE       Status = 0xC00001A1
+	STATUS_INVALID_OPLOCK_PROTOCOL  Status = 0xC00000E3
+	STATUS_REQUEST_NOT_ACCEPTED     Status = 0xC00000D0
+	STATUS_SHARING_VIOLATION        Status = 0xC0000043
+	STATUS_OBJECT_NAME_COLLISION    Status = 0xC0000035
+	STATUS_DELETE_PENDING           Status = 0xC0000056
+	STATUS_NOT_A_DIRECTORY          Status = 0xC0000103
+	STATUS_DIRECTORY_NOT_EMPTY      Status = 0xC0000101
+	STATUS_INVALID_INFO_CLASS       Status = 0xC0000003
+	STATUS_INFO_LENGTH_MISMATCH     Status = 0xC0000004
+	STATUS_INVALID_OWNER            Status = 0xC000005A
+	STATUS_INVALID_PRIMARY_GROUP    Status = 0xC000005B
+	STATUS_INVALID_SECURITY_DESCR   Status = 0xC0000079
+	STATUS_DISK_FULL                Status = 0xC000007F
+	STATUS_NO_MORE_ENTRIES          Status = 0x8000001A
+	STATUS_NO_EAS_ON_FILE           Status = 0xC0000052
+	STATUS_NO_MORE_EAS              Status = 0x80000012
+	STATUS_INVALID_EA_NAME          Status = 0x80000013
+	STATUS_EA_LIST_INCONSISTENT     Status = 0x80000014
+	STATUS_OBJECT_NAME_INVALID      Status = 0xC0000033
+
+	STATUS_SMB_NO_PREAUTH_INTEGRITY_HASH_OVERLAP Status = 0xC05D0000
+	STATUS_SHORT_NAMES_NOT_ENABLED_ON_VOLUME     Status = 0xC019005F
 )
 
 var StatusMap = map[Status]string{
@@ -312,3 +342,26 @@ func ERR(header Header, stat Status) (interface{}, error) {
 		StructureSize: 0x0009,
 	}, nil
 }
+
+// ErrDataResponse is an error response with ErrorData, STATUS_BUFFER_TOO_SMALL tells the size it needs.
+type ErrDataResponse struct {
+	Header
+	StructureSize     uint16
+	ErrorContextCount uint8
+	Reserved          uint8
+	ByteCount         uint32 `smb:"len:ErrorData"`
+	ErrorData         []byte
+}
+
+// ERRSIZE is STATUS_BUFFER_TOO_SMALL with the buffer size that is needed, MS-SMB2 2.2.2.2.
+func ERRSIZE(header Header, size uint32) (interface{}, error) {
+	header.Flags = SMB2_FLAGS_RESPONSE
+	header.Status = STATUS_BUFFER_TOO_SMALL
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, size)
+	return ErrDataResponse{
+		Header:        header,
+		StructureSize: 0x0009,
+		ErrorData:     data,
+	}, nil
+}
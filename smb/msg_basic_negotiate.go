@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github/izouxv/smbapi/gss"
+	"github/izouxv/smbapi/smb/encoder"
 
 	"github.com/izouxv/logx"
 )
@@ -34,6 +35,55 @@ const (
 	SMB2_GLOBAL_CAP_ENCRYPTION         = 0x00000040
 )
 
+// gServerGuid identifies the server, it is the same on every connection.
+var gServerGuid []byte = func() []byte {
+	// type GUID [16]byte
+	var g GUID
+
+	mustReadRand := func(dst []byte) {
+		_, err := cryptorand.Read(dst[:])
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	mustReadRand(g[:])
+	return g[:]
+}()
+
+// supportedDialects are the dialects the server speaks, best first.
+var supportedDialects = []uint16{DialectSmb_3_1_1, DialectSmb_3_0_2, DialectSmb_3_0, DialectSmb_2_1, DialectSmb_2_0_2}
+
+// selectDialect returns the best dialect offered by the client, 0 if none is supported.
+func selectDialect(dialects []uint16) uint16 {
+	for _, d := range supportedDialects {
+		for _, c := range dialects {
+			if c == d {
+				return d
+			}
+		}
+	}
+	return 0
+}
+
+// serverCapabilities are the capabilities announced for dialect.
+// Directory leasing is offered from 3.0 on, persistent handles are added by the caller
+// when the server has a store for them, multichannel is not supported. 3.1.1 negotiates encryption with
+// a negotiate context instead of SMB2_GLOBAL_CAP_ENCRYPTION.
+func serverCapabilities(dialect uint16, clientCapabilities uint32) uint32 {
+	if dialect == DialectSmb_2_0_2 {
+		return SMB2_GLOBAL_CAP_DFS
+	}
+	caps := uint32(SMB2_GLOBAL_CAP_DFS | SMB2_GLOBAL_CAP_LEASING | SMB2_GLOBAL_CAP_LARGE_MTU)
+	if dialect >= DialectSmb_3_0 {
+		caps |= SMB2_GLOBAL_CAP_DIRECTORY_LEASING
+	}
+	if (dialect == DialectSmb_3_0 || dialect == DialectSmb_3_0_2) && clientCapabilities&SMB2_GLOBAL_CAP_ENCRYPTION != 0 {
+		caps |= SMB2_GLOBAL_CAP_ENCRYPTION
+	}
+	return caps
+}
+
 func timeToFiletime(tm time.Time) uint64 {
 	nsec := tm.UnixNano()
 	// convert into 100-nanosecond
@@ -43,6 +93,11 @@ func timeToFiletime(tm time.Time) uint64 {
 	return uint64(nsec)
 }
 
+func filetimeToTime(ft uint64) time.Time {
+	// FILETIME counts 100-nanoseconds since January 1, 1601
+	return time.Unix(0, (int64(ft)-116444736000000000)*100)
+}
+
 type HeaderSmb1 struct {
 	ProtocolID  []byte `smb:"fixed:4"`
 	SmbCommand  uint8  //0x72: negotiate protocol
@@ -65,14 +120,18 @@ type NegotiateSmb1Request struct {
 }
 type NegotiateRequest struct {
 	Header
-	StructureSize   uint16
-	DialectCount    uint16 `smb:"count:Dialects"`
-	SecurityMode    uint16
-	Reserved        uint16
-	Capabilities    uint32
-	ClientGuid      []byte `smb:"fixed:16"`
-	ClientStartTime uint64
-	Dialects        []uint16
+	StructureSize uint16
+	DialectCount  uint16 `smb:"count:Dialects"`
+	SecurityMode  uint16
+	Reserved      uint16
+	Capabilities  uint32
+	ClientGuid    []byte `smb:"fixed:16"`
+	//ClientStartTime before 3.1.1
+	NegotiateContextOffset uint32
+	NegotiateContextCount  uint16
+	Reserved2              uint16
+	Dialects               []uint16
+	NegotiateContextList   NegotiateContextList
 }
 
 var myMech = func() asn1.ObjectIdentifier {
@@ -87,21 +146,22 @@ var myMech = func() asn1.ObjectIdentifier {
 
 type NegotiateResponse struct {
 	Header
-	StructureSize        uint16
-	SecurityMode         uint16
-	DialectRevision      uint16
-	Reserved             uint16
-	ServerGuid           []byte `smb:"fixed:16"`
-	Capabilities         uint32
-	MaxTransactSize      uint32
-	MaxReadSize          uint32
-	MaxWriteSize         uint32
-	SystemTime           uint64
-	ServerStartTime      uint64
-	SecurityBufferOffset uint16 `smb:"offset:SecurityBlob"`
-	SecurityBufferLength uint16 `smb:"len:SecurityBlob"`
-	Reserved2            uint32
-	SecurityBlob         *gss.NegTokenInit
+	StructureSize          uint16
+	SecurityMode           uint16
+	DialectRevision        uint16
+	NegotiateContextCount  uint16 //Reserved before 3.1.1
+	ServerGuid             []byte `smb:"fixed:16"`
+	Capabilities           uint32
+	MaxTransactSize        uint32
+	MaxReadSize            uint32
+	MaxWriteSize           uint32
+	SystemTime             uint64
+	ServerStartTime        uint64
+	SecurityBufferOffset   uint16 `smb:"offset:SecurityBlob"`
+	SecurityBufferLength   uint16 `smb:"len:SecurityBlob"`
+	NegotiateContextOffset uint32 //Reserved2 before 3.1.1
+	SecurityBlob           *gss.NegTokenInit
+	NegotiateContextList   NegotiateContextList
 }
 
 func (data *NegotiateSmb1Request) ServerAction(ctx *DataCtx) (interface{}, error) {
@@ -115,7 +175,6 @@ func (data *NegotiateSmb1Request) ServerAction(ctx *DataCtx) (interface{}, error
 		SecurityBlob: &gss.NegTokenInit{},
 	}
 	resp.Header.CreditCharge = 0
-	resp.Header.Credits = 1
 	resp.Header.Status = StatusOk
 	resp.Header.Flags = SMB2_FLAGS_RESPONSE
 	resp.Header.Reserved = 1
@@ -142,22 +201,10 @@ func (data *NegotiateSmb1Request) ServerAction(ctx *DataCtx) (interface{}, error
 	}
 	resp.SecurityBlob.OID = asn1.ObjectIdentifier(spnegoOID)
 	resp.SecurityBlob.Data.MechTypes = []asn1.ObjectIdentifier{myMech()}
-	resp.SecurityMode = SecurityModeSigningEnabled //| SecurityModeSigningRequired 这个需要验证header的signature
-
-	var gServerGuid []byte = func() []byte {
-		// type GUID [16]byte
-		var g GUID
-
-		mustReadRand := func(dst []byte) {
-			_, err := cryptorand.Read(dst[:])
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		mustReadRand(g[:])
-		return g[:]
-	}()
+	resp.SecurityMode = SecurityModeSigningEnabled
+	if ctx.session.IsSigningRequired {
+		resp.SecurityMode |= SecurityModeSigningRequired
+	}
 
 	resp.StructureSize = 0x41
 	// resp.SecurityMode = 0x03
@@ -181,26 +228,34 @@ func (data *NegotiateRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 		SecurityBlob: &gss.NegTokenInit{},
 	}
 	resp.Header = data.Header
-	resp.Header.Credits = 1
 	resp.Header.Status = StatusOk
 	resp.StructureSize = 65
 	resp.Header.Flags = SMB2_FLAGS_RESPONSE
 
-	if true {
-		//check dialect
-		foundMyVer := false
-		for _, d := range data.Dialects {
-			if d == DialectSmb_2_1 {
-				foundMyVer = true
-			}
-		}
-		if !foundMyVer {
-			return ERR(data.Header, STATUS_NOT_SUPPORTED)
-		}
+	dialect := selectDialect(data.Dialects)
+	if dialect == 0 {
+		return ERR(data.Header, STATUS_NOT_SUPPORTED)
 	}
 
 	logx.Printf("clientSupportDialect: %v", data.Dialects)
-	ctx.session.dialect = uint16(DialectSmb_2_1)
+	ctx.session.dialect = dialect
+	//FSCTL_VALIDATE_NEGOTIATE_INFO checks them later
+	ctx.session.clientGuid = data.ClientGuid
+	ctx.session.clientCapabilities = data.Capabilities
+	ctx.session.clientSecurityMode = data.SecurityMode
+	ctx.session.signingAlgorithm = signingAlgorithm(dialect)
+	if dialect == DialectSmb_3_1_1 {
+		ctxs, stat := data.negotiateContexts(ctx)
+		if stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		list, err := newNegotiateContextList(ctxs)
+		if err != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		resp.NegotiateContextList = list
+		resp.NegotiateContextCount = uint16(len(ctxs))
+	}
 	return data.serverAction(ctx, resp)
 }
 
@@ -212,26 +267,23 @@ func (data *NegotiateRequest) serverAction(ctx *DataCtx, resp NegotiateResponse)
 	}
 	resp.SecurityBlob.OID = asn1.ObjectIdentifier(spnegoOID)
 	resp.SecurityBlob.Data.MechTypes = []asn1.ObjectIdentifier{myMech()}
-	resp.SecurityMode = SecurityModeSigningEnabled //| SecurityModeSigningRequired 这个需要验证header的signature
+	resp.SecurityMode = SecurityModeSigningEnabled
+	if ctx.session.IsSigningRequired {
+		resp.SecurityMode |= SecurityModeSigningRequired
+	}
 	resp.DialectRevision = ctx.session.dialect
 
-	var gServerGuid []byte = func() []byte {
-		// type GUID [16]byte
-		var g GUID
-
-		mustReadRand := func(dst []byte) {
-			_, err := cryptorand.Read(dst[:])
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		mustReadRand(g[:])
-		return g[:]
-	}()
-
 	resp.ServerGuid = gServerGuid
-	resp.Capabilities = SMB2_GLOBAL_CAP_DFS | SMB2_GLOBAL_CAP_LEASING | SMB2_GLOBAL_CAP_LARGE_MTU //| SMB2_GLOBAL_CAP_DIRECTORY_LEASING // TODO: check 3.3.5.4, page 259
+	resp.Capabilities = serverCapabilities(ctx.session.dialect, ctx.session.clientCapabilities)
+	if ctx.session.store != nil && ctx.session.dialect >= DialectSmb_3_0 {
+		resp.Capabilities |= SMB2_GLOBAL_CAP_PERSISTENT_HANDLES
+	}
+	if resp.Capabilities&SMB2_GLOBAL_CAP_ENCRYPTION != 0 {
+		//3.0 and 3.0.2 only know AES-128-CCM
+		ctx.session.cipherId = SMB2_ENCRYPTION_AES128_CCM
+	}
+	ctx.session.capabilities = resp.Capabilities
+	ctx.session.serverSecurityMode = resp.SecurityMode
 
 	resp.MaxTransactSize = kMaxTransactSize
 	resp.MaxReadSize = kMaxTransactSize
@@ -239,6 +291,14 @@ func (data *NegotiateRequest) serverAction(ctx *DataCtx, resp NegotiateResponse)
 	resp.SystemTime = timeToFiletime(time.Now())
 	resp.SecurityBufferOffset = 0x80
 	// resp.SecurityBufferLength = uint16(len(gSPNEGOResponse))
+	if resp.NegotiateContextCount > 0 {
+		blob, err := encoder.Marshal(resp.SecurityBlob)
+		if err != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		offset := uint64(resp.SecurityBufferOffset) + uint64(len(blob))
+		resp.NegotiateContextOffset = uint32(offset + pad8(offset))
+	}
 
 	return &resp, nil
 }
@@ -305,14 +365,13 @@ func (s *SessionC) NewNegotiateRequest() *NegotiateRequest {
 		uint16(DialectSmb_3_0_2),
 	}
 	return &NegotiateRequest{
-		Header:          header,
-		StructureSize:   36,
-		DialectCount:    uint16(len(dialects)),
-		SecurityMode:    SecurityModeSigningEnabled,
-		Reserved:        0,
-		Capabilities:    0,
-		ClientGuid:      make([]byte, 16),
-		ClientStartTime: 0,
-		Dialects:        dialects,
+		Header:        header,
+		StructureSize: 36,
+		DialectCount:  uint16(len(dialects)),
+		SecurityMode:  SecurityModeSigningEnabled,
+		Reserved:      0,
+		Capabilities:  0,
+		ClientGuid:    make([]byte, 16),
+		Dialects:      dialects,
 	}
 }
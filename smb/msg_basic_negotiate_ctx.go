@@ -0,0 +1,283 @@
+package smb
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+
+	"github/izouxv/smbapi/smb/encoder"
+)
+
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/15332256-522e-4a53-8cd7-0bd17678a2f7
+
+const (
+	SMB2_PREAUTH_INTEGRITY_CAPABILITIES uint16 = 0x0001
+	SMB2_ENCRYPTION_CAPABILITIES        uint16 = 0x0002
+	SMB2_COMPRESSION_CAPABILITIES       uint16 = 0x0003
+	SMB2_NETNAME_NEGOTIATE_CONTEXT_ID   uint16 = 0x0005
+	SMB2_TRANSPORT_CAPABILITIES         uint16 = 0x0006
+	SMB2_RDMA_TRANSFORM_CAPABILITIES    uint16 = 0x0007
+	SMB2_SIGNING_CAPABILITIES           uint16 = 0x0008
+)
+
+const SMB2_PREAUTH_INTEGRITY_SHA512 uint16 = 0x0001
+
+// ciphers of SMB2_ENCRYPTION_CAPABILITIES, 0 means none
+const (
+	SMB2_ENCRYPTION_AES128_CCM uint16 = 0x0001
+	SMB2_ENCRYPTION_AES128_GCM uint16 = 0x0002
+	SMB2_ENCRYPTION_AES256_CCM uint16 = 0x0003
+	SMB2_ENCRYPTION_AES256_GCM uint16 = 0x0004
+)
+
+const SMB2_COMPRESSION_NONE uint16 = 0x0000
+
+// supportedCiphers and supportedSigning are in server preference order, like Windows.
+var supportedCiphers = []uint16{SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES256_GCM, SMB2_ENCRYPTION_AES256_CCM}
+var supportedSigning = []uint16{SigningAesGmac, SigningAesCmac, SigningHmacSha256}
+
+type NegotiateContext struct {
+	ContextType uint16
+	DataLength  uint16 `smb:"len:Data"`
+	Reserved    uint32
+	Data        []byte
+}
+
+type PreauthIntegrityCapabilities struct {
+	HashAlgorithmCount uint16 `smb:"count:HashAlgorithms"`
+	SaltLength         uint16 `smb:"len:Salt"`
+	HashAlgorithms     []uint16
+	Salt               []byte
+}
+
+type EncryptionCapabilities struct {
+	CipherCount uint16 `smb:"count:Ciphers"`
+	Ciphers     []uint16
+}
+
+type SigningCapabilities struct {
+	SigningAlgorithmCount uint16 `smb:"count:SigningAlgorithms"`
+	SigningAlgorithms     []uint16
+}
+
+type CompressionCapabilities struct {
+	CompressionAlgorithmCount uint16 `smb:"count:CompressionAlgorithms"`
+	Padding                   uint16
+	Flags                     uint32
+	CompressionAlgorithms     []uint16
+}
+
+// NegotiateContextList is the negotiate context list of a 3.1.1 NEGOTIATE. It starts at the
+// first 8 byte boundary after the field before it, the padding is not part of it. Only the
+// request is parsed this way, a response has the security buffer in between and is read
+// at NegotiateContextOffset.
+type NegotiateContextList []byte
+
+func (l NegotiateContextList) MarshalBinary(meta *encoder.Metadata) ([]byte, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	//the encoder keeps the length of every field before this one
+	var offset uint64
+	for _, n := range meta.Lens {
+		offset += n
+	}
+	return append(make([]byte, pad8(offset)), l...), nil
+}
+
+func (l NegotiateContextList) UnmarshalBinary(buf []byte, meta *encoder.Metadata) (interface{}, error) {
+	skip := pad8(meta.CurrOffset)
+	if uint64(len(buf)) <= skip {
+		return NegotiateContextList(nil), nil
+	}
+	return NegotiateContextList(buf[skip:]), nil
+}
+
+func pad8(offset uint64) uint64 {
+	return (8 - offset%8) % 8
+}
+
+// Contexts splits the list into its count contexts.
+func (l NegotiateContextList) Contexts(count uint16) ([]NegotiateContext, error) {
+	var ctxs []NegotiateContext
+	buf := []byte(l)
+	for i := 0; i < int(count); i++ {
+		if len(buf) < 8 {
+			return nil, ErrStructSizeInvalid
+		}
+		size := 8 + int(binary.LittleEndian.Uint16(buf[2:]))
+		if len(buf) < size {
+			return nil, ErrStructSizeInvalid
+		}
+		ctxs = append(ctxs, NegotiateContext{
+			ContextType: binary.LittleEndian.Uint16(buf),
+			DataLength:  uint16(size - 8),
+			Data:        buf[8:size],
+		})
+		if size += int(pad8(uint64(size))); size > len(buf) {
+			size = len(buf)
+		}
+		buf = buf[size:]
+	}
+	return ctxs, nil
+}
+
+// newNegotiateContextList lays out the contexts, every context but the last one is padded to 8 bytes.
+func newNegotiateContextList(ctxs []NegotiateContext) (NegotiateContextList, error) {
+	var list []byte
+	for i, ctx := range ctxs {
+		ctx.DataLength = uint16(len(ctx.Data))
+		buf, err := encoder.Marshal(&ctx)
+		if err != nil {
+			return nil, err
+		}
+		if i != len(ctxs)-1 {
+			buf = append(buf, make([]byte, pad8(uint64(len(buf))))...)
+		}
+		list = append(list, buf...)
+	}
+	return list, nil
+}
+
+func newNegotiateContext(contextType uint16, data interface{}) (NegotiateContext, error) {
+	buf, err := encoder.Marshal(data)
+	if err != nil {
+		return NegotiateContext{}, err
+	}
+	return NegotiateContext{ContextType: contextType, DataLength: uint16(len(buf)), Data: buf}, nil
+}
+
+// pickAlgorithm returns the first of ours the client offered, 0 if none.
+func pickAlgorithm(ours, theirs []uint16) (uint16, bool) {
+	for _, a := range ours {
+		for _, b := range theirs {
+			if a == b {
+				return a, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// negotiateContexts answers the contexts of a 3.1.1 NEGOTIATE and keeps what was agreed in the session.
+func (data *NegotiateRequest) negotiateContexts(ctx *DataCtx) ([]NegotiateContext, Status) {
+	reqCtxs, err := data.NegotiateContextList.Contexts(data.NegotiateContextCount)
+	if err != nil {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+	var preauth, encryption, signing, compression *NegotiateContext
+	for i := range reqCtxs {
+		c := &reqCtxs[i]
+		var seen **NegotiateContext
+		switch c.ContextType {
+		case SMB2_PREAUTH_INTEGRITY_CAPABILITIES:
+			seen = &preauth
+		case SMB2_ENCRYPTION_CAPABILITIES:
+			seen = &encryption
+		case SMB2_SIGNING_CAPABILITIES:
+			seen = &signing
+		case SMB2_COMPRESSION_CAPABILITIES:
+			seen = &compression
+		default:
+			//netname, transport and RDMA are informational
+			continue
+		}
+		if *seen != nil {
+			//each of them is allowed once
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		*seen = c
+	}
+	if preauth == nil {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+
+	var respCtxs []NegotiateContext
+	add := func(contextType uint16, v interface{}) Status {
+		c, err := newNegotiateContext(contextType, v)
+		if err != nil {
+			return STATUS_INVALID_PARAMETER
+		}
+		respCtxs = append(respCtxs, c)
+		return StatusOk
+	}
+
+	var preauthReq PreauthIntegrityCapabilities
+	if err := encoder.Unmarshal(preauth.Data, &preauthReq); err != nil || len(preauthReq.HashAlgorithms) == 0 {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+	if _, ok := pickAlgorithm([]uint16{SMB2_PREAUTH_INTEGRITY_SHA512}, preauthReq.HashAlgorithms); !ok {
+		return nil, STATUS_SMB_NO_PREAUTH_INTEGRITY_HASH_OVERLAP
+	}
+	salt := make([]byte, 32)
+	cryptorand.Read(salt)
+	if stat := add(SMB2_PREAUTH_INTEGRITY_CAPABILITIES, &PreauthIntegrityCapabilities{
+		HashAlgorithmCount: 1,
+		SaltLength:         uint16(len(salt)),
+		HashAlgorithms:     []uint16{SMB2_PREAUTH_INTEGRITY_SHA512},
+		Salt:               salt,
+	}); stat != StatusOk {
+		return nil, stat
+	}
+
+	if encryption != nil {
+		var encryptionReq EncryptionCapabilities
+		if err := encoder.Unmarshal(encryption.Data, &encryptionReq); err != nil || len(encryptionReq.Ciphers) == 0 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		//no common cipher is answered with cipher 0, the connection goes on without encryption
+		ctx.session.cipherId, _ = pickAlgorithm(supportedCiphers, encryptionReq.Ciphers)
+		if stat := add(SMB2_ENCRYPTION_CAPABILITIES, &EncryptionCapabilities{
+			CipherCount: 1,
+			Ciphers:     []uint16{ctx.session.cipherId},
+		}); stat != StatusOk {
+			return nil, stat
+		}
+	}
+
+	if compression != nil {
+		var compressionReq CompressionCapabilities
+		if err := encoder.Unmarshal(compression.Data, &compressionReq); err != nil || len(compressionReq.CompressionAlgorithms) == 0 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		//compression is not supported
+		if stat := add(SMB2_COMPRESSION_CAPABILITIES, &CompressionCapabilities{
+			CompressionAlgorithmCount: 1,
+			CompressionAlgorithms:     []uint16{SMB2_COMPRESSION_NONE},
+		}); stat != StatusOk {
+			return nil, stat
+		}
+	}
+
+	if signing != nil {
+		var signingReq SigningCapabilities
+		if err := encoder.Unmarshal(signing.Data, &signingReq); err != nil || len(signingReq.SigningAlgorithms) == 0 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		if algorithm, ok := pickAlgorithm(supportedSigning, signingReq.SigningAlgorithms); ok {
+			ctx.session.signingAlgorithm = algorithm
+		}
+		if stat := add(SMB2_SIGNING_CAPABILITIES, &SigningCapabilities{
+			SigningAlgorithmCount: 1,
+			SigningAlgorithms:     []uint16{ctx.session.signingAlgorithm},
+		}); stat != StatusOk {
+			return nil, stat
+		}
+	}
+	return respCtxs, StatusOk
+}
+
+// updatePreauthHash chains msg into the preauth integrity hash of a 3.1.1 connection.
+// The session has one connection, so the connection hash goes on as the session hash.
+func (s *SessionS) updatePreauthHash(msg []byte) {
+	if s.dialect != DialectSmb_3_1_1 {
+		return
+	}
+	if s.preauthHash == nil {
+		s.preauthHash = make([]byte, sha512.Size)
+	}
+	h := sha512.New()
+	h.Write(s.preauthHash)
+	h.Write(msg)
+	s.preauthHash = h.Sum(nil)
+}
@@ -0,0 +1,92 @@
+package smb
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NegotiateContexts(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	session := NewSessionServer(true, srv, nil, nil)
+	ctx := NewDataCtx(session, srv, nil)
+
+	preauth, _ := newNegotiateContext(SMB2_PREAUTH_INTEGRITY_CAPABILITIES, &PreauthIntegrityCapabilities{
+		HashAlgorithmCount: 1,
+		SaltLength:         4,
+		HashAlgorithms:     []uint16{SMB2_PREAUTH_INTEGRITY_SHA512},
+		Salt:               []byte{1, 2, 3, 4},
+	})
+	encryption, _ := newNegotiateContext(SMB2_ENCRYPTION_CAPABILITIES, &EncryptionCapabilities{
+		CipherCount: 2,
+		Ciphers:     []uint16{SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES128_GCM},
+	})
+	signing, _ := newNegotiateContext(SMB2_SIGNING_CAPABILITIES, &SigningCapabilities{
+		SigningAlgorithmCount: 2,
+		SigningAlgorithms:     []uint16{SigningAesCmac, SigningAesGmac},
+	})
+	list, err := newNegotiateContextList([]NegotiateContext{preauth, encryption, signing})
+	assert.Nil(t, err)
+
+	req := &NegotiateRequest{
+		Header:                 newHeader(CommandNegotiate, 0, 0),
+		StructureSize:          36,
+		DialectCount:           3,
+		SecurityMode:           SecurityModeSigningEnabled,
+		ClientGuid:             make([]byte, 16),
+		NegotiateContextOffset: 0x70,
+		NegotiateContextCount:  3,
+		Dialects:               []uint16{DialectSmb_2_1, DialectSmb_3_0_2, DialectSmb_3_1_1},
+		NegotiateContextList:   list,
+	}
+	buf, err := encoder.Marshal(req)
+	assert.Nil(t, err)
+	//64 + 36 + 3 dialects, padded to 8
+	assert.Equal(t, list, NegotiateContextList(buf[0x70:]))
+
+	var parsed NegotiateRequest
+	assert.Nil(t, encoder.Unmarshal(buf, &parsed))
+	resp, err := parsed.ServerAction(ctx)
+	assert.Nil(t, err)
+	negResp := resp.(*NegotiateResponse)
+	assert.Equal(t, uint16(DialectSmb_3_1_1), negResp.DialectRevision)
+	assert.Equal(t, uint16(3), negResp.NegotiateContextCount)
+	assert.Equal(t, SMB2_ENCRYPTION_AES128_GCM, session.cipherId)
+	assert.Equal(t, SigningAesGmac, session.signingAlgorithm)
+
+	respBuf, err := encoder.Marshal(negResp)
+	assert.Nil(t, err)
+	offset := binary.LittleEndian.Uint32(respBuf[64+60:])
+	assert.Equal(t, uint32(0), offset%8)
+	respCtxs, err := NegotiateContextList(respBuf[offset:]).Contexts(3)
+	assert.Nil(t, err)
+	assert.Equal(t, SMB2_PREAUTH_INTEGRITY_CAPABILITIES, respCtxs[0].ContextType)
+	var sign SigningCapabilities
+	assert.Nil(t, encoder.Unmarshal(respCtxs[2].Data, &sign))
+	assert.Equal(t, []uint16{SigningAesGmac}, sign.SigningAlgorithms)
+
+	//the preauth context is mandatory
+	parsed.NegotiateContextList, _ = newNegotiateContextList([]NegotiateContext{signing})
+	parsed.NegotiateContextCount = 1
+	resp, _ = parsed.ServerAction(ctx)
+	assert.Equal(t, STATUS_INVALID_PARAMETER, resp.(ErrResponse).Header.Status)
+}
+
+func Test_PreauthHash(t *testing.T) {
+	session := &SessionS{}
+	session.updatePreauthHash([]byte("negotiate"))
+	assert.Nil(t, session.preauthHash)
+
+	session.dialect = DialectSmb_3_1_1
+	session.updatePreauthHash([]byte("negotiate"))
+	first := session.preauthHash
+	assert.Equal(t, 64, len(first))
+	session.updatePreauthHash([]byte("setup"))
+	assert.NotEqual(t, first, session.preauthHash)
+}
@@ -77,7 +77,6 @@ func (data *SessionSetup1Request) ServerAction(ctx *DataCtx) (interface{}, error
 	}
 
 	resp1.Header = data.Header
-	resp1.Header.Credits = 33
 	resp1.Header.Status = StatusLogonFailure
 	resp1.Header.SessionID = ctx.session.sessionID
 	resp1.StructureSize = 9
@@ -105,6 +104,8 @@ func (data *SessionSetup1Request) ServerAction(ctx *DataCtx) (interface{}, error
 	// challenge.TargetName = encoder.ToUnicode("testGoGo")
 
 	challenge := data.challengeData()
+	//signing needs the key exchange, offer what the client asked for
+	challenge.NegotiateFlags |= ntlmsspneg.NegotiateFlags & (ntlmssp.FlgNegSign | ntlmssp.FlgNegAlwaysSign | ntlmssp.FlgNegKeyExch)
 
 	if true {
 		type AvPair struct {
@@ -32,9 +32,9 @@ type SessionSetup2Request struct {
 type SessionFlags uint16
 
 const (
-	SMB2_SESSION_FLAG_IS_GUEST SessionFlags = 0x0001
-	SMB2_SESSION_FLAG_IS_NULL  SessionFlags = 0x0002
-	// SMB2_SESSION_FLAG_ENCRYPT_DATA SessionFlags = 0x0004 //only valid for the SMB 3.x dialect family
+	SMB2_SESSION_FLAG_IS_GUEST     SessionFlags = 0x0001
+	SMB2_SESSION_FLAG_IS_NULL      SessionFlags = 0x0002
+	SMB2_SESSION_FLAG_ENCRYPT_DATA SessionFlags = 0x0004
 )
 
 var treeId = uint32(0)
@@ -56,7 +56,6 @@ func (data *SessionSetup2Request) ServerAction(ctx *DataCtx) (interface{}, error
 	}
 
 	resp2.Header = data.Header
-	resp2.Header.Credits = 1
 	resp2.Header.Status = StatusLogonFailure
 	resp2.Header.SessionID = ctx.session.sessionID
 	// respSetUp2.StructureSize = 9
@@ -105,6 +104,7 @@ func (data *SessionSetup2Request) ServerAction(ctx *DataCtx) (interface{}, error
 
 				if loginSuc {
 					ctx.session.IsAuthenticated = true
+					ctx.session.userName = name
 
 					// // https://msdn.microsoft.com/en-us/library/cc236700.aspx
 					// byte[] responseKeyNT = NTLMCryptography.NTOWFv2(password, message.UserName, message.DomainName);
@@ -112,11 +112,23 @@ func (data *SessionSetup2Request) ServerAction(ctx *DataCtx) (interface{}, error
 					// sessionBaseKey = new HMACMD5(responseKeyNT).ComputeHash(ntProofStr);
 					// keyExchangeKey = sessionBaseKey;
 					keyExchangeKey := ntlmssp.NTLMv2KeyExchangeKey(clientNTProof, password, name, domain)
-					// if (ntlmsspnegAuth.NegotiateFlags & ntlmssp.FlgNegKeyExch) > 0 {
-					// 	s.SessionKey = RC4.Decrypt(keyExchangeKey, message.EncryptedRandomSessionKey)
-					// } else {
-					ctx.session.SessionKey = keyExchangeKey
-					// }
+					if (ntlmsspnegAuth.NegotiateFlags&ntlmssp.FlgNegKeyExch) > 0 && len(ntlmsspnegAuth.EncryptedRandomSessionKey) == 16 {
+						ctx.session.SessionKey = ntlmssp.RC4K(keyExchangeKey, ntlmsspnegAuth.EncryptedRandomSessionKey)
+					} else {
+						ctx.session.SessionKey = keyExchangeKey
+					}
+					if data.SecurityMode&SecurityModeSigningRequired != 0 {
+						ctx.session.IsSigningRequired = true
+					}
+					ctx.session.deriveKeys()
+					if ctx.session.EncryptData {
+						if !ctx.session.canEncrypt() {
+							logx.Warnf("encryption required, the client can not encrypt, IP: %v", ctx.conn.RemoteAddr().String())
+							ctx.session.IsAuthenticated = false
+							return ERR(data.Header, STATUS_ACCESS_DENIED)
+						}
+						resp2.SessionFlags |= uint16(SMB2_SESSION_FLAG_ENCRYPT_DATA)
+					}
 
 					tid := atomic.AddUint64(&ctx.session.fileNum, 1)
 					// trees, err := conn.openUserCallback(nil)
@@ -5,8 +5,11 @@ import (
 )
 
 var (
-	ErrStructSizeInvalid    = fmt.Errorf("ErrStructSizeInvalid")
-	ErrHeaderSmb1           = fmt.Errorf("ErrHeaderSmb1")
-	ErrHeaderSessionIdError = fmt.Errorf("ErrHeaderSessionIdError")
-	ErrDataParserError      = fmt.Errorf("ErrDataParserError")
+	ErrStructSizeInvalid     = fmt.Errorf("ErrStructSizeInvalid")
+	ErrHeaderSmb1            = fmt.Errorf("ErrHeaderSmb1")
+	ErrHeaderSessionIdError  = fmt.Errorf("ErrHeaderSessionIdError")
+	ErrDataParserError       = fmt.Errorf("ErrDataParserError")
+	ErrInvalidMessageId      = fmt.Errorf("ErrInvalidMessageId")
+	ErrValidateNegotiateInfo = fmt.Errorf("ErrValidateNegotiateInfo")
+	ErrEncryption            = fmt.Errorf("ErrEncryption")
 )
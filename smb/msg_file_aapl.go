@@ -0,0 +1,192 @@
+package smb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"golang.org/x/net/webdav"
+)
+
+// The AAPL create context of macOS clients, the extensions Apple added to SMB2 and Samba's
+// vfs_fruit serves. The first CREATE of a connection that carries it agrees on them.
+
+// AAPL CommandCode
+const (
+	SMB2_CRTCTX_AAPL_SERVER_QUERY uint32 = 1
+	SMB2_CRTCTX_AAPL_RESOLVE_ID   uint32 = 2
+)
+
+// AAPL RequestBitmap and ReplyBitmap, the parts of the reply
+const (
+	SMB2_CRTCTX_AAPL_SERVER_CAPS uint64 = 0x01
+	SMB2_CRTCTX_AAPL_VOLUME_CAPS uint64 = 0x02
+	SMB2_CRTCTX_AAPL_MODEL_INFO  uint64 = 0x04
+)
+
+// AAPL server caps
+const (
+	SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR uint64 = 0x01
+	SMB2_CRTCTX_AAPL_SUPPORTS_OSX_COPYFILE  uint64 = 0x02 //needs FSCTL_SRV_COPYCHUNK, not offered
+	SMB2_CRTCTX_AAPL_UNIX_BASED             uint64 = 0x04
+	SMB2_CRTCTX_AAPL_SUPPORTS_NFS_ACE       uint64 = 0x08
+)
+
+// AAPL volume caps
+const (
+	SMB2_CRTCTX_AAPL_SUPPORT_RESOLVE_ID uint64 = 0x01
+	SMB2_CRTCTX_AAPL_CASE_SENSITIVE     uint64 = 0x02
+	SMB2_CRTCTX_AAPL_FULL_SYNC          uint64 = 0x04
+)
+
+const (
+	kAAPLRequestSize = 24
+	kAAPLHeaderSize  = 16 //CommandCode, Reserved, ReplyBitmap
+	kDefaultModel    = "Xserve"
+)
+
+// aaplResponse answers the AAPL context of a CREATE on a share of anchor, ok is false when there is
+// nothing to answer: a malformed context, an other command or a connection that agreed already.
+func (s *SessionS) aaplResponse(anchor *Anchor, buf []byte) (createContext, bool) {
+	var req SMB2_APPL_CREATE_CONTENT_TAG_REQUEST
+	if len(buf) < kAAPLRequestSize || encoder.Unmarshal(buf, &req) != nil || req.ServerQuery != SMB2_CRTCTX_AAPL_SERVER_QUERY {
+		return createContext{}, false
+	}
+	//the server is UNIX, macOS reads the mode from NFS ACEs without asking for them
+	caps := SMB2_CRTCTX_AAPL_UNIX_BASED | SMB2_CRTCTX_AAPL_SUPPORTS_NFS_ACE
+	if req.ClientServerCap&SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR != 0 {
+		caps |= SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR
+	}
+	s.mu.Lock()
+	if s.aaplDone {
+		s.mu.Unlock()
+		return createContext{}, false
+	}
+	s.aaplDone = true
+	if req.QueryBitmask&SMB2_CRTCTX_AAPL_SERVER_CAPS != 0 {
+		s.aaplCaps = caps
+	}
+	model := s.model
+	s.mu.Unlock()
+
+	//a flush syncs the file, F_FULLFSYNC on macOS
+	volume := SMB2_CRTCTX_AAPL_FULL_SYNC
+	if anchor.caseSensitive() {
+		volume |= SMB2_CRTCTX_AAPL_CASE_SENSITIVE
+	}
+	if model == "" {
+		model = kDefaultModel
+	}
+	resp := SMB2_APPL_CREATE_CONTENT_TAG_RESPONSE{
+		ServerQuery:  SMB2_CRTCTX_AAPL_SERVER_QUERY,
+		QueryBitmask: req.QueryBitmask & (SMB2_CRTCTX_AAPL_SERVER_CAPS | SMB2_CRTCTX_AAPL_VOLUME_CAPS | SMB2_CRTCTX_AAPL_MODEL_INFO),
+		ServerCap:    caps,
+		VolumeCap:    volume,
+		ModelString:  encoder.ToUnicode(model),
+	}
+	full, err := encoder.Marshal(&resp)
+	if err != nil {
+		return createContext{}, false
+	}
+	//the reply only has the parts the client asked for, in the order of the bits
+	data := append([]byte(nil), full[:kAAPLHeaderSize]...)
+	if resp.QueryBitmask&SMB2_CRTCTX_AAPL_SERVER_CAPS != 0 {
+		data = append(data, full[kAAPLHeaderSize:kAAPLHeaderSize+8]...)
+	}
+	if resp.QueryBitmask&SMB2_CRTCTX_AAPL_VOLUME_CAPS != 0 {
+		data = append(data, full[kAAPLHeaderSize+8:kAAPLHeaderSize+16]...)
+	}
+	if resp.QueryBitmask&SMB2_CRTCTX_AAPL_MODEL_INFO != 0 {
+		data = append(data, full[kAAPLHeaderSize+16:]...)
+	}
+	return createContext{tag: SMB2_APPL_CREATE_CONTENT_TAG, data: data}, true
+}
+
+// aaplCap tells if the connection agreed on the AAPL server cap c.
+func (s *SessionS) aaplCap(c uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aaplCaps&c != 0
+}
+
+// caseSensitive tells if the file system of the share tells names apart by case: the name of the
+// root in the other case finds the root on one that does not. A root without letters goes by the
+// system.
+func (a *Anchor) caseSensitive() bool {
+	root := filepath.Clean(a.RootPath)
+	base := filepath.Base(root)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, base)
+	if swapped == base {
+		return runtime.GOOS != "darwin" && runtime.GOOS != "windows"
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return true
+	}
+	other, err := os.Stat(filepath.Join(filepath.Dir(root), swapped))
+	return err != nil || !os.SameFile(fi, other)
+}
+
+// unixMode is the st_mode of m, the type and the permission bits.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	switch {
+	case m.IsDir():
+		mode |= 0040000
+	case m&os.ModeSymlink != 0:
+		mode |= 0120000
+	case m.IsRegular():
+		mode |= 0100000
+	}
+	return mode
+}
+
+// readdirAttr fills the fields of a FileIdBothDirectoryInformation entry the READDIR_ATTR extension
+// gives other meanings, the Finder needs no more requests for each entry: EaSize is the maximal
+// access of the user of session s, ShortName the size of the resource fork and the first 16 bytes of
+// the Finder info and Reserved2 the UNIX mode. The resource fork is not read and "._" files are not
+// converted while a directory is listed.
+func (a *Anchor) readdirAttr(s *SessionS, fsys webdav.FileSystem, path string, fi os.FileInfo, info *FileIdBothDirectoryInfo) {
+	info.EASize = uint32(s.maximalAccess(fi))
+	info.ShortNameLength = 0
+	info.ShortName = make([]byte, 24)
+	info.Reserved2 = uint16(unixMode(fi.Mode()))
+	d, ok := diskDir(fsys)
+	if !ok {
+		return
+	}
+	name, store := dirPath(d, path), a.streams()
+	resourceSize := func() (int64, error) { return streamSize(store, name, kAFPResourceStream) }
+	finderInfo := func() ([]byte, error) { return store.ReadStream(name, kAppleFinderInfoXattr) }
+	if f, ok := store.(FruitStreams); ok {
+		resourceSize = func() (int64, error) { return f.resourceSize(name) }
+		finderInfo = func() ([]byte, error) { return f.finderInfo(name) }
+	}
+	if !fi.IsDir() {
+		if size, err := resourceSize(); err == nil {
+			binary.LittleEndian.PutUint64(info.ShortName, uint64(size))
+		}
+	}
+	if finderInfo, err := finderInfo(); err == nil {
+		copy(info.ShortName[8:], finderInfo)
+	}
+}
@@ -0,0 +1,118 @@
+package smb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AAPL(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "d"), 0755))
+	path := filepath.Join(dir, "d", "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("data"), 0644))
+	finderInfo := []byte("TEXTttxt\x00\x0c" + string(make([]byte, 22)))
+	assert.Nil(t, XAttrSet(path, kAppleFinderInfoXattr, finderInfo))
+	assert.Nil(t, AppleDoubleStreams{}.WriteStream(path, kAFPResourceStream, []byte("rsrc")))
+	//a read-only file whose metadata a Mac left in a "._" file
+	other := filepath.Join(dir, "d", "b.txt")
+	assert.Nil(t, os.WriteFile(other, []byte("data"), 0444))
+	left := &appleDouble{finderInfo: finderInfo, resource: []byte("rs"), attrs: []adAttr{{name: "com.apple.quarantine", value: []byte("0083;")}}}
+	assert.Nil(t, os.WriteFile(appleDoublePath(other), left.marshal(), 0644))
+	session, tree := testDurableSession(dir, nil)
+	session.model = "MacPro7,1"
+
+	aapl, err := encoder.Marshal(&SMB2_APPL_CREATE_CONTENT_TAG_REQUEST{
+		ServerQuery:     SMB2_CRTCTX_AAPL_SERVER_QUERY,
+		QueryBitmask:    SMB2_CRTCTX_AAPL_SERVER_CAPS | SMB2_CRTCTX_AAPL_VOLUME_CAPS | SMB2_CRTCTX_AAPL_MODEL_INFO,
+		ClientServerCap: SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR | SMB2_CRTCTX_AAPL_SUPPORTS_OSX_COPYFILE | SMB2_CRTCTX_AAPL_UNIX_BASED,
+	})
+	assert.Nil(t, err)
+	aaplQuery := createContext{tag: SMB2_APPL_CREATE_CONTENT_TAG, data: aapl}
+	//the first create agrees on the caps, OSX copyfile is not offered
+	out, ctxs := testCreate(t, session, tree, testOpen("d", FILE_READ_DATA, FILE_OPEN, FILE_DIRECTORY_FILE), aaplQuery)
+	resp := out.(CreateResponse)
+	reply := findCreateContext(ctxs, SMB2_APPL_CREATE_CONTENT_TAG)
+	assert.Equal(t, SMB2_CRTCTX_AAPL_SERVER_QUERY, binary.LittleEndian.Uint32(reply))
+	assert.Equal(t, uint64(7), binary.LittleEndian.Uint64(reply[8:]))
+	assert.Equal(t, SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR|SMB2_CRTCTX_AAPL_UNIX_BASED|SMB2_CRTCTX_AAPL_SUPPORTS_NFS_ACE, binary.LittleEndian.Uint64(reply[16:]))
+	volume := SMB2_CRTCTX_AAPL_FULL_SYNC
+	if tree.anchor.caseSensitive() {
+		volume |= SMB2_CRTCTX_AAPL_CASE_SENSITIVE
+	}
+	assert.Equal(t, volume, binary.LittleEndian.Uint64(reply[24:]))
+	model := encoder.ToUnicode("MacPro7,1")
+	assert.Equal(t, uint32(len(model)), binary.LittleEndian.Uint32(reply[36:]))
+	assert.Equal(t, model, reply[40:])
+	out, ctxs = testCreate(t, session, tree, testOpen("d/a.txt", FILE_READ_DATA, FILE_OPEN, 0), aaplQuery)
+	file := out.(CreateResponse)
+	assert.Nil(t, findCreateContext(ctxs, SMB2_APPL_CREATE_CONTENT_TAG))
+
+	//READDIR_ATTR entries carry the maximal access, the resource fork, the Finder info and the mode
+	find := QueryDirectoryRequest{
+		Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandFind, TreeID: tree.id},
+		StructureSize:      33,
+		InfoLevel:          FileIdBothDirectoryInformation,
+		FileId:             resp.FileId,
+		FileName:           encoder.ToUnicode("a.txt"),
+		OutputBufferLength: 4096,
+	}
+	out, err = find.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	entry := &FileIdBothDirectoryInfo{}
+	assert.Nil(t, encoder.Unmarshal(out.(*QueryDirectoryResponse).OutputBuffer, entry))
+	fi, _ := os.Stat(path)
+	assert.Equal(t, uint32(session.maximalAccess(fi)), entry.EASize)
+	assert.Equal(t, FILE_WRITE_DATA, AccessMask(entry.EASize)&FILE_WRITE_DATA)
+	assert.Equal(t, uint64(4), binary.LittleEndian.Uint64(entry.ShortName))
+	assert.Equal(t, finderInfo[:16], entry.ShortName[8:])
+	assert.Equal(t, uint16(unixMode(fi.Mode())), entry.Reserved2)
+
+	//a read-only file grants no writes, the "._" file is read and not converted
+	out, _ = testCreate(t, session, tree, testOpen("d", FILE_READ_DATA, FILE_OPEN, FILE_DIRECTORY_FILE))
+	again := out.(CreateResponse)
+	find.FileId, find.FileName = again.FileId, encoder.ToUnicode("b.txt")
+	out, err = find.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	entry = &FileIdBothDirectoryInfo{}
+	assert.Nil(t, encoder.Unmarshal(out.(*QueryDirectoryResponse).OutputBuffer, entry))
+	assert.Equal(t, AccessMask(0), AccessMask(entry.EASize)&(FILE_WRITE_DATA|FILE_APPEND_DATA))
+	assert.Equal(t, FILE_READ_DATA, AccessMask(entry.EASize)&FILE_READ_DATA)
+	assert.Equal(t, uint64(2), binary.LittleEndian.Uint64(entry.ShortName))
+	assert.Equal(t, finderInfo[:16], entry.ShortName[8:])
+	buf, err := os.ReadFile(appleDoublePath(other))
+	assert.Nil(t, err)
+	assert.Equal(t, left.marshal(), buf)
+
+	//the DACL carries the mode as an NFS ACE, one that is set becomes the mode
+	sd, stat := session.securityDescriptor(fi, path, DACL_SECURITY_INFORMATION)
+	assert.Equal(t, StatusOk, stat)
+	assert.Contains(t, sd.Dacl, ACE{Type: ACCESS_DENIED_ACE_TYPE, SID: nfsSID(kNFSMode, unixMode(fi.Mode()))})
+	osFile, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	defer osFile.Close()
+	sd = &SecurityDescriptor{Control: SE_DACL_PRESENT, Dacl: []ACE{{Type: ACCESS_DENIED_ACE_TYPE, SID: nfsSID(kNFSMode, 0600)}}}
+	assert.Equal(t, StatusOk, session.setSecurity(osFile, sd, DACL_SECURITY_INFORMATION))
+	fi, _ = os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	//a flush syncs the open, FULLSYNC
+	flush := FlushRequest{
+		Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandFlush, TreeID: tree.id},
+		StructureSize: 24,
+		FileId:        file.FileId,
+	}
+	flushed, err := flush.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	assert.IsType(t, &FlushResponse{}, flushed)
+
+	for _, fileid := range []GUID{resp.FileId, again.FileId, file.FileId} {
+		webfile, _ := session.DelFile(fileid)
+		webfile.Close()
+	}
+}
@@ -0,0 +1,317 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The streams macOS opens for the metadata of AFP, the way Samba's vfs_fruit serves them.
+// AFP_AfpInfo wraps the Finder info, AFP_Resource is the resource fork.
+const (
+	kAFPInfoStream    = "AFP_AfpInfo"
+	kAFPInfoSize      = 60
+	kAFPInfoSignature = "AFP\x00"
+	kAFPInfoVersion   = 0x00010000
+	kAFPBackupTime    = 0x80000000 //the backup time AFP leaves unset
+	kAFPFinderInfoOff = 16
+)
+
+var errAFPInfo = errors.New("bad AFP_AfpInfo stream")
+
+// marshalAFPInfo is the AFP_AfpInfo stream of the Finder info.
+func marshalAFPInfo(finderInfo []byte) []byte {
+	buf := make([]byte, kAFPInfoSize)
+	copy(buf, kAFPInfoSignature)
+	binary.BigEndian.PutUint32(buf[4:], kAFPInfoVersion)
+	binary.BigEndian.PutUint32(buf[12:], kAFPBackupTime)
+	copy(buf[kAFPFinderInfoOff:kAFPFinderInfoOff+kADFinderInfoSize], finderInfo)
+	return buf
+}
+
+// parseAFPInfo is the Finder info of an AFP_AfpInfo stream. A stream written in parts is read as
+// far as it goes.
+func parseAFPInfo(buf []byte) ([]byte, error) {
+	if len(buf) > kAFPInfoSize {
+		return nil, errAFPInfo
+	}
+	info := make([]byte, kAFPInfoSize)
+	copy(info, buf)
+	if string(info[:4]) != kAFPInfoSignature || binary.BigEndian.Uint32(info[4:]) != kAFPInfoVersion {
+		return nil, errAFPInfo
+	}
+	return info[kAFPFinderInfoOff : kAFPFinderInfoOff+kADFinderInfoSize], nil
+}
+
+// the characters NTFS does not allow in names, macOS sends them from the Unicode private range
+var macPrivateChars = map[rune]rune{'"': 0xF020, '*': 0xF021, ':': 0xF022, '<': 0xF023, '>': 0xF024, '?': 0xF025, '\\': 0xF026, '|': 0xF027}
+
+// nativeStreamName is the name macOS gives the stream name it sends, its xattr name.
+func nativeStreamName(stream string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0xF000 && r < 0xF020 {
+			return r - 0xF000
+		}
+		for c, p := range macPrivateChars {
+			if r == p {
+				return c
+			}
+		}
+		return r
+	}, stream)
+}
+
+// privateStreamName is the name macOS knows the stream native by.
+func privateStreamName(native string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0 && r < 0x20 {
+			return r + 0xF000
+		}
+		if p, ok := macPrivateChars[r]; ok {
+			return p
+		}
+		return r
+	}, native)
+}
+
+// FruitStreams serves the AFP streams of macOS clients on top of the stores that keep the data,
+// Samba's vfs_fruit. AFP_AfpInfo is made from the Finder info in Store, AFP_Resource is the resource
+// fork in Resource, the other streams keep the xattr names macOS gives them. The "._" AppleDouble
+// files a Mac left on the share are moved into the stores the first time the streams of their file
+// are used. Stores of the same type are one store.
+type FruitStreams struct {
+	//Store keeps the Finder info and the other streams, XattrStreams{} when nil
+	Store StreamStore
+	//Resource keeps the resource forks, AppleDoubleStreams{} when nil
+	Resource StreamStore
+}
+
+func (f FruitStreams) store() StreamStore {
+	if f.Store == nil {
+		return XattrStreams{}
+	}
+	return f.Store
+}
+
+func (f FruitStreams) resource() StreamStore {
+	if f.Resource == nil {
+		return AppleDoubleStreams{}
+	}
+	return f.Resource
+}
+
+// stores are the distinct stores, the metadata one first.
+func (f FruitStreams) stores() []StreamStore {
+	if reflect.TypeOf(f.store()) == reflect.TypeOf(f.resource()) {
+		return []StreamStore{f.store()}
+	}
+	return []StreamStore{f.store(), f.resource()}
+}
+
+func isAppleDouble(store StreamStore) bool {
+	_, ok := store.(AppleDoubleStreams)
+	return ok
+}
+
+// convertMu serializes the conversions of "._" files.
+var convertMu sync.Mutex
+
+// convert moves the Finder info, the xattrs and the resource fork of the "._" file of name into the
+// stores that are none, what the stores have already stays. The "._" file goes once it is empty, a
+// file that is no AppleDouble file stays as it is. It is best effort, the streams are served from
+// the stores either way.
+func (f FruitStreams) convert(name string) {
+	store, resource := f.store(), f.resource()
+	if isAppleDouble(store) && isAppleDouble(resource) {
+		return
+	}
+	convertMu.Lock()
+	defer convertMu.Unlock()
+	buf, err := os.ReadFile(appleDoublePath(name))
+	if err != nil {
+		return
+	}
+	ad, err := parseAppleDouble(buf)
+	if err != nil {
+		return
+	}
+	keep, changed := &appleDouble{}, false
+	move := func(s StreamStore, stream string, data []byte) bool {
+		if _, err := s.ReadStream(name, stream); err != nil && (!os.IsNotExist(err) || s.WriteStream(name, stream, data) != nil) {
+			return false
+		}
+		changed = true
+		return true
+	}
+	if isAppleDouble(store) {
+		keep.finderInfo, keep.attrs = ad.finderInfo, ad.attrs
+	} else {
+		if ad.finderInfo != nil && !move(store, kAppleFinderInfoXattr, ad.finderInfo) {
+			keep.finderInfo = ad.finderInfo
+		}
+		for _, a := range ad.attrs {
+			//the names come from a file of the client, they are streams only when a CREATE could name them
+			if !validStreamName(a.name) || !move(store, a.name, a.value) {
+				keep.attrs = append(keep.attrs, a)
+			}
+		}
+	}
+	if isAppleDouble(resource) || (len(ad.resource) > 0 && !move(resource, kAppleResourceFork, ad.resource)) {
+		keep.resource = ad.resource
+	}
+	if changed {
+		writeAppleDouble(name, keep)
+	}
+}
+
+// resolveStream is the store and the stream in it the stream name of a client stands for.
+func (f FruitStreams) resolveStream(stream string) (StreamStore, string) {
+	switch {
+	case strings.EqualFold(stream, kAFPResourceStream), stream == kAppleResourceFork:
+		return f.resource(), kAppleResourceFork
+	case strings.EqualFold(stream, kAFPInfoStream):
+		return f.store(), kAppleFinderInfoXattr
+	}
+	return f.store(), nativeStreamName(stream)
+}
+
+func isAFPInfo(stream string) bool {
+	return strings.EqualFold(stream, kAFPInfoStream)
+}
+
+func (f FruitStreams) Streams(name string) ([]StreamInfo, error) {
+	f.convert(name)
+	infos, err := f.store().Streams(name)
+	if err != nil {
+		return nil, err
+	}
+	var streams []StreamInfo
+	for _, info := range infos {
+		switch info.Name {
+		case kAppleFinderInfoXattr:
+			finderInfo, err := f.store().ReadStream(name, kAppleFinderInfoXattr)
+			if err == nil && !bytes.Equal(finderInfo, make([]byte, len(finderInfo))) {
+				streams = append(streams, StreamInfo{Name: kAFPInfoStream, Size: kAFPInfoSize})
+			}
+		case kAppleResourceFork, kAFPResourceStream:
+		default:
+			streams = append(streams, StreamInfo{Name: privateStreamName(info.Name), Size: info.Size})
+		}
+	}
+	//the resource fork is listed once it has data
+	if size, err := f.resourceSize(name); err == nil && size > 0 {
+		streams = append(streams, StreamInfo{Name: kAFPResourceStream, Size: size})
+	}
+	return streams, nil
+}
+
+func (f FruitStreams) ReadStream(name, stream string) ([]byte, error) {
+	f.convert(name)
+	store, key := f.resolveStream(stream)
+	data, err := store.ReadStream(name, key)
+	if err != nil || !isAFPInfo(stream) {
+		return data, err
+	}
+	if bytes.Equal(data, make([]byte, len(data))) {
+		return nil, os.ErrNotExist
+	}
+	return marshalAFPInfo(data), nil
+}
+
+// WriteStream of AFP_AfpInfo keeps its Finder info, an empty one removes it.
+func (f FruitStreams) WriteStream(name, stream string, data []byte) error {
+	f.convert(name)
+	store, key := f.resolveStream(stream)
+	if !isAFPInfo(stream) {
+		return store.WriteStream(name, key, data)
+	}
+	if len(data) == 0 {
+		return store.RemoveStream(name, key)
+	}
+	finderInfo, err := parseAFPInfo(data)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(finderInfo, make([]byte, kADFinderInfoSize)) {
+		return store.RemoveStream(name, key)
+	}
+	return store.WriteStream(name, key, finderInfo)
+}
+
+func (f FruitStreams) RemoveStream(name, stream string) error {
+	f.convert(name)
+	store, key := f.resolveStream(stream)
+	return store.RemoveStream(name, key)
+}
+
+func (f FruitStreams) RenameStreams(oldName, newName string) error {
+	f.convert(oldName)
+	for _, store := range f.stores() {
+		if err := store.RenameStreams(oldName, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveStreams removes the "._" file of name along with the streams, the stores may keep none.
+func (f FruitStreams) RemoveStreams(name string) error {
+	for _, store := range f.stores() {
+		if err := store.RemoveStreams(name); err != nil {
+			return err
+		}
+	}
+	return AppleDoubleStreams{}.RemoveStreams(name)
+}
+
+// resourceSize is the size of the resource fork of name, the fork is not read.
+func (f FruitStreams) resourceSize(name string) (int64, error) {
+	size, err := streamSize(f.resource(), name, kAppleResourceFork)
+	if os.IsNotExist(err) && !isAppleDouble(f.resource()) {
+		//the fork of a "._" file that is not converted yet
+		return readResourceSize(name)
+	}
+	return size, err
+}
+
+// finderInfo is the Finder info of name, from the "._" file when the store has none. The "._" file
+// is not converted.
+func (f FruitStreams) finderInfo(name string) ([]byte, error) {
+	finderInfo, err := f.store().ReadStream(name, kAppleFinderInfoXattr)
+	if os.IsNotExist(err) && !isAppleDouble(f.store()) {
+		return readFinderInfo(name)
+	}
+	return finderInfo, err
+}
+
+// maxStreamSize bounds AFP_AfpInfo to its size and the other streams to the bound of their store.
+func (f FruitStreams) maxStreamSize(stream string) int64 {
+	if isAFPInfo(stream) {
+		return kAFPInfoSize
+	}
+	store, key := f.resolveStream(stream)
+	return streamLimit(store, key, 0)
+}
+
+// place is where the store of the stream keeps it, AFP_AfpInfo is made from the Finder info and
+// is written whole.
+func (f FruitStreams) place(name, stream string) streamPlace {
+	if isAFPInfo(stream) {
+		return nil
+	}
+	store, key := f.resolveStream(stream)
+	return streamPlaceOf(store, name, key)
+}
+
+func (f FruitStreams) Hidden(name string) bool {
+	for _, store := range f.stores() {
+		if store.Hidden(name) {
+			return true
+		}
+	}
+	return false
+}
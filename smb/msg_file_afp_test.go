@@ -0,0 +1,142 @@
+package smb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AFPStreams(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("data"), 0666))
+	finderInfo := []byte("TEXTttxt\x00\x0c" + string(make([]byte, 22)))
+	ad := &appleDouble{finderInfo: finderInfo, resource: []byte("rsrc"), attrs: []adAttr{{name: "com.apple.quarantine", value: []byte("0083;")}}}
+	assert.Nil(t, os.WriteFile(appleDoublePath(path), ad.marshal(), 0644))
+	session, tree := testDurableSession(dir, nil)
+
+	closeFile := func(fileid GUID) {
+		webfile, _ := session.DelFile(fileid)
+		webfile.Close()
+	}
+	read := func(fileid GUID) []byte {
+		req := ReadRequest{
+			Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandRead, TreeID: tree.id},
+			StructureSize: 49,
+			Length:        1024,
+			FileId:        fileid,
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		return resp.(*ReadResponse).Data
+	}
+	write := func(fileid GUID, data []byte) {
+		req := WriteRequest{
+			Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandWrite, TreeID: tree.id},
+			StructureSize: 49,
+			DataLength:    uint32(len(data)),
+			FileId:        fileid,
+			Data:          data,
+		}
+		_, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+	}
+
+	//the "._" file a Mac left is moved into the xattrs, the resource fork stays in it
+	file, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|FILE_WRITE_DATA, FILE_OPEN, 0)))
+	req := QueryInfoRequest{
+		Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+		StructureSize:      41,
+		Class:              SMB2_0_INFO_FILE,
+		InfoLevel:          uint8(FileStreamInformation),
+		OutputBufferLength: 4096,
+		FileId:             file,
+	}
+	resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	var names []string
+	for buf := resp.(*QueryInfoResponse).OutputBuffer; ; {
+		info := &FileStreamInformationX{}
+		assert.Nil(t, encoder.Unmarshal(buf, info))
+		name, _ := encoder.FromUnicode(info.StreamName)
+		names = append(names, name)
+		if info.NextOffset == 0 {
+			break
+		}
+		buf = buf[info.NextOffset:]
+	}
+	closeFile(file)
+	assert.Equal(t, []string{"::$DATA", ":AFP_AfpInfo:$DATA", ":AFP_Resource:$DATA", ":com.apple.quarantine:$DATA"}, names)
+	value, err := XAttrGet(path, kAppleFinderInfoXattr)
+	assert.Nil(t, err)
+	assert.Equal(t, finderInfo, value)
+	buf, err := os.ReadFile(appleDoublePath(path))
+	assert.Nil(t, err)
+	left, err := parseAppleDouble(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, &appleDouble{resource: []byte("rsrc")}, left)
+	assert.True(t, tree.anchor.hiddenEntry("._a.txt"))
+
+	//AFP_AfpInfo wraps the Finder info, a new label lands in the xattr
+	stream, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt:AFP_AfpInfo", FILE_READ_DATA|FILE_WRITE_DATA, FILE_OPEN, 0)))
+	info := read(stream)
+	assert.Equal(t, marshalAFPInfo(finderInfo), info)
+	info[kAFPFinderInfoOff+9] = 0x02
+	write(stream, info)
+	closeFile(stream)
+	value, _ = XAttrGet(path, kAppleFinderInfoXattr)
+	assert.Equal(t, byte(0x02), value[9])
+
+	//the resource fork and the tags round trip, macOS sends the colon from the private range
+	stream, _ = testFileId(testCreate(t, session, tree, testOpen("a.txt:AFP_Resource", FILE_READ_DATA|FILE_WRITE_DATA, FILE_OPEN, 0)))
+	assert.Equal(t, "rsrc", string(read(stream)))
+	write(stream, []byte("fork"))
+	closeFile(stream)
+	stream, _ = testFileId(testCreate(t, session, tree, testOpen("a.txt:com.apple.metadata\uf022_kMDItemUserTags", FILE_READ_DATA|FILE_WRITE_DATA, FILE_CREATE, 0)))
+	write(stream, []byte("tags"))
+	closeFile(stream)
+	value, err = XAttrGet(path, "com.apple.metadata:_kMDItemUserTags")
+	assert.Nil(t, err)
+	assert.Equal(t, "tags", string(value))
+	data, err := FruitStreams{}.ReadStream(path, kAFPResourceStream)
+	assert.Nil(t, err)
+	assert.Equal(t, "fork", string(data))
+
+	//a Finder info without a label or type is no AFP_AfpInfo
+	assert.Nil(t, FruitStreams{}.WriteStream(path, kAFPInfoStream, marshalAFPInfo(nil)))
+	_, err = FruitStreams{}.ReadStream(path, kAFPInfoStream)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, errAFPInfo, FruitStreams{}.WriteStream(path, kAFPInfoStream, []byte("bad")))
+}
+
+func Test_AFPStreamNames(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "share"), 0755))
+	path := filepath.Join(dir, "share", "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("data"), 0666))
+
+	//a "._" file of a client can not name a stream outside the directory of the streams
+	ad := &appleDouble{attrs: []adAttr{{name: "../../../escaped", value: []byte("x")}, {name: "com.apple.quarantine", value: []byte("0083;")}}}
+	assert.Nil(t, os.WriteFile(appleDoublePath(path), ad.marshal(), 0644))
+	store := FruitStreams{Store: DirStreams{}}
+	infos, err := store.Streams(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []StreamInfo{{Name: "com.apple.quarantine", Size: 5}}, infos)
+	_, err = os.Stat(filepath.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+	buf, err := os.ReadFile(appleDoublePath(path))
+	assert.Nil(t, err)
+	left, err := parseAppleDouble(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []adAttr{{name: "../../../escaped", value: []byte("x")}}, left.attrs)
+
+	for _, name := range []string{"..", ".", "a/b", "a\\b", "a\x00b", ""} {
+		assert.Equal(t, os.ErrInvalid, DirStreams{}.WriteStream(path, name, []byte("x")))
+		_, err := DirStreams{}.ReadStream(path, name)
+		assert.Equal(t, os.ErrInvalid, err)
+	}
+}
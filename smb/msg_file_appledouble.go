@@ -0,0 +1,515 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AppleDouble version 2, the "._" files macOS writes for the metadata of files on volumes
+// without xattrs. The xattrs follow the Finder info in an "ATTR" block.
+const (
+	kAppleDoubleMagic   uint32 = 0x00051607
+	kAppleDoubleVersion uint32 = 0x00020000
+	kAppleDoublePrefix         = "._"
+
+	kADEntryResource   uint32 = 2
+	kADEntryFinderInfo uint32 = 9
+
+	kADHeaderSize     = 26
+	kADEntrySize      = 12
+	kADFinderInfoSize = 32
+	kADAttrMagic      = "ATTR"
+	kADAttrHeaderSize = 36
+	kADAttrEntrySize  = 11 //offset, length, flags, namelen
+)
+
+// stream names of the parts of an AppleDouble file that are no xattr
+const (
+	kAFPResourceStream    = "AFP_Resource"
+	kAppleResourceFork    = "com.apple.ResourceFork"
+	kAppleFinderInfoXattr = string(XATTR_FINDER_INFO_EA_NAME)
+)
+
+var errAppleDouble = errors.New("bad AppleDouble file")
+
+// adAttr is an xattr of an AppleDouble file.
+type adAttr struct {
+	name  string
+	value []byte
+}
+
+// appleDouble is the content of a "._" file.
+type appleDouble struct {
+	finderInfo []byte //kADFinderInfoSize bytes, or nil
+	resource   []byte
+	attrs      []adAttr
+}
+
+func parseAppleDouble(buf []byte) (*appleDouble, error) {
+	if len(buf) < kADHeaderSize || binary.BigEndian.Uint32(buf) != kAppleDoubleMagic ||
+		binary.BigEndian.Uint32(buf[4:]) != kAppleDoubleVersion {
+		return nil, errAppleDouble
+	}
+	ad := &appleDouble{}
+	n := int(binary.BigEndian.Uint16(buf[24:]))
+	if kADHeaderSize+n*kADEntrySize > len(buf) {
+		return nil, errAppleDouble
+	}
+	for i := 0; i < n; i++ {
+		e := buf[kADHeaderSize+i*kADEntrySize:]
+		id, off, length := binary.BigEndian.Uint32(e), binary.BigEndian.Uint32(e[4:]), binary.BigEndian.Uint32(e[8:])
+		if uint64(off)+uint64(length) > uint64(len(buf)) {
+			return nil, errAppleDouble
+		}
+		data := buf[off : off+length]
+		switch id {
+		case kADEntryResource:
+			ad.resource = append([]byte(nil), data...)
+		case kADEntryFinderInfo:
+			if len(data) >= kADFinderInfoSize {
+				ad.finderInfo = append([]byte(nil), data[:kADFinderInfoSize]...)
+			}
+			//the xattrs start 2 bytes after the Finder info, their offsets are the ones of the file
+			if hdr := kADFinderInfoSize + 2; len(data) >= hdr+kADAttrHeaderSize && string(data[hdr:hdr+4]) == kADAttrMagic {
+				attrs, err := parseADAttrs(buf, int(off)+hdr)
+				if err != nil {
+					return nil, err
+				}
+				ad.attrs = attrs
+			}
+		}
+	}
+	if ad.finderInfo != nil && bytes.Equal(ad.finderInfo, make([]byte, kADFinderInfoSize)) {
+		ad.finderInfo = nil
+	}
+	return ad, nil
+}
+
+func parseADAttrs(buf []byte, hdr int) ([]adAttr, error) {
+	count := int(binary.BigEndian.Uint16(buf[hdr+34:]))
+	var attrs []adAttr
+	pos := hdr + kADAttrHeaderSize
+	for i := 0; i < count; i++ {
+		if pos+kADAttrEntrySize > len(buf) {
+			return nil, errAppleDouble
+		}
+		off, length := binary.BigEndian.Uint32(buf[pos:]), binary.BigEndian.Uint32(buf[pos+4:])
+		nameLen := int(buf[pos+10])
+		if pos+kADAttrEntrySize+nameLen > len(buf) || uint64(off)+uint64(length) > uint64(len(buf)) {
+			return nil, errAppleDouble
+		}
+		name := strings.TrimRight(string(buf[pos+kADAttrEntrySize:pos+kADAttrEntrySize+nameLen]), "\x00")
+		attrs = append(attrs, adAttr{name: name, value: append([]byte(nil), buf[off:off+length]...)})
+		pos = (pos + kADAttrEntrySize + nameLen + 3) &^ 3
+	}
+	return attrs, nil
+}
+
+// marshal lays the file out the way macOS does, the Finder info with the xattrs and then the
+// resource fork.
+func (ad *appleDouble) marshal() []byte {
+	finderOff := kADHeaderSize + 2*kADEntrySize
+	finder := make([]byte, kADFinderInfoSize)
+	copy(finder, ad.finderInfo)
+	if len(ad.attrs) > 0 {
+		hdr := finderOff + kADFinderInfoSize + 2
+		entries := hdr + kADAttrHeaderSize
+		dataStart := entries
+		for _, a := range ad.attrs {
+			dataStart = (dataStart + kADAttrEntrySize + len(a.name) + 1 + 3) &^ 3
+		}
+		//the entries are aligned in the file, the block starts right after the Finder info
+		start := finderOff + kADFinderInfoSize
+		block := make([]byte, dataStart-start)
+		var data []byte
+		pos := entries
+		for _, a := range ad.attrs {
+			e := block[pos-start:]
+			binary.BigEndian.PutUint32(e, uint32(dataStart+len(data)))
+			binary.BigEndian.PutUint32(e[4:], uint32(len(a.value)))
+			e[10] = uint8(len(a.name) + 1)
+			copy(e[kADAttrEntrySize:], a.name)
+			pos = (pos + kADAttrEntrySize + len(a.name) + 1 + 3) &^ 3
+			data = append(data, a.value...)
+		}
+		h := block[2:]
+		copy(h, kADAttrMagic)
+		binary.BigEndian.PutUint32(h[8:], uint32(dataStart+len(data)+len(ad.resource)))
+		binary.BigEndian.PutUint32(h[12:], uint32(dataStart))
+		binary.BigEndian.PutUint32(h[16:], uint32(len(data)))
+		binary.BigEndian.PutUint16(h[34:], uint16(len(ad.attrs)))
+		finder = append(append(finder, block...), data...)
+	}
+	buf := make([]byte, finderOff, finderOff+len(finder)+len(ad.resource))
+	binary.BigEndian.PutUint32(buf, kAppleDoubleMagic)
+	binary.BigEndian.PutUint32(buf[4:], kAppleDoubleVersion)
+	copy(buf[8:], "Mac OS X        ")
+	binary.BigEndian.PutUint16(buf[24:], 2)
+	e := buf[kADHeaderSize:]
+	binary.BigEndian.PutUint32(e, kADEntryFinderInfo)
+	binary.BigEndian.PutUint32(e[4:], uint32(finderOff))
+	binary.BigEndian.PutUint32(e[8:], uint32(len(finder)))
+	binary.BigEndian.PutUint32(e[12:], kADEntryResource)
+	binary.BigEndian.PutUint32(e[16:], uint32(finderOff+len(finder)))
+	binary.BigEndian.PutUint32(e[20:], uint32(len(ad.resource)))
+	return append(append(buf, finder...), ad.resource...)
+}
+
+func (ad *appleDouble) empty() bool {
+	return ad.finderInfo == nil && len(ad.resource) == 0 && len(ad.attrs) == 0
+}
+
+// AppleDoubleStreams keeps the streams of a file in the "._" file beside it the way macOS does on
+// volumes without xattrs, the resource fork as AFP_Resource, the Finder info and the other streams
+// as xattrs. Callers serialize the changes of a file.
+type AppleDoubleStreams struct{}
+
+func appleDoublePath(name string) string {
+	return filepath.Join(filepath.Dir(name), kAppleDoublePrefix+filepath.Base(name))
+}
+
+func readAppleDouble(name string) (*appleDouble, error) {
+	buf, err := os.ReadFile(appleDoublePath(name))
+	if os.IsNotExist(err) {
+		return &appleDouble{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAppleDouble(buf)
+}
+
+func writeAppleDouble(name string, ad *appleDouble) error {
+	path := appleDoublePath(name)
+	if ad.empty() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, ad.marshal(), 0644)
+}
+
+func isResourceStream(stream string) bool {
+	return stream == kAFPResourceStream || stream == kAppleResourceFork
+}
+
+func (AppleDoubleStreams) Streams(name string) ([]StreamInfo, error) {
+	ad, err := readAppleDouble(name)
+	if err != nil {
+		return nil, err
+	}
+	var infos []StreamInfo
+	if ad.finderInfo != nil {
+		infos = append(infos, StreamInfo{Name: kAppleFinderInfoXattr, Size: kADFinderInfoSize})
+	}
+	if len(ad.resource) > 0 {
+		infos = append(infos, StreamInfo{Name: kAFPResourceStream, Size: int64(len(ad.resource))})
+	}
+	for _, a := range ad.attrs {
+		infos = append(infos, StreamInfo{Name: a.name, Size: int64(len(a.value))})
+	}
+	return infos, nil
+}
+
+func (AppleDoubleStreams) ReadStream(name, stream string) ([]byte, error) {
+	ad, err := readAppleDouble(name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isResourceStream(stream):
+		//the resource fork is there as long as the file is, empty or not
+		if _, err := os.Stat(appleDoublePath(name)); err != nil {
+			return nil, err
+		}
+		return ad.resource, nil
+	case stream == kAppleFinderInfoXattr:
+		if ad.finderInfo == nil {
+			return nil, os.ErrNotExist
+		}
+		return ad.finderInfo, nil
+	}
+	for _, a := range ad.attrs {
+		if a.name == stream {
+			return a.value, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s AppleDoubleStreams) WriteStream(name, stream string, data []byte) error {
+	ad, err := readAppleDouble(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isResourceStream(stream):
+		ad.resource = data
+		//an empty resource fork keeps the "._" file, it stands for the created stream
+		if ad.empty() {
+			return os.WriteFile(appleDoublePath(name), ad.marshal(), 0644)
+		}
+	case stream == kAppleFinderInfoXattr:
+		ad.finderInfo = make([]byte, kADFinderInfoSize)
+		copy(ad.finderInfo, data)
+	default:
+		ad.setAttr(stream, data)
+	}
+	return writeAppleDouble(name, ad)
+}
+
+func (ad *appleDouble) setAttr(name string, value []byte) {
+	for i := range ad.attrs {
+		if ad.attrs[i].name == name {
+			ad.attrs[i].value = value
+			return
+		}
+	}
+	ad.attrs = append(ad.attrs, adAttr{name: name, value: value})
+}
+
+func (AppleDoubleStreams) RemoveStream(name, stream string) error {
+	ad, err := readAppleDouble(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isResourceStream(stream):
+		ad.resource = nil
+	case stream == kAppleFinderInfoXattr:
+		ad.finderInfo = nil
+	default:
+		for i, a := range ad.attrs {
+			if a.name == stream {
+				ad.attrs = append(ad.attrs[:i], ad.attrs[i+1:]...)
+				break
+			}
+		}
+	}
+	return writeAppleDouble(name, ad)
+}
+
+func (AppleDoubleStreams) RenameStreams(oldName, newName string) error {
+	err := os.Rename(appleDoublePath(oldName), appleDoublePath(newName))
+	if os.IsNotExist(err) {
+		//the renamed file had no streams, a "._" file of the file it replaced goes
+		return AppleDoubleStreams{}.RemoveStreams(newName)
+	}
+	return err
+}
+
+func (AppleDoubleStreams) RemoveStreams(name string) error {
+	if err := os.Remove(appleDoublePath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (AppleDoubleStreams) Hidden(name string) bool {
+	return strings.HasPrefix(name, kAppleDoublePrefix)
+}
+
+// maxStreamSize keeps the "._" file within the 32-bit offsets of its entries.
+func (AppleDoubleStreams) maxStreamSize(stream string) int64 {
+	return math.MaxInt32
+}
+
+// place is the resource fork in the "._" file, the other streams are written whole.
+func (AppleDoubleStreams) place(name, stream string) streamPlace {
+	if !isResourceStream(stream) {
+		return nil
+	}
+	return adResource(name)
+}
+
+// errADLayout is a "._" file whose resource fork is not its end.
+var errADLayout = errors.New("AppleDouble resource fork is not last")
+
+// adResource is the resource fork of the "._" file of a file. It is the end of the file the way
+// marshal lays it out and is changed in place, a "._" file laid out otherwise is laid out again.
+type adResource string
+
+// adEntry is where the resource fork is, pos is the offset of its entry.
+type adEntry struct {
+	pos, off, length int64
+}
+
+// open opens the "._" file with flag and finds the resource fork, create makes a missing file.
+// The streams of the file are locked.
+func (r adResource) open(flag int, create bool) (*os.File, adEntry, error) {
+	name := string(r)
+	for laidOut := false; ; laidOut = true {
+		f, err := os.OpenFile(appleDoublePath(name), flag, 0)
+		if os.IsNotExist(err) && create {
+			if err := os.WriteFile(appleDoublePath(name), (&appleDouble{}).marshal(), 0644); err != nil {
+				return nil, adEntry{}, err
+			}
+			f, err = os.OpenFile(appleDoublePath(name), flag, 0)
+		}
+		if err != nil {
+			return nil, adEntry{}, err
+		}
+		e, err := locateResource(f)
+		if err == nil {
+			return f, e, nil
+		}
+		f.Close()
+		if err != errADLayout || laidOut {
+			return nil, adEntry{}, err
+		}
+		ad, err := readAppleDouble(name)
+		if err != nil {
+			return nil, adEntry{}, err
+		}
+		if err := os.WriteFile(appleDoublePath(name), ad.marshal(), 0644); err != nil {
+			return nil, adEntry{}, err
+		}
+	}
+}
+
+// locateResource reads the header of the "._" file f for its resource fork.
+func locateResource(f *os.File) (adEntry, error) {
+	e, ok, err := findADEntry(f, kADEntryResource)
+	if err != nil {
+		return adEntry{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return adEntry{}, err
+	}
+	if !ok || e.off+e.length != fi.Size() {
+		return adEntry{}, errADLayout
+	}
+	return e, nil
+}
+
+// findADEntry reads the header of the "._" file f for the entry id, ok is false when it has none.
+func findADEntry(f *os.File, id uint32) (e adEntry, ok bool, err error) {
+	hdr := make([]byte, kADHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return adEntry{}, false, errAppleDouble
+	}
+	if binary.BigEndian.Uint32(hdr) != kAppleDoubleMagic || binary.BigEndian.Uint32(hdr[4:]) != kAppleDoubleVersion {
+		return adEntry{}, false, errAppleDouble
+	}
+	entries := make([]byte, int(binary.BigEndian.Uint16(hdr[24:]))*kADEntrySize)
+	if _, err := f.ReadAt(entries, kADHeaderSize); err != nil {
+		return adEntry{}, false, errAppleDouble
+	}
+	for i := 0; i < len(entries); i += kADEntrySize {
+		if binary.BigEndian.Uint32(entries[i:]) == id {
+			return adEntry{pos: int64(kADHeaderSize + i), off: int64(binary.BigEndian.Uint32(entries[i+4:])),
+				length: int64(binary.BigEndian.Uint32(entries[i+8:]))}, true, nil
+		}
+	}
+	return adEntry{}, false, nil
+}
+
+// readResourceSize reads the size of the resource fork of the "._" file of name from its header.
+func readResourceSize(name string) (int64, error) {
+	f, err := os.Open(appleDoublePath(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	e, _, err := findADEntry(f, kADEntryResource)
+	return e.length, err
+}
+
+// readFinderInfo reads the Finder info of the "._" file of name and not the rest of the file.
+func readFinderInfo(name string) ([]byte, error) {
+	f, err := os.Open(appleDoublePath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e, ok, err := findADEntry(f, kADEntryFinderInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || e.length < kADFinderInfoSize {
+		return nil, os.ErrNotExist
+	}
+	finderInfo := make([]byte, kADFinderInfoSize)
+	if _, err := f.ReadAt(finderInfo, e.off); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(finderInfo, make([]byte, kADFinderInfoSize)) {
+		return nil, os.ErrNotExist
+	}
+	return finderInfo, nil
+}
+
+// setLength writes the length of the resource fork into its entry.
+func (e adEntry) setLength(f *os.File, length int64) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(length))
+	_, err := f.WriteAt(buf, e.pos+8)
+	return err
+}
+
+func (r adResource) ReadAt(p []byte, off int64) (int, error) {
+	unlock := lockStreams(string(r))
+	defer unlock()
+	f, e, err := r.open(os.O_RDONLY, false)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if off >= e.length {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(p)) > e.length-off {
+		want = p[:e.length-off]
+	}
+	n, err := f.ReadAt(want, e.off+off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r adResource) WriteAt(p []byte, off int64) (int, error) {
+	unlock := lockStreams(string(r))
+	defer unlock()
+	f, e, err := r.open(os.O_RDWR, true)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.WriteAt(p, e.off+off)
+	if end := off + int64(n); end > e.length {
+		if err := e.setLength(f, end); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+func (r adResource) Truncate(size int64) error {
+	unlock := lockStreams(string(r))
+	defer unlock()
+	f, e, err := r.open(os.O_RDWR, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(e.off + size); err != nil {
+		return err
+	}
+	return e.setLength(f, size)
+}
+
+func (r adResource) Size() (int64, error) {
+	unlock := lockStreams(string(r))
+	defer unlock()
+	return readResourceSize(string(r))
+}
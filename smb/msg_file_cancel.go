@@ -20,10 +20,10 @@ type CancelResponse struct {
 }
 
 func (data *CancelRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
-	data.Header.Flags = SMB2_FLAGS_RESPONSE
-	resp := CancelResponse{
-		Header:        data.Header,
-		StructureSize: 17,
-	}
-	return &resp, nil
+	async := data.Header.Flags&SMB2_FLAGS_ASYNC_COMMAND != 0
+	//the AsyncId takes the place of Reserved and TreeID
+	asyncId := uint64(data.Header.TreeID)<<32 | uint64(data.Header.Reserved)
+	ctx.session.CancelOp(data.Header.MessageID, asyncId, async)
+	//CANCEL is never answered, the cancelled request completes with STATUS_CANCELLED
+	return nil, nil
 }
@@ -53,9 +53,130 @@ type ChangeNotifyResponse struct {
 	OutputBuffer       []byte
 }
 
+// ChangeNotifyRequest.Flags
+const SMB2_WATCH_TREE uint16 = 0x0001
+
+// pendingNotify is a CHANGE_NOTIFY waiting on its directory. The requests of an open queue up and
+// complete in the order they came, ready is closed when the request is the first of its open and
+// cleanup when the handle is closed.
+type pendingNotify struct {
+	req     *ChangeNotifyRequest
+	ready   chan struct{}
+	cleanup chan struct{}
+}
+
 func (data *ChangeNotifyRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
-	data.Header.Status = STATUS_PENDING
-	ctx.session.notify[data.FileId] = data
-	return ERR(data.Header, STATUS_PENDING)
+
+	fileid := ctx.FileID(data.FileId)
+	webfile, ok := ctx.session.GetFile(fileid)
+	if !ok {
+		return ERR(data.Header, STATUS_FILE_CLOSED)
+	}
+	path := ctx.session.FilePath(fileid)
+	if stat, err := webfile.Stat(); path == "" || err != nil || !stat.IsDir() {
+		return ERR(data.Header, STATUS_INVALID_PARAMETER)
+	}
+	handle := ctx.Handle(data.TreeID)
+	if handle == nil {
+		return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
+	}
+	//the first CHANGE_NOTIFY of the open decides what is watched, changes are kept until it is closed
+	watch, stat := ctx.session.watchDir(fileid, handle.FileSystem, path, data.Flags&SMB2_WATCH_TREE != 0, data.CompletionFilter)
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+
+	pending := &pendingNotify{req: data, ready: make(chan struct{}), cleanup: make(chan struct{})}
+	ctx.session.mu.Lock()
+	if _, ok := ctx.session.openedFiles[fileid]; !ok {
+		ctx.session.mu.Unlock()
+		return ERR(data.Header, STATUS_FILE_CLOSED)
+	}
+	queue := ctx.session.notify[fileid]
+	if len(queue) == 0 {
+		close(pending.ready)
+	}
+	ctx.session.notify[fileid] = append(queue, pending)
+	ctx.session.mu.Unlock()
+	defer ctx.session.dequeueNotify(fileid, pending)
+
+	//a request behind others waits for them to complete before it takes changes
+	select {
+	case <-pending.ready:
+	default:
+		if !ctx.GoAsync() {
+			return ERR(data.Header, STATUS_NOT_SUPPORTED)
+		}
+		select {
+		case <-ctx.Done():
+			return ERR(data.Header, STATUS_CANCELLED)
+		case <-pending.cleanup:
+			return ERR(data.Header, STATUS_NOTIFY_CLEANUP)
+		case <-pending.ready:
+		}
+	}
+	buf, stat, changed := watch.take(data.OutputBufferLength)
+	if changed == nil {
+		return data.response(buf, stat)
+	}
+	if !ctx.GoAsync() {
+		//only the last request of a compound can wait
+		return ERR(data.Header, STATUS_NOT_SUPPORTED)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ERR(data.Header, STATUS_CANCELLED)
+		case <-pending.cleanup:
+			return ERR(data.Header, STATUS_NOTIFY_CLEANUP)
+		case <-changed:
+		}
+		if buf, stat, changed = watch.take(data.OutputBufferLength); changed == nil {
+			return data.response(buf, stat)
+		}
+	}
+}
+
+// dequeueNotify takes the completed request pending off the queue of the open guid, the next one
+// becomes the first.
+func (s *SessionS) dequeueNotify(guid GUID, pending *pendingNotify) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.notify[guid]
+	for i, p := range queue {
+		if p != pending {
+			continue
+		}
+		queue = append(queue[:i:i], queue[i+1:]...)
+		if i == 0 && len(queue) > 0 {
+			close(queue[0].ready)
+		}
+		break
+	}
+	if len(queue) == 0 {
+		delete(s.notify, guid)
+	} else {
+		s.notify[guid] = queue
+	}
+}
+
+// cleanupNotify completes every request waiting on the open guid with STATUS_NOTIFY_CLEANUP, s.mu is held.
+func (s *SessionS) cleanupNotify(guid GUID) {
+	for _, pending := range s.notify[guid] {
+		close(pending.cleanup)
+	}
+	delete(s.notify, guid)
+}
+
+func (data *ChangeNotifyRequest) response(buf []byte, stat Status) (interface{}, error) {
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+	resp := ChangeNotifyResponse{
+		Header:        data.Header,
+		StructureSize: 0x0009,
+		OutputBuffer:  buf,
+	}
+	return &resp, nil
 }
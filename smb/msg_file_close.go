@@ -39,7 +39,7 @@ func (data *CloseRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	}
 
 	fileid := ctx.FileID(data.FileId)
-	webfile, ok := ctx.session.openedFiles[fileid]
+	webfile, ok := ctx.session.DelFile(fileid)
 	if !ok {
 		return ERR(data.Header, STATUS_FILE_CLOSED)
 	}
@@ -63,7 +63,6 @@ func (data *CloseRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 		}
 	}
 
-	delete(ctx.session.openedFiles, fileid)
 	if webfile != nil {
 		webfile.Close()
 	}
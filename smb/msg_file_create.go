@@ -4,13 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"fmt"
 	"os"
 	"strings"
 	"sync/atomic"
 
 	"github/izouxv/smbapi/smb/encoder"
-	"github/izouxv/smbapi/util"
 
 	"github.com/izouxv/logx"
 	"golang.org/x/net/webdav"
@@ -258,84 +256,172 @@ const k_srvsvc = "srvsvc"
 
 var ipc_file = &webdavFile{filename: "$IPC", filenameAttr: "", webdavType: XATTR_FINDER_INFO_EA_NAME}
 
-func (data *CreateRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
-	data.Header.Flags = SMB2_FLAGS_RESPONSE
-	Filename, err := encoder.FromUnicode(data.Filename)
-	if err != nil {
-		return ERR(data.Header, STATUS_INVALID_PARAMETER)
+// createAction is what a CREATE with the disposition d did to the file, exists tells if it was there.
+func (d CreateDisposition) createAction(exists bool) CreateAction {
+	if !exists {
+		return FILE_CREATED
 	}
-
-	var createContextsResp []byte = nil
-	if len(data.CreateContexts) > 0 {
-		createContextsRequest := &SMB2_CREATE_CONTEXT_REQUEST{}
-		encoder.Unmarshal(data.CreateContexts, createContextsRequest)
-
-		createContextsResp = createContextsRequest.Action(func(ttt SMB2_CREATE_CONTEXT_RESPONSE_TYPE, request interface{}) (interface{}, error) {
-			switch ttt {
-			case SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG:
-				return &SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE{MaximalAccess: AllAccessMask}, nil
-			case SMB2_APPL_CREATE_CONTENT_TAG:
-				return nil, fmt.Errorf("NA")
-				return &SMB2_APPL_CREATE_CONTENT_TAG_RESPONSE{}, nil
-			default:
-				return nil, fmt.Errorf("NA")
-			}
-		})
+	switch d {
+	case FILE_SUPERSEDE:
+		return FILE_SUPERSEDED
+	case FILE_OVERWRITE, FILE_OVERWRITE_IF:
+		return FILE_OVERWRITTEN
 	}
+	return FILE_OPENED
+}
 
-	Filename = strings.Replace(Filename, "\\", "/", -1)
-
-	var createAction = FILE_SUPERSEDED
-
-	openFlags := 0
+// openFlags checks CreateDisposition and CreateOptions against fi, the file found or nil, and gives
+// the flags to open it with, MS-SMB2 3.3.5.9 and MS-FSA 2.1.5.1. isDir tells if the open is for a
+// directory, a missing one is made by the caller.
+func (data *CreateRequest) openFlags(fi os.FileInfo) (flags int, isDir bool, stat Status) {
+	exists := fi != nil
+	wantDir := data.CreateOptions&FILE_DIRECTORY_FILE != 0
+	if wantDir && data.CreateOptions&FILE_NON_DIRECTORY_FILE != 0 {
+		return 0, false, STATUS_INVALID_PARAMETER
+	}
 	switch data.CreateDisposition {
-	case FILE_SUPERSEDE:
-		createAction = FILE_SUPERSEDED
-		openFlags = os.O_TRUNC | os.O_CREATE | os.O_RDWR
+	case FILE_SUPERSEDE, FILE_OVERWRITE_IF:
+		flags = os.O_CREATE | os.O_TRUNC
 	case FILE_OPEN:
-		createAction = FILE_OPENED
+		if !exists {
+			return 0, false, STATUS_OBJECT_NAME_NOT_FOUND
+		}
 	case FILE_CREATE:
-		createAction = FILE_CREATED
-		openFlags = os.O_TRUNC | os.O_CREATE | os.O_RDWR //os.O_EXCL | os.O_RDWR
+		if exists {
+			return 0, false, STATUS_OBJECT_NAME_COLLISION
+		}
+		//the file system fails it if somebody created the file in the meantime
+		flags = os.O_CREATE | os.O_EXCL
 	case FILE_OPEN_IF:
-		createAction = FILE_CREATED
-		openFlags = os.O_CREATE
+		flags = os.O_CREATE
 	case FILE_OVERWRITE:
-		createAction = FILE_OVERWRITTEN
-		openFlags = os.O_TRUNC
-	case FILE_OVERWRITE_IF:
-		createAction = FILE_OVERWRITTEN
-		openFlags = os.O_TRUNC | os.O_CREATE | os.O_RDWR
+		if !exists {
+			return 0, false, STATUS_OBJECT_NAME_NOT_FOUND
+		}
+		flags = os.O_TRUNC
 	default:
+		return 0, false, STATUS_INVALID_PARAMETER
+	}
+	isDir = wantDir
+	if exists {
+		isDir = fi.IsDir()
+		if wantDir && !isDir {
+			return 0, false, STATUS_NOT_A_DIRECTORY
+		}
+		if data.CreateOptions&FILE_NON_DIRECTORY_FILE != 0 && isDir {
+			return 0, false, STATUS_FILE_IS_A_DIRECTORY
+		}
+	}
+	if isDir {
+		if flags&os.O_TRUNC == 0 {
+			return os.O_RDONLY, true, StatusOk
+		}
+		if wantDir {
+			return 0, false, STATUS_INVALID_PARAMETER
+		}
+		return 0, false, STATUS_FILE_IS_A_DIRECTORY
+	}
+	if flags&os.O_TRUNC != 0 || data.AccessMask&(FILE_WRITE_DATA|GENERIC_ALL|GENERIC_WRITE) != 0 {
+		flags |= os.O_RDWR
+	}
+	return flags, false, StatusOk
+}
+
+// fill reports the attributes, size and times of the opened file, path is its absolute path.
+func (resp *CreateResponse) fill(fi os.FileInfo, path string) {
+	meta := newFileMeta(fi, path)
+	resp.FileAttributes |= meta.attributes
+	resp.EndOfFile = meta.size
+	resp.AllocationSize = meta.allocation
+	resp.CreationTime = meta.creation
+	resp.LastAccessTime = meta.access
+	resp.LastWriteTime = meta.write
+	resp.ChangeTime = meta.change
+}
+
+func (data *CreateRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
+	data.Header.Flags = SMB2_FLAGS_RESPONSE
+	Filename, err := encoder.FromUnicode(data.Filename)
+	if err != nil {
 		return ERR(data.Header, STATUS_INVALID_PARAMETER)
 	}
 
-	if true {
-		if openFlags&os.O_TRUNC > 0 {
-			absPath := ctx.session.GetAbsPath(Filename)
-			if util.FileExist(absPath) {
-				logx.Printf("truncate")
-			}
+	contexts, err := parseCreateContexts(data.CreateContexts)
+	if err != nil {
+		return ERR(data.Header, STATUS_INVALID_PARAMETER)
+	}
+	var respContexts []createContext
+	if findCreateContext(contexts, SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG) != nil {
+		buf, err := encoder.Marshal(&SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE{MaximalAccess: AllAccessMask})
+		if err != nil {
+			return ERR(data.Header, STATUS_UNSUCCESSFUL)
 		}
+		respContexts = append(respContexts, createContext{tag: SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG, data: buf})
 	}
 
-	if data.AccessMask&(FILE_WRITE_DATA|GENERIC_ALL|GENERIC_WRITE) != 0 {
-		openFlags |= os.O_RDWR
-	} else if openFlags&os.O_RDWR == 0 {
-		openFlags |= os.O_RDONLY
+	//the security descriptor of a new file is checked before anything is created
+	var sd *SecurityDescriptor
+	if buf := findCreateContext(contexts, SMB2_CREATE_SD_BUFFER_TAG); buf != nil {
+		if sd, err = parseSecurityDescriptor(buf); err != nil {
+			return ERR(data.Header, STATUS_INVALID_SECURITY_DESCR)
+		}
+	}
+	var eas []EA
+	if buf := findCreateContext(contexts, SMB2_CREATE_EA_BUFFER_TAG); buf != nil {
+		if eas, err = parseFullEAs(buf); err != nil {
+			return ERR(data.Header, STATUS_EA_LIST_INCONSISTENT)
+		}
+	}
+
+	Filename = strings.Replace(Filename, "\\", "/", -1)
+	//a stream is opened as "file:stream", the unnamed data stream is the file itself
+	file, stream, stat := splitStream(Filename)
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+	Filename = file
+	if stream != "" {
+		if data.CreateOptions&FILE_DIRECTORY_FILE != 0 {
+			return ERR(data.Header, STATUS_NOT_A_DIRECTORY)
+		}
+		Filename = file + ":" + stream
+	}
+
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
+	}
+	if stat := checkEAs(tree.anchor.eaMap(), eas); stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+	if buf := findCreateContext(contexts, SMB2_APPL_CREATE_CONTENT_TAG); buf != nil {
+		if aapl, ok := ctx.session.aaplResponse(tree.anchor, buf); ok {
+			respContexts = append(respContexts, aapl)
+		}
+	}
+	if findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_TAG) != nil ||
+		findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2_TAG) != nil {
+		return data.reconnect(ctx, tree, tree.GetAbsPath(Filename), contexts, respContexts)
+	}
+
+	if data.CreateDisposition > FILE_OVERWRITE_IF {
+		return ERR(data.Header, STATUS_INVALID_PARAMETER)
+	}
+	if data.CreateOptions&FILE_DELETE_ON_CLOSE != 0 && mapGenericAccess(data.AccessMask)&DELETE == 0 {
+		return ERR(data.Header, STATUS_ACCESS_DENIED)
 	}
 	fid := atomic.AddUint64(&ctx.session.fileNum, 1)
-	guid := makeGUID(data.TreeID, fid)
+	guid := makeGUID(tree.id, fid)
 
 	data.Header.Status = StatusOk
 	resp := CreateResponse{
 		Header:        data.Header,
 		StructureSize: 89,
 		FileId:        guid,
-		CreateAction:  createAction,
+		CreateAction:  FILE_OPENED,
 	}
 
-	if data.TreeID == ctx.session.GetAnchor(NamedPipeShareName).tid {
+	if tree.IsIPC() {
 		if Filename != k_srvsvc {
 			return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
 		}
@@ -349,50 +435,96 @@ func (data *CreateRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 		// 	}
 		// }
 
-		ctx.session.openedFiles[guid] = ipc_file
+		ctx.session.PutFile(guid, ipc_file, "")
 		resp.FileAttributes |= FILE_ATTRIBUTE_HIDDEN | FILE_ATTRIBUTE_NORMAL
 		resp.AllocationSize = 0
 		resp.EndOfFile = 0
 	} else {
 		var webfile webdav.File
-		isDir := data.FileAttributes&FILE_ATTRIBUTE_DIRECTORY > 0
-		if data.CreateDisposition == FILE_CREATE {
-			// openFlags = (os.O_RDWR | os.O_CREATE | os.O_TRUNC)
-			if isDir {
-				absPath := ctx.session.GetAbsPath(Filename)
-				err = ctx.Handle().FileSystem.Mkdir(context.Background(), absPath, 07777)
-				if err != nil {
-					return ERR(data.Header, STATUS_UNSUCCESSFUL)
-				}
-				openFlags = 0
-			} else {
+		var durable *durableOpen
+		absPath := tree.GetAbsPath(Filename)
+		handle := ctx.Handle(tree.id)
+		gQuotaTable.open(tree.anchor, handle.FileSystem)
+		fs := tree.anchor.streamFS(handle.FileSystem)
+		fi, serr := fs.Stat(context.Background(), absPath)
+		if serr != nil {
+			fi = nil
+		}
+		openFlags, isDir, stat := data.openFlags(fi)
+		if stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		resp.CreateAction = data.CreateDisposition.createAction(fi != nil)
+		wait := func(done <-chan struct{}) bool {
+			ctx.GoAsync()
+			select {
+			case <-done:
+				return true
+			case <-ctx.Done():
+				return false
 			}
 		}
-
-		ok, path, xattr := IsXAttr(Filename)
-		if ok { //处理xattr数据
-			// return ERR(data.Header, STATUS_NOT_IMPLEMENTED)
-			// } else if (data.AccessMask&FILE_READ_ATTRIBUTES > 0 || data.AccessMask&DELETE > 0) && ok {
-			absPath := ctx.session.GetAbsPath(path)
-			absPathAttr := ctx.session.GetAbsPath(Filename)
-			attrTag := XATTR_Key(xattr)
-			// 	// com.apple.lastuseddate#PS
-			// 	// com.apple.metadata _kMDItemUserTag s
-			// 	// com.apple.metadata _kMDItemFavoriteRank
-			openFlags = 0 // os.O_TRUNC会重置文件，所以需要把它换成0
-			// webfile, err = ctx.Handle().FileSystem.OpenFile(context.Background(), absPath, openFlags, 0666)
-			webfile = &webdavFile{filename: absPath, filenameAttr: absPathAttr, webdavType: attrTag}
-			_, err = webfile.Stat()
-			if err != nil {
-				webfile.Close()
-				return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
+		//the share mode of the other opens is checked before the file is touched
+		if stat := openShared(absPath, guid, ctx.session, data.AccessMask, data.ShareAccess, wait); stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		//conflicting oplocks and leases are broken before the open takes effect
+		req, lease := data.oplockRequest(ctx, guid, isDir, contexts)
+		req.fsys = fs
+		grant, stat := gOplockTable.acquire(absPath, req, wait)
+		if stat != StatusOk {
+			gShareTable.release(absPath, guid)
+			return ERR(data.Header, stat)
+		}
+		if fi == nil || req.overwrite {
+			gOplockTable.expectChange(absPath, guid)
+		}
+		if isDir && fi == nil {
+			//Mkdir fails like O_EXCL when the directory was created in the meantime
+			err = fs.Mkdir(context.Background(), absPath, 07777)
+			if os.IsExist(err) && data.CreateDisposition == FILE_OPEN_IF {
+				err = nil
 			}
-		} else {
-			absPath := ctx.session.GetAbsPath(Filename)
-			webfile, err = ctx.Handle().FileSystem.OpenFile(context.Background(), absPath, openFlags, 0666)
-			if err != nil {
-				return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
+		}
+		if err == nil {
+			webfile, err = fs.OpenFile(context.Background(), absPath, openFlags, 0666)
+		}
+		if err != nil {
+			gOplockTable.release(absPath, guid)
+			gShareTable.release(absPath, guid)
+			if os.IsExist(err) {
+				return ERR(data.Header, STATUS_OBJECT_NAME_COLLISION)
 			}
+			return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
+		}
+		if data.CreateOptions&FILE_DELETE_ON_CLOSE != 0 {
+			gShareTable.deleteOnClose(absPath, guid, fs)
+		}
+		if sd != nil && fi == nil {
+			ctx.session.createSecurity(webfile, sd)
+		}
+		//the EAs of an overwritten file are replaced
+		if eas != nil && stream == "" && (fi == nil || openFlags&os.O_TRUNC != 0) {
+			if stat := tree.anchor.setFileEAs(fs, absPath, eas, fi != nil); stat != StatusOk {
+				logx.Warnf("EAs of %v, status: %#x", absPath, uint32(stat))
+			}
+		}
+		if fi == nil && !isDir {
+			gQuotaTable.created(absPath, ctx.session.userName)
+		} else if fi != nil && openFlags&os.O_TRUNC != 0 {
+			gQuotaTable.charge(absPath, ctx.session.userName, -fi.Size())
+		}
+		if fi == nil || req.overwrite {
+			gOplockTable.childChanged(absPath, guid)
+		}
+		resp.Oplock = grant.level
+		if lease != nil {
+			respContexts = append(respContexts, lease.response(grant))
+		}
+		if d := data.durableRequest(ctx, guid, tree, absPath, contexts); d != nil && (grant.durable() || d.store != nil) {
+			d.keep(data, openFlags, req, grant)
+			durable = d
+			respContexts = append(respContexts, d.response())
 		}
 
 		if os.IsNotExist(err) {
@@ -402,28 +534,22 @@ func (data *CreateRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 			return ERR(data.Header, STATUS_UNSUCCESSFUL)
 		}
 
-		ctx.session.openedFiles[guid] = webfile
+		ctx.session.PutFile(guid, webfile, tree.GetAbsPath(Filename))
+		ctx.session.setFileMode(guid, fileMode{mode: data.CreateOptions & kFileModeOptions})
+		if durable != nil {
+			ctx.session.setDurable(durable)
+		}
 
 		fi, err := webfile.Stat()
 		if err != nil {
 			return ERR(data.Header, STATUS_UNSUCCESSFUL)
 		}
-
-		if fi.IsDir() {
-			resp.FileAttributes |= FILE_ATTRIBUTE_DIRECTORY
-		} else {
-			resp.FileAttributes |= FILE_ATTRIBUTE_NORMAL
-			resp.EndOfFile = uint64(fi.Size())
-			resp.AllocationSize = uint64(fi.Size())
-		}
-		mtime := timeToFiletime(fi.ModTime())
-		resp.CreationTime = mtime
-		resp.LastWriteTime = mtime
-		resp.ChangeTime = mtime
-		resp.LastAccessTime = 0
+		resp.fill(fi, tree.GetAbsPath(Filename))
 	}
 	ctx.latestFileId = guid
-	resp.CreateContexts = createContextsResp
+	if resp.CreateContexts, err = marshalCreateContexts(respContexts); err != nil {
+		return ERR(data.Header, STATUS_UNSUCCESSFUL)
+	}
 
 	return resp, nil
 
@@ -1,6 +1,9 @@
 package smb
 
 import (
+	"encoding/binary"
+	"time"
+
 	"github/izouxv/smbapi/smb/encoder"
 )
 
@@ -24,11 +27,16 @@ import (
 type SMB2_CREATE_CONTEXT_RESPONSE_TYPE string
 
 const (
-	// SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG       SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "DHnQ"
+	SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG       SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "DHnQ"
+	SMB2_CREATE_DURABLE_HANDLE_RECONNECT_TAG      SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "DHnC"
+	SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG    SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "DH2Q"
+	SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2_TAG   SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "DH2C"
 	SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "MxAc"
 	// SMB2_CREATE_QUERY_ON_DISK_ID_TAG              SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "QFid"
-	// SMB2_CREATE_RESPONSE_LEASE_TAG                SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "RqLs"
-	SMB2_APPL_CREATE_CONTENT_TAG SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "AAPL"
+	SMB2_CREATE_RESPONSE_LEASE_TAG SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "RqLs"
+	SMB2_APPL_CREATE_CONTENT_TAG   SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "AAPL"
+	SMB2_CREATE_SD_BUFFER_TAG      SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "SecD"
+	SMB2_CREATE_EA_BUFFER_TAG      SMB2_CREATE_CONTEXT_RESPONSE_TYPE = "ExtA"
 )
 
 type SMB2_CREATE_CONTEXT_REQUEST struct {
@@ -43,36 +51,67 @@ type SMB2_CREATE_CONTEXT_REQUEST struct {
 	Data       []byte
 }
 
-func (s *SMB2_CREATE_CONTEXT_REQUEST) Action(actioncb func(SMB2_CREATE_CONTEXT_RESPONSE_TYPE, interface{}) (interface{}, error)) []byte {
-	tag := SMB2_CREATE_CONTEXT_RESPONSE_TYPE(s.Tag)
-	// logx.Printf("create ext type : %v", tag)
+// createContext is one element of the CreateContexts chain of a CREATE.
+type createContext struct {
+	tag  SMB2_CREATE_CONTEXT_RESPONSE_TYPE
+	data []byte
+}
 
-	var data interface{}
-	switch tag {
-	// case SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG:
-	case SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG:
-		data = &SMB2_CREATE_QUERY_MAXIMAL_ACCESS_REQUEST{}
-	// case SMB2_CREATE_QUERY_ON_DISK_ID_TAG:
-	// case SMB2_CREATE_RESPONSE_LEASE_TAG:
-	case SMB2_APPL_CREATE_CONTENT_TAG:
-		data = &SMB2_APPL_CREATE_CONTENT_TAG_REQUEST{}
-	default:
-		return nil
+// parseCreateContexts splits the CreateContexts chain, every element starts 8 byte aligned at Next.
+func parseCreateContexts(buf []byte) ([]createContext, error) {
+	var ctxs []createContext
+	for len(buf) > 0 {
+		if len(buf) < 16 {
+			return nil, ErrStructSizeInvalid
+		}
+		next := binary.LittleEndian.Uint32(buf)
+		tagOff, tagLen := int(binary.LittleEndian.Uint16(buf[4:])), int(binary.LittleEndian.Uint16(buf[6:]))
+		dataOff, dataLen := int(binary.LittleEndian.Uint16(buf[10:])), int(binary.LittleEndian.Uint32(buf[12:]))
+		if tagOff+tagLen > len(buf) || dataOff+dataLen > len(buf) || int(next) > len(buf) || next%8 != 0 {
+			return nil, ErrStructSizeInvalid
+		}
+		ctxs = append(ctxs, createContext{
+			tag:  SMB2_CREATE_CONTEXT_RESPONSE_TYPE(buf[tagOff : tagOff+tagLen]),
+			data: buf[dataOff : dataOff+dataLen],
+		})
+		if next == 0 {
+			break
+		}
+		buf = buf[next:]
 	}
-	resp, err := actioncb(tag, data)
-	if err != nil {
-		return nil
-	}
-	respBuf, err := encoder.Marshal(resp)
-	if err != nil {
-		return nil
+	return ctxs, nil
+}
+
+// findCreateContext returns the data of the context tag, nil when the client did not send it.
+func findCreateContext(ctxs []createContext, tag SMB2_CREATE_CONTEXT_RESPONSE_TYPE) []byte {
+	for _, c := range ctxs {
+		if c.tag == tag {
+			if c.data == nil {
+				return []byte{}
+			}
+			return c.data
+		}
 	}
-	s.Data = respBuf
-	sBuf, err := encoder.Marshal(s)
-	if err != nil {
-		return nil
+	return nil
+}
+
+// marshalCreateContexts builds the CreateContexts chain of a CREATE response.
+func marshalCreateContexts(ctxs []createContext) ([]byte, error) {
+	var buf []byte
+	last := 0
+	for _, c := range ctxs {
+		elem, err := encoder.Marshal(&SMB2_CREATE_CONTEXT_REQUEST{Tag: []byte(c.tag), Data: c.data})
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			buf = append(buf, make([]byte, pad8(uint64(len(buf))))...)
+			binary.LittleEndian.PutUint32(buf[last:], uint32(len(buf)-last))
+		}
+		last = len(buf)
+		buf = append(buf, elem...)
 	}
-	return sBuf
+	return buf, nil
 }
 
 type SMB2_CREATE_QUERY_MAXIMAL_ACCESS_REQUEST struct {
@@ -88,12 +127,270 @@ type SMB2_APPL_CREATE_CONTENT_TAG_REQUEST struct {
 	QueryBitmask    uint64
 	ClientServerCap uint64
 }
+
+// SMB2_APPL_CREATE_CONTENT_TAG_RESPONSE is the whole AAPL reply, the caps and the model are only
+// sent when QueryBitmask has their bit.
 type SMB2_APPL_CREATE_CONTENT_TAG_RESPONSE struct {
-	ServerQuery     uint32
-	Reserved        uint32
-	QueryBitmask    uint64
-	ClientServerCap uint64
-	VolumeCap       uint64
-	ModelStringLen  uint16 `smb:"len:ModelString"`
-	ModelString     uint16
+	ServerQuery    uint32
+	Reserved       uint32
+	QueryBitmask   uint64
+	ServerCap      uint64
+	VolumeCap      uint64
+	Reserved2      uint32
+	ModelStringLen uint32 `smb:"len:ModelString"`
+	ModelString    []byte //unicode
+}
+
+// SMB2_CREATE_REQUEST_LEASE, the RqLs context of SMB 2.1, the response has the same layout.
+type SMB2_CREATE_REQUEST_LEASE struct {
+	LeaseKey      GUID
+	LeaseState    uint32
+	LeaseFlags    uint32
+	LeaseDuration uint64
+}
+
+// SMB2_CREATE_REQUEST_LEASE_V2, the RqLs context of SMB 3.x, the response has the same layout.
+type SMB2_CREATE_REQUEST_LEASE_V2 struct {
+	LeaseKey       GUID
+	LeaseState     uint32
+	LeaseFlags     uint32
+	LeaseDuration  uint64
+	ParentLeaseKey GUID
+	Epoch          uint16
+	Reserved       uint16
+}
+
+const (
+	kCreateLeaseSize   = 32
+	kCreateLeaseV2Size = 52
+)
+
+// SMB2_CREATE_DURABLE_HANDLE_RECONNECT, the DHnC context, the FileId of the open to reclaim.
+type SMB2_CREATE_DURABLE_HANDLE_RECONNECT struct {
+	FileId GUID
+}
+
+// SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2, the DH2Q context of SMB 3.x.
+type SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2 struct {
+	Timeout    uint32 //milliseconds, 0 lets the server choose
+	Flags      uint32
+	Reserved   uint64
+	CreateGuid GUID
+}
+
+type SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2 struct {
+	Timeout uint32
+	Flags   uint32
+}
+
+// SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2, the DH2C context of SMB 3.x.
+type SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2 struct {
+	FileId     GUID
+	CreateGuid GUID
+	Flags      uint32
+}
+
+const (
+	kDurableRequestSize     = 16
+	kDurableReconnectSize   = 16
+	kDurableRequestV2Size   = 32
+	kDurableReconnectV2Size = 36
+)
+
+// LeaseFlags
+const (
+	SMB2_LEASE_FLAG_BREAK_IN_PROGRESS    uint32 = 0x00000002
+	SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET uint32 = 0x00000004
+)
+
+// leaseRequest is the RqLs context of a CREATE, version 1 only fills the SMB 2.1 fields.
+type leaseRequest struct {
+	SMB2_CREATE_REQUEST_LEASE_V2
+	version uint16
+}
+
+// parseLeaseRequest reads the RqLs context, the V2 layout is only used by SMB 3.x.
+func parseLeaseRequest(buf []byte, dialect uint16) *leaseRequest {
+	lease := &leaseRequest{}
+	switch {
+	case len(buf) >= kCreateLeaseV2Size && dialect >= DialectSmb_3_0:
+		if encoder.Unmarshal(buf, &lease.SMB2_CREATE_REQUEST_LEASE_V2) != nil {
+			return nil
+		}
+		lease.version = 2
+	case len(buf) >= kCreateLeaseSize:
+		var v1 SMB2_CREATE_REQUEST_LEASE
+		if encoder.Unmarshal(buf, &v1) != nil {
+			return nil
+		}
+		lease.LeaseKey, lease.LeaseState = v1.LeaseKey, v1.LeaseState
+		lease.version = 1
+	default:
+		return nil
+	}
+	return lease
+}
+
+// response is the RqLs context of the CREATE response, in the version the client asked with.
+func (l *leaseRequest) response(grant oplockGrant) createContext {
+	var flags uint32
+	if grant.breaking {
+		flags |= SMB2_LEASE_FLAG_BREAK_IN_PROGRESS
+	}
+	var buf []byte
+	if l.version == 2 {
+		resp := SMB2_CREATE_REQUEST_LEASE_V2{
+			LeaseKey:   l.LeaseKey,
+			LeaseState: grant.state,
+			LeaseFlags: flags | l.LeaseFlags&SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET,
+			Epoch:      grant.epoch,
+		}
+		if resp.LeaseFlags&SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET != 0 {
+			resp.ParentLeaseKey = l.ParentLeaseKey
+		}
+		buf, _ = encoder.Marshal(&resp)
+	} else {
+		buf, _ = encoder.Marshal(&SMB2_CREATE_REQUEST_LEASE{LeaseKey: l.LeaseKey, LeaseState: grant.state, LeaseFlags: flags})
+	}
+	return createContext{tag: SMB2_CREATE_RESPONSE_LEASE_TAG, data: buf}
+}
+
+// oplockRequest is what the CREATE asks the oplock table for, the lease is nil unless one was requested.
+func (data *CreateRequest) oplockRequest(ctx *DataCtx, guid GUID, isDir bool, contexts []createContext) (*oplockRequest, *leaseRequest) {
+	req := &oplockRequest{
+		open:      guid,
+		session:   ctx.session,
+		level:     data.OpLock,
+		isDir:     isDir,
+		overwrite: data.CreateDisposition == FILE_SUPERSEDE || data.CreateDisposition == FILE_OVERWRITE || data.CreateDisposition == FILE_OVERWRITE_IF,
+		attrOnly:  data.AccessMask&^kAttributeAccess == 0,
+	}
+	if data.OpLock != SMB2_OPLOCK_LEVEL_LEASE {
+		return req, nil
+	}
+	req.level = SMB2_OPLOCK_LEVEL_NONE
+	if ctx.session.dialect < DialectSmb_2_1 {
+		return req, nil
+	}
+	lease := parseLeaseRequest(findCreateContext(contexts, SMB2_CREATE_RESPONSE_LEASE_TAG), ctx.session.dialect)
+	if lease == nil {
+		return req, nil
+	}
+	key := ctx.session.leaseKey(lease.LeaseKey)
+	req.level = SMB2_OPLOCK_LEVEL_LEASE
+	req.lease = &key
+	req.leaseState = lease.LeaseState
+	req.version = lease.version
+	if lease.version == 2 && lease.LeaseFlags&SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET != 0 {
+		parent := ctx.session.leaseKey(lease.ParentLeaseKey)
+		req.parent = &parent
+	}
+	return req, lease
+}
+
+// durableRequest is the DHnQ or DH2Q context of a CREATE as the open it would make durable, nil
+// without one. DH2Q is only read from SMB 3.x clients, it asks for a persistent handle on shares
+// with continuous availability.
+func (data *CreateRequest) durableRequest(ctx *DataCtx, guid GUID, tree *TreeS, path string, contexts []createContext) *durableOpen {
+	d := &durableOpen{guid: guid, path: path, share: tree.anchor.Name, user: ctx.session.userName}
+	copy(d.clientGuid[:], ctx.session.clientGuid)
+	if buf := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG); buf != nil && ctx.session.dialect >= DialectSmb_3_0 {
+		var req SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2
+		if len(buf) < kDurableRequestV2Size || encoder.Unmarshal(buf, &req) != nil {
+			return nil
+		}
+		d.version, d.createGuid, d.timeout = 2, req.CreateGuid, ctx.session.durableTimeout(req.Timeout)
+		if req.Flags&SMB2_DHANDLE_FLAG_PERSISTENT != 0 && ctx.session.persistentShare(tree.anchor) {
+			d.store = ctx.session.store
+		}
+		return d
+	}
+	if buf := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG); len(buf) >= kDurableRequestSize {
+		d.version, d.timeout = 1, ctx.session.durableTimeout(0)
+		return d
+	}
+	return nil
+}
+
+// keep records how the open was made, a persistent open journals it.
+func (d *durableOpen) keep(data *CreateRequest, openFlags int, req *oplockRequest, grant oplockGrant) {
+	d.access, d.shareAccess, d.openFlags = data.AccessMask, data.ShareAccess, openFlags
+	d.oplock, d.lease, d.leaseState, d.leaseVersion = grant.level, req.lease, grant.state, req.version
+}
+
+// durable tells if the open can be durable, a client has to cache the handle to reconnect it.
+// A persistent handle is durable without it.
+func (grant oplockGrant) durable() bool {
+	if grant.level == SMB2_OPLOCK_LEVEL_LEASE {
+		return grant.state&kLeaseH != 0
+	}
+	return grant.level == SMB2_OPLOCK_LEVEL_BATCH
+}
+
+// response is the context of the CREATE response that tells the client the handle is durable.
+func (d *durableOpen) response() createContext {
+	if d.version == 2 {
+		resp := SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2{Timeout: uint32(d.timeout / time.Millisecond)}
+		if d.store != nil {
+			resp.Flags = SMB2_DHANDLE_FLAG_PERSISTENT
+		}
+		buf, _ := encoder.Marshal(&resp)
+		return createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG, data: buf}
+	}
+	return createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG, data: make([]byte, 8)}
+}
+
+// reconnect answers a CREATE with a DHnC or DH2C context, the client reclaims the durable handle it
+// had on a connection that dropped. The handle keeps its FileId, locks and oplock or lease.
+func (data *CreateRequest) reconnect(ctx *DataCtx, tree *TreeS, absPath string, contexts, respContexts []createContext) (interface{}, error) {
+	var fileid GUID
+	var createGuid *GUID
+	if buf := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2_TAG); buf != nil && ctx.session.dialect >= DialectSmb_3_0 {
+		var req SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2
+		if len(buf) < kDurableReconnectV2Size || encoder.Unmarshal(buf, &req) != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		fileid, createGuid = req.FileId, &req.CreateGuid
+	} else {
+		var req SMB2_CREATE_DURABLE_HANDLE_RECONNECT
+		buf := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_TAG)
+		if len(buf) < kDurableReconnectSize || encoder.Unmarshal(buf, &req) != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		fileid = req.FileId
+	}
+
+	d := ctx.session.reclaimDurable(fileid, createGuid, tree, absPath)
+	if d == nil {
+		return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
+	}
+	webfile, _ := ctx.session.GetFile(d.guid)
+	fi, err := webfile.Stat()
+	if err != nil {
+		if webfile, ok := ctx.session.DelFile(d.guid); ok {
+			webfile.Close()
+		}
+		return ERR(data.Header, STATUS_OBJECT_NAME_NOT_FOUND)
+	}
+	grant := gOplockTable.reclaim(d.path, d.guid, ctx.session)
+
+	data.Header.Status = StatusOk
+	resp := CreateResponse{
+		Header:        data.Header,
+		StructureSize: 89,
+		Oplock:        grant.level,
+		FileId:        d.guid,
+		CreateAction:  FILE_OPENED,
+	}
+	resp.fill(fi, d.path)
+	if grant.level == SMB2_OPLOCK_LEVEL_LEASE {
+		if lease := parseLeaseRequest(findCreateContext(contexts, SMB2_CREATE_RESPONSE_LEASE_TAG), ctx.session.dialect); lease != nil {
+			respContexts = append(respContexts, lease.response(grant))
+		}
+	}
+	ctx.latestFileId = d.guid
+	if resp.CreateContexts, err = marshalCreateContexts(respContexts); err != nil {
+		return ERR(data.Header, STATUS_UNSUCCESSFUL)
+	}
+	return resp, nil
 }
@@ -1,6 +1,8 @@
 package smb
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github/izouxv/smbapi/util"
@@ -37,3 +39,72 @@ func Test_Xattr(t *testing.T) {
 	assert.Equal(t, path, "")
 	assert.Equal(t, xattr, Filename)
 }
+
+func Test_CreateDisposition(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("abc"), 0666))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "d"), 0777))
+	session, tree := testDurableSession(dir, nil)
+	create := func(name string, disposition CreateDisposition, options CreateOptions) (CreateResponse, Status) {
+		return testResponse(testCreate(t, session, tree, testOpen(name, FILE_READ_DATA|FILE_WRITE_DATA|DELETE, disposition, options)))
+	}
+	closeFile := func(resp CreateResponse) {
+		webfile, ok := session.DelFile(resp.FileId)
+		assert.True(t, ok)
+		webfile.Close()
+	}
+
+	//FILE_CREATE fails on an existing file and creates a missing one
+	_, stat := create("a.txt", FILE_CREATE, 0)
+	assert.Equal(t, STATUS_OBJECT_NAME_COLLISION, stat)
+	resp, stat := create("b.txt", FILE_CREATE, 0)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, FILE_CREATED, resp.CreateAction)
+	closeFile(resp)
+
+	_, stat = create("c.txt", FILE_OPEN, 0)
+	assert.Equal(t, STATUS_OBJECT_NAME_NOT_FOUND, stat)
+	_, stat = create("c.txt", FILE_OVERWRITE, 0)
+	assert.Equal(t, STATUS_OBJECT_NAME_NOT_FOUND, stat)
+	resp, _ = create("a.txt", FILE_OPEN_IF, 0)
+	assert.Equal(t, FILE_OPENED, resp.CreateAction)
+	assert.Equal(t, uint64(3), resp.EndOfFile)
+	closeFile(resp)
+	resp, _ = create("c.txt", FILE_OPEN_IF, 0)
+	assert.Equal(t, FILE_CREATED, resp.CreateAction)
+	closeFile(resp)
+
+	//FILE_SUPERSEDE replaces the data
+	resp, _ = create("a.txt", FILE_SUPERSEDE, 0)
+	assert.Equal(t, FILE_SUPERSEDED, resp.CreateAction)
+	assert.Equal(t, uint64(0), resp.EndOfFile)
+	closeFile(resp)
+	resp, _ = create("b.txt", FILE_OVERWRITE_IF, 0)
+	assert.Equal(t, FILE_OVERWRITTEN, resp.CreateAction)
+	closeFile(resp)
+
+	//the file type has to match the options
+	_, stat = create("a.txt", FILE_OPEN, FILE_DIRECTORY_FILE)
+	assert.Equal(t, STATUS_NOT_A_DIRECTORY, stat)
+	_, stat = create("d", FILE_OPEN, FILE_NON_DIRECTORY_FILE)
+	assert.Equal(t, STATUS_FILE_IS_A_DIRECTORY, stat)
+	_, stat = create("e", FILE_OVERWRITE_IF, FILE_DIRECTORY_FILE)
+	assert.Equal(t, STATUS_INVALID_PARAMETER, stat)
+	resp, stat = create("e", FILE_CREATE, FILE_DIRECTORY_FILE)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, FILE_ATTRIBUTE_DIRECTORY, resp.FileAttributes&FILE_ATTRIBUTE_DIRECTORY)
+	closeFile(resp)
+
+	//delete on close waits for the last handle, the file can not be opened again meanwhile
+	first, _ := create("b.txt", FILE_OPEN, 0)
+	second, _ := create("b.txt", FILE_OPEN, FILE_DELETE_ON_CLOSE)
+	closeFile(second)
+	_, stat = create("b.txt", FILE_OPEN, 0)
+	assert.Equal(t, STATUS_DELETE_PENDING, stat)
+	assert.FileExists(t, filepath.Join(dir, "b.txt"))
+	closeFile(first)
+	assert.NoFileExists(t, filepath.Join(dir, "b.txt"))
+	resp, _ = create("e", FILE_OPEN, FILE_DIRECTORY_FILE|FILE_DELETE_ON_CLOSE)
+	closeFile(resp)
+	assert.NoDirExists(t, filepath.Join(dir, "e"))
+}
@@ -0,0 +1,308 @@
+package smb
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/0eb94f48-6aac-41df-a878-79f4dcfd8989
+
+// FILE_FULL_EA_INFORMATION Flags
+const FILE_NEED_EA uint8 = 0x80
+
+// QUERY_INFO Flags of FileFullEaInformation
+const (
+	SL_RESTART_SCAN        uint32 = 0x00000001
+	SL_RETURN_SINGLE_ENTRY uint32 = 0x00000002
+	SL_INDEX_SPECIFIED     uint32 = 0x00000004
+)
+
+const (
+	kFullEAHeaderSize = 8 //NextEntryOffset, Flags, EaNameLength, EaValueLength
+	kGetEAHeaderSize  = 5 //NextEntryOffset, EaNameLength
+	kMaxEANameLength  = 255
+)
+
+var errEAList = errors.New("bad extended attribute list")
+
+// EA is an extended attribute of a file, an empty Value removes it.
+type EA struct {
+	Flags uint8
+	Name  string
+	Value []byte
+}
+
+// size is the size of ea in a FILE_FULL_EA_INFORMATION list, without the alignment.
+func (ea EA) size() int {
+	return kFullEAHeaderSize + len(ea.Name) + 1 + len(ea.Value)
+}
+
+// marshal writes ea at the start of buf, NextEntryOffset stays zero.
+func (ea EA) marshal(buf []byte) {
+	buf[4] = ea.Flags
+	buf[5] = uint8(len(ea.Name))
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(ea.Value)))
+	copy(buf[kFullEAHeaderSize:], ea.Name)
+	copy(buf[kFullEAHeaderSize+len(ea.Name)+1:], ea.Value)
+}
+
+// marshalEAs is the FILE_FULL_EA_INFORMATION list of eas, entries start 4 byte aligned.
+func marshalEAs(eas []EA) []byte {
+	buf := make([]byte, eaListSize(eas))
+	off, last := 0, 0
+	for i, ea := range eas {
+		if i > 0 {
+			off = (off + 3) &^ 3
+			binary.LittleEndian.PutUint32(buf[last:], uint32(off-last))
+		}
+		ea.marshal(buf[off:])
+		last = off
+		off += ea.size()
+	}
+	return buf
+}
+
+// eaListSize is the size of the FILE_FULL_EA_INFORMATION list of eas, the EaSize of FileEaInformation
+// and directory entries.
+func eaListSize(eas []EA) int {
+	n := 0
+	for i, ea := range eas {
+		if i > 0 {
+			n = (n + 3) &^ 3
+		}
+		n += ea.size()
+	}
+	return n
+}
+
+// parseFullEAs reads a FILE_FULL_EA_INFORMATION list, the set of SET_INFO and the ExtA create
+// context. Every entry has to lie in buf.
+func parseFullEAs(buf []byte) ([]EA, error) {
+	var eas []EA
+	for off := 0; ; {
+		if off+kFullEAHeaderSize > len(buf) {
+			return nil, errEAList
+		}
+		entry := buf[off:]
+		next := int(binary.LittleEndian.Uint32(entry))
+		nameLen, valueLen := int(entry[5]), int(binary.LittleEndian.Uint16(entry[6:]))
+		end := kFullEAHeaderSize + nameLen + 1 + valueLen
+		if end > len(entry) || (next != 0 && next < end) || entry[kFullEAHeaderSize+nameLen] != 0 {
+			return nil, errEAList
+		}
+		value := entry[kFullEAHeaderSize+nameLen+1 : end]
+		eas = append(eas, EA{
+			Flags: entry[4],
+			Name:  string(entry[kFullEAHeaderSize : kFullEAHeaderSize+nameLen]),
+			Value: append([]byte(nil), value...),
+		})
+		if next == 0 {
+			return eas, nil
+		}
+		off += next
+	}
+}
+
+// parseGetEAs reads the FILE_GET_EA_INFORMATION list of a FileFullEaInformation query, the names
+// it asks for.
+func parseGetEAs(buf []byte) ([]string, error) {
+	var names []string
+	for off := 0; ; {
+		if off+kGetEAHeaderSize > len(buf) {
+			return nil, errEAList
+		}
+		entry := buf[off:]
+		next := int(binary.LittleEndian.Uint32(entry))
+		nameLen := int(entry[4])
+		end := kGetEAHeaderSize + nameLen + 1
+		if end > len(entry) || (next != 0 && next < end) {
+			return nil, errEAList
+		}
+		names = append(names, string(entry[kGetEAHeaderSize:kGetEAHeaderSize+nameLen]))
+		if next == 0 {
+			return names, nil
+		}
+		off += next
+	}
+}
+
+// validEAName tells if name can be an extended attribute, FsRtlIsEaNameValid.
+func validEAName(name string) bool {
+	if len(name) == 0 || len(name) > kMaxEANameLength {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c >= 0x7f || strings.IndexByte("\"*+,/:;<=>?[\\]|", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// EAMap maps the extended attributes of clients to xattr keys, XAttrSet keeps a key in the user
+// namespace of the file system or in a sidecar.
+type EAMap interface {
+	//Key is the xattr key of the extended attribute name, empty when name can not be kept
+	Key(name string) string
+	//Name is the extended attribute the xattr key keeps, ok is false for keys that are none
+	Name(key string) (name string, ok bool)
+}
+
+// kServerXattrPrefix is the namespace of the xattrs the server keeps for itself, user attributes
+// on Linux like every key without a namespace.
+const kServerXattrPrefix = "smb."
+
+// kReservedXattrs are the keys of the server and of the Apple metadata served as streams, no
+// extended attribute maps to them.
+var kReservedXattrs = []string{kServerXattrPrefix, "com.apple."}
+
+// PrefixEAMap keeps the extended attribute NAME under the key Prefix+NAME.
+type PrefixEAMap struct {
+	Prefix string
+}
+
+func (m PrefixEAMap) Key(name string) string {
+	key := m.Prefix + name
+	//a name with a namespace of its own would leave the user namespace
+	if xattrName(key) != kXattrUserPrefix+key || reservedXattr(key) {
+		return ""
+	}
+	return key
+}
+
+func (m PrefixEAMap) Name(key string) (string, bool) {
+	if !strings.HasPrefix(key, m.Prefix) || reservedXattr(key) {
+		return "", false
+	}
+	name := key[len(m.Prefix):]
+	return name, validEAName(name)
+}
+
+// reservedXattr tells if key is one of kReservedXattrs, spelled with its namespace or without.
+func reservedXattr(key string) bool {
+	if kXattrUserPrefix != "" {
+		key = strings.TrimPrefix(xattrName(key), kXattrUserPrefix)
+	}
+	for _, prefix := range kReservedXattrs {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eaMap is EAs or the plain mapping.
+func (a *Anchor) eaMap() EAMap {
+	if a == nil || a.EAs == nil {
+		return PrefixEAMap{}
+	}
+	return a.EAs
+}
+
+// readEAs reads the extended attributes of the file name, sorted by name.
+func readEAs(m EAMap, name string) ([]EA, error) {
+	keys, err := XAttrGetKeys(name)
+	if err != nil {
+		return nil, err
+	}
+	var eas []EA
+	for _, key := range keys {
+		eaName, ok := m.Name(key)
+		if !ok || reservedXattr(key) {
+			continue
+		}
+		value, err := XAttrGet(name, key)
+		if err != nil || len(value) == 0 || len(value) > 0xFFFF {
+			continue
+		}
+		eas = append(eas, EA{Name: eaName, Value: value})
+	}
+	sort.Slice(eas, func(i, j int) bool { return strings.ToUpper(eas[i].Name) < strings.ToUpper(eas[j].Name) })
+	return eas, nil
+}
+
+// writeEAs sets eas on the file name, an empty value removes the attribute. Names are case
+// insensitive, a name that replaces one spelled differently removes the old spelling. replace
+// removes the attributes eas leaves out.
+func writeEAs(m EAMap, name string, eas []EA, replace bool) error {
+	old, err := readEAs(m, name)
+	if err != nil {
+		return err
+	}
+	for _, o := range old {
+		keep := !replace
+		for _, ea := range eas {
+			if strings.EqualFold(o.Name, ea.Name) {
+				keep = o.Name == ea.Name && len(ea.Value) > 0
+			}
+		}
+		if !keep {
+			if err := XAttrDel(name, m.Key(o.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ea := range eas {
+		if len(ea.Value) == 0 {
+			continue
+		}
+		if err := XAttrSet(name, m.Key(ea.Name), ea.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEAs tells if every name of eas can be kept on the share.
+func checkEAs(m EAMap, eas []EA) Status {
+	for _, ea := range eas {
+		if key := m.Key(ea.Name); !validEAName(ea.Name) || key == "" || reservedXattr(key) {
+			return STATUS_INVALID_EA_NAME
+		}
+	}
+	return StatusOk
+}
+
+// fileEAs reads the extended attributes of path on fsys, file systems that are not a directory on
+// disk keep none.
+func (a *Anchor) fileEAs(fsys webdav.FileSystem, path string) ([]EA, error) {
+	d, ok := diskDir(fsys)
+	if !ok {
+		return nil, nil
+	}
+	return readEAs(a.eaMap(), dirPath(d, path))
+}
+
+// setFileEAs sets eas on path, replace drops the attributes the file had, the file is overwritten.
+func (a *Anchor) setFileEAs(fsys webdav.FileSystem, path string, eas []EA, replace bool) Status {
+	d, ok := diskDir(fsys)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	if stat := checkEAs(a.eaMap(), eas); stat != StatusOk {
+		return stat
+	}
+	if err := writeEAs(a.eaMap(), dirPath(d, path), eas, replace); err != nil {
+		return fsErrStatus(err)
+	}
+	return StatusOk
+}
+
+// eaScan is the next entry an EA enumeration of the open guid returns.
+func (s *SessionS) eaScan(guid GUID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.eaScans[guid]
+}
+
+func (s *SessionS) setEAScan(guid GUID, next int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.openedFiles[guid]; ok {
+		s.eaScans[guid] = next
+	}
+}
@@ -0,0 +1,86 @@
+package smb
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExtendedAttributes(t *testing.T) {
+	dir := t.TempDir()
+	session, tree := testDurableSession(dir, nil)
+	path := filepath.Join(dir, "a.txt")
+
+	ext := marshalEAs([]EA{{Name: "Color", Value: []byte("red")}})
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|FILE_READ_EA|FILE_WRITE_EA, FILE_CREATE, 0),
+		createContext{tag: SMB2_CREATE_EA_BUFFER_TAG, data: ext}))
+
+	query := func(level FileInformationClass, flags uint32, input []byte) interface{} {
+		req := QueryInfoRequest{
+			Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+			StructureSize:      41,
+			Class:              SMB2_0_INFO_FILE,
+			InfoLevel:          uint8(level),
+			OutputBufferLength: 4096,
+			Flags:              flags,
+			FileId:             fileid,
+			InputBuffer:        input,
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		return resp
+	}
+	setEAs := func(eas ...EA) Status {
+		return testSetInfo(t, session, tree, SetInfoRequest{FileInfoClass: FileFullEaInformation, FileId: fileid}, marshalEAs(eas))
+	}
+	list := func(flags uint32, input []byte) []EA {
+		eas, err := parseFullEAs(query(FileFullEaInformation, flags, input).(*QueryInfoResponse).OutputBuffer)
+		assert.Nil(t, err)
+		return eas
+	}
+
+	//the EAs of the create context land on the file and are kept as user xattrs
+	value, err := XAttrGet(path, "Color")
+	assert.Nil(t, err)
+	assert.Equal(t, "red", string(value))
+	info := query(FileEaInformation, 0, nil).(*QueryInfoResponse).OutputBuffer
+	assert.Equal(t, uint32(len(ext)), binary.LittleEndian.Uint32(info))
+
+	//names are case insensitive, the new spelling replaces the old one
+	assert.Equal(t, StatusOk, setEAs(EA{Name: "COLOR", Value: []byte("blue")}, EA{Name: "Size", Value: []byte("1")}))
+	eas := list(SL_RESTART_SCAN, nil)
+	assert.Equal(t, []EA{{Name: "COLOR", Value: []byte("blue")}, {Name: "Size", Value: []byte("1")}}, eas)
+	assert.Equal(t, STATUS_NO_MORE_EAS, query(FileFullEaInformation, 0, nil).(ErrResponse).Header.Status)
+
+	//an enumeration of single entries goes on where the last one stopped
+	assert.Equal(t, "COLOR", list(SL_RESTART_SCAN|SL_RETURN_SINGLE_ENTRY, nil)[0].Name)
+	assert.Equal(t, "Size", list(SL_RETURN_SINGLE_ENTRY, nil)[0].Name)
+
+	//a FILE_GET_EA_INFORMATION list gets the names it asks for, missing ones without a value
+	get := []byte{12, 0, 0, 0, 4, 's', 'i', 'z', 'e', 0, 0, 0, 0, 0, 0, 0, 7, 'm', 'i', 's', 's', 'i', 'n', 'g', 0}
+	assert.Equal(t, []EA{{Name: "Size", Value: []byte("1")}, {Name: "missing"}}, list(0, get))
+
+	//an invalid name is refused, an empty value removes the EA
+	assert.Equal(t, STATUS_INVALID_EA_NAME, setEAs(EA{Name: "a:b", Value: []byte("x")}))
+	assert.Equal(t, StatusOk, setEAs(EA{Name: "color"}, EA{Name: "size"}))
+	assert.Equal(t, STATUS_NO_EAS_ON_FILE, query(FileFullEaInformation, SL_RESTART_SCAN, nil).(ErrResponse).Header.Status)
+
+	webfile, _ := session.DelFile(fileid)
+	webfile.Close()
+
+	//a file system without xattrs keeps them in a sidecar the file takes along
+	assert.Nil(t, updateSidecar(path, func(attrs map[string][]byte) error {
+		attrs["Color"] = []byte("green")
+		return nil
+	}))
+	renameSidecar(path, filepath.Join(dir, "b.txt"))
+	sidecarMu.Lock()
+	attrs, err := readSidecar(filepath.Join(dir, "b.txt"))
+	sidecarMu.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, "green", string(attrs["Color"]))
+	removeSidecar(filepath.Join(dir, "b.txt"))
+	assert.NoDirExists(t, filepath.Join(dir, kSidecarDir))
+}
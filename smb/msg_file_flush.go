@@ -24,6 +24,16 @@ type FlushResponse struct {
 
 func (data *FlushRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
+	webfile, ok := ctx.session.GetFile(ctx.FileID(data.FileId))
+	if !ok {
+		return ERR(data.Header, STATUS_FILE_CLOSED)
+	}
+	//the data is on the disk once the flush is answered, Sync is F_FULLFSYNC on macOS
+	if file, ok := webfile.(interface{ Sync() error }); ok {
+		if err := file.Sync(); err != nil {
+			return ERR(data.Header, fsErrStatus(err))
+		}
+	}
 	resp := FlushResponse{
 		Header:        data.Header,
 		StructureSize: 0x001,
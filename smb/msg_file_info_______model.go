@@ -12,35 +12,36 @@ const (
 	FileDirectoryInformation FileInformationClass = 0x01 // Uses: Query
 	// FileFullDirectoryInformation FileInformationClass = 0x02 // Uses: Query
 	// FileBothDirectoryInformation FileInformationClass = 0x03 // Uses: Query
-	FileBasicInformation FileInformationClass = 0x04 // Uses: Query, Set
-	// FileStandardInformation        FileInformationClass = 0x05 // Uses: Query
-	// FileInternalInformation        FileInformationClass = 0x06 // Uses: Query
-	// FileEaInformation              FileInformationClass = 0x07 // Uses: Query
-	// FileAccessInformation          FileInformationClass = 0x08 // Uses: Query
+	FileBasicInformation    FileInformationClass = 0x04 // Uses: Query, Set
+	FileStandardInformation FileInformationClass = 0x05 // Uses: Query
+	FileInternalInformation FileInformationClass = 0x06 // Uses: Query
+	FileEaInformation       FileInformationClass = 0x07 // Uses: Query
+	FileAccessInformation   FileInformationClass = 0x08 // Uses: Query
 	// FileNameInformation            FileInformationClass = 0x09 // Uses: LOCAL
 	FileRenameInformation FileInformationClass = 0x0A // Uses: Set
-	// FileLinkInformation            FileInformationClass = 0x0B // Uses: Set
+	FileLinkInformation   FileInformationClass = 0x0B // Uses: Set
 	// FileNamesInformation FileInformationClass = 0x0C // Uses: Query
 	FileDispositionInformation FileInformationClass = 0x0D // Uses: Set
-	// FilePositionInformation        FileInformationClass = 0x0E // Uses: Query, Set
-	// FileFullEaInformation          FileInformationClass = 0x0F // Uses: Query, Set
-	// FileModeInformation            FileInformationClass = 0x10 // Uses: Query, Set
-	// FileAlignmentInformation       FileInformationClass = 0x11 // Uses: Query
-	FileAllInformation FileInformationClass = 0x12 // Uses: Query
-	// FileAllocationInformation      FileInformationClass = 0x13 // Uses: Set
-	// FileEndOfFileInformation       FileInformationClass = 0x14 // Uses: Set
+	FilePositionInformation    FileInformationClass = 0x0E // Uses: Query, Set
+	FileFullEaInformation      FileInformationClass = 0x0F // Uses: Query, Set
+	FileModeInformation        FileInformationClass = 0x10 // Uses: Query, Set
+	FileAlignmentInformation   FileInformationClass = 0x11 // Uses: Query
+	FileAllInformation         FileInformationClass = 0x12 // Uses: Query
+	FileAllocationInformation  FileInformationClass = 0x13 // Uses: Set
+	FileEndOfFileInformation   FileInformationClass = 0x14 // Uses: Set
 	// FileAlternateNameInformation   FileInformationClass = 0x15 // Uses: Query
 	FileStreamInformation FileInformationClass = 0x16 // Uses: Query
 	// FilePipeInformation            FileInformationClass = 0x17 // Uses: Query, Set
 	// FilePipeLocalInformation       FileInformationClass = 0x18 // Uses: Query
 	// FilePipeRemoteInformation      FileInformationClass = 0x19 // Uses: Query
-	// FileCompressionInformation     FileInformationClass = 0x1C // Uses: Query
-	// FileNetworkOpenInformation     FileInformationClass = 0x22 // Uses: Query
-	// FileAttributeTagInformation    FileInformationClass = 0x23 // Uses: Query
+	FileCompressionInformation     FileInformationClass = 0x1C // Uses: Query
+	FileNetworkOpenInformation     FileInformationClass = 0x22 // Uses: Query
+	FileAttributeTagInformation    FileInformationClass = 0x23 // Uses: Query
 	FileIdBothDirectoryInformation FileInformationClass = 0x25 // Uses: Query
 	// FileIdFullDirectoryInformation FileInformationClass = 0x26 // Uses: Query
-	// FileValidDataLengthInformation FileInformationClass = 0x27 // Uses: Set
-	// FileShortNameInformation       FileInformationClass = 0x28 // Uses: Set
+	FileValidDataLengthInformation FileInformationClass = 0x27 // Uses: Set
+	FileShortNameInformation       FileInformationClass = 0x28 // Uses: Set
+	FileNormalizedNameInformation  FileInformationClass = 0x30 // Uses: Query
 )
 
 func (c FileInformationClass) MarshalBinary(meta *encoder.Metadata) ([]byte, error) {
@@ -53,17 +54,17 @@ func (c FileInformationClass) UnmarshalBinary(data []byte, meta *encoder.Metadat
 type FileSystemInformationClass uint8
 
 const (
-	// FileFsVolumeInformation FileSystemInformationClass = 0x01 // Uses: Query
+	FileFsVolumeInformation FileSystemInformationClass = 0x01 // Uses: Query
 	// // FileFsLabelInformation       FileSystemInformationClass = 0x02
-	FileFsSizeInformation FileSystemInformationClass = 0x03 // Uses: Query
-	// FileFsDeviceInformation     FileSystemInformationClass = 0x04 // Uses: Query
+	FileFsSizeInformation      FileSystemInformationClass = 0x03 // Uses: Query
+	FileFsDeviceInformation    FileSystemInformationClass = 0x04 // Uses: Query
 	FileFsAttributeInformation FileSystemInformationClass = 0x05 // Uses: Query
-// FileFsControlInformation    FileSystemInformationClass = 0x06 // Uses: Query Set
-// FileFsFullSizeInformation   FileSystemInformationClass = 0x07 // Uses: Query
-// FileFsObjectIdInformation   FileSystemInformationClass = 0x08 // Uses: Query Set
-// FileFsDriverPathInformation FileSystemInformationClass = 0x09
-// // FileFsVolumeFlagsInformation FileSystemInformationClass = 0x0A
-// FileFsSectorSizeInformation FileSystemInformationClass = 0x0B // Uses: Query
+	// FileFsControlInformation    FileSystemInformationClass = 0x06 // Uses: Query Set
+	FileFsFullSizeInformation FileSystemInformationClass = 0x07 // Uses: Query
+	FileFsObjectIdInformation FileSystemInformationClass = 0x08 // Uses: Query Set
+	// FileFsDriverPathInformation FileSystemInformationClass = 0x09
+	// // FileFsVolumeFlagsInformation FileSystemInformationClass = 0x0A
+	FileFsSectorSizeInformation FileSystemInformationClass = 0x0B // Uses: Query
 )
 
 type FileDirectoryInfo struct {
@@ -160,6 +161,94 @@ type FileRenameInformationX struct {
 	FileNameLength  uint32 `smb:"len:FileName"`
 	FileName        []byte
 }
+type FileStandardInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/5afa7f66-619c-48f3-955f-68c4ece704ae
+	AllocationSize uint64
+	EndOfFile      uint64
+	NumberOfLinks  uint32
+	DeletePending  uint8
+	Directory      uint8
+	Reserved       uint16
+}
+type FileInternalInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/7d796611-2fa5-41ac-8178-b6fea3a017b3
+	IndexNumber uint64
+}
+type FileEaInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/db6cf109-ead8-441a-b29e-cb2032778b0f
+	EaSize uint32
+}
+type FileAccessInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/01cf43d2-deb3-40d3-a39b-9e68693d7c90
+	AccessFlags AccessMask
+}
+type FileAlignmentInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/9b0b9971-85aa-4651-8438-f1c4298bcb0d
+	AlignmentRequirement uint32
+}
+type FileNetworkOpenInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/26d261db-58d1-4513-a548-074448cbb146
+	CreateTime     uint64
+	LastAccess     uint64
+	LastWrite      uint64
+	LastChange     uint64
+	AllocationSize uint64
+	EndOfFile      uint64
+	FileAttributes FileAttributes
+	Reserved       uint32
+}
+type FileAttributeTagInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/d295752f-ce89-4b98-8553-266d37c84f0e
+	FileAttributes FileAttributes
+	ReparseTag     uint32
+}
+type FileCompressionInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/0a7e50c4-2839-438e-aa6c-0da7d681a5a7
+	CompressedFileSize   uint64
+	CompressionFormat    uint16
+	CompressionUnitShift uint8
+	ChunkShift           uint8
+	ClusterShift         uint8
+	Reserved             []byte `smb:"fixed:3"`
+}
+type FileNameInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/20406fb1-605f-4629-ba9a-c67ee25f23d2
+	FileNameLength uint32 `smb:"len:FileName"`
+	FileName       []byte
+}
+type FileLinkInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/69643dd7-5b6e-4ef7-8a56-ae5a5e1e7bd0
+	ReplaceIfExists uint8
+	Reserved        []byte `smb:"fixed:7"`
+	RootDirHandle   uint64
+	FileNameLength  uint32 `smb:"len:FileName"`
+	FileName        []byte
+}
+type FileEndOfFileInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/75241cca-3167-472f-8058-a52d77c6bb17
+	EndOfFile uint64
+}
+type FileAllocationInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/0201c69b-50db-412d-bab3-dd97aeede13b
+	AllocationSize uint64
+}
+type FileValidDataLengthInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/5c9f9d50-f0e0-40b1-9b07-bfb3f14c2c4f
+	ValidDataLength uint64
+}
+type FilePositionInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/e3ce4a39-327e-495c-99b6-6b61606b6f16
+	CurrentByteOffset uint64
+}
+type FileModeInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/52df7798-8330-474b-ac31-9afe8075640c
+	Mode CreateOptions
+}
+type FileShortNameInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/20406fb1-605f-4629-ba9a-c67ee25f23d2
+	FileNameLength uint32 `smb:"len:FileName"`
+	FileName       []byte
+}
 
 func Duiqi4Byte(buf []byte) []byte {
 	if len(buf)%4 != 0 {
@@ -210,3 +299,51 @@ type FileFsSizeInformationX struct {
 	SectorsUnit    uint32
 	BytesPerSector uint32
 }
+type FileFsVolumeInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/bf691378-c34e-4a13-976e-404ea1a87738
+	VolumeCreationTime uint64
+	VolumeSerialNumber uint32
+	VolumeLabelLength  uint32 `smb:"len:VolumeLabel"`
+	SupportsObjects    uint8
+	Reserved           uint8
+	VolumeLabel        []byte
+}
+type FileFsFullSizeInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/63768db7-9012-4209-8cca-00781e7322f5
+	AllocationSize  uint64
+	CallerFreeUnits uint64
+	ActualFreeUnits uint64
+	SectorsUnit     uint32
+	BytesPerSector  uint32
+}
+type FileFsDeviceInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/616b66d5-b335-4e1c-8f87-b4a55e8d3e4a
+	DeviceType      uint32
+	Characteristics uint32
+}
+type FileFsObjectIdInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/dbf535ae-315a-4508-8bc5-84276ea106d4
+	ObjectId     GUID
+	ExtendedInfo []byte `smb:"fixed:48"`
+}
+
+// FileQuotaInformationX is an entry of a SMB2_0_INFO_QUOTA answer, MS-FSCC 2.4.41
+type FileQuotaInformationX struct {
+	NextEntryOffset uint32
+	SidLength       uint32 `smb:"len:Sid"`
+	ChangeTime      uint64
+	QuotaUsed       uint64
+	QuotaThreshold  uint64
+	QuotaLimit      uint64
+	Sid             []byte
+}
+type FileFsSectorSizeInformationX struct {
+	// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/3e75d97f-1d0b-4e47-b435-73c513837a57
+	LogicalBytesPerSector                                 uint32
+	PhysicalBytesPerSectorForAtomicity                    uint32
+	PhysicalBytesPerSectorForPerformance                  uint32
+	FileSystemEffectivePhysicalBytesPerSectorForAtomicity uint32
+	Flags                                                 uint32
+	ByteOffsetForSectorAlignment                          uint32
+	ByteOffsetForPartitionAlignment                       uint32
+}
@@ -1,5 +1,11 @@
 package smb
 
+import (
+	"encoding/binary"
+
+	"github/izouxv/smbapi/smb/encoder"
+)
+
 func init() {
 	commandRequestMap[CommandLock] = func() DataI {
 		return &LockRequest{}
@@ -8,12 +14,62 @@ func init() {
 
 //CommandLock
 
+const (
+	SMB2_LOCKFLAG_SHARED_LOCK      uint32 = 0x00000001
+	SMB2_LOCKFLAG_EXCLUSIVE_LOCK   uint32 = 0x00000002
+	SMB2_LOCKFLAG_UNLOCK           uint32 = 0x00000004
+	SMB2_LOCKFLAG_FAIL_IMMEDIATELY uint32 = 0x00000010
+)
+
+type LockElement struct {
+	Offset   uint64
+	Length   uint64
+	Flags    uint32
+	Reserved uint32
+}
+
+// LockElements is the Locks array of a LOCK request, LockCount elements of 24 bytes.
+type LockElements []LockElement
+
+const kLockElementSize = 24
+
+func (l LockElements) MarshalBinary(meta *encoder.Metadata) ([]byte, error) {
+	buf := make([]byte, 0, len(l)*kLockElementSize)
+	for i := range l {
+		b, err := encoder.Marshal(&l[i])
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+func (l LockElements) UnmarshalBinary(buf []byte, meta *encoder.Metadata) (interface{}, error) {
+	count := int(meta.Count[meta.CurrField])
+	if len(buf) < count*kLockElementSize {
+		return nil, ErrStructSizeInvalid
+	}
+	elems := make(LockElements, count)
+	for i := range elems {
+		b := buf[i*kLockElementSize:]
+		elems[i] = LockElement{
+			Offset: binary.LittleEndian.Uint64(b),
+			Length: binary.LittleEndian.Uint64(b[8:]),
+			Flags:  binary.LittleEndian.Uint32(b[16:]),
+		}
+	}
+	meta.CurrOffset += uint64(count * kLockElementSize)
+	return elems, nil
+}
+
 type LockRequest struct {
 	Header
 	StructureSize uint16
-	Reserved1     uint16
-	Reserved2     uint32
+	LockCount     uint16 `smb:"count:Locks"`
+	LockSequence  uint32 //LockSequenceNumber and LockSequenceIndex, for resilient handles
 	FileId        GUID
+	Locks         LockElements
 }
 
 type LockResponse struct {
@@ -22,8 +78,75 @@ type LockResponse struct {
 	Reserved      uint16
 }
 
+// checkFlags validates the Locks array, a request either unlocks or locks, and only a single lock may wait.
+func (data *LockRequest) checkFlags() (unlock bool, wait bool, stat Status) {
+	if len(data.Locks) == 0 {
+		return false, false, STATUS_INVALID_PARAMETER
+	}
+	unlock = data.Locks[0].Flags&SMB2_LOCKFLAG_UNLOCK != 0
+	wait = len(data.Locks) == 1
+	for _, e := range data.Locks {
+		switch {
+		case unlock && e.Flags == SMB2_LOCKFLAG_UNLOCK:
+		case !unlock && (e.Flags&^SMB2_LOCKFLAG_FAIL_IMMEDIATELY == SMB2_LOCKFLAG_SHARED_LOCK ||
+			e.Flags&^SMB2_LOCKFLAG_FAIL_IMMEDIATELY == SMB2_LOCKFLAG_EXCLUSIVE_LOCK):
+			if e.Flags&SMB2_LOCKFLAG_FAIL_IMMEDIATELY != 0 {
+				wait = false
+			} else if len(data.Locks) > 1 {
+				return false, false, STATUS_INVALID_PARAMETER
+			}
+		default:
+			return false, false, STATUS_INVALID_PARAMETER
+		}
+	}
+	return unlock, wait, StatusOk
+}
+
 func (data *LockRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
+
+	fileid := ctx.FileID(data.FileId)
+	if _, ok := ctx.session.GetFile(fileid); !ok {
+		return ERR(data.Header, STATUS_FILE_CLOSED)
+	}
+	unlock, wait, stat := data.checkFlags()
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+
+	path := ctx.session.FilePath(fileid)
+	if path == "" {
+		//pipes have no byte ranges
+		return ERR(data.Header, STATUS_INVALID_DEVICE_REQUEST)
+	}
+	if unlock {
+		stat = gLockTable.unlock(path, fileid, data.Locks)
+	} else {
+		for {
+			var changed <-chan struct{}
+			stat, changed = gLockTable.lock(path, fileid, data.Locks)
+			if stat != STATUS_LOCK_NOT_GRANTED || !wait {
+				break
+			}
+			if !ctx.GoAsync() {
+				//only the last request of a compound can wait
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ERR(data.Header, STATUS_CANCELLED)
+			case <-changed:
+			}
+			if _, ok := ctx.session.GetFile(fileid); !ok {
+				return ERR(data.Header, STATUS_FILE_CLOSED)
+			}
+		}
+	}
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+	ctx.session.journalOpen(fileid)
+
 	resp := LockResponse{
 		Header:        data.Header,
 		StructureSize: 0x0004,
@@ -1,6 +1,8 @@
 package smb
 
 import (
+	"bytes"
+
 	"github/izouxv/smbapi/smb/encoder"
 
 	"github.com/izouxv/logx"
@@ -78,6 +80,9 @@ func (data *IOCTLRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	if data.Flags != SMB2_0_IOCTL_IS_FSCTL {
 		return ERR(data.Header, STATUS_NOT_SUPPORTED)
 	}
+	if data.Function == FSCTL_VALIDATE_NEGOTIATE_INFO {
+		return data.validateNegotiateInfo(ctx)
+	}
 	if !data.GUIDHandle.IsSvrSvc(ctx.session) {
 		return ERR(data.Header, STATUS_NOT_SUPPORTED)
 	}
@@ -113,6 +118,63 @@ func (data *IOCTLRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	return &resp, nil
 }
 
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/261ec397-d692-4e3e-8bcd-c96ce02bb969
+type ValidateNegotiateInfoRequest struct {
+	Capabilities uint32
+	Guid         []byte `smb:"fixed:16"`
+	SecurityMode uint16
+	DialectCount uint16 `smb:"count:Dialects"`
+	Dialects     []uint16
+}
+
+type ValidateNegotiateInfoResponse struct {
+	Capabilities uint32
+	Guid         []byte `smb:"fixed:16"`
+	SecurityMode uint16
+	Dialect      uint16
+}
+
+// validateNegotiateInfo lets a 3.0/3.0.2 client detect a tampered NEGOTIATE, any mismatch drops the connection.
+func (data *IOCTLRequest) validateNegotiateInfo(ctx *DataCtx) (interface{}, error) {
+	session := ctx.session
+	var req ValidateNegotiateInfoRequest
+	if err := encoder.Unmarshal(data.Buffer, &req); err != nil {
+		return nil, err
+	}
+	if req.Capabilities != session.clientCapabilities ||
+		!bytes.Equal(req.Guid, session.clientGuid) ||
+		req.SecurityMode != session.clientSecurityMode ||
+		selectDialect(req.Dialects) != session.dialect {
+		logx.Warnf("validate negotiate info mismatch, IP: %v", ctx.conn.RemoteAddr())
+		return nil, ErrValidateNegotiateInfo
+	}
+
+	out, err := encoder.Marshal(&ValidateNegotiateInfoResponse{
+		Capabilities: session.capabilities,
+		Guid:         gServerGuid,
+		SecurityMode: session.serverSecurityMode,
+		Dialect:      session.dialect,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data.MaxOutputSize < uint32(len(out)) {
+		return nil, ErrValidateNegotiateInfo
+	}
+
+	resp := IOCTLResponse{
+		Header:        data.Header,
+		StructureSize: 0x31,
+		Function:      data.Function,
+		GUIDHandle:    data.GUIDHandle,
+		BlobOffset:    0x70,
+		BlobOffset2:   0x70,
+		BlobLength2:   uint32(len(out)),
+		Buffer:        out,
+	}
+	return &resp, nil
+}
+
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/f030a3b9-539c-4c7b-a893-86b795b9b711
 // 请求服务器等待连接
 type FSCTLPIPEWAITRequestStruct struct {
@@ -0,0 +1,61 @@
+package smb
+
+import (
+	"net"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SelectDialect(t *testing.T) {
+	assert.Equal(t, uint16(DialectSmb_3_0_2), selectDialect([]uint16{DialectSmb_2_1, DialectSmb_3_0_2, DialectSmb_3_0}))
+	assert.Equal(t, uint16(DialectSmb_2_0_2), selectDialect([]uint16{DialectSmb_2_0_2}))
+	assert.Equal(t, uint16(0), selectDialect([]uint16{0x0222}))
+}
+
+func Test_ValidateNegotiateInfo(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	session := NewSessionServer(true, srv, nil, nil)
+	session.dialect = DialectSmb_3_0_2
+	session.clientGuid = make([]byte, 16)
+	session.clientCapabilities = 0x7f
+	session.clientSecurityMode = SecurityModeSigningEnabled
+	session.capabilities = serverCapabilities(session.dialect, session.clientCapabilities)
+	session.serverSecurityMode = SecurityModeSigningEnabled
+	ctx := NewDataCtx(session, srv, nil)
+
+	info := ValidateNegotiateInfoRequest{
+		Capabilities: 0x7f,
+		Guid:         make([]byte, 16),
+		SecurityMode: SecurityModeSigningEnabled,
+		DialectCount: 3,
+		Dialects:     []uint16{DialectSmb_2_1, DialectSmb_3_0, DialectSmb_3_0_2},
+	}
+	buf, err := encoder.Marshal(&info)
+	assert.Nil(t, err)
+	req := &IOCTLRequest{
+		Header:        Header{ProtocolID: []byte(ProtocolSmb2), Signature: make([]byte, 16)},
+		Function:      FSCTL_VALIDATE_NEGOTIATE_INFO,
+		GUIDHandle:    LastGUID,
+		MaxOutputSize: 24,
+		Flags:         SMB2_0_IOCTL_IS_FSCTL,
+		Buffer:        buf,
+	}
+	resp, err := req.ServerAction(ctx)
+	assert.Nil(t, err)
+	var out ValidateNegotiateInfoResponse
+	assert.Nil(t, encoder.Unmarshal(resp.(*IOCTLResponse).Buffer, &out))
+	assert.Equal(t, uint16(DialectSmb_3_0_2), out.Dialect)
+	assert.Equal(t, gServerGuid, out.Guid)
+
+	//a downgraded NEGOTIATE drops the connection
+	info.DialectCount = 2
+	info.Dialects = []uint16{DialectSmb_2_1, DialectSmb_3_0}
+	req.Buffer, _ = encoder.Marshal(&info)
+	_, err = req.ServerAction(ctx)
+	assert.Equal(t, ErrValidateNegotiateInfo, err)
+}
@@ -1,5 +1,7 @@
 package smb
 
+import "github.com/izouxv/logx"
+
 func init() {
 	commandRequestMap[CommandLogoff] = func() DataI {
 		return &LogoffRequest{}
@@ -20,5 +22,10 @@ type LogoffResponse struct {
 
 func (data *LogoffRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
-	return &LogoffResponse{Header: data.Header}, nil
+	//the opens of the session are closed, durable ones too, nothing is left for a reconnect, MS-SMB2 3.3.5.6
+	if err := ctx.session.Close(); err != nil {
+		logx.Warnf("logoff, err: %v", err)
+	}
+	data.Header.Status = StatusOk
+	return &LogoffResponse{Header: data.Header, StructureSize: 4}, nil
 }
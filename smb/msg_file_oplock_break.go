@@ -0,0 +1,135 @@
+package smb
+
+import (
+	"github/izouxv/smbapi/smb/encoder"
+)
+
+func init() {
+	commandRequestMap[CommandOplockBreak] = func() DataI {
+		return &OplockBreakRequest{}
+	}
+}
+
+//CommandOplockBreak
+
+const SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED uint32 = 0x00000001
+
+// OplockBreakBody is the rest of an acknowledgment, StructureSize tells an oplock from a lease one.
+type OplockBreakBody []byte
+
+func (b OplockBreakBody) MarshalBinary(meta *encoder.Metadata) ([]byte, error) {
+	return b, nil
+}
+
+func (b OplockBreakBody) UnmarshalBinary(buf []byte, meta *encoder.Metadata) (interface{}, error) {
+	body := make(OplockBreakBody, len(buf))
+	copy(body, buf)
+	meta.CurrOffset += uint64(len(buf))
+	return body, nil
+}
+
+type OplockBreakRequest struct {
+	Header
+	StructureSize uint16
+	Body          OplockBreakBody
+}
+
+// OplockBreakAck is the body of an oplock break acknowledgment, StructureSize 24.
+type OplockBreakAck struct {
+	OplockLevel uint8
+	Reserved    uint8
+	Reserved2   uint32
+	FileId      GUID
+}
+
+// LeaseBreakAck is the body of a lease break acknowledgment, StructureSize 36.
+type LeaseBreakAck struct {
+	Reserved      uint16
+	Flags         uint32
+	LeaseKey      GUID
+	LeaseState    uint32
+	LeaseDuration uint64
+}
+
+// OplockBreakResponse answers an oplock acknowledgment, the oplock break notification looks the same.
+type OplockBreakResponse struct {
+	Header
+	StructureSize uint16
+	OplockLevel   uint8
+	Reserved      uint8
+	Reserved2     uint32
+	FileId        GUID
+}
+
+type LeaseBreakResponse struct {
+	Header
+	StructureSize uint16
+	Reserved      uint16
+	Flags         uint32
+	LeaseKey      GUID
+	LeaseState    uint32
+	LeaseDuration uint64
+}
+
+type LeaseBreakNotification struct {
+	Header
+	StructureSize     uint16
+	NewEpoch          uint16
+	Flags             uint32
+	LeaseKey          GUID
+	CurrentLeaseState uint32
+	NewLeaseState     uint32
+	BreakReason       uint32
+	AccessMaskHint    uint32
+	ShareMaskHint     uint32
+}
+
+const (
+	kOplockBreakAckSize = 24
+	kLeaseBreakAckSize  = 36
+)
+
+func (data *OplockBreakRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
+	data.Header.Flags = SMB2_FLAGS_RESPONSE
+
+	switch data.StructureSize {
+	case kOplockBreakAckSize:
+		var ack OplockBreakAck
+		if len(data.Body) < kOplockBreakAckSize-2 || encoder.Unmarshal(data.Body, &ack) != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		fileid := ctx.FileID(ack.FileId)
+		if _, ok := ctx.session.GetFile(fileid); !ok {
+			return ERR(data.Header, STATUS_FILE_CLOSED)
+		}
+		level, stat := gOplockTable.ackOplock(ctx.session.FilePath(fileid), fileid, ack.OplockLevel)
+		//the break is over either way, a persistent open journals the level it kept
+		ctx.session.journalOpen(fileid)
+		if stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		resp := OplockBreakResponse{
+			Header:        data.Header,
+			StructureSize: kOplockBreakAckSize,
+			OplockLevel:   level,
+			FileId:        ack.FileId,
+		}
+		return &resp, nil
+	case kLeaseBreakAckSize:
+		var ack LeaseBreakAck
+		if len(data.Body) < kLeaseBreakAckSize-2 || encoder.Unmarshal(data.Body, &ack) != nil {
+			return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		}
+		if stat := gOplockTable.ackLease(ctx.session.leaseKey(ack.LeaseKey), ack.LeaseState); stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		resp := LeaseBreakResponse{
+			Header:        data.Header,
+			StructureSize: kLeaseBreakAckSize,
+			LeaseKey:      ack.LeaseKey,
+			LeaseState:    ack.LeaseState,
+		}
+		return &resp, nil
+	}
+	return ERR(data.Header, STATUS_INVALID_PARAMETER)
+}
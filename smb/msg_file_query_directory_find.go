@@ -6,7 +6,6 @@ import (
 	"errors"
 	"io/fs"
 	"path/filepath"
-	"sync/atomic"
 
 	"github/izouxv/smbapi/smb/encoder"
 )
@@ -58,13 +57,17 @@ type QueryDirectoryResponse struct {
 	OutputBuffer       []byte
 }
 
-var KFILEID = uint64(0)
-
 func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
 
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
+	}
+	fsys := ctx.Handle(tree.id).FileSystem
+
 	fileid := ctx.FileID(data.FileId)
-	webfile, ok := ctx.session.openedFiles[fileid]
+	webfile, ok := ctx.session.GetFile(fileid)
 	if !ok {
 		return ERR(data.Header, STATUS_FILE_CLOSED)
 	}
@@ -80,6 +83,9 @@ func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, erro
 		}
 	}
 
+	dirPath := ctx.session.FilePath(fileid)
+	//macOS reads the resource fork, the Finder info and the mode from the entries
+	readdirAttr := ctx.session.aaplCap(SMB2_CRTCTX_AAPL_SUPPORTS_READ_DIR_ATTR)
 	getFileDirInfo := func(fi fs.FileInfo) *FileDirectoryInfo {
 		mtime := timeToFiletime(fi.ModTime())
 		filename := filepath.Base(fi.Name())
@@ -113,26 +119,20 @@ func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, erro
 		filename := filepath.Base(fi.Name())
 		nameByte := encoder.ToUnicode(filename)
 		var fa FileAttributes
-		size := uint32(fi.Size())
 		var AllocationSize, EndOfFile uint64
 		if fi.IsDir() {
 			fa |= FILE_ATTRIBUTE_DIRECTORY
 			// logx.Printf("fa if: %v", fa)
-			//TODO
-			size = 0x011111111
 		} else {
 			// fa |= FILE_ATTRIBUTE_ARCHIVE
 			fa |= FILE_ATTRIBUTE_NORMAL
 			AllocationSize = uint64(fi.Size()) //磁盘大小, 会有碎片, 比endoffile大一点
 			EndOfFile = uint64(fi.Size())      //文件大小
-			if size == 0 {
-				size = 0x011111111
-			}
 		}
-
 		// logx.Printf("fa: %v", fa)
-		fid := atomic.AddUint64(&KFILEID, 1)
-		return &FileIdBothDirectoryInfo{
+		//the same id FileInternalInformation reports for the file
+		fid := newFileMeta(fi, filepath.Join(dirPath, fi.Name())).index
+		info := &FileIdBothDirectoryInfo{
 			CreateTime:     mtime,
 			LastAccessTime: mtime,
 			LastWriteTime:  mtime,
@@ -142,8 +142,15 @@ func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, erro
 			EndOfFile:      EndOfFile,      //文件大小
 			FileAttributes: fa,
 			FileId:         fid,
-			EASize:         size,
 		}
+		if readdirAttr {
+			tree.anchor.readdirAttr(ctx.session, fsys, filepath.Join(dirPath, fi.Name()), fi, info)
+			return info
+		}
+		//clients only ask for the EAs of entries that have some
+		eas, _ := tree.anchor.fileEAs(fsys, filepath.Join(dirPath, fi.Name()))
+		info.EASize = uint32(eaListSize(eas))
+		return info
 	}
 
 	getFileInfo := func(fi fs.FileInfo, level FileInformationClass) ([]byte, error) {
@@ -185,6 +192,9 @@ func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, erro
 			// fis = append(fis, &fileInfoX{FileInfo: selfFI, name: ".."})
 
 			for _, fi := range fis {
+				if tree.anchor.hiddenEntry(fi.Name()) {
+					continue
+				}
 				itemBuf, err := getFileInfo(fi, data.InfoLevel)
 				if err != nil {
 					//如果有错误, 就继续. 这个看以后是否修改.
@@ -216,7 +226,7 @@ func (data *QueryDirectoryRequest) ServerAction(ctx *DataCtx) (interface{}, erro
 			}
 			var fi fs.FileInfo
 			for _, item := range fis {
-				if item.Name() == FileName {
+				if item.Name() == FileName && !tree.anchor.hiddenEntry(item.Name()) {
 					fi = item
 					break
 				}
@@ -1,14 +1,17 @@
 package smb
 
 import (
-	"bytes"
 	"encoding/binary"
-	"fmt"
+	"hash/fnv"
 	"os"
 	"path/filepath"
-	"sync/atomic"
+	"strings"
+	"time"
 
 	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
 )
 
 func init() {
@@ -44,139 +47,118 @@ func (data *QueryInfoRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
 
 	fileid := ctx.FileID(data.FileId)
-	webfile, ok := ctx.session.openedFiles[fileid]
+	webfile, ok := ctx.session.GetFile(fileid)
 	if !ok {
 		return ERR(data.Header, STATUS_FILE_CLOSED)
 	}
 
 	var OutputBuffer []byte
 	var err error
+	var minSize uint32 //the fixed part of the answer
+	status := StatusOk //a list that is cut between entries says so
 
 	switch data.Class {
 	case SMB2_0_INFO_FILE:
 		switch FileInformationClass(data.InfoLevel) {
 		case FileStreamInformation:
-			ff := webfile.(*os.File)
-
-			var infos [][]byte
-			if true {
-				fi, err := ff.Stat()
-				if err != nil {
-					return nil, err
-				}
-				datakey := "::$DATA"
-				name := encoder.ToUnicode(datakey)
-				info := &FileStreamInformationX{
-					StreamSize:           uint64(fi.Size()),
-					StreamAllocationSize: uint64(fi.Size()),
-					StreamName:           name,
-				}
-				infobuf, err := encoder.Marshal(info)
-				if err != nil {
-					panic(-1)
-				}
-
-				infos = append(infos, Duiqi4Byte(infobuf))
-			}
-
-			keys, err := XAttrGetKeys(ff.Name())
-			if err != nil {
-				return nil, fmt.Errorf("err")
-			}
-
-			for _, key := range keys {
-				datakey := fmt.Sprintf(":%v:$DATA", key)
-				name := encoder.ToUnicode(datakey)
-
-				data, err := XAttrGet(ff.Name(), key)
-				if err != nil {
-					continue
-				}
-				info := &FileStreamInformationX{
-					StreamSize:           uint64(len(data)),
-					StreamAllocationSize: uint64(len(data)),
-					StreamName:           name,
-				}
-				infobuf, err := encoder.Marshal(info)
-				if err != nil {
-					continue
-				}
-				infos = append(infos, Duiqi4Byte(infobuf))
-			}
-
-			//write offset
-			for i, info := range infos {
-				if i != len(infos)-1 {
-					binary.LittleEndian.PutUint32(info, uint32(len(info)))
-				}
+			if OutputBuffer, status = data.streamInformation(ctx, fileid); status != StatusOk && status != STATUS_BUFFER_OVERFLOW {
+				return ERR(data.Header, status)
 			}
 
-			OutputBuffer = bytes.Join(infos, []byte{})
-
 		case FileAllInformation:
-			fi, _ := webfile.Stat()
-			fname := filepath.Base(fi.Name())
-			IsDirectory := 0
-			fid := uint64(0)
-			FileAttributes := uint32(0x000020)
-			if fi.IsDir() {
-				IsDirectory = 1
-				FileAttributes = uint32(0x000010)
-			} else {
-				fid = atomic.AddUint64(&KFILEID, 1)
+			fi, err := webfile.Stat()
+			if err != nil {
+				return ERR(data.Header, STATUS_UNSUCCESSFUL)
 			}
-			mtime := timeToFiletime(fi.ModTime())
-
+			path := ctx.session.FilePath(fileid)
+			meta := newFileMeta(fi, path)
+			access, deletePending := gShareTable.openState(path, fileid)
+			m := ctx.session.FileMode(fileid)
 			info := SMB2_FILE_ALL_INFO{
-				CreateTime:     mtime,
-				LastAccessTime: mtime,
-				LastWriteTime:  mtime,
-				LastChangeTime: mtime,
-				AccessMask:     AllAccessMask,
-				NumberOfLinks:  18,
-				FileID:         fid,
-				FileAttributes: FileAttributes,
-				IsDirectory:    uint8(IsDirectory),
-				FileName:       encoder.ToUnicode(fname),
+				CreateTime:          meta.creation,
+				LastAccessTime:      meta.access,
+				LastWriteTime:       meta.write,
+				LastChangeTime:      meta.change,
+				FileAttributes:      uint32(meta.attributes),
+				AllocationSize:      meta.allocation,
+				EndOfFile:           meta.size,
+				NumberOfLinks:       meta.links,
+				DeletePending:       boolByte(deletePending),
+				IsDirectory:         boolByte(fi.IsDir()),
+				FileID:              meta.index,
+				EASize:              data.eaSize(ctx, fileid),
+				AccessMask:          access,
+				PositionInformation: m.position,
+				ModeInformation:     uint32(m.mode),
+				FileName:            encoder.ToUnicode(filepath.Base(fi.Name())),
 			}
-
+			minSize = 100
 			OutputBuffer, err = encoder.Marshal(info)
 			if err != nil {
 				return ERR(data.Header, STATUS_INVALID_PARAMETER)
 			}
 
 			// logx.Printf("FileAllInformation: \n%v", hex.Dump(OutputBuffer))
-		}
-	case SMB2_0_INFO_FILESYSTEM:
-		switch FileSystemInformationClass(data.InfoLevel) {
-		case FileFsAttributeInformation:
-			//TODO 获取FSInfo
-			ntfs := encoder.ToUnicode("NTFS")
-			info := FileFsAttributeInformationX{
-				FSAttributes:  0x10400c6,
-				MaxNameLength: 256,
-				FSName:        ntfs,
+		case FileFullEaInformation:
+			if OutputBuffer, status = data.eaInformation(ctx, fileid); status != StatusOk && status != STATUS_BUFFER_OVERFLOW {
+				return ERR(data.Header, status)
 			}
-			OutputBuffer, err = encoder.Marshal(info)
-			if err != nil {
-				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+		default:
+			info, stat := data.fileInformation(ctx, webfile, fileid)
+			if stat != StatusOk {
+				return ERR(data.Header, stat)
 			}
-		case FileFsSizeInformation:
-			//TODO 计算磁盘剩余大小.
-			info := FileFsSizeInformationX{
-				AllocationSize: 0xfffffff,
-				FreeUnits:      0xffffff,
-				SectorsUnit:    1,
-				BytesPerSector: 4096,
+			if OutputBuffer, err = encoder.Marshal(info); err != nil {
+				return ERR(data.Header, STATUS_UNSUCCESSFUL)
 			}
-			OutputBuffer, err = encoder.Marshal(info)
-			if err != nil {
-				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			if _, ok := info.(*FileNameInformationX); ok {
+				minSize = 4
+			} else {
+				minSize = uint32(len(OutputBuffer))
 			}
 		}
+	case SMB2_0_INFO_FILESYSTEM:
+		info, stat := data.fsInformation(ctx)
+		if stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		if OutputBuffer, err = encoder.Marshal(info); err != nil {
+			return ERR(data.Header, STATUS_UNSUCCESSFUL)
+		}
+		switch info.(type) {
+		case *FileFsVolumeInformationX:
+			minSize = 18
+		case *FileFsAttributeInformationX:
+			minSize = 12
+		default:
+			minSize = uint32(len(OutputBuffer))
+		}
+	case SMB2_0_INFO_SECURITY:
+		sd, stat := data.securityInformation(ctx, webfile, fileid)
+		if stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		//a descriptor is not cut, the client asks again with the size it needs
+		OutputBuffer = sd.Marshal()
+		if uint32(len(OutputBuffer)) > data.OutputBufferLength {
+			return ERRSIZE(data.Header, uint32(len(OutputBuffer)))
+		}
+	case SMB2_0_INFO_QUOTA:
+		var stat Status
+		if OutputBuffer, stat = data.quotaInformation(ctx, fileid); stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
 	}
 
-	data.Header.Status = StatusOk
+	data.Header.Status = status
+	//a fixed size answer has to fit, a longer one is cut at OutputBufferLength
+	if uint32(len(OutputBuffer)) > data.OutputBufferLength {
+		if data.OutputBufferLength < minSize {
+			return ERR(data.Header, STATUS_INFO_LENGTH_MISMATCH)
+		}
+		OutputBuffer = OutputBuffer[:data.OutputBufferLength]
+		data.Header.Status = STATUS_BUFFER_OVERFLOW
+	}
 	resp := QueryInfoResponse{
 		Header:        data.Header,
 		StructureSize: 9,
@@ -184,3 +166,437 @@ func (data *QueryInfoRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	}
 	return &resp, nil
 }
+
+// fileStat is what the file system keeps beside os.FileInfo.
+type fileStat struct {
+	ino       uint64
+	nlink     uint32
+	uid       uint32
+	gid       uint32
+	allocated int64
+	atime     time.Time
+	ctime     time.Time
+	btime     time.Time //zero where the file system keeps no birth time
+}
+
+// fileMeta is the metadata of a file the information classes are made of, times are FILETIMEs.
+type fileMeta struct {
+	index      uint64
+	links      uint32
+	allocation uint64
+	size       uint64
+	attributes FileAttributes
+	creation   uint64
+	access     uint64
+	write      uint64
+	change     uint64
+}
+
+// newFileMeta reads the metadata of fi, path is its absolute path. The index is the inode number, a
+// file system without one gets a hash of the path, both stay the same as long as the file does.
+func newFileMeta(fi os.FileInfo, path string) fileMeta {
+	mtime := timeToFiletime(fi.ModTime())
+	meta := fileMeta{
+		links:      1,
+		attributes: fileAttributes(fi),
+		creation:   mtime,
+		access:     mtime,
+		write:      mtime,
+		change:     mtime,
+	}
+	if !fi.IsDir() {
+		meta.size = uint64(fi.Size())
+		meta.allocation = meta.size
+	}
+	st, ok := statOf(fi)
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(path))
+		meta.index = h.Sum64()
+		return meta
+	}
+	meta.index = st.ino
+	meta.links = st.nlink
+	if !fi.IsDir() {
+		meta.allocation = uint64(st.allocated)
+	}
+	meta.access = timeToFiletime(st.atime)
+	meta.change = timeToFiletime(st.ctime)
+	if !st.btime.IsZero() {
+		meta.creation = timeToFiletime(st.btime)
+	}
+	return meta
+}
+
+// fileAttributes maps fi to FileAttributes, a file without the write permission of its owner is read-only.
+func fileAttributes(fi os.FileInfo) FileAttributes {
+	if fi.IsDir() {
+		return FILE_ATTRIBUTE_DIRECTORY
+	}
+	attrs := FILE_ATTRIBUTE_ARCHIVE
+	if fi.Mode().Perm()&0200 == 0 {
+		attrs |= FILE_ATTRIBUTE_READONLY
+	}
+	return attrs
+}
+
+func boolByte(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fileInformation answers the fixed size file information classes and FileNormalizedNameInformation.
+func (data *QueryInfoRequest) fileInformation(ctx *DataCtx, webfile webdav.File, fileid GUID) (interface{}, Status) {
+	fi, err := webfile.Stat()
+	if err != nil {
+		return nil, STATUS_UNSUCCESSFUL
+	}
+	path := ctx.session.FilePath(fileid)
+	meta := newFileMeta(fi, path)
+	switch FileInformationClass(data.InfoLevel) {
+	case FileBasicInformation:
+		return &FileBasicInformationX{
+			CreateTime:     meta.creation,
+			LastAccess:     meta.access,
+			LastWrite:      meta.write,
+			LastChange:     meta.change,
+			FileAttributes: meta.attributes,
+		}, StatusOk
+	case FileStandardInformation:
+		_, deletePending := gShareTable.openState(path, fileid)
+		return &FileStandardInformationX{
+			AllocationSize: meta.allocation,
+			EndOfFile:      meta.size,
+			NumberOfLinks:  meta.links,
+			DeletePending:  boolByte(deletePending),
+			Directory:      boolByte(fi.IsDir()),
+		}, StatusOk
+	case FileInternalInformation:
+		return &FileInternalInformationX{IndexNumber: meta.index}, StatusOk
+	case FileEaInformation:
+		return &FileEaInformationX{EaSize: data.eaSize(ctx, fileid)}, StatusOk
+	case FileAccessInformation:
+		access, _ := gShareTable.openState(path, fileid)
+		return &FileAccessInformationX{AccessFlags: access}, StatusOk
+	case FilePositionInformation:
+		return &FilePositionInformationX{CurrentByteOffset: ctx.session.FileMode(fileid).position}, StatusOk
+	case FileModeInformation:
+		return &FileModeInformationX{Mode: ctx.session.FileMode(fileid).mode}, StatusOk
+	case FileAlignmentInformation:
+		//FILE_BYTE_ALIGNMENT, buffers need no alignment
+		return &FileAlignmentInformationX{}, StatusOk
+	case FileNetworkOpenInformation:
+		return &FileNetworkOpenInformationX{
+			CreateTime:     meta.creation,
+			LastAccess:     meta.access,
+			LastWrite:      meta.write,
+			LastChange:     meta.change,
+			AllocationSize: meta.allocation,
+			EndOfFile:      meta.size,
+			FileAttributes: meta.attributes,
+		}, StatusOk
+	case FileAttributeTagInformation:
+		return &FileAttributeTagInformationX{FileAttributes: meta.attributes}, StatusOk
+	case FileCompressionInformation:
+		//COMPRESSION_FORMAT_NONE, the file takes its size
+		return &FileCompressionInformationX{CompressedFileSize: meta.size, Reserved: make([]byte, 3)}, StatusOk
+	case FileNormalizedNameInformation:
+		//MS-SMB2 3.3.5.20.1, only a 3.1.1 client may ask
+		if ctx.session.dialect < DialectSmb_3_1_1 {
+			return nil, STATUS_NOT_SUPPORTED
+		}
+		tree := ctx.Tree(data.TreeID)
+		if tree == nil {
+			return nil, STATUS_NETWORK_NAME_DELETED
+		}
+		name, err := filepath.Rel(tree.anchor.RootPath, path)
+		if err != nil || name == "." {
+			name = ""
+		}
+		return &FileNameInformationX{FileName: encoder.ToUnicode(strings.ReplaceAll(filepath.ToSlash(name), "/", "\\"))}, StatusOk
+	}
+	return nil, STATUS_INVALID_INFO_CLASS
+}
+
+// file system attributes, MS-FSCC 2.5.1
+const (
+	FILE_CASE_SENSITIVE_SEARCH        uint32 = 0x00000001
+	FILE_CASE_PRESERVED_NAMES         uint32 = 0x00000002
+	FILE_UNICODE_ON_DISK              uint32 = 0x00000004
+	FILE_PERSISTENT_ACLS              uint32 = 0x00000008
+	FILE_VOLUME_QUOTAS                uint32 = 0x00000020
+	FILE_SUPPORTS_SPARSE_FILES        uint32 = 0x00000040
+	FILE_SUPPORTS_REPARSE_POINTS      uint32 = 0x00000080
+	FILE_NAMED_STREAMS                uint32 = 0x00040000
+	FILE_SUPPORTS_HARD_LINKS          uint32 = 0x00400000
+	FILE_SUPPORTS_EXTENDED_ATTRIBUTES uint32 = 0x00800000
+	FILE_SUPPORTS_OPEN_BY_FILE_ID     uint32 = 0x01000000
+)
+
+// FileFsDeviceInformation
+const (
+	FILE_DEVICE_DISK       uint32 = 0x00000007
+	FILE_DEVICE_IS_MOUNTED uint32 = 0x00000020
+)
+
+// SSINFO flags of FileFsSectorSizeInformation
+const (
+	SSINFO_FLAGS_ALIGNED_DEVICE              uint32 = 0x00000001
+	SSINFO_FLAGS_PARTITION_ALIGNED_ON_DEVICE uint32 = 0x00000002
+)
+
+// fsAttributes is what the share supports of FileFsAttributeInformation. Streams, EAs, hard links and
+// ACLs need the files of the share on a disk, sparse files, reparse points and opening by file id are
+// not served.
+func (a *Anchor) fsAttributes(fsys webdav.FileSystem) uint32 {
+	attributes := FILE_CASE_PRESERVED_NAMES | FILE_UNICODE_ON_DISK
+	if a.caseSensitive() {
+		attributes |= FILE_CASE_SENSITIVE_SEARCH
+	}
+	if _, ok := diskDir(fsys); ok {
+		attributes |= FILE_PERSISTENT_ACLS | FILE_NAMED_STREAMS | FILE_SUPPORTS_HARD_LINKS | FILE_SUPPORTS_EXTENDED_ATTRIBUTES
+	}
+	if a.hasQuota() {
+		attributes |= FILE_VOLUME_QUOTAS
+	}
+	return attributes
+}
+
+// fsInformation answers the file system information classes for the volume of the share. The space
+// comes from Anchor.Volume or statfs of the share root, free space is what the user may still write.
+func (data *QueryInfoRequest) fsInformation(ctx *DataCtx) (interface{}, Status) {
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return nil, STATUS_NETWORK_NAME_DELETED
+	}
+	anchor := tree.anchor
+	class := FileSystemInformationClass(data.InfoLevel)
+	switch class {
+	case FileFsVolumeInformation:
+		label := anchor.VolumeLabel
+		if label == "" {
+			label = anchor.Name
+		}
+		return &FileFsVolumeInformationX{
+			VolumeCreationTime: anchor.volumeCreated(ctx.session.userName),
+			VolumeSerialNumber: anchor.volumeSerial(),
+			VolumeLabel:        encoder.ToUnicode(label),
+		}, StatusOk
+	case FileFsAttributeInformation:
+		//clients turn features off for file systems they do not know, the share looks like NTFS
+		//and only claims what it serves
+		return &FileFsAttributeInformationX{
+			FSAttributes:  anchor.fsAttributes(ctx.Handle(tree.id).FileSystem),
+			MaxNameLength: 255,
+			FSName:        encoder.ToUnicode("NTFS"),
+		}, StatusOk
+	case FileFsDeviceInformation:
+		return &FileFsDeviceInformationX{DeviceType: FILE_DEVICE_DISK, Characteristics: FILE_DEVICE_IS_MOUNTED}, StatusOk
+	case FileFsObjectIdInformation:
+		return &FileFsObjectIdInformationX{ObjectId: anchor.volumeId(), ExtendedInfo: make([]byte, 48)}, StatusOk
+	case FileFsSizeInformation, FileFsFullSizeInformation, FileFsSectorSizeInformation:
+		vs, err := anchor.volumeStat(ctx.session.userName)
+		if err != nil {
+			logx.Warnf("volume of %v, err: %v", anchor.Name, err)
+			return nil, STATUS_UNSUCCESSFUL
+		}
+		//a user sees the space the quotas leave
+		vs = gQuotaTable.view(anchor, ctx.session.userName, vs)
+		unit := uint64(vs.BlockSize)
+		if unit < kSectorSize {
+			unit = kSectorSize
+		}
+		switch class {
+		case FileFsSizeInformation:
+			return &FileFsSizeInformationX{
+				AllocationSize: vs.Total / unit,
+				FreeUnits:      vs.Available / unit,
+				SectorsUnit:    uint32(unit / kSectorSize),
+				BytesPerSector: kSectorSize,
+			}, StatusOk
+		case FileFsFullSizeInformation:
+			return &FileFsFullSizeInformationX{
+				AllocationSize:  vs.Total / unit,
+				CallerFreeUnits: vs.Available / unit,
+				ActualFreeUnits: vs.Free / unit,
+				SectorsUnit:     uint32(unit / kSectorSize),
+				BytesPerSector:  kSectorSize,
+			}, StatusOk
+		}
+		return &FileFsSectorSizeInformationX{
+			LogicalBytesPerSector:                                 kSectorSize,
+			PhysicalBytesPerSectorForAtomicity:                    uint32(unit),
+			PhysicalBytesPerSectorForPerformance:                  uint32(unit),
+			FileSystemEffectivePhysicalBytesPerSectorForAtomicity: uint32(unit),
+			Flags: SSINFO_FLAGS_ALIGNED_DEVICE | SSINFO_FLAGS_PARTITION_ALIGNED_ON_DEVICE,
+		}, StatusOk
+	}
+	return nil, STATUS_INVALID_INFO_CLASS
+}
+
+// quotaInformation lists the quotas of the users of the share of the open fileid, SMB2_0_INFO_QUOTA.
+// Whole entries are returned, an enumeration goes on where the previous query of the open stopped.
+func (data *QueryInfoRequest) quotaInformation(ctx *DataCtx, fileid GUID) ([]byte, Status) {
+	query, err := parseQuotaQuery(data.InputBuffer)
+	if err != nil {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+	entries := gQuotaTable.entries(ctx.session.FilePath(fileid), ctx.session.userName)
+	if entries == nil {
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	sids := make([]SID, len(entries))
+	for i, e := range entries {
+		sids[i] = ctx.session.accountSID(e.user)
+	}
+	var picked []int
+	start := -1 //where an enumeration starts, the SidList asks for users instead
+	if query.sids != nil {
+		for _, sid := range query.sids {
+			for i := range entries {
+				if sids[i].Equal(sid) {
+					picked = append(picked, i)
+				}
+			}
+		}
+	} else {
+		start = ctx.session.quotaScan(fileid)
+		if query.restartScan {
+			start = 0
+		}
+		if query.startSid != nil {
+			start = len(entries)
+			for i := range entries {
+				if sids[i].Equal(*query.startSid) {
+					start = i
+				}
+			}
+		}
+		for i := start; i < len(entries); i++ {
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) == 0 {
+		return nil, STATUS_NO_MORE_ENTRIES
+	}
+	var out []byte
+	last, n := 0, 0
+	for _, i := range picked {
+		e := entries[i]
+		sid := make([]byte, sids[i].size())
+		sids[i].marshal(sid)
+		info := &FileQuotaInformationX{
+			QuotaUsed:      e.used,
+			QuotaThreshold: e.threshold,
+			QuotaLimit:     e.limit,
+			Sid:            sid,
+		}
+		if !e.change.IsZero() {
+			info.ChangeTime = timeToFiletime(e.change)
+		}
+		buf, err := encoder.Marshal(info)
+		if err != nil {
+			return nil, STATUS_UNSUCCESSFUL
+		}
+		//entries start 8 byte aligned
+		aligned := (len(out) + 7) &^ 7
+		if n > 0 && uint32(aligned+len(buf)) > data.OutputBufferLength {
+			break
+		}
+		if n > 0 {
+			out = append(out, make([]byte, aligned-len(out))...)
+			binary.LittleEndian.PutUint32(out[last:], uint32(aligned-last))
+		}
+		last = len(out)
+		out = append(out, buf...)
+		n++
+		if query.returnSingle {
+			break
+		}
+	}
+	if uint32(len(out)) > data.OutputBufferLength {
+		return nil, STATUS_BUFFER_TOO_SMALL
+	}
+	if start >= 0 {
+		ctx.session.setQuotaScan(fileid, start+n)
+	}
+	return out, StatusOk
+}
+
+// eaSize is the EaSize of the open fileid, the size of the FILE_FULL_EA_INFORMATION list of its EAs.
+func (data *QueryInfoRequest) eaSize(ctx *DataCtx, fileid GUID) uint32 {
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return 0
+	}
+	eas, _ := tree.anchor.fileEAs(ctx.Handle(tree.id).FileSystem, ctx.session.FilePath(fileid))
+	return uint32(eaListSize(eas))
+}
+
+// eaInformation answers FileFullEaInformation with the EAs the FILE_GET_EA_INFORMATION list of the
+// request names, a name the file lacks comes back without a value. Without a list the EAs of the
+// file are enumerated from where the last answer of the open stopped. A list that does not fit
+// whole is cut between entries with STATUS_BUFFER_OVERFLOW.
+func (data *QueryInfoRequest) eaInformation(ctx *DataCtx, fileid GUID) ([]byte, Status) {
+	path := ctx.session.FilePath(fileid)
+	if access, _ := gShareTable.openState(path, fileid); access&FILE_READ_EA == 0 {
+		return nil, STATUS_ACCESS_DENIED
+	}
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return nil, STATUS_NETWORK_NAME_DELETED
+	}
+	eas, err := tree.anchor.fileEAs(ctx.Handle(tree.id).FileSystem, path)
+	if err != nil {
+		return nil, fsErrStatus(err)
+	}
+	var picked []EA
+	start := -1 //where an enumeration starts, the list asks for names instead
+	if len(data.InputBuffer) > 0 {
+		names, err := parseGetEAs(data.InputBuffer)
+		if err != nil {
+			return nil, STATUS_EA_LIST_INCONSISTENT
+		}
+		for _, name := range names {
+			ea := EA{Name: name}
+			for _, e := range eas {
+				if strings.EqualFold(e.Name, name) {
+					ea = e
+				}
+			}
+			picked = append(picked, ea)
+		}
+	} else {
+		if len(eas) == 0 {
+			return nil, STATUS_NO_EAS_ON_FILE
+		}
+		start = ctx.session.eaScan(fileid)
+		if data.Flags&SL_RESTART_SCAN != 0 {
+			start = 0
+		}
+		if start >= len(eas) {
+			return nil, STATUS_NO_MORE_EAS
+		}
+		picked = eas[start:]
+	}
+	if data.Flags&SL_RETURN_SINGLE_ENTRY != 0 {
+		picked = picked[:1]
+	}
+	n := len(picked)
+	for n > 0 && uint32(eaListSize(picked[:n])) > data.OutputBufferLength {
+		n--
+	}
+	if n == 0 {
+		return nil, STATUS_BUFFER_TOO_SMALL
+	}
+	if start < 0 {
+		if n < len(picked) {
+			return marshalEAs(picked[:n]), STATUS_BUFFER_OVERFLOW
+		}
+		return marshalEAs(picked), StatusOk
+	}
+	ctx.session.setEAScan(fileid, start+n)
+	return marshalEAs(picked[:n]), StatusOk
+}
@@ -5,12 +5,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github/izouxv/smbapi/smb/encoder"
 
 	"github.com/izouxv/logx"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
 )
 
 func Test_query_info(t *testing.T) {
@@ -51,3 +56,131 @@ func Test_path(t *testing.T) {
 	logx.Printf("f name: %v", tmpfile.Name())
 	logx.Printf("f: %v", tmpfile)
 }
+
+func Test_QueryInfoClasses(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("abc"), 0666))
+	session, tree := testDurableSession(dir, nil)
+	resp, _ := testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_NONE))
+	fileid := resp.(CreateResponse).FileId
+	query := func(class FileInformationClass, size uint32, info interface{}) Status {
+		req := QueryInfoRequest{
+			Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+			StructureSize:      41,
+			Class:              SMB2_0_INFO_FILE,
+			InfoLevel:          uint8(class),
+			OutputBufferLength: size,
+			FileId:             fileid,
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		if resp, ok := resp.(ErrResponse); ok {
+			return resp.Header.Status
+		}
+		if info != nil {
+			assert.Nil(t, encoder.Unmarshal(resp.(*QueryInfoResponse).OutputBuffer, info))
+		}
+		return resp.(*QueryInfoResponse).Header.Status
+	}
+
+	standard := FileStandardInformationX{}
+	assert.Equal(t, StatusOk, query(FileStandardInformation, 1024, &standard))
+	assert.Equal(t, uint64(3), standard.EndOfFile)
+	assert.Equal(t, uint32(1), standard.NumberOfLinks)
+
+	//the index is the inode, it stays the same across queries and listings
+	internal := FileInternalInformationX{}
+	assert.Equal(t, StatusOk, query(FileInternalInformation, 1024, &internal))
+	fi, _ := os.Stat(filepath.Join(dir, "a.txt"))
+	assert.Equal(t, fi.Sys().(*syscall.Stat_t).Ino, internal.IndexNumber)
+
+	access := FileAccessInformationX{}
+	assert.Equal(t, StatusOk, query(FileAccessInformation, 1024, &access))
+	assert.Equal(t, FILE_READ_DATA|FILE_WRITE_DATA, access.AccessFlags)
+
+	open := FileNetworkOpenInformationX{}
+	assert.Equal(t, StatusOk, query(FileNetworkOpenInformation, 1024, &open))
+	assert.Equal(t, timeToFiletime(fi.ModTime()), open.LastWrite)
+	assert.Equal(t, FILE_ATTRIBUTE_ARCHIVE, open.FileAttributes)
+
+	name := FileNameInformationX{}
+	assert.Equal(t, StatusOk, query(FileNormalizedNameInformation, 1024, &name))
+	assert.Equal(t, encoder.ToUnicode("a.txt"), name.FileName)
+
+	//a fixed size class has to fit, a variable one is cut
+	assert.Equal(t, STATUS_INFO_LENGTH_MISMATCH, query(FileBasicInformation, 8, nil))
+	assert.Equal(t, STATUS_BUFFER_OVERFLOW, query(FileAllInformation, 104, nil))
+	assert.Equal(t, STATUS_INVALID_INFO_CLASS, query(FileInformationClass(0x3f), 1024, nil))
+
+	webfile, _ := session.DelFile(fileid)
+	webfile.Close()
+}
+
+func Test_QueryFsInfo(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0666))
+	anchor := NewAnchor("share", dir)
+	session, tree := testDurableSession(dir, anchor)
+	resp, _ := testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_NONE))
+	fileid := resp.(CreateResponse).FileId
+	query := func(class FileSystemInformationClass, info interface{}) Status {
+		req := QueryInfoRequest{
+			Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+			StructureSize:      41,
+			Class:              SMB2_0_INFO_FILESYSTEM,
+			InfoLevel:          uint8(class),
+			OutputBufferLength: 1024,
+			FileId:             fileid,
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		if resp, ok := resp.(ErrResponse); ok {
+			return resp.Header.Status
+		}
+		assert.Nil(t, encoder.Unmarshal(resp.(*QueryInfoResponse).OutputBuffer, info))
+		return StatusOk
+	}
+
+	//the serial is the same for every query of the share
+	volume := FileFsVolumeInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsVolumeInformation, &volume))
+	assert.Equal(t, anchor.volumeSerial(), volume.VolumeSerialNumber)
+	assert.Equal(t, encoder.ToUnicode("share"), volume.VolumeLabel)
+
+	//the share claims what it serves on a disk, nothing it does not
+	attribute := FileFsAttributeInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsAttributeInformation, &attribute))
+	assert.Equal(t, FILE_NAMED_STREAMS|FILE_SUPPORTS_HARD_LINKS, attribute.FSAttributes&(FILE_NAMED_STREAMS|FILE_SUPPORTS_HARD_LINKS))
+	assert.Equal(t, uint32(0), attribute.FSAttributes&(FILE_SUPPORTS_REPARSE_POINTS|FILE_SUPPORTS_OPEN_BY_FILE_ID|FILE_SUPPORTS_SPARSE_FILES))
+	assert.Equal(t, FILE_CASE_PRESERVED_NAMES|FILE_UNICODE_ON_DISK, anchor.fsAttributes(webdav.NewMemFS())&^FILE_CASE_SENSITIVE_SEARCH)
+
+	//the space of the disk comes from statfs
+	size := FileFsSizeInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsSizeInformation, &size))
+	vs, err := statVolume(dir)
+	assert.Nil(t, err)
+	unit := uint64(size.SectorsUnit) * uint64(size.BytesPerSector)
+	assert.Equal(t, vs.Total/unit, size.AllocationSize)
+
+	//a provider answers for shares that are not on a disk, per user
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	anchor.Volume = func(userName string) (VolumeStat, error) {
+		assert.Equal(t, "user", userName)
+		return VolumeStat{Total: 1 << 30, Free: 1 << 29, Available: 1 << 20, BlockSize: 4096, Created: created}, nil
+	}
+	assert.Equal(t, StatusOk, query(FileFsVolumeInformation, &volume))
+	assert.Equal(t, timeToFiletime(created), volume.VolumeCreationTime)
+	full := FileFsFullSizeInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsFullSizeInformation, &full))
+	assert.Equal(t, FileFsFullSizeInformationX{AllocationSize: 1 << 18, CallerFreeUnits: 1 << 8, ActualFreeUnits: 1 << 17, SectorsUnit: 8, BytesPerSector: 512}, full)
+	sector := FileFsSectorSizeInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsSectorSizeInformation, &sector))
+	assert.Equal(t, uint32(4096), sector.PhysicalBytesPerSectorForAtomicity)
+
+	device := FileFsDeviceInformationX{}
+	assert.Equal(t, StatusOk, query(FileFsDeviceInformation, &device))
+	assert.Equal(t, FILE_DEVICE_DISK, device.DeviceType)
+
+	webfile, _ := session.DelFile(fileid)
+	webfile.Close()
+}
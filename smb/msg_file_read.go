@@ -40,8 +40,13 @@ type ReadResponse struct {
 func (data *ReadRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
 
+	//the buffer is allocated before reading, a read is never more than the MaxReadSize negotiated
+	if data.Length > kMaxTransactSize {
+		return ERR(data.Header, STATUS_INVALID_PARAMETER)
+	}
+
 	fileid := ctx.FileID(data.FileId)
-	webfile, ok := ctx.session.openedFiles[fileid]
+	webfile, ok := ctx.session.GetFile(fileid)
 	if !ok {
 		return ERR(data.Header, STATUS_FILE_CLOSED)
 	}
@@ -49,13 +54,15 @@ func (data *ReadRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	if fileid.IsSvrSvc(ctx.session) {
 		return DcerpcRead(ctx, data)
 	}
+	if ctx.session.lockConflict(fileid, data.Offset, uint64(data.Length), false) {
+		return ERR(data.Header, STATUS_FILE_LOCK_CONFLICT)
+	}
 
 	buffer := make([]byte, data.Length)
-	_, err := webfile.Seek(int64(data.Offset), 0)
-	if err != nil {
-		return ERR(data.Header, STATUS_UNSUCCESSFUL)
+	n, err := readAt(webfile, buffer, int64(data.Offset))
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
 	}
-	n, err := webfile.Read(buffer)
 	if n < int(data.MinimumCount) {
 		return ERR(data.Header, STATUS_END_OF_FILE)
 	}
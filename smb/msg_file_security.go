@@ -0,0 +1,803 @@
+package smb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// SecurityInformation selects the parts of a security descriptor QUERY_INFO and SET_INFO deal with,
+// the AdditionalInformation of SMB2_0_INFO_SECURITY. MS-DTYP 2.4.7
+const (
+	OWNER_SECURITY_INFORMATION uint32 = 0x00000001
+	GROUP_SECURITY_INFORMATION uint32 = 0x00000002
+	DACL_SECURITY_INFORMATION  uint32 = 0x00000004
+	SACL_SECURITY_INFORMATION  uint32 = 0x00000008
+)
+
+// SECURITY_DESCRIPTOR Control
+const (
+	SE_OWNER_DEFAULTED uint16 = 0x0001
+	SE_GROUP_DEFAULTED uint16 = 0x0002
+	SE_DACL_PRESENT    uint16 = 0x0004
+	SE_SACL_PRESENT    uint16 = 0x0010
+	SE_SELF_RELATIVE   uint16 = 0x8000
+)
+
+// AceType and AceFlags
+const (
+	ACCESS_ALLOWED_ACE_TYPE uint8 = 0x00
+	ACCESS_DENIED_ACE_TYPE  uint8 = 0x01
+
+	OBJECT_INHERIT_ACE    uint8 = 0x01
+	CONTAINER_INHERIT_ACE uint8 = 0x02
+	INHERIT_ONLY_ACE      uint8 = 0x08
+)
+
+const (
+	kSDHeaderSize  = 20
+	kACLHeaderSize = 8
+	kACEHeaderSize = 8
+)
+
+// SID is a security identifier, MS-DTYP 2.4.2.
+type SID struct {
+	Authority      uint64 //48 bits
+	SubAuthorities []uint32
+}
+
+// SidEveryone is S-1-1-0, the other class of a mode.
+var SidEveryone = SID{Authority: 1, SubAuthorities: []uint32{0}}
+
+// ParseSID reads the S-1-5-21-... form of a SID.
+func ParseSID(s string) (SID, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 3 || len(parts) > 18 || !strings.EqualFold(parts[0], "S") || parts[1] != "1" {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	auth, err := strconv.ParseUint(parts[2], 0, 48)
+	if err != nil {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	sid := SID{Authority: auth}
+	for _, p := range parts[3:] {
+		sub, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return SID{}, fmt.Errorf("invalid SID %q", s)
+		}
+		sid.SubAuthorities = append(sid.SubAuthorities, uint32(sub))
+	}
+	return sid, nil
+}
+
+func (sid SID) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "S-1-%d", sid.Authority)
+	for _, sub := range sid.SubAuthorities {
+		fmt.Fprintf(&b, "-%d", sub)
+	}
+	return b.String()
+}
+
+func (sid SID) Equal(other SID) bool {
+	if sid.Authority != other.Authority || len(sid.SubAuthorities) != len(other.SubAuthorities) {
+		return false
+	}
+	for i, sub := range sid.SubAuthorities {
+		if other.SubAuthorities[i] != sub {
+			return false
+		}
+	}
+	return true
+}
+
+func (sid SID) size() int {
+	return 8 + 4*len(sid.SubAuthorities)
+}
+
+func (sid SID) marshal(buf []byte) {
+	buf[0] = 1
+	buf[1] = uint8(len(sid.SubAuthorities))
+	for i := 0; i < 6; i++ {
+		buf[2+i] = uint8(sid.Authority >> (8 * (5 - i)))
+	}
+	for i, sub := range sid.SubAuthorities {
+		binary.LittleEndian.PutUint32(buf[8+4*i:], sub)
+	}
+}
+
+var errSecurityDescriptor = errors.New("malformed security descriptor")
+
+// parseSID reads the SID at the start of buf.
+func parseSID(buf []byte) (SID, error) {
+	if len(buf) < 8 || buf[0] != 1 || len(buf) < 8+4*int(buf[1]) {
+		return SID{}, errSecurityDescriptor
+	}
+	var sid SID
+	for i := 0; i < 6; i++ {
+		sid.Authority = sid.Authority<<8 | uint64(buf[2+i])
+	}
+	for i := 0; i < int(buf[1]); i++ {
+		sid.SubAuthorities = append(sid.SubAuthorities, binary.LittleEndian.Uint32(buf[8+4*i:]))
+	}
+	return sid, nil
+}
+
+// ACE is an access allowed or denied entry of a DACL.
+type ACE struct {
+	Type  uint8
+	Flags uint8
+	Mask  AccessMask
+	SID   SID
+}
+
+// SecurityDescriptor is the owner, group and DACL of a file. It travels self-relative, MS-DTYP 2.4.6.
+type SecurityDescriptor struct {
+	Control uint16
+	Owner   *SID
+	Group   *SID
+	Dacl    []ACE //a present DACL without entries denies everything, without SE_DACL_PRESENT everything is granted
+}
+
+// Marshal lays sd out self-relative.
+func (sd *SecurityDescriptor) Marshal() []byte {
+	size := kSDHeaderSize
+	if sd.Owner != nil {
+		size += sd.Owner.size()
+	}
+	if sd.Group != nil {
+		size += sd.Group.size()
+	}
+	aclSize := 0
+	if sd.Control&SE_DACL_PRESENT != 0 {
+		aclSize = kACLHeaderSize
+		for _, ace := range sd.Dacl {
+			aclSize += kACEHeaderSize + ace.SID.size()
+		}
+		size += aclSize
+	}
+	buf := make([]byte, size)
+	buf[0] = 1
+	binary.LittleEndian.PutUint16(buf[2:], (sd.Control|SE_SELF_RELATIVE)&^SE_SACL_PRESENT)
+	off := kSDHeaderSize
+	if sd.Owner != nil {
+		binary.LittleEndian.PutUint32(buf[4:], uint32(off))
+		sd.Owner.marshal(buf[off:])
+		off += sd.Owner.size()
+	}
+	if sd.Group != nil {
+		binary.LittleEndian.PutUint32(buf[8:], uint32(off))
+		sd.Group.marshal(buf[off:])
+		off += sd.Group.size()
+	}
+	if sd.Control&SE_DACL_PRESENT != 0 {
+		binary.LittleEndian.PutUint32(buf[16:], uint32(off))
+		acl := buf[off:]
+		acl[0] = 2
+		binary.LittleEndian.PutUint16(acl[2:], uint16(aclSize))
+		binary.LittleEndian.PutUint16(acl[4:], uint16(len(sd.Dacl)))
+		off = kACLHeaderSize
+		for _, ace := range sd.Dacl {
+			acl[off] = ace.Type
+			acl[off+1] = ace.Flags
+			binary.LittleEndian.PutUint16(acl[off+2:], uint16(kACEHeaderSize+ace.SID.size()))
+			binary.LittleEndian.PutUint32(acl[off+4:], uint32(ace.Mask))
+			ace.SID.marshal(acl[off+kACEHeaderSize:])
+			off += kACEHeaderSize + ace.SID.size()
+		}
+	}
+	return buf
+}
+
+// parseSecurityDescriptor reads a self-relative security descriptor, the SACL is skipped.
+func parseSecurityDescriptor(buf []byte) (*SecurityDescriptor, error) {
+	if len(buf) < kSDHeaderSize || buf[0] != 1 {
+		return nil, errSecurityDescriptor
+	}
+	sd := &SecurityDescriptor{Control: binary.LittleEndian.Uint16(buf[2:])}
+	if sd.Control&SE_SELF_RELATIVE == 0 {
+		return nil, errSecurityDescriptor
+	}
+	sidAt := func(field int) (*SID, error) {
+		off := int(binary.LittleEndian.Uint32(buf[field:]))
+		if off == 0 {
+			return nil, nil
+		}
+		if off >= len(buf) {
+			return nil, errSecurityDescriptor
+		}
+		sid, err := parseSID(buf[off:])
+		return &sid, err
+	}
+	var err error
+	if sd.Owner, err = sidAt(4); err != nil {
+		return nil, err
+	}
+	if sd.Group, err = sidAt(8); err != nil {
+		return nil, err
+	}
+	off := int(binary.LittleEndian.Uint32(buf[16:]))
+	if sd.Control&SE_DACL_PRESENT == 0 || off == 0 {
+		sd.Control &^= SE_DACL_PRESENT
+		return sd, nil
+	}
+	if off+kACLHeaderSize > len(buf) {
+		return nil, errSecurityDescriptor
+	}
+	acl := buf[off:]
+	aclSize := int(binary.LittleEndian.Uint16(acl[2:]))
+	if aclSize < kACLHeaderSize || aclSize > len(acl) {
+		return nil, errSecurityDescriptor
+	}
+	acl = acl[:aclSize]
+	sd.Dacl = []ACE{}
+	off = kACLHeaderSize
+	for n := binary.LittleEndian.Uint16(acl[4:]); n > 0; n-- {
+		if off+kACEHeaderSize > len(acl) {
+			return nil, errSecurityDescriptor
+		}
+		aceSize := int(binary.LittleEndian.Uint16(acl[off+2:]))
+		if aceSize < kACEHeaderSize || off+aceSize > len(acl) {
+			return nil, errSecurityDescriptor
+		}
+		//object and callback entries carry more than a mask and a SID, they do not map to a mode
+		if t := acl[off]; t == ACCESS_ALLOWED_ACE_TYPE || t == ACCESS_DENIED_ACE_TYPE {
+			sid, err := parseSID(acl[off+kACEHeaderSize : off+aceSize])
+			if err != nil {
+				return nil, err
+			}
+			sd.Dacl = append(sd.Dacl, ACE{Type: t, Flags: acl[off+1], Mask: AccessMask(binary.LittleEndian.Uint32(acl[off+4:])), SID: sid})
+		}
+		off += aceSize
+	}
+	return sd, nil
+}
+
+// IdMap maps the users and groups owning files to SIDs and back, Config.IdMap.
+type IdMap interface {
+	UserSID(uid uint32) SID
+	GroupSID(gid uint32) SID
+	// UID is the user sid stands for, ok is false when it is no user of the server
+	UID(sid SID) (uid uint32, ok bool)
+	// GID is the group sid stands for, ok is false when it is no group of the server
+	GID(sid SID) (gid uint32, ok bool)
+}
+
+// UnixIdMap names users S-1-22-1-uid and groups S-1-22-2-gid, the way Samba shows unix ids.
+type UnixIdMap struct{}
+
+func (UnixIdMap) UserSID(uid uint32) SID {
+	return SID{Authority: 22, SubAuthorities: []uint32{1, uid}}
+}
+
+func (UnixIdMap) GroupSID(gid uint32) SID {
+	return SID{Authority: 22, SubAuthorities: []uint32{2, gid}}
+}
+
+func (UnixIdMap) UID(sid SID) (uint32, bool) {
+	if sid.Authority != 22 || len(sid.SubAuthorities) != 2 || sid.SubAuthorities[0] != 1 {
+		return 0, false
+	}
+	return sid.SubAuthorities[1], true
+}
+
+func (UnixIdMap) GID(sid SID) (uint32, bool) {
+	if sid.Authority != 22 || len(sid.SubAuthorities) != 2 || sid.SubAuthorities[0] != 2 {
+		return 0, false
+	}
+	return sid.SubAuthorities[1], true
+}
+
+// ids is the IdMap of the session, UnixIdMap unless the server was given one.
+func (s *SessionS) ids() IdMap {
+	if s.idMap != nil {
+		return s.idMap
+	}
+	return UnixIdMap{}
+}
+
+// POSIX ACL entries as Linux keeps them in system.posix_acl_access
+const (
+	ACL_USER_OBJ  uint16 = 0x01
+	ACL_USER      uint16 = 0x02
+	ACL_GROUP_OBJ uint16 = 0x04
+	ACL_GROUP     uint16 = 0x08
+	ACL_MASK      uint16 = 0x10
+	ACL_OTHER     uint16 = 0x20
+
+	kPosixACLXattr   = "system.posix_acl_access"
+	kPosixACLVersion = 2
+	kPosixACLNoId    = 0xFFFFFFFF
+)
+
+type posixACE struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// readPosixACL reads the ACL of the file name, nil when it has none beside its mode.
+func readPosixACL(name string) []posixACE {
+	if !posixACLs {
+		return nil
+	}
+	buf, err := XAttrGet(name, kPosixACLXattr)
+	if err != nil || len(buf) < 4 || binary.LittleEndian.Uint32(buf) != kPosixACLVersion {
+		return nil
+	}
+	var acl []posixACE
+	for buf = buf[4:]; len(buf) >= 8; buf = buf[8:] {
+		acl = append(acl, posixACE{
+			tag:  binary.LittleEndian.Uint16(buf),
+			perm: binary.LittleEndian.Uint16(buf[2:]),
+			id:   binary.LittleEndian.Uint32(buf[4:]),
+		})
+	}
+	return acl
+}
+
+// writePosixACL replaces the ACL of the file name, the entries are sorted by tag and id.
+func writePosixACL(name string, acl []posixACE) error {
+	buf := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(buf, kPosixACLVersion)
+	for i, e := range acl {
+		binary.LittleEndian.PutUint16(buf[4+8*i:], e.tag)
+		binary.LittleEndian.PutUint16(buf[6+8*i:], e.perm)
+		binary.LittleEndian.PutUint32(buf[8+8*i:], e.id)
+	}
+	return XAttrSet(name, kPosixACLXattr, buf)
+}
+
+// permRights are the rights the rwx bits perm grant.
+func permRights(perm uint16, dir bool) AccessMask {
+	rights := READ_CONTROL | SYNCHRONIZE | FILE_READ_ATTRIBUTES
+	if perm&4 != 0 {
+		rights |= FILE_READ_DATA | FILE_READ_EA
+	}
+	if perm&2 != 0 {
+		rights |= FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_WRITE_EA | FILE_WRITE_ATTRIBUTES
+		if dir {
+			rights |= FILE_DELETE_CHILD
+		}
+	}
+	if perm&1 != 0 {
+		rights |= FILE_EXECUTE
+	}
+	return rights
+}
+
+// rightsPerm are the rwx bits that grant the data rights of mask.
+func rightsPerm(mask AccessMask) uint16 {
+	mask = mapGenericAccess(mask)
+	var perm uint16
+	if mask&FILE_READ_DATA != 0 {
+		perm |= 4
+	}
+	if mask&(FILE_WRITE_DATA|FILE_APPEND_DATA) != 0 {
+		perm |= 2
+	}
+	if mask&FILE_EXECUTE != 0 {
+		perm |= 1
+	}
+	return perm
+}
+
+// kOwnerRights are what the owner of a file can do beside its mode.
+const kOwnerRights = DELETE | WRITE_DAC | WRITE_OWNER
+
+// securityDescriptor is the owner, group and DACL of the file fi, name is where the OS finds it.
+// The DACL has an entry for the owner, the named users, the group, the named groups and Everyone.
+func (s *SessionS) securityDescriptor(fi os.FileInfo, name string, info uint32) (*SecurityDescriptor, Status) {
+	st, ok := statOf(fi)
+	if !ok {
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	ids := s.ids()
+	sd := &SecurityDescriptor{}
+	if info&OWNER_SECURITY_INFORMATION != 0 {
+		owner := ids.UserSID(st.uid)
+		sd.Owner = &owner
+	}
+	if info&GROUP_SECURITY_INFORMATION != 0 {
+		group := ids.GroupSID(st.gid)
+		sd.Group = &group
+	}
+	if info&DACL_SECURITY_INFORMATION == 0 {
+		return sd, StatusOk
+	}
+	dir := fi.IsDir()
+	mode := uint16(fi.Mode().Perm())
+	groupPerm, mask := (mode>>3)&7, uint16(7)
+	acl := readPosixACL(name)
+	for _, e := range acl {
+		switch e.tag {
+		case ACL_GROUP_OBJ:
+			groupPerm = e.perm
+		case ACL_MASK:
+			mask = e.perm
+		}
+	}
+	sd.Control = SE_DACL_PRESENT
+	allow := func(sid SID, rights AccessMask) {
+		sd.Dacl = append(sd.Dacl, ACE{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: rights, SID: sid})
+	}
+	allow(ids.UserSID(st.uid), permRights((mode>>6)&7, dir)|kOwnerRights)
+	for _, e := range acl {
+		if e.tag == ACL_USER {
+			allow(ids.UserSID(e.id), permRights(e.perm&mask, dir))
+		}
+	}
+	allow(ids.GroupSID(st.gid), permRights(groupPerm&mask, dir))
+	for _, e := range acl {
+		if e.tag == ACL_GROUP {
+			allow(ids.GroupSID(e.id), permRights(e.perm&mask, dir))
+		}
+	}
+	allow(SidEveryone, permRights(mode&7, dir))
+	//macOS reads the mode, the owner and the group from NFS ACEs that deny nothing
+	if s.aaplCap(SMB2_CRTCTX_AAPL_SUPPORTS_NFS_ACE) {
+		for _, sid := range []SID{nfsSID(kNFSMode, unixMode(fi.Mode())), nfsSID(kNFSUser, st.uid), nfsSID(kNFSGroup, st.gid)} {
+			sd.Dacl = append(sd.Dacl, ACE{Type: ACCESS_DENIED_ACE_TYPE, SID: sid})
+		}
+	}
+	return sd, StatusOk
+}
+
+// NFS ACEs, S-1-5-88-1-uid, S-1-5-88-2-gid and S-1-5-88-3-mode, the UNIX owner, group and mode of
+// a file in its DACL.
+const (
+	kNFSAuthority = 88
+	kNFSUser      = 1
+	kNFSGroup     = 2
+	kNFSMode      = 3
+)
+
+func nfsSID(kind, id uint32) SID {
+	return SID{Authority: 5, SubAuthorities: []uint32{kNFSAuthority, kind, id}}
+}
+
+// nfsACE is the kind and the id of an NFS ACE, ok is false for other SIDs.
+func nfsACE(sid SID) (kind, id uint32, ok bool) {
+	if sid.Authority != 5 || len(sid.SubAuthorities) != 3 || sid.SubAuthorities[0] != kNFSAuthority {
+		return 0, 0, false
+	}
+	return sid.SubAuthorities[1], sid.SubAuthorities[2], true
+}
+
+// permSet is the rwx bits a DACL grants one class, the first entry that mentions a bit decides it.
+type permSet struct {
+	allowed, decided uint16
+}
+
+func (p *permSet) add(ace ACE) {
+	perm := rightsPerm(ace.Mask) &^ p.decided
+	if ace.Type == ACCESS_ALLOWED_ACE_TYPE {
+		p.allowed |= perm
+	}
+	p.decided |= perm
+}
+
+// setSecurity applies the parts of sd info selects to file. The owner and the group are changed
+// with chown, to the user of the session and its groups unless it may take the ownership of files.
+// The DACL becomes the mode, entries of other users and groups a POSIX ACL where the system keeps
+// them. Entries of SIDs that are neither are dropped.
+func (s *SessionS) setSecurity(file *os.File, sd *SecurityDescriptor, info uint32) Status {
+	fi, err := file.Stat()
+	if err != nil {
+		return fsErrStatus(err)
+	}
+	st, ok := statOf(fi)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	ids := s.ids()
+	uid, gid := st.uid, st.gid
+	if info&OWNER_SECURITY_INFORMATION != 0 && sd.Owner != nil {
+		if uid, ok = ids.UID(*sd.Owner); !ok || (uid != st.uid && !s.mayOwn(uid)) {
+			return STATUS_INVALID_OWNER
+		}
+	}
+	if info&GROUP_SECURITY_INFORMATION != 0 && sd.Group != nil {
+		if gid, ok = ids.GID(*sd.Group); !ok || (gid != st.gid && !s.mayGroup(gid)) {
+			return STATUS_INVALID_PRIMARY_GROUP
+		}
+	}
+	if uid != st.uid || gid != st.gid {
+		if err := file.Chown(int(uid), int(gid)); err != nil {
+			return fsErrStatus(err)
+		}
+		//chown clears the setuid and setgid bits, the DACL keeps what is left
+		if fi, err = file.Stat(); err != nil {
+			return fsErrStatus(err)
+		}
+	}
+	if info&DACL_SECURITY_INFORMATION == 0 {
+		return StatusOk
+	}
+
+	special := fi.Mode() & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if sd.Control&SE_DACL_PRESENT == 0 {
+		//no DACL grants everything
+		perm := os.FileMode(0666)
+		if fi.IsDir() {
+			perm = 0777
+		}
+		return chmodACL(file, perm|special, nil)
+	}
+	var owner, group, other permSet
+	users, groups := make(map[uint32]*permSet), make(map[uint32]*permSet)
+	named := func(m map[uint32]*permSet, id uint32) *permSet {
+		if m[id] == nil {
+			m[id] = &permSet{}
+		}
+		return m[id]
+	}
+	ownerSID, groupSID := ids.UserSID(uid), ids.GroupSID(gid)
+	var nfsMode *uint32
+	for _, ace := range sd.Dacl {
+		if ace.Flags&INHERIT_ONLY_ACE != 0 {
+			continue
+		}
+		//the mode of an NFS ACE wins over the entries, the owner and group ones are only read back
+		if kind, id, ok := nfsACE(ace.SID); ok {
+			if kind == kNFSMode {
+				nfsMode = &id
+			}
+			continue
+		}
+		if ace.SID.Equal(ownerSID) {
+			owner.add(ace)
+		} else if ace.SID.Equal(groupSID) {
+			group.add(ace)
+		} else if ace.SID.Equal(SidEveryone) {
+			other.add(ace)
+		} else if id, ok := ids.UID(ace.SID); ok {
+			named(users, id).add(ace)
+		} else if id, ok := ids.GID(ace.SID); ok {
+			named(groups, id).add(ace)
+		} else {
+			logx.Debugf("security descriptor of %v, %v has no owner on the server", file.Name(), ace.SID)
+		}
+	}
+	if nfsMode != nil {
+		owner.allowed, group.allowed, other.allowed = uint16(*nfsMode>>6)&7, uint16(*nfsMode>>3)&7, uint16(*nfsMode)&7
+	}
+	perm := os.FileMode(owner.allowed)<<6 | os.FileMode(group.allowed)<<3 | os.FileMode(other.allowed)
+	if len(users)+len(groups) == 0 {
+		return chmodACL(file, perm|special, nil)
+	}
+	if !posixACLs {
+		logx.Warnf("security descriptor of %v, no POSIX ACLs for %v users and %v groups", file.Name(), len(users), len(groups))
+		return chmodACL(file, perm|special, nil)
+	}
+	//the mask bounds the named entries and the group, it is what the mode shows as the group bits
+	mask := group.allowed
+	acl := []posixACE{{tag: ACL_USER_OBJ, perm: owner.allowed, id: kPosixACLNoId}}
+	for _, id := range sortedIds(users) {
+		acl = append(acl, posixACE{tag: ACL_USER, perm: users[id].allowed, id: id})
+		mask |= users[id].allowed
+	}
+	acl = append(acl, posixACE{tag: ACL_GROUP_OBJ, perm: group.allowed, id: kPosixACLNoId})
+	for _, id := range sortedIds(groups) {
+		acl = append(acl, posixACE{tag: ACL_GROUP, perm: groups[id].allowed, id: id})
+		mask |= groups[id].allowed
+	}
+	acl = append(acl,
+		posixACE{tag: ACL_MASK, perm: mask, id: kPosixACLNoId},
+		posixACE{tag: ACL_OTHER, perm: other.allowed, id: kPosixACLNoId})
+	return chmodACL(file, perm&^070|os.FileMode(mask)<<3|special, acl)
+}
+
+// userIdsOf is the unix user and the groups of the user of the session, ok is false when it has none.
+func (s *SessionS) userIdsOf() (uid uint32, gids []uint32, ok bool) {
+	ids := &s.unixIds
+	ids.once.Do(func() {
+		userIds := s.userIds
+		if userIds == nil {
+			userIds = localUserIds
+		}
+		var err error
+		if ids.uid, ids.gids, err = userIds(s.userName); err != nil {
+			logx.Debugf("user %v has no unix ids: %v", s.userName, err)
+			return
+		}
+		ids.ok = true
+	})
+	return ids.uid, ids.gids, ids.ok
+}
+
+// localUserIds is the uid and the groups of the local account userName.
+func localUserIds(userName string) (uint32, []uint32, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, nil, err
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		groups = []string{u.Gid}
+	}
+	var gids []uint32
+	for _, group := range groups {
+		if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+			gids = append(gids, uint32(gid))
+		}
+	}
+	return uint32(uid), gids, nil
+}
+
+// maximalAccess is the access the mode of fi gives the user of the session, the rights its class has
+// in the DACL securityDescriptor shows. A user without unix ids acts as the server, root as the
+// owner of every file.
+func (s *SessionS) maximalAccess(fi os.FileInfo) AccessMask {
+	st, ok := statOf(fi)
+	if !ok {
+		return AllAccessMask
+	}
+	uid, gids, ok := s.userIdsOf()
+	if !ok {
+		uid, gids = uint32(os.Getuid()), []uint32{uint32(os.Getgid())}
+		groups, _ := os.Getgroups()
+		for _, gid := range groups {
+			gids = append(gids, uint32(gid))
+		}
+	}
+	mode, dir := uint16(fi.Mode().Perm()), fi.IsDir()
+	if uid == st.uid || uid == 0 {
+		return permRights((mode>>6)&7, dir) | kOwnerRights
+	}
+	for _, gid := range gids {
+		if gid == st.gid {
+			return permRights((mode>>3)&7, dir)
+		}
+	}
+	return permRights(mode&7, dir)
+}
+
+// mayTakeOwnership tells if the user of the session may give files any owner and group.
+func (s *SessionS) mayTakeOwnership() bool {
+	return s.takeOwnership != nil && s.takeOwnership(s.userName)
+}
+
+// mayOwn tells if the user of the session may make uid the owner of a file, itself unless it
+// may take the ownership of files.
+func (s *SessionS) mayOwn(uid uint32) bool {
+	if s.mayTakeOwnership() {
+		return true
+	}
+	own, _, ok := s.userIdsOf()
+	return ok && own == uid
+}
+
+// mayGroup tells if the user of the session may make gid the group of a file, one of its own
+// groups unless it may take the ownership of files.
+func (s *SessionS) mayGroup(gid uint32) bool {
+	if s.mayTakeOwnership() {
+		return true
+	}
+	_, gids, _ := s.userIdsOf()
+	for _, id := range gids {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// chmodACL sets the mode of file and replaces its POSIX ACL, nil leaves only the mode.
+func chmodACL(file *os.File, mode os.FileMode, acl []posixACE) Status {
+	if err := file.Chmod(mode); err != nil {
+		return fsErrStatus(err)
+	}
+	if acl != nil {
+		if err := writePosixACL(file.Name(), acl); err != nil {
+			return fsErrStatus(err)
+		}
+	} else if readPosixACL(file.Name()) != nil {
+		if err := XAttrDel(file.Name(), kPosixACLXattr); err != nil {
+			return fsErrStatus(err)
+		}
+	}
+	return StatusOk
+}
+
+func sortedIds(m map[uint32]*permSet) []uint32 {
+	ids := make([]uint32, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// securityInformation is the security descriptor of the open fileid, SMB2_0_INFO_SECURITY.
+func (data *QueryInfoRequest) securityInformation(ctx *DataCtx, webfile webdav.File, fileid GUID) (*SecurityDescriptor, Status) {
+	access, _ := gShareTable.openState(ctx.session.FilePath(fileid), fileid)
+	if access&READ_CONTROL == 0 {
+		return nil, STATUS_ACCESS_DENIED
+	}
+	file, ok := webfile.(*os.File)
+	if !ok {
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, fsErrStatus(err)
+	}
+	return ctx.session.securityDescriptor(fi, file.Name(), data.AdditionalInformation)
+}
+
+// setSecurity applies the security descriptor of the request to its open, the owner and the group
+// need WRITE_OWNER and the DACL WRITE_DAC.
+func (data *SetInfoRequest) setSecurity(ctx *DataCtx) Status {
+	fileid := ctx.FileID(data.FileId)
+	webfile, ok := ctx.session.GetFile(fileid)
+	if !ok {
+		return STATUS_FILE_CLOSED
+	}
+	sd, err := parseSecurityDescriptor(data.Buffer)
+	if err != nil {
+		return STATUS_INVALID_SECURITY_DESCR
+	}
+	var need AccessMask
+	if data.AdditionalInformation&(OWNER_SECURITY_INFORMATION|GROUP_SECURITY_INFORMATION) != 0 {
+		need |= WRITE_OWNER
+	}
+	if data.AdditionalInformation&DACL_SECURITY_INFORMATION != 0 {
+		need |= WRITE_DAC
+	}
+	path := ctx.session.FilePath(fileid)
+	if access, _ := gShareTable.openState(path, fileid); access&need != need {
+		return STATUS_ACCESS_DENIED
+	}
+	file, ok := webfile.(*os.File)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	gOplockTable.expectChange(path, fileid)
+	if stat := ctx.session.setSecurity(file, sd, data.AdditionalInformation); stat != StatusOk {
+		return stat
+	}
+	//the mode is the READONLY attribute directory listings show
+	gOplockTable.childChanged(path, fileid)
+	return StatusOk
+}
+
+// createSecurity applies the SecD create context to the file an open created. The owner and the group
+// only change when they map to ids the user may give, without a DACL the file keeps the mode it was
+// created with.
+func (s *SessionS) createSecurity(webfile webdav.File, sd *SecurityDescriptor) {
+	file, ok := webfile.(*os.File)
+	if !ok {
+		return
+	}
+	ids := s.ids()
+	var info uint32
+	if sd.Owner != nil {
+		if uid, ok := ids.UID(*sd.Owner); ok && s.mayOwn(uid) {
+			info |= OWNER_SECURITY_INFORMATION
+		}
+	}
+	if sd.Group != nil {
+		if gid, ok := ids.GID(*sd.Group); ok && s.mayGroup(gid) {
+			info |= GROUP_SECURITY_INFORMATION
+		}
+	}
+	if sd.Control&SE_DACL_PRESENT != 0 {
+		info |= DACL_SECURITY_INFORMATION
+	}
+	if stat := s.setSecurity(file, sd, info); stat != StatusOk {
+		logx.Warnf("security descriptor of %v, status: %#x", file.Name(), uint32(stat))
+	}
+}
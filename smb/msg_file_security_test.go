@@ -0,0 +1,136 @@
+package smb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SecurityDescriptor(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("a"), 0666))
+	assert.Nil(t, os.Chmod(path, 0640))
+	session, tree := testDurableSession(dir, nil)
+	ids := UnixIdMap{}
+	owner, group := ids.UserSID(uint32(os.Getuid())), ids.GroupSID(uint32(os.Getgid()))
+
+	query := func(fileid GUID, length uint32) interface{} {
+		req := QueryInfoRequest{
+			Header:                Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+			StructureSize:         41,
+			Class:                 SMB2_0_INFO_SECURITY,
+			OutputBufferLength:    length,
+			AdditionalInformation: OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION,
+			FileId:                fileid,
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		return resp
+	}
+	setInfo := func(fileid GUID, info uint32, sd *SecurityDescriptor) Status {
+		return testSetInfo(t, session, tree, SetInfoRequest{InfoType: SMB2_0_INFO_SECURITY, AdditionalInformation: info, FileId: fileid}, sd)
+	}
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|READ_CONTROL|WRITE_DAC, FILE_OPEN, 0)))
+
+	//a short buffer is told the size the descriptor needs
+	resp := query(fileid, 8).(ErrDataResponse)
+	assert.Equal(t, STATUS_BUFFER_TOO_SMALL, resp.Header.Status)
+	size := binary.LittleEndian.Uint32(resp.ErrorData)
+
+	//the owner, the group and Everyone get the bits of their class
+	buf := query(fileid, size).(*QueryInfoResponse).OutputBuffer
+	assert.Equal(t, int(size), len(buf))
+	sd, err := parseSecurityDescriptor(buf)
+	assert.Nil(t, err)
+	assert.True(t, sd.Owner.Equal(owner))
+	assert.True(t, sd.Group.Equal(group))
+	assert.Equal(t, 3, len(sd.Dacl))
+	assert.Equal(t, FILE_READ_DATA|FILE_WRITE_DATA, sd.Dacl[0].Mask&(FILE_READ_DATA|FILE_WRITE_DATA|FILE_EXECUTE))
+	assert.Equal(t, WRITE_DAC, sd.Dacl[0].Mask&WRITE_DAC)
+	assert.Equal(t, FILE_READ_DATA, sd.Dacl[1].Mask&(FILE_READ_DATA|FILE_WRITE_DATA|FILE_EXECUTE))
+	assert.True(t, sd.Dacl[2].SID.Equal(SidEveryone))
+	assert.Equal(t, AccessMask(0), sd.Dacl[2].Mask&(FILE_READ_DATA|FILE_WRITE_DATA|FILE_EXECUTE))
+
+	//a DACL becomes the mode, the first entry that mentions a right decides it
+	dacl := &SecurityDescriptor{Control: SE_DACL_PRESENT, Dacl: []ACE{
+		{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: GENERIC_ALL, SID: owner},
+		{Type: ACCESS_DENIED_ACE_TYPE, Mask: FILE_WRITE_DATA, SID: SidEveryone},
+		{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: GENERIC_READ | GENERIC_WRITE, SID: SidEveryone},
+	}}
+	assert.Equal(t, StatusOk, setInfo(fileid, DACL_SECURITY_INFORMATION, dacl))
+	fi, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0704), fi.Mode().Perm())
+
+	//the owner needs WRITE_OWNER
+	assert.Equal(t, STATUS_ACCESS_DENIED, setInfo(fileid, OWNER_SECURITY_INFORMATION, &SecurityDescriptor{Owner: &owner}))
+
+	//a created file takes the DACL of its SecD context
+	secd := &SecurityDescriptor{Control: SE_DACL_PRESENT, Dacl: []ACE{
+		{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: FILE_READ_DATA | FILE_WRITE_DATA, SID: owner},
+	}}
+	created, _ := testFileId(testCreate(t, session, tree, testOpen("b.txt", FILE_READ_DATA|READ_CONTROL|WRITE_DAC, FILE_CREATE, 0),
+		createContext{tag: SMB2_CREATE_SD_BUFFER_TAG, data: secd.Marshal()}))
+	fi, _ = os.Stat(filepath.Join(dir, "b.txt"))
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	for _, guid := range []GUID{fileid, created} {
+		webfile, _ := session.DelFile(guid)
+		webfile.Close()
+	}
+}
+
+func Test_SecurityOwner(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("a"), 0666))
+	assert.Nil(t, os.Chmod(path, 0755|os.ModeSetuid))
+	session, tree := testDurableSession(dir, nil)
+	session.userIds = func(userName string) (uint32, []uint32, error) {
+		return 1000, []uint32{1000, 1001}, nil
+	}
+	ids := UnixIdMap{}
+
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", MAXIMUM_ALLOWED, FILE_OPEN, 0)))
+	defer func() {
+		webfile, _ := session.DelFile(fileid)
+		webfile.Close()
+	}()
+	setOwner := func(owner, group SID) Status {
+		sd := &SecurityDescriptor{Owner: &owner, Group: &group, Control: SE_DACL_PRESENT, Dacl: []ACE{
+			{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: GENERIC_ALL, SID: owner},
+		}}
+		info := OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION
+		return testSetInfo(t, session, tree, SetInfoRequest{InfoType: SMB2_0_INFO_SECURITY, AdditionalInformation: info, FileId: fileid}, sd)
+	}
+	owner := func() (uint32, uint32, os.FileMode) {
+		fi, err := os.Stat(path)
+		assert.Nil(t, err)
+		st, _ := statOf(fi)
+		return st.uid, st.gid, fi.Mode()
+	}
+
+	//the owner and the group can only become the user and its groups
+	assert.Equal(t, STATUS_INVALID_OWNER, setOwner(ids.UserSID(2000), ids.GroupSID(1001)))
+	assert.Equal(t, STATUS_INVALID_PRIMARY_GROUP, setOwner(ids.UserSID(1000), ids.GroupSID(2000)))
+	if os.Getuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	assert.Equal(t, StatusOk, setOwner(ids.UserSID(1000), ids.GroupSID(1001)))
+	uid, gid, mode := owner()
+	assert.Equal(t, uint32(1000), uid)
+	assert.Equal(t, uint32(1001), gid)
+	//the setuid bit chown cleared does not come back with the DACL
+	assert.Equal(t, os.FileMode(0), mode&os.ModeSetuid)
+	assert.Equal(t, os.FileMode(0700), mode.Perm())
+
+	//a user that may take the ownership of files gives any owner
+	session.takeOwnership = func(userName string) bool { return userName == "user" }
+	assert.Equal(t, StatusOk, setOwner(ids.UserSID(2000), ids.GroupSID(2000)))
+	uid, gid, _ = owner()
+	assert.Equal(t, uint32(2000), uid)
+	assert.Equal(t, uint32(2000), gid)
+}
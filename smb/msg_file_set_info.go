@@ -2,12 +2,16 @@ package smb
 
 import (
 	"context"
+	"errors"
+	"math"
 	"os"
 	"strings"
+	"time"
 
 	"github/izouxv/smbapi/smb/encoder"
 
 	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
 )
 
 func init() {
@@ -42,40 +46,172 @@ func (data *SetInfoRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	// 	panic(-1)
 	// }
 
+	if data.InfoType == SMB2_0_INFO_SECURITY {
+		if stat := data.setSecurity(ctx); stat != StatusOk {
+			return ERR(data.Header, stat)
+		}
+		data.Header.Status = StatusOk
+		return &SetInfoResponse{Header: data.Header, StructureSize: 2}, nil
+	}
 	if data.InfoType != SMB2_0_INFO_FILE {
 		logx.Warnf("data.InfoType NotSupport: %v", data.InfoType)
 		return ERR(data.Header, STATUS_NOT_SUPPORTED)
 	}
 	if len(data.Buffer) > 0 {
 		fileid := ctx.FileID(data.FileId)
-		webfile, ok := ctx.session.openedFiles[fileid]
+		webfile, ok := ctx.session.GetFile(fileid)
 		if !ok {
 			return ERR(data.Header, STATUS_FILE_CLOSED)
 		}
+		tree := ctx.Tree(data.TreeID)
+		if tree == nil {
+			return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
+		}
+		handle := ctx.Handle(tree.id)
+		//removes and renames take the streams of the files along
+		fsys := tree.anchor.streamFS(handle.FileSystem)
 
 		switch data.FileInfoClass {
 		case FileBasicInformation:
-			resp := &FileBasicInformationX{}
-			if err := encoder.Unmarshal(data.Buffer, resp); err == nil {
-				ctx.closeAction = func() {
+			info := &FileBasicInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			path := ctx.session.FilePath(fileid)
+			if access, _ := gShareTable.openState(path, fileid); access&FILE_WRITE_ATTRIBUTES == 0 {
+				return ERR(data.Header, STATUS_ACCESS_DENIED)
+			}
+			if file, ok := webfile.(*os.File); ok {
+				gOplockTable.expectChange(path, fileid)
+				if stat := info.apply(file); stat != StatusOk {
+					return ERR(data.Header, stat)
 				}
+				if path != "" {
+					gOplockTable.childChanged(path, fileid)
+				}
+			}
+		case FileEndOfFileInformation:
+			info := &FileEndOfFileInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			if stat := truncateFile(ctx, webfile, fileid, info.EndOfFile); stat != StatusOk {
+				return ERR(data.Header, stat)
+			}
+		case FileAllocationInformation:
+			info := &FileAllocationInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			fi, err := webfile.Stat()
+			if err != nil {
+				return ERR(data.Header, fsErrStatus(err))
+			}
+			//the file system allocates on write, only an allocation below the end of file changes the file
+			if fi.IsDir() {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			if info.AllocationSize < uint64(fi.Size()) {
+				if stat := truncateFile(ctx, webfile, fileid, info.AllocationSize); stat != StatusOk {
+					return ERR(data.Header, stat)
+				}
+			}
+		case FileValidDataLengthInformation:
+			info := &FileValidDataLengthInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			fi, err := webfile.Stat()
+			if err != nil {
+				return ERR(data.Header, fsErrStatus(err))
+			}
+			//every byte up to the end of file is valid already, the length can not grow past it
+			if fi.IsDir() || info.ValidDataLength > uint64(fi.Size()) {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+		case FilePositionInformation:
+			info := &FilePositionInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			m := ctx.session.FileMode(fileid)
+			if m.mode&FILE_NO_INTERMEDIATE_BUFFERING != 0 && info.CurrentByteOffset%kSectorSize != 0 {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			m.position = info.CurrentByteOffset
+			ctx.session.setFileMode(fileid, m)
+		case FileModeInformation:
+			info := &FileModeInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			//MS-FSA 2.1.5.14.7, only these can change and the synchronous flags must stay as they were opened
+			m := ctx.session.FileMode(fileid)
+			sync := FILE_SYNCHRONOUS_IO_ALERT | FILE_SYNCHRONOUS_IO_NONALERT
+			if info.Mode&^(FILE_WRITE_THROUGH|FILE_SEQUENTIAL_ONLY|sync) != 0 || info.Mode&sync != m.mode&sync {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
 			}
+			m.mode = m.mode&^(FILE_WRITE_THROUGH|FILE_SEQUENTIAL_ONLY) | info.Mode
+			ctx.session.setFileMode(fileid, m)
+		case FileLinkInformation:
+			info := &FileLinkInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			file, ok := webfile.(*os.File)
+			if !ok {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			filename, err := encoder.FromUnicode(info.FileName)
+			if err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			NewFilePath := tree.GetAbsPath(strings.ReplaceAll(filename, "\\", "/"))
+			gOplockTable.expectChange(NewFilePath, fileid)
+			if stat := linkFile(fsys, file, NewFilePath, info.ReplaceIfExists != 0); stat != StatusOk {
+				return ERR(data.Header, stat)
+			}
+			gOplockTable.childChanged(NewFilePath, fileid)
+		case FileFullEaInformation:
+			eas, err := parseFullEAs(data.Buffer)
+			if err != nil {
+				return ERR(data.Header, STATUS_EA_LIST_INCONSISTENT)
+			}
+			path := ctx.session.FilePath(fileid)
+			if access, _ := gShareTable.openState(path, fileid); access&FILE_WRITE_EA == 0 {
+				return ERR(data.Header, STATUS_ACCESS_DENIED)
+			}
+			gOplockTable.expectChange(path, fileid)
+			if stat := tree.anchor.setFileEAs(handle.FileSystem, path, eas, false); stat != StatusOk {
+				return ERR(data.Header, stat)
+			}
+			//the EaSize of the directory entry changed
+			gOplockTable.childChanged(path, fileid)
+		case FileShortNameInformation:
+			info := &FileShortNameInformationX{}
+			if err := encoder.Unmarshal(data.Buffer, info); err != nil {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			name, err := encoder.FromUnicode(info.FileName)
+			if err != nil || !isShortName(name) {
+				return ERR(data.Header, STATUS_INVALID_PARAMETER)
+			}
+			//the names of the file system are long names only, there is no 8.3 alias to set
+			return ERR(data.Header, STATUS_SHORT_NAMES_NOT_ENABLED_ON_VOLUME)
 		case FileDispositionInformation:
 			resp := &FileDispositionInformationX{}
 			if err := encoder.Unmarshal(data.Buffer, resp); err == nil {
-				if file, ok := webfile.(*os.File); ok {
-					//删除文件.
-					if resp.DeletePending == 1 {
-						ctx.closeAction = func() {
-							FilePath := file.Name()
-							ctx.Handle().FileSystem.RemoveAll(context.Background(), FilePath)
+				switch webfile.(type) {
+				case *os.File, *streamFile:
+					//删除文件, the last handle to close removes it
+					absPath := ctx.session.FilePath(fileid)
+					if resp.DeletePending != 0 {
+						if empty, err := dirEmpty(fsys, absPath); err == nil && !empty {
+							return ERR(data.Header, STATUS_DIRECTORY_NOT_EMPTY)
 						}
 					}
-				}
-				if file, ok := webfile.(*webdavFile); ok {
-					//删除文件xattr属性
-					ctx.closeAction = func() {
-						file.XAttrDelete()
+					if stat := gShareTable.setDeletePending(absPath, fileid, resp.DeletePending != 0, fsys); stat != StatusOk {
+						return ERR(data.Header, stat)
 					}
 				}
 			}
@@ -92,17 +228,41 @@ func (data *SetInfoRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 						return ERR(data.Header, STATUS_UNSUCCESSFUL)
 					}
 					filename = strings.ReplaceAll(filename, "\\", "/")
-					NewFilePath := ctx.session.GetAbsPath(filename)
+					NewFilePath := tree.GetAbsPath(filename)
+					oldPath := ctx.session.FilePath(fileid)
+					//an open target can not be replaced, MS-FSA 2.1.5.14.11
+					if NewFilePath != oldPath && gShareTable.isOpen(NewFilePath) {
+						return ERR(data.Header, STATUS_ACCESS_DENIED)
+					}
+					gOplockTable.expectChange(oldPath, fileid)
+					gOplockTable.expectChange(NewFilePath, fileid)
 					if resp.ReplaceIfExists == 0x01 {
-						err = ctx.Handle().FileSystem.RemoveAll(context.Background(), NewFilePath)
+						//only a file is replaced, a directory target is refused, MS-FSA 2.1.5.14.11
+						if fi, err := fsys.Stat(context.Background(), NewFilePath); err == nil && fi.IsDir() {
+							return ERR(data.Header, STATUS_ACCESS_DENIED)
+						}
+						owner, size := gQuotaTable.fileUsage(NewFilePath)
+						err = fsys.RemoveAll(context.Background(), NewFilePath)
 						if err != nil {
 							return ERR(data.Header, STATUS_UNSUCCESSFUL)
 						}
+						gQuotaTable.discharge(NewFilePath, owner, size)
+						if d, ok := diskDir(fsys); ok {
+							removeSidecar(dirPath(d, NewFilePath))
+						}
 					}
-					err = ctx.Handle().FileSystem.Rename(context.Background(), FilePath, NewFilePath)
+					err = fsys.Rename(context.Background(), FilePath, NewFilePath)
 					if err != nil {
 						return ERR(data.Header, STATUS_UNSUCCESSFUL)
 					}
+					if d, ok := diskDir(fsys); ok {
+						renameSidecar(FilePath, dirPath(d, NewFilePath))
+					}
+					//the opens follow the file, a delete on close must not hit a new file of the old name
+					renameOpens(oldPath, NewFilePath)
+					//the directory leases of both parents list a stale name
+					gOplockTable.childChanged(oldPath, fileid)
+					gOplockTable.childChanged(NewFilePath, fileid)
 					// }
 				}
 			}
@@ -119,3 +279,160 @@ func (data *SetInfoRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	}
 	return &resp, nil
 }
+
+// kFileModeOptions are the CreateOptions FileModeInformation reports, MS-FSCC 2.4.26.
+const kFileModeOptions = FILE_WRITE_THROUGH | FILE_SEQUENTIAL_ONLY | FILE_NO_INTERMEDIATE_BUFFERING |
+	FILE_SYNCHRONOUS_IO_ALERT | FILE_SYNCHRONOUS_IO_NONALERT | FILE_DELETE_ON_CLOSE
+
+// kSectorSize is the sector a position of an unbuffered open is aligned to.
+const kSectorSize = 512
+
+// fsErrStatus maps an error of the file system to a status.
+func fsErrStatus(err error) Status {
+	switch {
+	case os.IsNotExist(err):
+		return STATUS_OBJECT_NAME_NOT_FOUND
+	case os.IsExist(err):
+		return STATUS_OBJECT_NAME_COLLISION
+	case os.IsPermission(err):
+		return STATUS_ACCESS_DENIED
+	case errors.Is(err, errStreamTooLarge):
+		return STATUS_DISK_FULL
+	}
+	return STATUS_UNSUCCESSFUL
+}
+
+// filetime is the time a FILETIME of FileBasicInformation sets, 0 keeps the time and -1 and -2 only
+// stop and resume its updates, MS-FSCC 2.4.7.
+func filetime(ft uint64) (time.Time, bool) {
+	if ft == 0 || ft == 0xFFFFFFFFFFFFFFFF || ft == 0xFFFFFFFFFFFFFFFE {
+		return time.Time{}, false
+	}
+	return filetimeToTime(ft), true
+}
+
+// apply sets the times and the attributes of file. Creation and change time are kept by the file
+// system, of the attributes only FILE_ATTRIBUTE_READONLY has a counterpart, the write permission.
+func (info *FileBasicInformationX) apply(file *os.File) Status {
+	fi, err := file.Stat()
+	if err != nil {
+		return fsErrStatus(err)
+	}
+	if attrs := info.FileAttributes; attrs != 0 {
+		if (attrs&FILE_ATTRIBUTE_DIRECTORY != 0 && !fi.IsDir()) || (attrs&FILE_ATTRIBUTE_TEMPORARY != 0 && fi.IsDir()) {
+			return STATUS_INVALID_PARAMETER
+		}
+		perm := fi.Mode().Perm()
+		if attrs&FILE_ATTRIBUTE_READONLY != 0 {
+			perm &^= 0222
+		} else {
+			perm |= 0200
+		}
+		if !fi.IsDir() && perm != fi.Mode().Perm() {
+			if err := file.Chmod(perm); err != nil {
+				return fsErrStatus(err)
+			}
+		}
+	}
+	mtime, setWrite := filetime(info.LastWrite)
+	atime, setAccess := filetime(info.LastAccess)
+	if !setWrite && !setAccess {
+		return StatusOk
+	}
+	if !setWrite {
+		mtime = fi.ModTime()
+	}
+	if !setAccess {
+		atime = time.Now()
+		if st, ok := statOf(fi); ok {
+			atime = st.atime
+		}
+	}
+	if err := os.Chtimes(file.Name(), atime, mtime); err != nil {
+		return fsErrStatus(err)
+	}
+	return StatusOk
+}
+
+// truncateFile sets the end of file of the open fileid, it cuts the file or extends it with zeros.
+// Like a WRITE it needs FILE_WRITE_DATA and breaks the read caching of the other opens.
+func truncateFile(ctx *DataCtx, webfile webdav.File, fileid GUID, size uint64) Status {
+	path := ctx.session.FilePath(fileid)
+	if access, _ := gShareTable.openState(path, fileid); access&FILE_WRITE_DATA == 0 {
+		return STATUS_ACCESS_DENIED
+	}
+	file, ok := webfile.(interface{ Truncate(int64) error })
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	fi, err := webfile.Stat()
+	if err != nil {
+		return fsErrStatus(err)
+	}
+	if fi.IsDir() || size > math.MaxInt64 {
+		return STATUS_INVALID_PARAMETER
+	}
+	//the size is read again once the writes of the file that change it are settled
+	unlock := gQuotaTable.lockFile(path)
+	defer unlock()
+	if fi, err = webfile.Stat(); err != nil {
+		return fsErrStatus(err)
+	}
+	delta := int64(size) - fi.Size()
+	if stat := gQuotaTable.charge(path, ctx.session.userName, delta); stat != StatusOk {
+		return stat
+	}
+	gOplockTable.expectChange(path, fileid)
+	if err := file.Truncate(int64(size)); err != nil {
+		gQuotaTable.charge(path, ctx.session.userName, -delta)
+		return fsErrStatus(err)
+	}
+	if path != "" {
+		gOplockTable.breakRead(path, fileid)
+		gOplockTable.childChanged(path, fileid)
+	}
+	return StatusOk
+}
+
+// linkFile makes target a hard link of file, both on the disk fsys serves. An existing target is only
+// replaced when asked, and never while it is a directory or open.
+func linkFile(fsys webdav.FileSystem, file *os.File, target string, replace bool) Status {
+	d, ok := diskDir(fsys)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return fsErrStatus(err)
+	}
+	if fi.IsDir() {
+		return STATUS_FILE_IS_A_DIRECTORY
+	}
+	if tfi, err := fsys.Stat(context.Background(), target); err == nil {
+		if !replace {
+			return STATUS_OBJECT_NAME_COLLISION
+		}
+		if tfi.IsDir() || gShareTable.isOpen(target) {
+			return STATUS_ACCESS_DENIED
+		}
+		if err := fsys.RemoveAll(context.Background(), target); err != nil {
+			return fsErrStatus(err)
+		}
+	}
+	if err := os.Link(file.Name(), dirPath(d, target)); err != nil {
+		return fsErrStatus(err)
+	}
+	return StatusOk
+}
+
+// isShortName tells if name is a valid 8.3 name, MS-FSCC 2.1.5.2.1.
+func isShortName(name string) bool {
+	base, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return false
+	}
+	return !strings.ContainsAny(name, `\/[]:|<>+=;,"*? `)
+}
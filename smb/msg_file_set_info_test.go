@@ -0,0 +1,114 @@
+package smb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SetInfo(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("abc"), 0666))
+	session, tree := testDurableSession(dir, nil)
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|FILE_WRITE_DATA|FILE_WRITE_ATTRIBUTES, FILE_OPEN, 0)))
+	setInfo := func(class FileInformationClass, info interface{}) Status {
+		return testSetInfo(t, session, tree, SetInfoRequest{FileInfoClass: class, FileId: fileid}, info)
+	}
+
+	//the times and the size need the rights to change them
+	reader, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA, FILE_OPEN, 0)))
+	denied := SetInfoRequest{FileInfoClass: FileBasicInformation, FileId: reader}
+	assert.Equal(t, STATUS_ACCESS_DENIED, testSetInfo(t, session, tree, denied, &FileBasicInformationX{FileAttributes: FILE_ATTRIBUTE_READONLY}))
+	denied.FileInfoClass = FileEndOfFileInformation
+	assert.Equal(t, STATUS_ACCESS_DENIED, testSetInfo(t, session, tree, denied, &FileEndOfFileInformationX{}))
+	webfile, _ := session.DelFile(reader)
+	webfile.Close()
+
+	//a copy keeps the modification time of its source, the access time stays
+	atime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(path, atime, time.Now()))
+	mtime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	assert.Equal(t, StatusOk, setInfo(FileBasicInformation, &FileBasicInformationX{LastWrite: timeToFiletime(mtime)}))
+	fi, _ := os.Stat(path)
+	assert.True(t, mtime.Equal(fi.ModTime()))
+	st, _ := statOf(fi)
+	assert.True(t, atime.Equal(st.atime))
+	assert.Equal(t, StatusOk, setInfo(FileBasicInformation, &FileBasicInformationX{FileAttributes: FILE_ATTRIBUTE_READONLY}))
+	fi, _ = os.Stat(path)
+	assert.Equal(t, os.FileMode(0), fi.Mode().Perm()&0222)
+	assert.Equal(t, StatusOk, setInfo(FileBasicInformation, &FileBasicInformationX{FileAttributes: FILE_ATTRIBUTE_NORMAL}))
+	fi, _ = os.Stat(path)
+	assert.Equal(t, os.FileMode(0200), fi.Mode().Perm()&0200)
+
+	//preallocation leaves the data alone, the end of file extends and cuts it
+	assert.Equal(t, StatusOk, setInfo(FileAllocationInformation, &FileAllocationInformationX{AllocationSize: 1 << 20}))
+	fi, _ = os.Stat(path)
+	assert.Equal(t, int64(3), fi.Size())
+	assert.Equal(t, StatusOk, setInfo(FileEndOfFileInformation, &FileEndOfFileInformationX{EndOfFile: 10}))
+	fi, _ = os.Stat(path)
+	assert.Equal(t, int64(10), fi.Size())
+	assert.Equal(t, StatusOk, setInfo(FileAllocationInformation, &FileAllocationInformationX{AllocationSize: 2}))
+	buf, _ := os.ReadFile(path)
+	assert.Equal(t, []byte("ab"), buf)
+	assert.Equal(t, STATUS_INVALID_PARAMETER, setInfo(FileValidDataLengthInformation, &FileValidDataLengthInformationX{ValidDataLength: 3}))
+	assert.Equal(t, StatusOk, setInfo(FileValidDataLengthInformation, &FileValidDataLengthInformationX{ValidDataLength: 2}))
+
+	//the position and the mode are kept with the open
+	assert.Equal(t, StatusOk, setInfo(FilePositionInformation, &FilePositionInformationX{CurrentByteOffset: 7}))
+	assert.Equal(t, StatusOk, setInfo(FileModeInformation, &FileModeInformationX{Mode: FILE_WRITE_THROUGH}))
+	assert.Equal(t, fileMode{position: 7, mode: FILE_WRITE_THROUGH}, session.FileMode(fileid))
+	assert.Equal(t, STATUS_INVALID_PARAMETER, setInfo(FileModeInformation, &FileModeInformationX{Mode: FILE_SYNCHRONOUS_IO_ALERT}))
+
+	//a hard link shares the data, an existing name is only replaced when asked
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "c.txt"), nil, 0666))
+	link := func(name string, replace uint8) Status {
+		return setInfo(FileLinkInformation, &FileLinkInformationX{ReplaceIfExists: replace, Reserved: make([]byte, 7), FileName: encoder.ToUnicode(name)})
+	}
+	assert.Equal(t, StatusOk, link("b.txt", 0))
+	buf, _ = os.ReadFile(filepath.Join(dir, "b.txt"))
+	assert.Equal(t, []byte("ab"), buf)
+	assert.Equal(t, STATUS_OBJECT_NAME_COLLISION, link("c.txt", 0))
+	assert.Equal(t, StatusOk, link("c.txt", 1))
+	fi, _ = os.Stat(path)
+	linked, _ := os.Stat(filepath.Join(dir, "c.txt"))
+	assert.True(t, os.SameFile(fi, linked))
+
+	assert.Equal(t, STATUS_INVALID_PARAMETER, setInfo(FileShortNameInformation, &FileShortNameInformationX{FileName: encoder.ToUnicode("toolongname.txt")}))
+	assert.Equal(t, STATUS_SHORT_NAMES_NOT_ENABLED_ON_VOLUME, setInfo(FileShortNameInformation, &FileShortNameInformationX{FileName: encoder.ToUnicode("A~1.TXT")}))
+
+	webfile, _ = session.DelFile(fileid)
+	webfile.Close()
+}
+
+func Test_RenameDeleteOnClose(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0666))
+	session, tree := testDurableSession(dir, nil)
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|DELETE, FILE_OPEN, 0)))
+	setInfo := func(class FileInformationClass, info interface{}) Status {
+		return testSetInfo(t, session, tree, SetInfoRequest{FileInfoClass: class, FileId: fileid}, info)
+	}
+
+	//the open moves with the file, a new file of the old name is somebody else's
+	assert.Equal(t, StatusOk, setInfo(FileRenameInformation, &FileRenameInformationX{Reserved: make([]byte, 7), FileName: encoder.ToUnicode("b.txt")}))
+	renamed := filepath.Join(dir, "b.txt")
+	assert.Equal(t, renamed, session.FilePath(fileid))
+	assert.True(t, gShareTable.isOpen(renamed))
+	assert.False(t, gShareTable.isOpen(filepath.Join(dir, "a.txt")))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("new"), 0666))
+	assert.Equal(t, StatusOk, setInfo(FileDispositionInformation, &FileDispositionInformationX{DeletePending: 1}))
+	webfile, _ := session.DelFile(fileid)
+	webfile.Close()
+
+	buf, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(buf))
+	_, err = os.Stat(renamed)
+	assert.True(t, os.IsNotExist(err))
+}
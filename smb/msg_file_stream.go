@@ -0,0 +1,863 @@
+package smb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/kormoc/xattr"
+	"golang.org/x/net/webdav"
+)
+
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/b134f29a-6278-4f3f-904f-5e58a713d2c5
+
+// kStreamDir keeps the streams of the files of a directory for DirStreams, a directory for each
+// file. Directory listings leave it out.
+const kStreamDir = ".smbstreams"
+
+// kStreamXattrPrefix is the xattr key XattrStreams keeps a stream under, before its name.
+const kStreamXattrPrefix = kServerXattrPrefix + "stream."
+
+// kAppleXattrPrefix are the names of the Apple metadata, macOS sends its xattrs as streams.
+const kAppleXattrPrefix = "com.apple."
+
+// StreamInfo is a named stream of a file.
+type StreamInfo struct {
+	Name string
+	Size int64
+}
+
+// StreamStore keeps the named streams of files, the unnamed data stream is the file itself. Names
+// are the paths of the files on disk.
+type StreamStore interface {
+	//Streams lists the streams of the file name
+	Streams(name string) ([]StreamInfo, error)
+	//ReadStream reads a stream, an error os.IsNotExist tells when the file has none of the name
+	ReadStream(name, stream string) ([]byte, error)
+	//WriteStream replaces the data of a stream, it is created when missing
+	WriteStream(name, stream string, data []byte) error
+	RemoveStream(name, stream string) error
+	//RenameStreams moves the streams of a renamed file along
+	RenameStreams(oldName, newName string) error
+	//RemoveStreams removes the streams of a deleted file
+	RemoveStreams(name string) error
+	//Hidden tells if the directory entry name is kept by the store, listings leave it out
+	Hidden(name string) bool
+}
+
+// streams is Streams or the AFP streams of macOS on xattrs and AppleDouble resource forks.
+func (a *Anchor) streams() StreamStore {
+	if a == nil || a.Streams == nil {
+		return FruitStreams{}
+	}
+	return a.Streams
+}
+
+// hiddenEntry tells if the directory entry name belongs to the server and not to the share.
+func (a *Anchor) hiddenEntry(name string) bool {
+	return storeEntry(name) || a.streams().Hidden(name)
+}
+
+// storeEntry tells if the directory entry name keeps the attributes or streams of its siblings.
+func storeEntry(name string) bool {
+	return name == kSidecarDir || name == kStreamDir
+}
+
+// splitStream splits the name a CREATE opens into the file and its stream, "file:stream:$DATA" or
+// "file:stream". The unnamed data stream, "file::$DATA", is the file itself and has no stream name.
+func splitStream(name string) (file, stream string, stat Status) {
+	file, rest, found := cutStream(name)
+	if !found {
+		return name, "", StatusOk
+	}
+	stream, kind := rest, ""
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 {
+		stream, kind = rest[:i], rest[i+1:]
+		//Apple metadata keeps the colon of its xattr name, "com.apple.metadata:_kMDItemUserTags"
+		if !strings.EqualFold(kind, "$DATA") {
+			if !strings.HasPrefix(rest, kAppleXattrPrefix) {
+				return "", "", STATUS_OBJECT_NAME_INVALID
+			}
+			stream, kind = rest, ""
+		}
+	}
+	if stream == "" && kind == "" {
+		return "", "", STATUS_OBJECT_NAME_INVALID
+	}
+	if !validStreamName(stream) {
+		return "", "", STATUS_OBJECT_NAME_INVALID
+	}
+	return file, stream, StatusOk
+}
+
+// validStreamName tells if stream can name a stream, one path element that only has a colon when it
+// is Apple metadata.
+func validStreamName(stream string) bool {
+	return pathElement(stream) && (strings.IndexByte(stream, ':') < 0 || strings.HasPrefix(stream, kAppleXattrPrefix))
+}
+
+// pathElement tells if name is a single element of a path, it can not leave its directory.
+func pathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "\x00/\\")
+}
+
+// cutStream cuts name at the first colon of its last element.
+func cutStream(name string) (file, rest string, found bool) {
+	i := strings.LastIndexAny(name, "/\\") + 1
+	j := strings.IndexByte(name[i:], ':')
+	if j < 0 {
+		return name, "", false
+	}
+	return name[:i+j], name[i+j+1:], true
+}
+
+// splitStreamPath splits the path of an open, "file:stream" for a stream.
+func splitStreamPath(name string) (file, stream string) {
+	file, stream, _ = cutStream(name)
+	return file, stream
+}
+
+// streamInfo is the os.FileInfo of a stream, its times are the ones of the file.
+type streamInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *streamInfo) Name() string       { return fi.name }
+func (fi *streamInfo) Size() int64        { return fi.size }
+func (fi *streamInfo) Mode() os.FileMode  { return 0666 }
+func (fi *streamInfo) ModTime() time.Time { return fi.modTime }
+func (fi *streamInfo) IsDir() bool        { return false }
+func (fi *streamInfo) Sys() any           { return nil }
+
+// errStreamTooLarge is a write or truncate of a stream past the size its store keeps.
+var errStreamTooLarge = errors.New("stream too large")
+
+// kStreamMaxSize bounds the streams that are kept in files when the share sets no MaxStreamSize.
+const kStreamMaxSize = 64 << 20
+
+// kXattrMaxSize is the largest xattr value Linux keeps, XATTR_SIZE_MAX.
+const kXattrMaxSize = 64 << 10
+
+// limitedStreams is a StreamStore that keeps streams up to a size, 0 for no bound of its own.
+type limitedStreams interface {
+	maxStreamSize(stream string) int64
+}
+
+// streamLimit is the largest size of the stream of store, max bounds the stores without a bound
+// and 0 is none.
+func streamLimit(store StreamStore, stream string, max int64) int64 {
+	if l, ok := store.(limitedStreams); ok {
+		if n := l.maxStreamSize(stream); n > 0 && (n < max || max == 0) {
+			return n
+		}
+	}
+	return max
+}
+
+// streamPlace reads and changes a stream where its store keeps it, a write does not rewrite the
+// stream whole.
+type streamPlace interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Size() (int64, error)
+}
+
+// placedStreams is a StreamStore that keeps streams where they can be changed in place.
+type placedStreams interface {
+	//place is where the stream of name is kept, nil when the store reads and writes it whole
+	place(name, stream string) streamPlace
+}
+
+// streamPlaceOf is where store keeps the stream of name, nil when the stream is read and written whole.
+func streamPlaceOf(store StreamStore, name, stream string) streamPlace {
+	if p, ok := store.(placedStreams); ok {
+		return p.place(name, stream)
+	}
+	return nil
+}
+
+// streamLocks orders the read, modify and write of the streams of a file by the opens of the
+// server, a lock for each file that is in use.
+var streamLocks = struct {
+	sync.Mutex
+	files map[string]*streamLock
+}{files: map[string]*streamLock{}}
+
+type streamLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockStreams locks the streams of the files names, it returns the unlock.
+func lockStreams(names ...string) func() {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	var locks []*streamLock
+	streamLocks.Lock()
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		l := streamLocks.files[name]
+		if l == nil {
+			l = &streamLock{}
+			streamLocks.files[name] = l
+		}
+		l.refs++
+		locks = append(locks, l)
+	}
+	streamLocks.Unlock()
+	for _, l := range locks {
+		l.mu.Lock()
+	}
+	return func() {
+		streamLocks.Lock()
+		defer streamLocks.Unlock()
+		for i, l := range locks {
+			l.mu.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(streamLocks.files, names[i])
+			}
+		}
+	}
+}
+
+// streamFile is an open stream. Reads and writes go to the store, the opens of a stream see the
+// data of each other. A stream the store keeps in place is changed there, the others are read,
+// changed and written back whole and are bounded by limit.
+type streamFile struct {
+	store  StreamStore
+	file   string //the path of the file on disk
+	stream string
+	place  streamPlace //nil when the stream is read and written whole
+	limit  int64
+	mu     sync.Mutex
+	pos    int64
+}
+
+var _ webdav.File = (*streamFile)(nil)
+
+// read reads the data of the stream, the streams of the file are locked. A store that keeps no
+// empty stream, the Finder info of AFP_AfpInfo, has none for a stream that was created and not
+// written yet.
+func (f *streamFile) read() ([]byte, error) {
+	data, err := f.store.ReadStream(f.file, f.stream)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f *streamFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.place != nil {
+		return f.place.ReadAt(p, off)
+	}
+	unlock := lockStreams(f.file)
+	data, err := f.read()
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *streamFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	//the size is checked before the stream grows to it
+	if off > f.limit || int64(len(p)) > f.limit-off {
+		return 0, errStreamTooLarge
+	}
+	if f.place != nil {
+		return f.place.WriteAt(p, off)
+	}
+	unlock := lockStreams(f.file)
+	defer unlock()
+	data, err := f.read()
+	if err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[off:], p)
+	if err := f.store.WriteStream(f.file, f.stream, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *streamFile) Truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size > f.limit {
+		return errStreamTooLarge
+	}
+	if f.place != nil {
+		return f.place.Truncate(size)
+	}
+	unlock := lockStreams(f.file)
+	defer unlock()
+	data, err := f.read()
+	if err != nil {
+		return err
+	}
+	if size <= int64(len(data)) {
+		data = data[:size]
+	} else {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	return f.store.WriteStream(f.file, f.stream, data)
+}
+
+func (f *streamFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *streamFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *streamFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fi.Size()
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *streamFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *streamFile) Stat() (fs.FileInfo, error) {
+	fi, err := statStream(f.store, f.file, f.stream)
+	if os.IsNotExist(err) {
+		if fi, err := os.Stat(f.file); err == nil {
+			return &streamInfo{name: fi.Name() + ":" + f.stream, modTime: fi.ModTime()}, nil
+		}
+	}
+	return fi, err
+}
+
+func (f *streamFile) Close() error {
+	return nil
+}
+
+// streamSize is the size of the stream of file, it is asked of the place of the stream or taken
+// from the listing of the store and the stream is not read.
+func streamSize(store StreamStore, file, stream string) (int64, error) {
+	if place := streamPlaceOf(store, file, stream); place != nil {
+		return place.Size()
+	}
+	infos, err := store.Streams(file)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if info.Name == stream {
+			return info.Size, nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+// statStream stats the stream of file, the size of a stream kept in place is asked of its place.
+func statStream(store StreamStore, file, stream string) (fs.FileInfo, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if place := streamPlaceOf(store, file, stream); place != nil {
+		size, err = place.Size()
+	} else {
+		unlock := lockStreams(file)
+		var data []byte
+		data, err = store.ReadStream(file, stream)
+		unlock()
+		size = int64(len(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamInfo{name: fi.Name() + ":" + stream, size: size, modTime: fi.ModTime()}, nil
+}
+
+// streamFS serves the streams of the files of a share beside its files: "file:stream" names open,
+// stat and remove a stream, files that are renamed or removed take their streams along.
+type streamFS struct {
+	webdav.Dir
+	store StreamStore
+	max   int64 //the size of the streams the store keeps in files
+}
+
+// streamFS adds the streams of the share to fsys, file systems that are not on disk have none.
+func (a *Anchor) streamFS(fsys webdav.FileSystem) webdav.FileSystem {
+	d, ok := fsys.(webdav.Dir)
+	if !ok {
+		return fsys
+	}
+	return streamFS{Dir: d, store: a.streams(), max: a.maxStreamSize()}
+}
+
+// maxStreamSize is MaxStreamSize or kStreamMaxSize.
+func (a *Anchor) maxStreamSize() int64 {
+	if a == nil || a.MaxStreamSize <= 0 {
+		return kStreamMaxSize
+	}
+	return a.MaxStreamSize
+}
+
+// diskDir is the directory on disk fsys serves, ok is false for other file systems.
+func diskDir(fsys webdav.FileSystem) (webdav.Dir, bool) {
+	switch fsys := fsys.(type) {
+	case webdav.Dir:
+		return fsys, true
+	case streamFS:
+		return fsys.Dir, true
+	}
+	return "", false
+}
+
+// resolve is the stream of the file on disk name the name stream stands for, stream names are case
+// insensitive.
+func (s streamFS) resolve(name, stream string) string {
+	infos, err := s.store.Streams(name)
+	if err != nil {
+		return stream
+	}
+	for _, info := range infos {
+		if info.Name == stream {
+			return stream
+		}
+	}
+	for _, info := range infos {
+		if strings.EqualFold(info.Name, stream) {
+			return info.Name
+		}
+	}
+	return stream
+}
+
+func (s streamFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, stream := splitStreamPath(name)
+	if stream == "" {
+		return s.Dir.OpenFile(ctx, name, flag, perm)
+	}
+	//a stream of a missing file brings the file along
+	if _, err := s.Dir.Stat(ctx, file); os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		f, err := s.Dir.OpenFile(ctx, file, os.O_CREATE|os.O_RDWR, perm)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	} else if err != nil {
+		return nil, err
+	}
+	osFile := dirPath(s.Dir, file)
+	stream = s.resolve(osFile, stream)
+	unlock := lockStreams(osFile)
+	defer unlock()
+	_, err := s.store.ReadStream(osFile, stream)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+	switch {
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, os.ErrExist
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	case !exists || flag&os.O_TRUNC != 0:
+		if err := s.store.WriteStream(osFile, stream, []byte{}); err != nil {
+			return nil, err
+		}
+	}
+	return &streamFile{store: s.store, file: osFile, stream: stream, place: streamPlaceOf(s.store, osFile, stream),
+		limit: streamLimit(s.store, stream, s.max)}, nil
+}
+
+func (s streamFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, stream := splitStreamPath(name)
+	if stream == "" {
+		return s.Dir.Stat(ctx, name)
+	}
+	osFile := dirPath(s.Dir, file)
+	return statStream(s.store, osFile, s.resolve(osFile, stream))
+}
+
+func (s streamFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, stream := splitStreamPath(name); stream != "" {
+		return os.ErrInvalid
+	}
+	return s.Dir.Mkdir(ctx, name, perm)
+}
+
+func (s streamFS) RemoveAll(ctx context.Context, name string) error {
+	file, stream := splitStreamPath(name)
+	if stream != "" {
+		osFile := dirPath(s.Dir, file)
+		unlock := lockStreams(osFile)
+		defer unlock()
+		return s.store.RemoveStream(osFile, s.resolve(osFile, stream))
+	}
+	if err := s.Dir.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	osFile := dirPath(s.Dir, name)
+	unlock := lockStreams(osFile)
+	defer unlock()
+	return s.store.RemoveStreams(osFile)
+}
+
+func (s streamFS) Rename(ctx context.Context, oldName, newName string) error {
+	if _, stream := splitStreamPath(oldName); stream != "" {
+		return os.ErrInvalid
+	}
+	if _, stream := splitStreamPath(newName); stream != "" {
+		return os.ErrInvalid
+	}
+	if err := s.Dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	oldFile, newFile := dirPath(s.Dir, oldName), dirPath(s.Dir, newName)
+	unlock := lockStreams(oldFile, newFile)
+	defer unlock()
+	return s.store.RenameStreams(oldFile, newFile)
+}
+
+// streamInformation answers FileStreamInformation for the file of the open fileid, the unnamed data
+// stream of a file first and then its named streams. A list cut at OutputBufferLength ends with a whole
+// entry and STATUS_BUFFER_OVERFLOW, STATUS_BUFFER_TOO_SMALL when not even the first one fits.
+func (data *QueryInfoRequest) streamInformation(ctx *DataCtx, fileid GUID) ([]byte, Status) {
+	tree := ctx.Tree(data.TreeID)
+	if tree == nil {
+		return nil, STATUS_NETWORK_NAME_DELETED
+	}
+	d, ok := diskDir(ctx.Handle(tree.id).FileSystem)
+	if !ok {
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	file, _ := splitStreamPath(ctx.session.FilePath(fileid))
+	osFile := dirPath(d, file)
+	fi, err := os.Stat(osFile)
+	if err != nil {
+		return nil, fsErrStatus(err)
+	}
+	var infos []StreamInfo
+	if !fi.IsDir() {
+		infos = append(infos, StreamInfo{Size: fi.Size()})
+	}
+	streams, err := tree.anchor.streams().Streams(osFile)
+	if err != nil {
+		return nil, fsErrStatus(err)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Name < streams[j].Name })
+	infos = append(infos, streams...)
+	//a list that does not fit is cut after the last whole entry, the padding of which is left out
+	var items [][]byte
+	size, status := 0, StatusOk
+	for _, info := range infos {
+		buf, err := encoder.Marshal(&FileStreamInformationX{
+			StreamSize:           uint64(info.Size),
+			StreamAllocationSize: uint64(info.Size),
+			StreamName:           encoder.ToUnicode(":" + info.Name + ":$DATA"),
+		})
+		if err != nil {
+			return nil, STATUS_UNSUCCESSFUL
+		}
+		if uint32(size+len(buf)) > data.OutputBufferLength {
+			status = STATUS_BUFFER_OVERFLOW
+			break
+		}
+		buf = Duiqi4Byte(buf)
+		size += len(buf)
+		items = append(items, buf)
+	}
+	if len(items) == 0 && status != StatusOk {
+		return nil, STATUS_BUFFER_TOO_SMALL
+	}
+	for i, item := range items {
+		if i != len(items)-1 {
+			binary.LittleEndian.PutUint32(item, uint32(len(item)))
+		}
+	}
+	out := bytes.Join(items, nil)
+	if uint32(len(out)) > data.OutputBufferLength {
+		out = out[:data.OutputBufferLength]
+	}
+	return out, status
+}
+
+// XattrStreams keeps a stream in the xattr kStreamXattrPrefix+name of its file, the Apple metadata
+// macOS sends as streams under its own name. Streams are bounded by the size the file system
+// allows an xattr, XAttrSet falls back to a sidecar file without xattrs.
+type XattrStreams struct{}
+
+func streamKey(stream string) string {
+	if strings.HasPrefix(stream, kAppleXattrPrefix) {
+		return stream
+	}
+	return kStreamXattrPrefix + stream
+}
+
+// xattrMissing tells if err is an xattr the file does not have.
+func xattrMissing(err error) bool {
+	return errors.Is(err, xattr.XAttrErrorNoDataAvailable) || errors.Is(err, xattr.XAttrErrorAttributeNotFound)
+}
+
+func (XattrStreams) Streams(name string) ([]StreamInfo, error) {
+	keys, err := XAttrGetKeys(name)
+	if err != nil {
+		return nil, err
+	}
+	var infos []StreamInfo
+	for _, key := range keys {
+		stream := key
+		if strings.HasPrefix(key, kStreamXattrPrefix) {
+			stream = key[len(kStreamXattrPrefix):]
+		} else if !strings.HasPrefix(key, kAppleXattrPrefix) {
+			continue
+		}
+		value, err := XAttrGet(name, key)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, StreamInfo{Name: stream, Size: int64(len(value))})
+	}
+	return infos, nil
+}
+
+func (XattrStreams) ReadStream(name, stream string) ([]byte, error) {
+	value, err := XAttrGet(name, streamKey(stream))
+	if xattrMissing(err) {
+		return nil, os.ErrNotExist
+	}
+	return value, err
+}
+
+func (XattrStreams) WriteStream(name, stream string, data []byte) error {
+	return XAttrSet(name, streamKey(stream), data)
+}
+
+func (XattrStreams) RemoveStream(name, stream string) error {
+	if err := XAttrDel(name, streamKey(stream)); err != nil && !xattrMissing(err) {
+		return err
+	}
+	return nil
+}
+
+// RenameStreams has nothing to do, xattrs stay with their file.
+func (XattrStreams) RenameStreams(oldName, newName string) error {
+	return nil
+}
+
+// RemoveStreams has nothing to do, xattrs go with their file.
+func (XattrStreams) RemoveStreams(name string) error {
+	return nil
+}
+
+func (XattrStreams) Hidden(name string) bool {
+	return false
+}
+
+func (XattrStreams) maxStreamSize(stream string) int64 {
+	return kXattrMaxSize
+}
+
+// DirStreams keeps the streams of a file as files of the directory kStreamDir/<file> beside it, for
+// streams larger than the file system allows an xattr.
+type DirStreams struct{}
+
+func streamDir(name string) string {
+	return filepath.Join(filepath.Dir(name), kStreamDir, filepath.Base(name))
+}
+
+// streamPath is the file of the stream of name, a stream name that is no single path element has none.
+func streamPath(name, stream string) (string, error) {
+	if !pathElement(stream) {
+		return "", os.ErrInvalid
+	}
+	return filepath.Join(streamDir(name), stream), nil
+}
+
+func (DirStreams) Streams(name string) ([]StreamInfo, error) {
+	entries, err := os.ReadDir(streamDir(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []StreamInfo
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, StreamInfo{Name: entry.Name(), Size: fi.Size()})
+	}
+	return infos, nil
+}
+
+func (DirStreams) ReadStream(name, stream string) ([]byte, error) {
+	file, err := streamPath(name, stream)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
+
+func (DirStreams) WriteStream(name, stream string, data []byte) error {
+	file, err := streamPath(name, stream)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func (DirStreams) RemoveStream(name, stream string) error {
+	file, err := streamPath(name, stream)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	//the directories go with their last stream
+	if os.Remove(dir) == nil {
+		os.Remove(filepath.Dir(dir))
+	}
+	return nil
+}
+
+func (DirStreams) RenameStreams(oldName, newName string) error {
+	oldDir, newDir := streamDir(oldName), streamDir(newName)
+	if err := os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(oldDir))
+	return nil
+}
+
+func (DirStreams) RemoveStreams(name string) error {
+	dir := streamDir(name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(dir))
+	return nil
+}
+
+func (DirStreams) Hidden(name string) bool {
+	return name == kStreamDir
+}
+
+// place is the file of the stream, its writes go to the file.
+func (DirStreams) place(name, stream string) streamPlace {
+	file, err := streamPath(name, stream)
+	if err != nil {
+		return nil
+	}
+	return dirStream(file)
+}
+
+// dirStream is the file of a stream of DirStreams.
+type dirStream string
+
+func (f dirStream) ReadAt(p []byte, off int64) (int, error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, off)
+}
+
+func (f dirStream) WriteAt(p []byte, off int64) (int, error) {
+	//a stream removed while open comes back, as it would when written whole
+	if err := os.MkdirAll(filepath.Dir(string(f)), 0755); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(string(f), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.WriteAt(p, off)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (f dirStream) Truncate(size int64) error {
+	return os.Truncate(string(f), size)
+}
+
+func (f dirStream) Size() (int64, error) {
+	fi, err := os.Stat(string(f))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,203 @@
+package smb
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func Test_Streams(t *testing.T) {
+	for name, store := range map[string]StreamStore{"xattr": XattrStreams{}, "dir": DirStreams{}, "appledouble": AppleDoubleStreams{}} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("data"), 0666))
+			anchor := NewAnchor("share", dir)
+			anchor.Streams = store
+			session, tree := testDurableSession(dir, anchor)
+
+			create := func(name string, disposition CreateDisposition) (GUID, Status) {
+				return testFileId(testCreate(t, session, tree, testOpen(name, FILE_READ_DATA|FILE_WRITE_DATA|DELETE, disposition, 0)))
+			}
+			closeFile := func(fileid GUID) {
+				webfile, _ := session.DelFile(fileid)
+				webfile.Close()
+			}
+			read := func(fileid GUID) string {
+				req := ReadRequest{
+					Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandRead, TreeID: tree.id},
+					StructureSize: 49,
+					Length:        1024,
+					FileId:        fileid,
+				}
+				resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+				assert.Nil(t, err)
+				return string(resp.(*ReadResponse).Data)
+			}
+			setInfo := func(fileid GUID, class FileInformationClass, info interface{}) Status {
+				return testSetInfo(t, session, tree, SetInfoRequest{FileInfoClass: class, FileId: fileid}, info)
+			}
+
+			//a stream is created, written and read beside the data of the file
+			_, stat := create("a.txt:Zone.Identifier:$INDEX_ALLOCATION", FILE_CREATE)
+			assert.Equal(t, STATUS_OBJECT_NAME_INVALID, stat)
+			stream, stat := create("a.txt:Zone.Identifier:$DATA", FILE_CREATE)
+			assert.Equal(t, StatusOk, stat)
+			write := WriteRequest{
+				Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandWrite, TreeID: tree.id},
+				StructureSize: 49,
+				DataLength:    24,
+				FileId:        stream,
+				Data:          []byte("[ZoneTransfer]\r\nZoneId=3"),
+			}
+			_, err := write.ServerAction(NewDataCtx(session, nil, testHandle))
+			assert.Nil(t, err)
+			_, stat = create("a.txt:Zone.Identifier", FILE_CREATE)
+			assert.Equal(t, STATUS_OBJECT_NAME_COLLISION, stat)
+			assert.Equal(t, StatusOk, setInfo(stream, FileEndOfFileInformation, &FileEndOfFileInformationX{EndOfFile: 14}))
+			closeFile(stream)
+
+			//names are case insensitive, the file keeps its data
+			stream, stat = create("a.txt:zone.identifier", FILE_OPEN)
+			assert.Equal(t, StatusOk, stat)
+			assert.Equal(t, "[ZoneTransfer]", read(stream))
+			closeFile(stream)
+			file, _ := create("a.txt", FILE_OPEN)
+			assert.Equal(t, "data", read(file))
+
+			//the streams are listed after the unnamed data stream
+			req := QueryInfoRequest{
+				Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+				StructureSize:      41,
+				Class:              SMB2_0_INFO_FILE,
+				InfoLevel:          uint8(FileStreamInformation),
+				OutputBufferLength: 4096,
+				FileId:             file,
+			}
+			resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+			assert.Nil(t, err)
+			buf := resp.(*QueryInfoResponse).OutputBuffer
+			first := &FileStreamInformationX{}
+			assert.Nil(t, encoder.Unmarshal(buf, first))
+			assert.Equal(t, encoder.ToUnicode("::$DATA"), first.StreamName)
+			second := &FileStreamInformationX{}
+			assert.Nil(t, encoder.Unmarshal(buf[first.NextOffset:], second))
+			assert.Equal(t, encoder.ToUnicode(":Zone.Identifier:$DATA"), second.StreamName)
+			assert.Equal(t, uint64(14), second.StreamSize)
+			//a short buffer gets the whole entries that fit, never a part of one
+			req.OutputBufferLength = first.NextOffset + 8
+			resp, _ = req.ServerAction(NewDataCtx(session, nil, testHandle))
+			assert.Equal(t, STATUS_BUFFER_OVERFLOW, resp.(*QueryInfoResponse).Header.Status)
+			buf = resp.(*QueryInfoResponse).OutputBuffer
+			assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(buf))
+			assert.True(t, uint32(len(buf)) <= first.NextOffset)
+			req.OutputBufferLength = 16
+			resp, _ = req.ServerAction(NewDataCtx(session, nil, testHandle))
+			assert.Equal(t, STATUS_BUFFER_TOO_SMALL, resp.(ErrResponse).Header.Status)
+
+			//the streams move with their file
+			assert.Equal(t, StatusOk, setInfo(file, FileRenameInformation, &FileRenameInformationX{FileName: encoder.ToUnicode("b.txt")}))
+			closeFile(file)
+			data, err := store.ReadStream(filepath.Join(dir, "b.txt"), "Zone.Identifier")
+			assert.Nil(t, err)
+			assert.Equal(t, "[ZoneTransfer]", string(data))
+
+			//a deleted stream leaves the file, the store keeps nothing in the directory
+			stream, _ = create("b.txt:Zone.Identifier", FILE_OPEN)
+			assert.Equal(t, StatusOk, setInfo(stream, FileDispositionInformation, &FileDispositionInformationX{DeletePending: 1}))
+			closeFile(stream)
+			_, err = store.ReadStream(filepath.Join(dir, "b.txt"), "Zone.Identifier")
+			assert.True(t, os.IsNotExist(err))
+			entries, _ := os.ReadDir(dir)
+			assert.Equal(t, 1, len(entries))
+			assert.Equal(t, "b.txt", entries[0].Name())
+		})
+	}
+}
+
+func Test_AppleDouble(t *testing.T) {
+	ad := &appleDouble{
+		finderInfo: []byte("TEXTttxt" + string(make([]byte, 24))),
+		resource:   []byte("resource"),
+		attrs:      []adAttr{{name: "com.apple.quarantine", value: []byte("0083;")}, {name: "user.tag", value: []byte("x")}},
+	}
+	got, err := parseAppleDouble(ad.marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, ad, got)
+	_, err = parseAppleDouble([]byte("not apple double"))
+	assert.Equal(t, errAppleDouble, err)
+}
+
+func Test_StreamLimits(t *testing.T) {
+	for name, store := range map[string]StreamStore{"xattr": XattrStreams{}, "dir": DirStreams{}, "appledouble": AppleDoubleStreams{}} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("data"), 0666))
+			fsys := streamFS{Dir: webdav.Dir(dir), store: store, max: 1 << 20}
+			f, err := fsys.OpenFile(context.Background(), "a.txt:AFP_Resource", os.O_CREATE|os.O_RDWR, 0666)
+			assert.Nil(t, err)
+			defer f.Close()
+			w := f.(*streamFile)
+
+			//the stream does not grow past what its store keeps
+			limit := streamLimit(store, "AFP_Resource", fsys.max)
+			_, err = w.WriteAt([]byte("x"), limit)
+			assert.Equal(t, errStreamTooLarge, err)
+			assert.Equal(t, errStreamTooLarge, w.Truncate(limit+1))
+			assert.Equal(t, STATUS_DISK_FULL, fsErrStatus(err))
+
+			//writes in chunks and a truncate leave the data of the stream
+			for i, chunk := range []string{"one", "two", "three"} {
+				_, err := w.WriteAt([]byte(chunk), int64(i*3))
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, w.Truncate(8))
+			fi, err := w.Stat()
+			assert.Nil(t, err)
+			assert.Equal(t, int64(8), fi.Size())
+			data, err := store.ReadStream(filepath.Join(dir, "a.txt"), "AFP_Resource")
+			assert.Nil(t, err)
+			assert.Equal(t, "onetwoth", string(data))
+		})
+	}
+}
+
+func Test_AppleDoubleResource(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(name, []byte("data"), 0666))
+
+	//a "._" file with the resource fork before the Finder info is laid out again on its first write
+	finderInfo := []byte("TEXTttxt" + string(make([]byte, 24)))
+	buf := make([]byte, kADHeaderSize+2*kADEntrySize)
+	binary.BigEndian.PutUint32(buf, kAppleDoubleMagic)
+	binary.BigEndian.PutUint32(buf[4:], kAppleDoubleVersion)
+	binary.BigEndian.PutUint16(buf[24:], 2)
+	e := buf[kADHeaderSize:]
+	binary.BigEndian.PutUint32(e, kADEntryResource)
+	binary.BigEndian.PutUint32(e[4:], uint32(len(buf)))
+	binary.BigEndian.PutUint32(e[8:], 3)
+	binary.BigEndian.PutUint32(e[12:], kADEntryFinderInfo)
+	binary.BigEndian.PutUint32(e[16:], uint32(len(buf)+3))
+	binary.BigEndian.PutUint32(e[20:], kADFinderInfoSize)
+	buf = append(append(buf, "res"...), finderInfo...)
+	assert.Nil(t, os.WriteFile(appleDoublePath(name), buf, 0644))
+
+	r := AppleDoubleStreams{}.place(name, kAFPResourceStream)
+	_, err := r.WriteAt([]byte("ource"), 3)
+	assert.Nil(t, err)
+	size, err := r.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), size)
+	ad, err := readAppleDouble(name)
+	assert.Nil(t, err)
+	assert.Equal(t, "resource", string(ad.resource))
+	assert.Equal(t, finderInfo, ad.finderInfo)
+	assert.Nil(t, AppleDoubleStreams{}.place(name, kAppleFinderInfoXattr))
+}
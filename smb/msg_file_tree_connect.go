@@ -144,6 +144,7 @@ func (data *TreeConnectRequest) ServerAction(ctx *DataCtx) (interface{}, error)
 
 	SMB2_SHAREFLAG_NO_CACHING := uint32(0x00000030)
 	SMB2_SHAREFLAG_ACCESS_BASED_DIRECTORY_ENUM := uint32(0x00000800)
+	SMB2_SHAREFLAG_ENCRYPT_DATA := uint32(0x00008000)
 
 	Access_Mask := (FILE_READ_DATA | FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_READ_EA |
 		FILE_WRITE_EA | FILE_DELETE_CHILD | FILE_EXECUTE | FILE_READ_ATTRIBUTES |
@@ -163,11 +164,19 @@ func (data *TreeConnectRequest) ServerAction(ctx *DataCtx) (interface{}, error)
 	if anchor == nil {
 		return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
 	}
-	data.Header.TreeID = anchor.tid
+	if anchor.EncryptData {
+		if !ctx.session.canEncrypt() {
+			return ERR(data.Header, STATUS_ACCESS_DENIED)
+		}
+		ShareFlags |= SMB2_SHAREFLAG_ENCRYPT_DATA
+	}
+	tree := ctx.session.TreeConnect(anchor)
+	data.Header.TreeID = tree.id
+	if handle := ctx.Handle(tree.id); handle != nil {
+		gQuotaTable.open(anchor, handle.FileSystem)
+	}
 	data.Header.Status = StatusOk
 
-	ctx.session.SetActiveAnchorKey(path)
-
 	resp := TreeConnectResponse{
 		Header:        data.Header,
 		StructureSize: 0x0010,
@@ -175,9 +184,11 @@ func (data *TreeConnectRequest) ServerAction(ctx *DataCtx) (interface{}, error)
 		ShareFlags:    ShareFlags,
 		Access_Mask:   Access_Mask,
 	}
+	if ctx.session.persistentShare(anchor) {
+		resp.Capabilities |= SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY
+	}
 	resp.Header.Status = StatusOk
 	resp.Header.Signature = make([]byte, 16)
-	resp.Header.Credits = 33
 	return &resp, nil
 }
 
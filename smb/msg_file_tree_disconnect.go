@@ -25,7 +25,11 @@ type TreeDisconnectResponse struct {
 
 func (data *TreeDisconnectRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	data.Header.Flags = SMB2_FLAGS_RESPONSE
-	resp := TreeDisconnectResponse{Header: data.Header}
+	if !ctx.session.TreeDisconnect(data.Header.TreeID) {
+		return ERR(data.Header, STATUS_NETWORK_NAME_DELETED)
+	}
+	data.Header.Status = StatusOk
+	resp := TreeDisconnectResponse{Header: data.Header, StructureSize: 4}
 	return &resp, nil
 }
 
@@ -1,5 +1,7 @@
 package smb
 
+import "errors"
+
 func init() {
 	commandRequestMap[CommandWrite] = func() DataI {
 		return &WriteRequest{}
@@ -51,7 +53,7 @@ func (data *WriteRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	}
 
 	fileid := ctx.FileID(data.FileId)
-	webfile, ok := ctx.session.openedFiles[fileid]
+	webfile, ok := ctx.session.GetFile(fileid)
 	if !ok {
 		return ERR(data.Header, STATUS_FILE_CLOSED)
 	}
@@ -59,12 +61,27 @@ func (data *WriteRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
 	if fileid.IsSvrSvc(ctx.session) {
 		return DcerpcWrite(ctx, data)
 	}
+	if ctx.session.lockConflict(fileid, data.FileOffset, uint64(data.DataLength), true) {
+		return ERR(data.Header, STATUS_FILE_LOCK_CONFLICT)
+	}
+	path := ctx.session.FilePath(fileid)
+	//the owner of the file pays for what the write adds to it
+	reserved, stat := gQuotaTable.reserveWrite(path, ctx.session.userName, webfile, data.FileOffset, uint64(data.DataLength))
+	if stat != StatusOk {
+		return ERR(data.Header, stat)
+	}
+	if path != "" {
+		//the cached data of the other opens is stale now, and so are the size and times the parent lists
+		gOplockTable.breakRead(path, fileid)
+		gOplockTable.expectChange(path, fileid)
+		gOplockTable.childChanged(path, fileid)
+	}
 
-	_, err := webfile.Seek(int64(data.FileOffset), 0)
-	if err != nil {
-		return ERR(data.Header, STATUS_UNSUCCESSFUL)
+	doneSize, err := writeAt(webfile, data.Data, int64(data.FileOffset))
+	reserved.settle(webfile)
+	if errors.Is(err, errStreamTooLarge) {
+		return ERR(data.Header, STATUS_DISK_FULL)
 	}
-	doneSize, err := webfile.Write(data.Data)
 	if err != nil {
 		return ERR(data.Header, STATUS_UNSUCCESSFUL)
 	}
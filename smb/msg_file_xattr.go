@@ -1,7 +1,14 @@
 package smb
 
 import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/kormoc/xattr"
 )
@@ -56,16 +63,157 @@ func IsXAttr(name string) (bool, string, string) {
 	return false, "", ""
 }
 
+// xattrNamespaces are the namespaces of Linux attributes, keys in one of them are kept as they are.
+var xattrNamespaces = []string{"user.", "system.", "security.", "trusted."}
+
+// xattrName is the name the system keeps the attribute key under, keys without a namespace are
+// user attributes.
+func xattrName(key string) string {
+	if kXattrUserPrefix == "" {
+		return key
+	}
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(key, ns) {
+			return key
+		}
+	}
+	return kXattrUserPrefix + key
+}
+
+// isUserKey tells if key is a user attribute, only those are kept in a sidecar.
+func isUserKey(key string) bool {
+	name := xattrName(key)
+	return kXattrUserPrefix == "" || strings.HasPrefix(name, kXattrUserPrefix)
+}
+
+// noXattrs tells if err is a file system without attributes.
+func noXattrs(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// kSidecarDir keeps the attributes of the files of a directory whose file system has no xattrs,
+// a file for each file. Directory listings leave it out.
+const kSidecarDir = ".smbattr"
+
+// sidecarMu serializes the read, modify and write of sidecars.
+var sidecarMu sync.Mutex
+
+func sidecarPath(name string) string {
+	return filepath.Join(filepath.Dir(name), kSidecarDir, filepath.Base(name))
+}
+
+// readSidecar reads the attributes of name kept in its sidecar, sidecarMu is held.
+func readSidecar(name string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	buf, err := os.ReadFile(sidecarPath(name))
+	if os.IsNotExist(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// writeSidecar replaces the sidecar of name, without attributes it goes away. sidecarMu is held.
+func writeSidecar(name string, attrs map[string][]byte) error {
+	path := sidecarPath(name)
+	if len(attrs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(filepath.Dir(path))
+		return nil
+	}
+	buf, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// updateSidecar changes the sidecar attributes of name with update.
+func updateSidecar(name string, update func(attrs map[string][]byte) error) error {
+	sidecarMu.Lock()
+	defer sidecarMu.Unlock()
+	attrs, err := readSidecar(name)
+	if err != nil {
+		return err
+	}
+	if err := update(attrs); err != nil {
+		return err
+	}
+	return writeSidecar(name, attrs)
+}
+
+// removeSidecar drops the attributes a sidecar keeps for name, the file went away.
+func removeSidecar(name string) {
+	sidecarMu.Lock()
+	defer sidecarMu.Unlock()
+	writeSidecar(name, nil)
+}
+
+// renameSidecar moves the sidecar attributes of oldName to newName.
+func renameSidecar(oldName, newName string) {
+	sidecarMu.Lock()
+	defer sidecarMu.Unlock()
+	attrs, err := readSidecar(oldName)
+	if err != nil || len(attrs) == 0 {
+		return
+	}
+	if err := writeSidecar(newName, attrs); err != nil {
+		return
+	}
+	writeSidecar(oldName, nil)
+}
+
 func XAttrSet(name string, key string, value []byte) error {
-	err := xattr.SetBytes(name, key, value)
+	err := xattr.SetBytes(name, xattrName(key), value)
+	if noXattrs(err) && isUserKey(key) {
+		return updateSidecar(name, func(attrs map[string][]byte) error {
+			attrs[key] = value
+			return nil
+		})
+	}
 	return err
 }
 func XAttrGet(name string, key string) (value []byte, err error) {
-	value, err = xattr.GetBytes(name, key)
+	value, err = xattr.GetBytes(name, xattrName(key))
+	if noXattrs(err) && isUserKey(key) {
+		sidecarMu.Lock()
+		defer sidecarMu.Unlock()
+		attrs, err := readSidecar(name)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := attrs[key]
+		if !ok {
+			return nil, xattr.XAttrErrorNoDataAvailable
+		}
+		return value, nil
+	}
 	return
 }
 func XAttrDel(name string, key string) (err error) {
-	err = xattr.Remove(name, key)
+	err = xattr.Remove(name, xattrName(key))
+	if noXattrs(err) && isUserKey(key) {
+		return updateSidecar(name, func(attrs map[string][]byte) error {
+			if _, ok := attrs[key]; !ok {
+				return xattr.XAttrErrorNoDataAvailable
+			}
+			delete(attrs, key)
+			return nil
+		})
+	}
 	return
 }
 func XAttrClear(name string) (err error) {
@@ -74,13 +222,15 @@ func XAttrClear(name string) (err error) {
 		return
 	}
 	for _, key := range keys {
-		err = xattr.Remove(name, key)
+		err = XAttrDel(name, key)
 		if err != nil {
 			return
 		}
 	}
 	return nil
 }
+
+// XAttrGetKeys lists the user attributes of name, the keys XAttrGet reads.
 func XAttrGetKeys(name string) (keys []string, err error) {
 	defer func() {
 		if cerr := recover(); cerr != nil {
@@ -89,13 +239,34 @@ func XAttrGetKeys(name string) (keys []string, err error) {
 
 	}()
 	keysBuf, err := xattr.ListBytes(name)
+	if noXattrs(err) {
+		sidecarMu.Lock()
+		defer sidecarMu.Unlock()
+		attrs, err := readSidecar(name)
+		if err != nil {
+			return nil, err
+		}
+		for key := range attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	keys = strings.Split(string(keysBuf), "\x00")
-	if len(keys[len(keys)-1]) == 0 {
-		keys = keys[:len(keys)-1]
+	for _, key := range strings.Split(string(keysBuf), "\x00") {
+		if key == "" {
+			continue
+		}
+		if kXattrUserPrefix != "" {
+			if !strings.HasPrefix(key, kXattrUserPrefix) {
+				continue
+			}
+			key = key[len(kXattrUserPrefix):]
+		}
+		keys = append(keys, key)
 	}
 
 	return
@@ -2,11 +2,17 @@ package smb
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,10 +20,8 @@ import (
 	"golang.org/x/net/webdav"
 )
 
-var treeIdX = uint32(0)
-
 func NewAnchor(name, rootpath string) *Anchor {
-	return &Anchor{Name: name, RootPath: rootpath, tid: atomic.AddUint32(&treeId, 1)}
+	return &Anchor{Name: name, RootPath: rootpath}
 }
 
 type Handler struct {
@@ -28,61 +32,324 @@ type Handler struct {
 type Anchor struct {
 	Name     string
 	RootPath string
-	tid      uint32
-	Handle   *Handler
+	Handle   *Handler //optional, Config.Handle is used when nil
+	//EncryptData only serves the share to sessions that encrypt, SMB2_SHAREFLAG_ENCRYPT_DATA
+	EncryptData bool
+	//ContinuousAvailability lets SMB 3.x clients open persistent handles on the share,
+	//SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY. It needs Config.PersistentStore.
+	ContinuousAvailability bool
+	//VolumeLabel and VolumeSerial tell clients which volume the share is, the share name and a
+	//hash of the share when empty
+	VolumeLabel  string
+	VolumeSerial uint32
+	//Volume reports the space and the creation time of the share, the file system of RootPath
+	//is asked when nil. Shares that are not on a local disk set it.
+	Volume VolumeFunc
+	//QuotaLimit bounds the bytes the files of the share take, no limit when zero. Writes that go
+	//over it or over the limit Quota gives the owner of the file fail with STATUS_DISK_FULL.
+	QuotaLimit uint64
+	Quota      QuotaFunc
+	//EAs maps the extended attributes clients set to the xattrs of the files, PrefixEAMap{} when
+	//nil. File systems without xattrs keep them in a sidecar file.
+	EAs EAMap
+	//Streams keeps the named streams of the files, "file:stream", FruitStreams{} when nil, the
+	//AFP streams of macOS. DirStreams and AppleDoubleStreams keep them in files beside the files.
+	Streams StreamStore
+	//MaxStreamSize bounds the streams kept in files, DirStreams and the resource forks of
+	//AppleDoubleStreams, 64 MiB when zero. Streams in xattrs are bounded by the size of an xattr.
+	MaxStreamSize int64
+}
+
+// VolumeStat is the space of a volume in bytes, Available is what the user may still write and
+// can be less than Free.
+type VolumeStat struct {
+	Total     uint64
+	Free      uint64
+	Available uint64
+	BlockSize uint32
+	Created   time.Time //zero when not known
+}
+
+// VolumeFunc reports the space of a share for userName.
+type VolumeFunc func(userName string) (VolumeStat, error)
+
+// volumeSerial is VolumeSerial or a hash of the share, it stays the same across restarts.
+func (a *Anchor) volumeSerial() uint32 {
+	if a.VolumeSerial != 0 {
+		return a.VolumeSerial
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToUpper(a.Name) + "\x00" + a.RootPath))
+	return h.Sum32()
+}
+
+// volumeId is the object id of the volume of the share, FileFsObjectIdInformation.
+func (a *Anchor) volumeId() GUID {
+	var guid GUID
+	h := fnv.New128a()
+	h.Write([]byte(strings.ToUpper(a.Name) + "\x00" + a.RootPath))
+	copy(guid[:], h.Sum(nil))
+	return guid
+}
+
+// volumeStat is the space of the share for userName.
+func (a *Anchor) volumeStat(userName string) (VolumeStat, error) {
+	if a.Volume != nil {
+		return a.Volume(userName)
+	}
+	return statVolume(a.RootPath)
 }
+
+// volumeCreated is the FILETIME the volume of the share was made, the creation of RootPath on a disk.
+func (a *Anchor) volumeCreated(userName string) uint64 {
+	if a.Volume != nil {
+		vs, err := a.Volume(userName)
+		if err != nil || vs.Created.IsZero() {
+			return 0
+		}
+		return timeToFiletime(vs.Created)
+	}
+	fi, err := os.Stat(a.RootPath)
+	if err != nil {
+		return 0
+	}
+	return newFileMeta(fi, a.RootPath).creation
+}
+
 type GetPwdFunc func(name string) (password string, err error)
 type GetAnchorFun func(userName string) (anchors []*Anchor, err error)
 
+// UserIdsFunc is the unix uid and the groups of userName.
+type UserIdsFunc func(userName string) (uid uint32, gids []uint32, err error)
+
 type Config struct {
 	// Port int
 	Pwd    GetPwdFunc
 	Tree   GetAnchorFun
 	Handle func(string) *Handler
+	// Credits bounds the credits of each connection, DefaultCreditPolicy when nil
+	Credits *CreditPolicy
+	// RequireSigning refuses unsigned requests once the session is set up
+	RequireSigning bool
+	// RequireEncryption encrypts every session, clients that can not encrypt are refused
+	RequireEncryption bool
+	// DurableTimeout is how long the durable handles of a dropped connection wait for the
+	// client to reconnect, 60 seconds when zero
+	DurableTimeout time.Duration
+	// PersistentStore is the directory persistent handles are journaled to, a restarted
+	// server gives them back to their clients. Persistent handles are off when empty.
+	PersistentStore string
+	// IdMap maps the owners and groups of files to the SIDs of their security descriptors,
+	// UnixIdMap when nil
+	IdMap IdMap
+	// UserIds maps the user of a session to its unix user and groups, the owner and the groups
+	// it may give files. The local account of the name when nil.
+	UserIds UserIdsFunc
+	// TakeOwnership tells if userName may give files any owner and group, what
+	// SeTakeOwnershipPrivilege and SeRestorePrivilege allow on Windows. Nobody may when nil.
+	TakeOwnership func(userName string) bool
+	// Model is the Mac model the Finder draws the server as, the AAPL model info, "Xserve"
+	// when empty
+	Model string
 }
 type ServerI interface {
-	Start(PORT int)
+	// Start listens on PORT and serves until the server is shut down.
+	Start(PORT int) error
+	// Serve accepts connections on l until ctx is done or Shutdown is called.
+	Serve(ctx context.Context, l net.Listener) error
+	// Shutdown stops accepting, waits for in-flight requests and closes every session. Requests
+	// still running when ctx is done are cancelled.
+	Shutdown(ctx context.Context) error
 }
 
+// ErrServerClosed is returned by Serve and Start after Shutdown.
+var ErrServerClosed = errors.New("smb: server closed")
+
 func NewServer(config *Config) ServerI {
-	return &server{config: config, sessions: make(map[uint64]SessionS)}
+	s := &server{
+		config:    config,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]*SessionS),
+
+		shutdownExpired: make(chan struct{}),
+	}
+	if config.PersistentStore != "" {
+		s.store = newHandleStore(config.PersistentStore)
+	}
+	return s
 }
 
 type server struct {
-	config   *Config
-	sessions map[uint64]SessionS
+	config  *Config
+	store   *handleStore //nil without Config.PersistentStore
+	restore sync.Once
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]*SessionS //session is nil until the connection is accepted by HandleConnection
+	connWg     sync.WaitGroup
+	inShutdown int32
+	//closed when Shutdown stops waiting, the requests still running are cancelled
+	shutdownExpired chan struct{}
+	expireOnce      sync.Once
 }
 
-func (s *server) Start(PORT int) {
+func (s *server) Start(PORT int) error {
 	// PORT := s.config.Port
-	getPwd := s.config.Pwd
-	getTree := s.config.Tree
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", PORT))
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+		logx.Errorf("Error listening: %v", err)
+		return err
+	}
+	logx.Printf("Listening on %v port", PORT)
+	return s.Serve(context.Background(), l)
+}
+
+func (s *server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+func (s *server) Serve(ctx context.Context, l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	if s.store != nil {
+		s.restore.Do(s.restorePersistent)
 	}
-	// Close the listener when the application closes.
+	// Close the listener when the server stops.
 	defer l.Close()
-	fmt.Printf("Listening on %v port\n", PORT)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	getPwd := s.config.Pwd
+	getTree := s.config.Tree
+	var tempDelay time.Duration
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				logx.Warnf("Error accepting: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
 		}
+		tempDelay = 0
 
 		logx.Printf("IP: %v", conn.RemoteAddr().String())
 
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
 		// Handle connections in a new goroutine.
 		go s.HandleConnection(conn, getPwd, getTree)
+	}
+}
 
+func (s *server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	// wake up the connections blocked in Recv, a request already being
+	// processed still gets its response before the connection goes away.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.expireOnce.Do(func() { close(s.shutdownExpired) })
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.conns[conn] = nil
+		s.connWg.Add(1)
+	} else {
+		delete(s.conns, conn)
+		s.connWg.Done()
+	}
+	return true
+}
+
+func (s *server) setConnSession(conn net.Conn, session *SessionS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = session
 	}
 }
 
 func (s *server) HandleConnection(conn net.Conn, getPwd GetPwdFunc, getTree GetAnchorFun) {
 	remoteAddr := conn.RemoteAddr()
+	defer s.trackConn(conn, false)
 	defer func() {
 		if err := recover(); err != nil {
 			b := make([]byte, 4000, 4000)
@@ -94,6 +361,28 @@ func (s *server) HandleConnection(conn net.Conn, getPwd GetPwdFunc, getTree GetA
 	defer conn.Close()
 
 	session := NewSessionServer(true, conn, getPwd, getTree)
+	session.credits = newCreditWindow(s.config.Credits)
+	session.IsSigningRequired = s.config.RequireSigning
+	session.EncryptData = s.config.RequireEncryption
+	session.durableMax = s.config.DurableTimeout
+	session.store = s.store
+	session.idMap = s.config.IdMap
+	session.userIds = s.config.UserIds
+	session.takeOwnership = s.config.TakeOwnership
+	session.model = s.config.Model
+	s.setConnSession(conn, session)
+	defer func() {
+		if s.shuttingDown() {
+			//the next run of the server gives the persistent handles back
+			session.keepPersistent()
+		} else {
+			//the client may come back on a new connection and reclaim its durable handles
+			session.preserveDurable()
+		}
+		if err := session.Close(); err != nil {
+			logx.Warnf("close session(%v), err: %v", remoteAddr, err)
+		}
+	}()
 
 	if err := session.NegotiateProtocolServer(); err != nil {
 		logx.Infof("login failed, %v, err: %v", session.IsAuthenticated, err)
@@ -112,20 +401,98 @@ func (s *server) HandleConnection(conn net.Conn, getPwd GetPwdFunc, getTree GetA
 	logx.Infof("login suc, %v", session.IsAuthenticated)
 
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	session.startWriter(rw)
+	var handlers sync.WaitGroup
+	defer func() {
+		//a shutdown lets the requests in progress finish while it waits, the ones still running
+		//after that are cancelled, their responses go out before the writer stops
+		if s.shuttingDown() {
+			s.drain(&handlers)
+		}
+		session.cancelOps()
+		handlers.Wait()
+		session.stopWriter()
+	}()
 	for {
-		reqMsg, _, err := session.Recv(rw)
+		reqMsg, ver, err := session.Recv(rw)
 		if err != nil {
 			return
 		}
-		respBuf, cmd, stat := ActionFunc(NewDataCtx(session, conn, s.config.Handle), reqMsg)
-		if stat != StatusOk {
+		encrypted := ver == ProtocolSmb2Transform
+		if encrypted {
+			if reqMsg, err = session.decryptMessage(reqMsg); err != nil {
+				logx.Warnf("decrypt(%v), err: %v", remoteAddr, err)
+				return
+			}
+		}
+		if len(reqMsg) < 64 {
+			return
+		}
+		if !session.consumeCredits(reqMsg) {
+			logx.Warnf("MessageID out of the credit window(%v)", remoteAddr)
+			return
+		}
+		if Command(binary.LittleEndian.Uint16(reqMsg[12:])) == CommandCancel {
+			//CANCEL has no response, handle it here so it is never queued behind the request it cancels
+			s.serveMsg(session, conn, reqMsg, nil, encrypted)
+			continue
+		}
+		//requests are independent, each one runs on its own and the writer orders the responses
+		op := session.beginOp(reqMsg, encrypted)
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer session.endOp(op)
+			s.serveMsg(session, conn, reqMsg, op, encrypted)
+		}()
+		if s.shuttingDown() {
 			return
 		}
+	}
+}
 
-		if false {
-			logx.Printf("\n\n\ncmd: %v req:\n%vresp:\n%v", cmd.String(), hex.Dump(reqMsg), hex.Dump(respBuf))
+// drain waits for handlers to finish, or for Shutdown to stop waiting.
+func (s *server) drain(handlers *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-s.shutdownExpired:
+	}
+}
+
+// serveMsg runs one message, compound or not, and queues its response.
+func (s *server) serveMsg(session *SessionS, conn net.Conn, reqMsg []byte, op *asyncOp, encrypted bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			b := make([]byte, 4000, 4000)
+			n := runtime.Stack(b, false)
+			fmt.Printf("%s\n", b[:n])
+			fmt.Printf("Error(%v): %s\n\n", conn.RemoteAddr(), err)
+			conn.Close()
 		}
+	}()
 
-		session.Send(respBuf, rw)
+	ctx := NewDataCtx(session, conn, s.config.Handle)
+	ctx.op = op
+	ctx.encrypted = encrypted
+	if op != nil && asyncCommands[Command(binary.LittleEndian.Uint16(reqMsg[12:]))] {
+		timer := time.AfterFunc(kAsyncInterimDelay, func() { session.goAsync(op) })
+		defer timer.Stop()
 	}
+
+	respBuf, cmd, stat := ActionFunc(ctx, reqMsg)
+	if stat != StatusOk {
+		conn.Close()
+		return
+	}
+
+	if false {
+		logx.Printf("\n\n\ncmd: %v req:\n%vresp:\n%v", cmd.String(), hex.Dump(reqMsg), hex.Dump(respBuf))
+	}
+
+	session.sendResponse(respBuf, encrypted)
 }
@@ -0,0 +1,92 @@
+package smb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ServeShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ser := NewServer(config)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ser.Serve(context.Background(), l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Equal(t, nil, ser.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-errCh)
+
+	//the idle connection is closed by the server
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	//a stopped server does not serve again
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrServerClosed, ser.Serve(context.Background(), l2))
+}
+
+func Test_ShutdownDrain(t *testing.T) {
+	ser := NewServer(config).(*server)
+	var handlers sync.WaitGroup
+
+	//a request in progress finishes before its connection goes away
+	handlers.Add(1)
+	drained := make(chan struct{})
+	go func() {
+		ser.drain(&handlers)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drained with a request in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	handlers.Done()
+	<-drained
+
+	//one that outlasts the shutdown is left to be cancelled
+	handlers.Add(1)
+	defer handlers.Done()
+	ser.connWg.Add(1)
+	defer ser.connWg.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, ser.Shutdown(ctx))
+	ser.drain(&handlers)
+}
+
+func Test_ServeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- NewServer(config).Serve(ctx, l)
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-errCh)
+}
@@ -0,0 +1,382 @@
+package smb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// kAsyncInterimDelay is how long a request may run before the client gets an interim STATUS_PENDING response.
+const kAsyncInterimDelay = 500 * time.Millisecond
+
+// asyncCommands may go async on their own once they take longer than kAsyncInterimDelay.
+var asyncCommands = map[Command]bool{
+	CommandCreate:       true,
+	CommandFlush:        true,
+	CommandRead:         true,
+	CommandWrite:        true,
+	CommandLock:         true,
+	CommandIOCtl:        true,
+	CommandFind:         true,
+	CommandChangeNotify: true,
+}
+
+// asyncOp is a request the connection is still working on, CANCEL finds it by MessageID or AsyncId.
+type asyncOp struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	messageId uint64
+	header    []byte //request header, the interim response is built from it
+	encrypted bool   //the request came encrypted
+
+	//guarded by SessionS.mu
+	asyncId uint64   //0 until the interim response is sent
+	prior   [][]byte //responses of the compound sent before this request
+	last    bool     //the last request of the compound is running, only it may go async
+	done    bool
+}
+
+// startWriter serializes the responses of the connection, handlers finish in any order.
+func (s *SessionS) startWriter(rw *bufio.ReadWriter) {
+	s.out = make(chan []byte, 64)
+	s.outDone = make(chan struct{})
+	go func() {
+		defer close(s.outDone)
+		for buf := range s.out {
+			if err := s.Send(buf, rw); err != nil {
+				//the reader fails too and stops the connection, drop what is left
+				s.conn.Close()
+				for range s.out {
+				}
+				return
+			}
+		}
+	}()
+}
+
+// stopWriter flushes the queued responses, every handler must be finished.
+func (s *SessionS) stopWriter() {
+	if s.out == nil {
+		return
+	}
+	s.mu.Lock()
+	s.outStopped = true
+	s.mu.Unlock()
+	close(s.out)
+	<-s.outDone
+}
+
+// SendAsync queues buf for the writer goroutine.
+func (s *SessionS) SendAsync(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	s.out <- buf
+}
+
+// sendResponse queues the signed response buf, encrypted when the request was or the session wants it.
+func (s *SessionS) sendResponse(buf []byte, encrypted bool) {
+	if len(buf) == 0 {
+		return
+	}
+	if s.encryptResponse(encrypted) {
+		var err error
+		if buf, err = s.encryptMessage(buf); err != nil {
+			logx.Errorf("encrypt, err: %v", err)
+			s.conn.Close()
+			return
+		}
+	}
+	s.SendAsync(buf)
+}
+
+// sendNotification queues an unsolicited message like a break notification about an open of tree,
+// encrypted when the session or the share of tree wants it. It never blocks, the message is dropped
+// when the connection is not writing anymore or falls behind.
+func (s *SessionS) sendNotification(buf []byte, tree *TreeS) {
+	if s.encryptResponse(tree != nil && tree.anchor.EncryptData && s.canEncrypt()) {
+		var err error
+		if buf, err = s.encryptMessage(buf); err != nil {
+			logx.Errorf("encrypt, err: %v", err)
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == nil || s.outStopped {
+		return
+	}
+	select {
+	case s.out <- buf:
+	default:
+		logx.Warnf("notification dropped, session: %v", s.sessionID)
+	}
+}
+
+// beginOp registers the request msg so CANCEL and a slow handler can find it.
+func (s *SessionS) beginOp(msg []byte, encrypted bool) *asyncOp {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &asyncOp{
+		ctx:       ctx,
+		cancel:    cancel,
+		messageId: binary.LittleEndian.Uint64(msg[24:]),
+		header:    append([]byte(nil), msg[:64]...),
+		encrypted: encrypted,
+	}
+	s.mu.Lock()
+	s.ops[op.messageId] = op
+	s.mu.Unlock()
+	return op
+}
+
+// endOp forgets op, it is called after the final response is queued.
+func (s *SessionS) endOp(op *asyncOp) {
+	s.mu.Lock()
+	if s.ops[op.messageId] == op {
+		delete(s.ops, op.messageId)
+	}
+	s.mu.Unlock()
+	op.cancel()
+}
+
+// goAsync sends the interim response of op once, the final response then carries the same AsyncId.
+func (s *SessionS) goAsync(op *asyncOp) bool {
+	if op == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if op.asyncId != 0 {
+		return true
+	}
+	if op.done || !op.last {
+		return false
+	}
+
+	var header Header
+	if err := encoder.Unmarshal(op.header, &header); err != nil {
+		return false
+	}
+	s.asyncId++
+	op.asyncId = s.asyncId
+	header.NextCommand = 0
+	interim, _ := ERR(header, STATUS_PENDING)
+	buf, err := encoder.Marshal(interim)
+	if err != nil {
+		logx.Errorf("interim response, err: %v", err)
+		return false
+	}
+	setAsyncId(buf, op.asyncId)
+	binary.LittleEndian.PutUint16(buf[14:], s.credits.grant(header.Credits))
+	//the responses before it in the compound go out with the interim one
+	resp := joinCompound(append(op.prior, buf))
+	s.signCompound(resp)
+	s.sendResponse(resp, op.encrypted)
+	op.prior = nil
+	return true
+}
+
+// startLast hands the responses of the compound over to op before its last request runs.
+func (s *SessionS) startLast(op *asyncOp, prior [][]byte) [][]byte {
+	if op == nil {
+		return prior
+	}
+	s.mu.Lock()
+	op.prior = prior
+	op.last = true
+	s.mu.Unlock()
+	return nil
+}
+
+// finishLast marks op done and returns what is left of the compound and the AsyncId of the final response.
+func (s *SessionS) finishLast(op *asyncOp, prior [][]byte) ([][]byte, uint64) {
+	if op == nil {
+		return prior, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op.done = true
+	prior, op.prior = op.prior, nil
+	return prior, op.asyncId
+}
+
+// CancelOp cancels the request with messageId, or asyncId for async requests.
+func (s *SessionS) CancelOp(messageId uint64, asyncId uint64, async bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range s.ops {
+		if (async && op.asyncId == asyncId) || (!async && op.messageId == messageId) {
+			op.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// cancelOps cancels every request still in progress, it is used when the connection goes away.
+func (s *SessionS) cancelOps() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range s.ops {
+		op.cancel()
+	}
+}
+
+func setAsyncId(buf []byte, asyncId uint64) {
+	flags := binary.LittleEndian.Uint32(buf[16:])
+	binary.LittleEndian.PutUint32(buf[16:], flags|uint32(SMB2_FLAGS_ASYNC_COMMAND))
+	binary.LittleEndian.PutUint64(buf[32:], asyncId)
+}
+
+// joinCompound chains the responses, each but the last one is padded to 8 bytes.
+func joinCompound(resps [][]byte) []byte {
+	var total []byte
+	for i, resp := range resps {
+		if i != len(resps)-1 {
+			if pad := len(resp) % 8; pad != 0 {
+				resp = append(resp, make([]byte, 8-pad)...)
+			}
+			binary.LittleEndian.PutUint32(resp[20:], uint32(len(resp)))
+		} else {
+			binary.LittleEndian.PutUint32(resp[20:], 0)
+		}
+		total = append(total, resp...)
+	}
+	return total
+}
+
+// GetFile returns the file opened as guid.
+func (s *SessionS) GetFile(guid GUID) (webdav.File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	webfile, ok := s.openedFiles[guid]
+	return webfile, ok
+}
+
+// PutFile adds the open guid, path is the absolute path of the file and empty for pipes.
+func (s *SessionS) PutFile(guid GUID, webfile webdav.File, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openedFiles[guid] = webfile
+	if path != "" {
+		s.filePaths[guid] = path
+	}
+}
+
+// FilePath returns the absolute path of the open guid, byte range locks are keyed by it.
+func (s *SessionS) FilePath(guid GUID) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filePaths[guid]
+}
+
+// renameFile moves the open guid to the path oldPath became, a durable open is reconnected by it.
+func (s *SessionS) renameFile(guid GUID, oldPath, newPath string) {
+	s.mu.Lock()
+	path, ok := renamedPath(s.filePaths[guid], oldPath, newPath)
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	s.filePaths[guid] = path
+	d := s.durable[guid]
+	if d != nil {
+		d.path = path
+	}
+	s.mu.Unlock()
+	if d != nil {
+		d.journal()
+	}
+}
+
+// fileMode is what an open keeps for FilePositionInformation and FileModeInformation.
+type fileMode struct {
+	position uint64
+	mode     CreateOptions
+}
+
+// FileMode returns the position and the mode of the open guid.
+func (s *SessionS) FileMode(guid GUID) fileMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fileModes[guid]
+}
+
+func (s *SessionS) setFileMode(guid GUID, m fileMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.openedFiles[guid]; ok {
+		s.fileModes[guid] = m
+	}
+}
+
+// DelFile forgets guid, only the caller that got ok closes the file.
+func (s *SessionS) DelFile(guid GUID) (webdav.File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	webfile, ok := s.openedFiles[guid]
+	s.forgetFile(guid)
+	return webfile, ok
+}
+
+// forgetFile drops everything that belongs to the open guid, s.mu is held.
+func (s *SessionS) forgetFile(guid GUID) {
+	delete(s.openedFiles, guid)
+	delete(s.fileTrees, guid)
+	delete(s.fileModes, guid)
+	delete(s.quotaScans, guid)
+	delete(s.eaScans, guid)
+	if d, ok := s.durable[guid]; ok {
+		delete(s.durable, guid)
+		if d.store != nil {
+			d.store.remove(guid)
+		}
+	}
+	s.cleanupNotify(guid)
+	if w, ok := s.watches[guid]; ok {
+		delete(s.watches, guid)
+		w.stop()
+	}
+	if path, ok := s.filePaths[guid]; ok {
+		delete(s.filePaths, guid)
+		//a pending delete happens first, the parent lease of the open is still known
+		gShareTable.release(path, guid)
+		gLockTable.releaseOpen(path, guid)
+		gOplockTable.release(path, guid)
+	}
+}
+
+// seekMu serializes Seek+Read/Write on files without positional I/O, requests on a handle run concurrently.
+var seekMu sync.Mutex
+
+func readAt(webfile webdav.File, buf []byte, off int64) (int, error) {
+	if r, ok := webfile.(io.ReaderAt); ok {
+		return r.ReadAt(buf, off)
+	}
+	seekMu.Lock()
+	defer seekMu.Unlock()
+	if _, err := webfile.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(webfile, buf)
+}
+
+func writeAt(webfile webdav.File, buf []byte, off int64) (int, error) {
+	if w, ok := webfile.(io.WriterAt); ok {
+		return w.WriteAt(buf, off)
+	}
+	seekMu.Lock()
+	defer seekMu.Unlock()
+	if _, err := webfile.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return webfile.Write(buf)
+}
@@ -0,0 +1,86 @@
+package smb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func testHandle(string) *Handler {
+	return &Handler{&webdav.Handler{FileSystem: webdav.Dir("/"), LockSystem: webdav.NewMemLS()}}
+}
+
+func Test_AsyncCancel(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	session := NewSessionServer(true, srv, nil, nil)
+	session.startWriter(bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)))
+	defer session.stopWriter()
+
+	dir := t.TempDir()
+	tree := session.TreeConnect(NewAnchor("share", dir))
+	webfile, err := os.Open(dir)
+	assert.Nil(t, err)
+	defer webfile.Close()
+	guid := makeGUID(tree.id, 1)
+	session.PutFile(guid, webfile, dir)
+	defer session.DelFile(guid)
+
+	req := ChangeNotifyRequest{
+		Header: Header{
+			ProtocolID:   []byte(ProtocolSmb2),
+			HeaderLength: 64,
+			Command:      CommandChangeNotify,
+			MessageID:    7,
+			TreeID:       tree.id,
+			SessionID:    session.sessionID,
+			Signature:    make([]byte, 16),
+		},
+		StructureSize:    32,
+		FileId:           guid,
+		CompletionFilter: FILE_NOTIFY_CHANGE_FILE_NAME,
+	}
+	msg, err := encoder.Marshal(&req)
+	assert.Nil(t, err)
+
+	ctx := NewDataCtx(session, srv, testHandle)
+	ctx.op = session.beginOp(msg, false)
+	go func() {
+		defer session.endOp(ctx.op)
+		respBuf, _, _ := ActionFunc(ctx, msg)
+		session.SendAsync(respBuf)
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(cli), bufio.NewWriter(cli))
+	interim, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(STATUS_PENDING), binary.LittleEndian.Uint32(interim[8:]))
+	assert.NotZero(t, binary.LittleEndian.Uint32(interim[16:])&uint32(SMB2_FLAGS_ASYNC_COMMAND))
+	asyncId := binary.LittleEndian.Uint64(interim[32:])
+	assert.NotZero(t, asyncId)
+
+	assert.Equal(t, false, session.CancelOp(0, asyncId+1, true))
+	assert.Equal(t, true, session.CancelOp(0, asyncId, true))
+
+	final, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(STATUS_CANCELLED), binary.LittleEndian.Uint32(final[8:]))
+	assert.Equal(t, asyncId, binary.LittleEndian.Uint64(final[32:]))
+	assert.Equal(t, uint64(7), binary.LittleEndian.Uint64(final[24:]))
+}
+
+func Test_JoinCompound(t *testing.T) {
+	resps := [][]byte{make([]byte, 73), make([]byte, 80), make([]byte, 70)}
+	total := joinCompound(resps)
+	assert.Equal(t, 80+80+70, len(total))
+	assert.Equal(t, uint32(80), binary.LittleEndian.Uint32(total[20:]))
+	assert.Equal(t, uint32(80), binary.LittleEndian.Uint32(total[80+20:]))
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(total[160+20:]))
+}
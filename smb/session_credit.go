@@ -0,0 +1,169 @@
+package smb
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// CreditPolicy bounds the credits granted to a connection, like Smb2CreditsMin/Smb2CreditsMax of Windows.
+type CreditPolicy struct {
+	Min uint16 //responses top the client up to Min credits, even when it asks for less
+	Max uint16 //credits a client may hold at once
+}
+
+var DefaultCreditPolicy = CreditPolicy{Min: 512, Max: 8192}
+
+// kCreditUnit is the payload one credit pays for on a LARGE_MTU connection.
+const kCreditUnit = 65536
+
+// creditWindow is the sequence window of a connection, a MessageID is valid once, and only after a credit for it was granted.
+type creditWindow struct {
+	mu     sync.Mutex
+	policy CreditPolicy
+	low    uint64              //lowest MessageID not used yet
+	high   uint64              //first MessageID without a credit
+	used   map[uint64]struct{} //used MessageIDs above low
+}
+
+func newCreditWindow(policy *CreditPolicy) *creditWindow {
+	w := &creditWindow{
+		policy: DefaultCreditPolicy,
+		high:   1, //the first NEGOTIATE needs no grant
+		used:   make(map[uint64]struct{}),
+	}
+	if policy != nil {
+		w.policy = *policy
+	}
+	if w.policy.Min == 0 {
+		w.policy.Min = 1
+	}
+	if w.policy.Max < w.policy.Min {
+		w.policy.Max = w.policy.Min
+	}
+	return w
+}
+
+// consume takes charge credits starting at messageId, false means the client left its window.
+func (w *creditWindow) consume(messageId uint64, charge uint16) bool {
+	if charge == 0 {
+		charge = 1
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	end := messageId + uint64(charge)
+	if messageId < w.low || end > w.high || end < messageId {
+		return false
+	}
+	for id := messageId; id < end; id++ {
+		if _, ok := w.used[id]; ok {
+			return false
+		}
+	}
+	for id := messageId; id < end; id++ {
+		w.used[id] = struct{}{}
+	}
+	for {
+		if _, ok := w.used[w.low]; !ok {
+			break
+		}
+		delete(w.used, w.low)
+		w.low++
+	}
+	return true
+}
+
+// grant opens the window by the credits the client asked for, within the policy.
+func (w *creditWindow) grant(request uint16) uint16 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	granted := request
+	outstanding := w.high - w.low - uint64(len(w.used))
+	if outstanding+uint64(granted) < uint64(w.policy.Min) {
+		granted = uint16(uint64(w.policy.Min) - outstanding)
+	}
+	if outstanding+uint64(granted) > uint64(w.policy.Max) {
+		granted = 0
+		if outstanding < uint64(w.policy.Max) {
+			granted = uint16(uint64(w.policy.Max) - outstanding)
+		}
+	}
+	if granted == 0 && outstanding == 0 {
+		//never leave the client without a credit
+		granted = 1
+	}
+	w.high += uint64(granted)
+	return granted
+}
+
+type headerI interface {
+	GetHeader() *Header
+}
+
+func (h *Header) GetHeader() *Header {
+	return h
+}
+
+// consumeCredits charges every request of the compound msg, CANCEL is free.
+func (s *SessionS) consumeCredits(msg []byte) bool {
+	for len(msg) >= 64 {
+		if Command(binary.LittleEndian.Uint16(msg[12:])) != CommandCancel {
+			charge := binary.LittleEndian.Uint16(msg[6:])
+			if s.dialect == DialectSmb_2_0_2 {
+				charge = 1
+			}
+			if !s.credits.consume(binary.LittleEndian.Uint64(msg[24:]), charge) {
+				return false
+			}
+		}
+		next := binary.LittleEndian.Uint32(msg[20:])
+		if next == 0 || int(next) > len(msg) {
+			break
+		}
+		msg = msg[next:]
+	}
+	return true
+}
+
+// grantCredits fills in the credits of resp, the response to data.
+func (s *SessionS) grantCredits(resp []byte, data DataI) {
+	request := uint16(1)
+	if h, ok := data.(headerI); ok {
+		request = h.GetHeader().Credits
+	}
+	binary.LittleEndian.PutUint16(resp[14:], s.credits.grant(request))
+}
+
+// checkCreditCharge makes sure a multi-credit request paid for its payload.
+func (s *SessionS) checkCreditCharge(data DataI) Status {
+	if s.dialect == DialectSmb_2_0_2 {
+		return StatusOk
+	}
+	h, ok := data.(headerI)
+	if !ok {
+		return StatusOk
+	}
+	var size uint32
+	switch req := data.(type) {
+	case *ReadRequest:
+		size = req.Length + uint32(req.ReadChannelInfoLength)
+	case *WriteRequest:
+		size = req.DataLength + uint32(req.WriteChannelInfoLength)
+	case *IOCTLRequest:
+		size = req.InputLength + req.OutputLength
+		if maxSize := req.MaxInputSize + req.MaxOutputSize; maxSize > size {
+			size = maxSize
+		}
+	case *QueryDirectoryRequest:
+		size = req.OutputBufferLength
+	default:
+		return StatusOk
+	}
+	charge := uint32(h.GetHeader().CreditCharge)
+	if charge == 0 {
+		charge = 1
+	}
+	if size > 0 && charge < 1+(size-1)/kCreditUnit {
+		return STATUS_INVALID_PARAMETER
+	}
+	return StatusOk
+}
@@ -0,0 +1,68 @@
+package smb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CreditWindow(t *testing.T) {
+	w := newCreditWindow(&CreditPolicy{Min: 1, Max: 8})
+
+	assert.Equal(t, true, w.consume(0, 1))
+	assert.Equal(t, false, w.consume(0, 1)) //used twice
+	assert.Equal(t, false, w.consume(1, 1)) //not granted yet
+
+	assert.Equal(t, uint16(4), w.grant(4))
+	assert.Equal(t, true, w.consume(3, 2)) //out of order is fine
+	assert.Equal(t, false, w.consume(4, 1))
+	assert.Equal(t, true, w.consume(1, 2))
+	assert.Equal(t, false, w.consume(5, 1))
+
+	//the window never holds more than Max
+	assert.Equal(t, uint16(8), w.grant(100))
+	assert.Equal(t, uint16(0), w.grant(1))
+	assert.Equal(t, true, w.consume(5, 8))
+	assert.Equal(t, false, w.consume(13, 1))
+
+	//nobody is left without a credit
+	assert.Equal(t, uint16(1), w.grant(0))
+
+	w = newCreditWindow(&CreditPolicy{Min: 16, Max: 64})
+	assert.Equal(t, uint16(15), w.grant(1))
+	assert.Equal(t, uint16(2), w.grant(2))
+}
+
+func Test_CreditCharge(t *testing.T) {
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_2_1
+
+	read := &ReadRequest{Length: 65536}
+	assert.Equal(t, StatusOk, session.checkCreditCharge(read))
+	read.Length = 65537
+	assert.Equal(t, STATUS_INVALID_PARAMETER, session.checkCreditCharge(read))
+	read.CreditCharge = 2
+	assert.Equal(t, StatusOk, session.checkCreditCharge(read))
+
+	write := &WriteRequest{DataLength: 1048576}
+	write.CreditCharge = 15
+	assert.Equal(t, STATUS_INVALID_PARAMETER, session.checkCreditCharge(write))
+	write.CreditCharge = 16
+	assert.Equal(t, StatusOk, session.checkCreditCharge(write))
+
+	find := &QueryDirectoryRequest{OutputBufferLength: 65536 * 3}
+	find.CreditCharge = 3
+	assert.Equal(t, StatusOk, session.checkCreditCharge(find))
+
+	ioctl := &IOCTLRequest{MaxOutputSize: 65536 * 2}
+	ioctl.CreditCharge = 1
+	assert.Equal(t, STATUS_INVALID_PARAMETER, session.checkCreditCharge(ioctl))
+
+	//SMB 2.0.2 charges no credits, a read is still bounded by MaxReadSize
+	session.dialect = DialectSmb_2_0_2
+	read = &ReadRequest{Length: kMaxTransactSize + 1}
+	assert.Equal(t, StatusOk, session.checkCreditCharge(read))
+	resp, err := read.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	assert.Equal(t, STATUS_INVALID_PARAMETER, resp.(ErrResponse).Header.Status)
+}
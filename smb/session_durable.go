@@ -0,0 +1,211 @@
+package smb
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// kDurableTimeout is how long a durable handle waits for its client when Config.DurableTimeout is zero.
+const kDurableTimeout = 60 * time.Second
+
+// durableOpen is an open that survives the loss of its connection. While the connection lives it is
+// kept by the session, once it drops the open waits in gDurableTable for a reconnect until it times out.
+type durableOpen struct {
+	guid       GUID
+	path       string
+	share      string
+	user       string
+	version    uint16 //1 for DHnQ, 2 for DH2Q
+	createGuid GUID   //set by DH2Q
+	clientGuid GUID
+	timeout    time.Duration
+
+	//what a persistent open journals to open the file again after a restart
+	access       AccessMask
+	shareAccess  ShareAccess
+	openFlags    int
+	oplock       uint8
+	lease        *leaseKey
+	leaseState   uint32
+	leaseVersion uint16
+	store        *handleStore //nil unless the open is persistent
+
+	file  webdav.File //set once disconnected
+	timer *time.Timer
+}
+
+// durableTable holds the durable opens of dropped connections, keyed by FileId.
+type durableTable struct {
+	mu    sync.Mutex
+	opens map[GUID]*durableOpen
+}
+
+var gDurableTable = &durableTable{opens: make(map[GUID]*durableOpen)}
+
+// put parks d until it is reclaimed or its timeout expires.
+func (t *durableTable) put(d *durableOpen) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.opens[d.guid] = d
+	d.timer = time.AfterFunc(d.timeout, func() { t.expire(d) })
+}
+
+// expire closes d, its locks and its oplock or lease go with it.
+func (t *durableTable) expire(d *durableOpen) {
+	t.mu.Lock()
+	if t.opens[d.guid] != d {
+		//reclaimed in the meantime
+		t.mu.Unlock()
+		return
+	}
+	delete(t.opens, d.guid)
+	t.mu.Unlock()
+	logx.Printf("durable handle of %v timed out", d.path)
+	if d.file != nil {
+		d.file.Close()
+	}
+	gShareTable.release(d.path, d.guid)
+	gLockTable.releaseOpen(d.path, d.guid)
+	gOplockTable.release(d.path, d.guid)
+	if d.store != nil {
+		d.store.remove(d.guid)
+	}
+}
+
+// rename moves the disconnected open guid to the path oldPath became, a persistent one is journaled again.
+func (t *durableTable) rename(guid GUID, oldPath, newPath string) {
+	t.mu.Lock()
+	d, ok := t.opens[guid]
+	if ok {
+		var path string
+		if path, ok = renamedPath(d.path, oldPath, newPath); ok {
+			d.path = path
+		}
+	}
+	t.mu.Unlock()
+	if ok {
+		d.journal()
+	}
+}
+
+// journal saves the disconnected open guid again when it is persistent.
+func (t *durableTable) journal(guid GUID) {
+	t.mu.Lock()
+	d := t.opens[guid]
+	t.mu.Unlock()
+	if d != nil {
+		d.journal()
+	}
+}
+
+// take removes the disconnected open fileid if match accepts it.
+func (t *durableTable) take(fileid GUID, match func(*durableOpen) bool) *durableOpen {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.opens[fileid]
+	if !ok || !match(d) {
+		return nil
+	}
+	delete(t.opens, fileid)
+	d.timer.Stop()
+	return d
+}
+
+// durableTimeout is how long an open waits for a reconnect, a DH2Q can ask for less than the server allows.
+func (s *SessionS) durableTimeout(requested uint32) time.Duration {
+	timeout := s.durableMax
+	if timeout <= 0 {
+		timeout = kDurableTimeout
+	}
+	if ms := time.Duration(requested) * time.Millisecond; ms > 0 && ms < timeout {
+		timeout = ms
+	}
+	return timeout
+}
+
+// setDurable marks the open guid durable, a persistent open is journaled.
+func (s *SessionS) setDurable(d *durableOpen) {
+	s.mu.Lock()
+	_, ok := s.openedFiles[d.guid]
+	if ok {
+		s.durable[d.guid] = d
+	}
+	s.mu.Unlock()
+	if ok {
+		d.journal()
+	}
+}
+
+// preserveDurable hands the durable opens of the session to gDurableTable, the connection dropped.
+// Their locks, oplocks and leases stay, Close then closes the other opens.
+func (s *SessionS) preserveDurable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for guid, d := range s.durable {
+		delete(s.durable, guid)
+		file, ok := s.openedFiles[guid]
+		if !ok {
+			continue
+		}
+		delete(s.openedFiles, guid)
+		delete(s.filePaths, guid)
+		delete(s.fileTrees, guid)
+		delete(s.fileModes, guid)
+		delete(s.quotaScans, guid)
+		delete(s.eaScans, guid)
+		s.cleanupNotify(guid)
+		if w, ok := s.watches[guid]; ok {
+			delete(s.watches, guid)
+			w.stop()
+		}
+		d.file = file
+		gDurableTable.put(d)
+	}
+}
+
+// reclaimDurable reconnects the durable open fileid to tree, the client lost its previous connection.
+// A v2 open is only given back with its CreateGuid.
+func (s *SessionS) reclaimDurable(fileid GUID, createGuid *GUID, tree *TreeS, path string) *durableOpen {
+	d := gDurableTable.take(fileid, func(d *durableOpen) bool {
+		if d.user != s.userName || !strings.EqualFold(d.share, tree.anchor.Name) || d.path != path {
+			return false
+		}
+		if createGuid != nil {
+			return d.version == 2 && d.createGuid == *createGuid
+		}
+		return d.version == 1
+	})
+	if d == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.openedFiles[d.guid] = d.file
+	s.filePaths[d.guid] = d.path
+	s.fileTrees[d.guid] = tree.id
+	s.durable[d.guid] = d
+	s.mu.Unlock()
+	d.file = nil
+	gShareTable.reclaim(d.path, d.guid, s)
+	return d
+}
+
+// fileTree is the tree the open guid belongs to, a reclaimed durable open keeps the FileId of its old
+// tree. s.mu is held.
+func (s *SessionS) fileTree(guid GUID) uint32 {
+	if tid, ok := s.fileTrees[guid]; ok {
+		return tid
+	}
+	return guid.treeId()
+}
+
+// openTree is the tree the open guid belongs to, nil when the tree is gone.
+func (s *SessionS) openTree(guid GUID) *TreeS {
+	s.mu.Lock()
+	tid := s.fileTree(guid)
+	s.mu.Unlock()
+	return s.GetTree(tid)
+}
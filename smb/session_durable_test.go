@@ -0,0 +1,191 @@
+package smb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDurableSession is a session of user on a 3.1.1 connection with the share dir connected.
+func testDurableSession(dir string, anchor *Anchor) (*SessionS, *TreeS) {
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_3_1_1
+	session.clientGuid = make([]byte, 16)
+	session.userName = "user"
+	if anchor == nil {
+		anchor = NewAnchor("share", dir)
+	}
+	return session, session.TreeConnect(anchor)
+}
+
+// testCreate sends the CREATE req on the tree with the create contexts ctxs, it returns the response
+// and the create contexts it answered with.
+func testCreate(t *testing.T, session *SessionS, tree *TreeS, req CreateRequest, ctxs ...createContext) (interface{}, []createContext) {
+	buf, err := marshalCreateContexts(ctxs)
+	assert.Nil(t, err)
+	req.Header = Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandCreate, TreeID: tree.id}
+	req.StructureSize = 57
+	req.CreateContexts = buf
+	resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	if resp, ok := resp.(CreateResponse); ok {
+		ctxs, err := parseCreateContexts(resp.CreateContexts)
+		assert.Nil(t, err)
+		return resp, ctxs
+	}
+	return resp, nil
+}
+
+// testOpen is a CREATE of name with access, disposition and options that shares the file with the
+// other opens.
+func testOpen(name string, access AccessMask, disposition CreateDisposition, options CreateOptions) CreateRequest {
+	return CreateRequest{
+		AccessMask:        access,
+		ShareAccess:       FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition: disposition,
+		CreateOptions:     options,
+		Filename:          encoder.ToUnicode(name),
+	}
+}
+
+// testOpenA opens a.txt to read and write with the oplock.
+func testOpenA(oplock uint8) CreateRequest {
+	req := testOpen("a.txt", FILE_READ_DATA|FILE_WRITE_DATA, FILE_OPEN, 0)
+	req.OpLock = oplock
+	return req
+}
+
+// testResponse is the response of a CREATE testCreate sent, or the status the CREATE failed with.
+func testResponse(resp interface{}, _ []createContext) (CreateResponse, Status) {
+	if resp, ok := resp.(CreateResponse); ok {
+		return resp, StatusOk
+	}
+	return CreateResponse{}, resp.(ErrResponse).Header.Status
+}
+
+// testFileId is the FileId of the response of a CREATE, or the status the CREATE failed with.
+func testFileId(resp interface{}, ctxs []createContext) (GUID, Status) {
+	created, stat := testResponse(resp, ctxs)
+	return created.FileId, stat
+}
+
+// testSetInfo sends the SET_INFO req on the tree with info as its buffer, a file information class
+// when req has no InfoType. Buffers that are no structure are passed as []byte. It returns the status.
+func testSetInfo(t *testing.T, session *SessionS, tree *TreeS, req SetInfoRequest, info interface{}) Status {
+	switch info := info.(type) {
+	case []byte:
+		req.Buffer = info
+	case *SecurityDescriptor:
+		req.Buffer = info.Marshal()
+	default:
+		buf, err := encoder.Marshal(info)
+		assert.Nil(t, err)
+		req.Buffer = buf
+	}
+	if req.InfoType == 0 {
+		req.InfoType = SMB2_0_INFO_FILE
+	}
+	req.Header = Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandSetInfo, TreeID: tree.id}
+	req.StructureSize = 33
+	resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	if resp, ok := resp.(ErrResponse); ok {
+		return resp.Header.Status
+	}
+	return StatusOk
+}
+
+func Test_DurableHandle(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0666))
+	path := filepath.Join(dir, "a.txt")
+	lease, _ := encoder.Marshal(&SMB2_CREATE_REQUEST_LEASE_V2{LeaseKey: makeGUID(9, 1), LeaseState: kLeaseR | kLeaseH})
+	durable, _ := encoder.Marshal(&SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2{CreateGuid: makeGUID(7, 1)})
+
+	//a lease with handle caching makes the handle durable
+	session, tree := testDurableSession(dir, nil)
+	resp, ctxs := testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_LEASE),
+		createContext{tag: SMB2_CREATE_RESPONSE_LEASE_TAG, data: lease},
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG, data: durable})
+	guid := resp.(CreateResponse).FileId
+	var granted SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2
+	assert.Nil(t, encoder.Unmarshal(findCreateContext(ctxs, SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG), &granted))
+	assert.Equal(t, uint32(kDurableTimeout/time.Millisecond), granted.Timeout)
+
+	//the connection drops, the open and its lease wait for the client
+	session.preserveDurable()
+	session.Close()
+	gDurableTable.mu.Lock()
+	_, parked := gDurableTable.opens[guid]
+	gDurableTable.mu.Unlock()
+	assert.True(t, parked)
+	gOplockTable.mu.Lock()
+	_, leased := gOplockTable.files[path]
+	gOplockTable.mu.Unlock()
+	assert.True(t, leased)
+
+	//only the CreateGuid of the open reclaims it
+	session, tree = testDurableSession(dir, nil)
+	reconnect := func(createGuid GUID) (interface{}, []createContext) {
+		buf, _ := encoder.Marshal(&SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2{FileId: guid, CreateGuid: createGuid})
+		return testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_LEASE),
+			createContext{tag: SMB2_CREATE_RESPONSE_LEASE_TAG, data: lease},
+			createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2_TAG, data: buf})
+	}
+	resp, _ = reconnect(makeGUID(7, 2))
+	assert.Equal(t, STATUS_OBJECT_NAME_NOT_FOUND, resp.(ErrResponse).Header.Status)
+	resp, ctxs = reconnect(makeGUID(7, 1))
+	assert.Equal(t, guid, resp.(CreateResponse).FileId)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_LEASE, resp.(CreateResponse).Oplock)
+	assert.NotNil(t, findCreateContext(ctxs, SMB2_CREATE_RESPONSE_LEASE_TAG))
+	_, ok := session.GetFile(guid)
+	assert.True(t, ok)
+
+	//the reclaimed open belongs to the new tree
+	assert.True(t, session.TreeDisconnect(tree.id))
+	_, ok = session.GetFile(guid)
+	assert.False(t, ok)
+
+	//a durable handle nobody reclaims is closed with its oplock
+	session, tree = testDurableSession(dir, nil)
+	session.durableMax = 50 * time.Millisecond
+	resp, ctxs = testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_BATCH),
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG, data: make([]byte, kDurableRequestSize)})
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_BATCH, resp.(CreateResponse).Oplock)
+	assert.NotNil(t, findCreateContext(ctxs, SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG))
+	session.preserveDurable()
+	session.Close()
+	time.Sleep(200 * time.Millisecond)
+	gDurableTable.mu.Lock()
+	assert.Equal(t, 0, len(gDurableTable.opens))
+	gDurableTable.mu.Unlock()
+	gOplockTable.mu.Lock()
+	_, leased = gOplockTable.files[path]
+	gOplockTable.mu.Unlock()
+	assert.False(t, leased)
+
+	//a LOGOFF closes the durable handle, the end of the connection has nothing left to park
+	session, tree = testDurableSession(dir, nil)
+	resp, _ = testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_BATCH),
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_TAG, data: make([]byte, kDurableRequestSize)})
+	guid = resp.(CreateResponse).FileId
+	logoff := LogoffRequest{Header: Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandLogoff}, StructureSize: 4}
+	out, err := logoff.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	assert.Equal(t, StatusOk, out.(*LogoffResponse).Header.Status)
+	_, ok = session.GetFile(guid)
+	assert.False(t, ok)
+	session.preserveDurable()
+	gDurableTable.mu.Lock()
+	assert.Equal(t, 0, len(gDurableTable.opens))
+	gDurableTable.mu.Unlock()
+	gOplockTable.mu.Lock()
+	_, leased = gOplockTable.files[path]
+	gOplockTable.mu.Unlock()
+	assert.False(t, leased)
+}
@@ -0,0 +1,228 @@
+package smb
+
+import (
+	"sync"
+)
+
+// byteRangeLock is a range locked through the open with FileId open.
+type byteRangeLock struct {
+	open      GUID
+	offset    uint64
+	length    uint64
+	exclusive bool
+}
+
+func (l *byteRangeLock) end() uint64 {
+	return l.offset + l.length
+}
+
+// overlaps follows MS-FSA, a zero length range only meets the inside of another range.
+func (l *byteRangeLock) overlaps(offset, length uint64) bool {
+	switch {
+	case l.length == 0 && length == 0:
+		return false
+	case l.length == 0:
+		return l.offset > offset && l.offset < offset+length
+	case length == 0:
+		return offset > l.offset && offset < l.end()
+	}
+	return offset < l.end() && l.offset < offset+length
+}
+
+// fileLocks are the locks of one file, every open of it on every connection shares them.
+type fileLocks struct {
+	locks   []byteRangeLock
+	changed chan struct{} //closed when a lock is released, blocked LOCK requests try again
+}
+
+// lockTable holds the byte range locks of the server, the key is the absolute path of the file.
+type lockTable struct {
+	mu    sync.Mutex
+	files map[string]*fileLocks
+}
+
+var gLockTable = &lockTable{files: make(map[string]*fileLocks)}
+
+func (t *lockTable) file(path string) *fileLocks {
+	f, ok := t.files[path]
+	if !ok {
+		f = &fileLocks{changed: make(chan struct{})}
+		t.files[path] = f
+	}
+	return f
+}
+
+// released wakes up the waiters of f and drops it once it is unused, t.mu is held.
+func (t *lockTable) released(path string, f *fileLocks) {
+	close(f.changed)
+	f.changed = make(chan struct{})
+	if len(f.locks) == 0 {
+		delete(t.files, path)
+	}
+}
+
+// conflicts tells if a new lock of open collides with the existing ones.
+func (f *fileLocks) conflicts(open GUID, offset, length uint64, exclusive bool) bool {
+	for i := range f.locks {
+		l := &f.locks[i]
+		if !l.overlaps(offset, length) {
+			continue
+		}
+		if exclusive || (l.exclusive && l.open != open) {
+			return true
+		}
+	}
+	return false
+}
+
+// lock takes every range of elems or none of them. A conflict returns STATUS_LOCK_NOT_GRANTED
+// and a channel that is closed the next time a lock of the file is released.
+func (t *lockTable) lock(path string, open GUID, elems []LockElement) (Status, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.file(path)
+	n := len(f.locks)
+	for _, e := range elems {
+		if e.Length > 0 && e.Offset+e.Length-1 < e.Offset {
+			f.locks = f.locks[:n]
+			return STATUS_INVALID_LOCK_RANGE, nil
+		}
+		exclusive := e.Flags&SMB2_LOCKFLAG_EXCLUSIVE_LOCK != 0
+		if f.conflicts(open, e.Offset, e.Length, exclusive) {
+			f.locks = f.locks[:n]
+			return STATUS_LOCK_NOT_GRANTED, f.changed
+		}
+		f.locks = append(f.locks, byteRangeLock{open: open, offset: e.Offset, length: e.Length, exclusive: exclusive})
+	}
+	return StatusOk, nil
+}
+
+// unlock releases the ranges of elems in order, each one must match a lock of open exactly.
+func (t *lockTable) unlock(path string, open GUID, elems []LockElement) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return STATUS_RANGE_NOT_LOCKED
+	}
+	stat := StatusOk
+	released := false
+	for _, e := range elems {
+		found := -1
+		for i := range f.locks {
+			l := &f.locks[i]
+			if l.open == open && l.offset == e.Offset && l.length == e.Length {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			stat = STATUS_RANGE_NOT_LOCKED
+			break
+		}
+		f.locks = append(f.locks[:found], f.locks[found+1:]...)
+		released = true
+	}
+	if released {
+		t.released(path, f)
+	}
+	return stat
+}
+
+// releaseOpen drops every lock of open, it is called when the open goes away.
+func (t *lockTable) releaseOpen(path string, open GUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return
+	}
+	locks := f.locks[:0]
+	for _, l := range f.locks {
+		if l.open != open {
+			locks = append(locks, l)
+		}
+	}
+	if len(locks) == len(f.locks) {
+		return
+	}
+	f.locks = locks
+	t.released(path, f)
+}
+
+// locksOf lists the locks open holds on path.
+func (t *lockTable) locksOf(path string, open GUID) []byteRangeLock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return nil
+	}
+	var locks []byteRangeLock
+	for _, l := range f.locks {
+		if l.open == open {
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// restore puts back the journaled locks of a persistent open, they were granted before a restart.
+func (t *lockTable) restore(path string, locks []byteRangeLock) {
+	if len(locks) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.file(path)
+	f.locks = append(f.locks, locks...)
+}
+
+// rename moves the locks of oldPath and of the files below it to newPath.
+func (t *lockTable) rename(oldPath, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	moved := make(map[string]*fileLocks)
+	for path, f := range t.files {
+		if to, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(t.files, path)
+			moved[to] = f
+		}
+	}
+	for path, f := range moved {
+		t.files[path] = f
+	}
+}
+
+// ioConflict tells if open may not read (or write) the range, MS-FSA 2.1.4.10.
+// Exclusive locks of other opens block both, shared locks block every writer.
+func (t *lockTable) ioConflict(path string, open GUID, offset, length uint64, write bool) bool {
+	if length == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return false
+	}
+	for i := range f.locks {
+		l := &f.locks[i]
+		if !l.overlaps(offset, length) {
+			continue
+		}
+		if (l.exclusive && l.open != open) || (!l.exclusive && write) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockConflict checks a READ or WRITE of the open fileid against the byte range locks.
+func (s *SessionS) lockConflict(fileid GUID, offset, length uint64, write bool) bool {
+	path := s.FilePath(fileid)
+	if path == "" {
+		return false
+	}
+	return gLockTable.ioConflict(path, fileid, offset, length, write)
+}
@@ -0,0 +1,129 @@
+package smb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LockTable(t *testing.T) {
+	table := &lockTable{files: make(map[string]*fileLocks)}
+	open1, open2 := makeGUID(1, 1), makeGUID(1, 2)
+	shared := []LockElement{{Offset: 0, Length: 10, Flags: SMB2_LOCKFLAG_SHARED_LOCK}}
+	exclusive := []LockElement{{Offset: 5, Length: 10, Flags: SMB2_LOCKFLAG_EXCLUSIVE_LOCK}}
+
+	stat, _ := table.lock("/f", open1, shared)
+	assert.Equal(t, StatusOk, stat)
+	stat, _ = table.lock("/f", open2, shared)
+	assert.Equal(t, StatusOk, stat)
+	stat, changed := table.lock("/f", open2, exclusive)
+	assert.Equal(t, STATUS_LOCK_NOT_GRANTED, stat)
+
+	//shared locks stop every writer, readers go on
+	assert.True(t, table.ioConflict("/f", open1, 0, 1, true))
+	assert.False(t, table.ioConflict("/f", open1, 0, 1, false))
+	assert.False(t, table.ioConflict("/f", open1, 10, 1, true))
+
+	assert.Equal(t, STATUS_RANGE_NOT_LOCKED, table.unlock("/f", open1, []LockElement{{Offset: 0, Length: 5}}))
+	assert.Equal(t, StatusOk, table.unlock("/f", open1, shared))
+	<-changed
+	table.releaseOpen("/f", open2)
+	assert.Equal(t, 0, len(table.files))
+
+	//a multi lock request is all or nothing
+	stat, _ = table.lock("/f", open1, []LockElement{
+		{Offset: 0, Length: 10, Flags: SMB2_LOCKFLAG_EXCLUSIVE_LOCK},
+		{Offset: 5, Length: 1, Flags: SMB2_LOCKFLAG_EXCLUSIVE_LOCK},
+	})
+	assert.Equal(t, STATUS_LOCK_NOT_GRANTED, stat)
+	assert.Equal(t, 0, len(table.files["/f"].locks))
+
+	//exclusive locks stop the other opens only
+	stat, _ = table.lock("/f", open1, exclusive)
+	assert.Equal(t, StatusOk, stat)
+	assert.False(t, table.ioConflict("/f", open1, 0, 10, true))
+	assert.True(t, table.ioConflict("/f", open2, 0, 10, false))
+
+	stat, _ = table.lock("/f", open2, []LockElement{{Offset: ^uint64(0), Length: 2, Flags: SMB2_LOCKFLAG_SHARED_LOCK}})
+	assert.Equal(t, STATUS_INVALID_LOCK_RANGE, stat)
+}
+
+func Test_LockCheckFlags(t *testing.T) {
+	check := func(flags ...uint32) Status {
+		req := &LockRequest{}
+		for _, f := range flags {
+			req.Locks = append(req.Locks, LockElement{Flags: f})
+		}
+		_, _, stat := req.checkFlags()
+		return stat
+	}
+	assert.Equal(t, StatusOk, check(SMB2_LOCKFLAG_EXCLUSIVE_LOCK))
+	assert.Equal(t, StatusOk, check(SMB2_LOCKFLAG_UNLOCK, SMB2_LOCKFLAG_UNLOCK))
+	assert.Equal(t, StatusOk, check(SMB2_LOCKFLAG_SHARED_LOCK|SMB2_LOCKFLAG_FAIL_IMMEDIATELY, SMB2_LOCKFLAG_EXCLUSIVE_LOCK|SMB2_LOCKFLAG_FAIL_IMMEDIATELY))
+	assert.Equal(t, STATUS_INVALID_PARAMETER, check())
+	assert.Equal(t, STATUS_INVALID_PARAMETER, check(SMB2_LOCKFLAG_SHARED_LOCK, SMB2_LOCKFLAG_SHARED_LOCK))
+	assert.Equal(t, STATUS_INVALID_PARAMETER, check(SMB2_LOCKFLAG_SHARED_LOCK|SMB2_LOCKFLAG_EXCLUSIVE_LOCK))
+	assert.Equal(t, STATUS_INVALID_PARAMETER, check(SMB2_LOCKFLAG_UNLOCK, SMB2_LOCKFLAG_SHARED_LOCK))
+}
+
+func Test_LockWait(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	session := NewSessionServer(true, srv, nil, nil)
+	session.startWriter(bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)))
+	defer session.stopWriter()
+
+	path := "/lockwait/file"
+	holder, waiter := makeGUID(1, 1), makeGUID(1, 2)
+	session.PutFile(holder, ipc_file, path)
+	session.PutFile(waiter, ipc_file, path)
+	stat, _ := gLockTable.lock(path, holder, []LockElement{{Offset: 0, Length: 100, Flags: SMB2_LOCKFLAG_EXCLUSIVE_LOCK}})
+	assert.Equal(t, StatusOk, stat)
+	assert.True(t, session.lockConflict(waiter, 10, 10, false))
+
+	req := LockRequest{
+		Header: Header{
+			ProtocolID:   []byte(ProtocolSmb2),
+			HeaderLength: 64,
+			Command:      CommandLock,
+			MessageID:    9,
+			SessionID:    session.sessionID,
+			Signature:    make([]byte, 16),
+		},
+		StructureSize: 48,
+		LockCount:     1,
+		FileId:        waiter,
+		Locks:         LockElements{{Offset: 50, Length: 10, Flags: SMB2_LOCKFLAG_SHARED_LOCK}},
+	}
+	msg, err := encoder.Marshal(&req)
+	assert.Nil(t, err)
+
+	ctx := NewDataCtx(session, srv, nil)
+	ctx.op = session.beginOp(msg, false)
+	go func() {
+		defer session.endOp(ctx.op)
+		respBuf, _, _ := ActionFunc(ctx, msg)
+		session.SendAsync(respBuf)
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(cli), bufio.NewWriter(cli))
+	interim, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(STATUS_PENDING), binary.LittleEndian.Uint32(interim[8:]))
+
+	//closing the holder releases its locks
+	session.DelFile(holder)
+	final, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(StatusOk), binary.LittleEndian.Uint32(final[8:]))
+	assert.True(t, gLockTable.ioConflict(path, holder, 55, 1, true))
+	assert.False(t, gLockTable.ioConflict(path, holder, 55, 1, false))
+
+	session.DelFile(waiter)
+	assert.False(t, gLockTable.ioConflict(path, holder, 55, 1, true))
+}
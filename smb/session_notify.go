@@ -0,0 +1,406 @@
+package smb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// FILE_NOTIFY_INFORMATION actions
+const (
+	FILE_ACTION_ADDED            uint32 = 0x00000001
+	FILE_ACTION_REMOVED          uint32 = 0x00000002
+	FILE_ACTION_MODIFIED         uint32 = 0x00000003
+	FILE_ACTION_RENAMED_OLD_NAME uint32 = 0x00000004
+	FILE_ACTION_RENAMED_NEW_NAME uint32 = 0x00000005
+
+	//kNotifyOverflow is no action, the watcher lost changes and the client has to enumerate again
+	kNotifyOverflow uint32 = 0
+)
+
+// kNotifyBufferMax bounds the changes an open keeps between two CHANGE_NOTIFY requests.
+const kNotifyBufferMax = 64 * 1024
+
+// notifyPollInterval is how often the polling watcher scans, file systems other than webdav.Dir use it.
+var notifyPollInterval = 2 * time.Second
+
+var errNotifyUnsupported = errors.New("smb: file system watching not supported")
+
+// notifyEvent is one change under a watched directory, name is relative to it and uses slashes.
+type notifyEvent struct {
+	action uint32
+	name   string
+	filter CompletionFilter //the CompletionFilter bits the change matches
+}
+
+func nameFilter(isDir bool) CompletionFilter {
+	if isDir {
+		return FILE_NOTIFY_CHANGE_DIR_NAME
+	}
+	return FILE_NOTIFY_CHANGE_FILE_NAME
+}
+
+// notifySize is the size of the FILE_NOTIFY_INFORMATION entry of e, 4 byte aligned.
+func notifySize(e *notifyEvent) int {
+	return (12 + len(encoder.ToUnicode(e.name)) + 3) &^ 3
+}
+
+// encodeNotify builds the FILE_NOTIFY_INFORMATION list of a CHANGE_NOTIFY response.
+func encodeNotify(events []notifyEvent) []byte {
+	var buf []byte
+	for i := range events {
+		name := encoder.ToUnicode(strings.ReplaceAll(events[i].name, "/", "\\"))
+		entry := make([]byte, notifySize(&events[i]))
+		if i != len(events)-1 {
+			binary.LittleEndian.PutUint32(entry, uint32(len(entry)))
+		}
+		binary.LittleEndian.PutUint32(entry[4:], events[i].action)
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(name)))
+		copy(entry[12:], name)
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+// notifyWatch collects the changes of one directory open, from its first CHANGE_NOTIFY until it is closed.
+type notifyWatch struct {
+	filter   CompletionFilter
+	shared   *sharedWatch
+	onChange func([]notifyEvent) //takes the changes instead of collecting them, runs with the hub locked
+
+	mu       sync.Mutex
+	events   []notifyEvent
+	size     int
+	overflow bool
+	changed  chan struct{} //closed when a change is added, a waiting CHANGE_NOTIFY completes
+}
+
+// add keeps the events the filter asks for, a file modified twice is reported once.
+func (w *notifyWatch) add(events []notifyEvent) {
+	if w.onChange != nil {
+		var matched []notifyEvent
+		for _, e := range events {
+			if e.action == kNotifyOverflow || e.filter&w.filter != 0 {
+				matched = append(matched, e)
+			}
+		}
+		if len(matched) > 0 {
+			w.onChange(matched)
+		}
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	added := false
+	for _, e := range events {
+		if e.action != kNotifyOverflow && e.filter&w.filter == 0 {
+			continue
+		}
+		added = true
+		if w.overflow {
+			continue
+		}
+		if e.action == kNotifyOverflow || w.size+notifySize(&e) > kNotifyBufferMax {
+			w.overflow = true
+			w.events, w.size = nil, 0
+			continue
+		}
+		if w.coalesce(&e) {
+			continue
+		}
+		w.events = append(w.events, e)
+		w.size += notifySize(&e)
+	}
+	if added {
+		close(w.changed)
+		w.changed = make(chan struct{})
+	}
+}
+
+// coalesce tells if e repeats a change that is already waiting, w.mu is held.
+func (w *notifyWatch) coalesce(e *notifyEvent) bool {
+	if n := len(w.events); n > 0 && w.events[n-1].action == e.action && w.events[n-1].name == e.name {
+		return true
+	}
+	if e.action != FILE_ACTION_MODIFIED {
+		return false
+	}
+	for i := range w.events {
+		if w.events[i].action == FILE_ACTION_MODIFIED && w.events[i].name == e.name {
+			return true
+		}
+	}
+	return false
+}
+
+// take hands the waiting changes to a CHANGE_NOTIFY with an output buffer of max bytes. When nothing
+// waits it returns the channel that is closed on the next change. Changes that do not fit are dropped
+// and the client is told to enumerate the directory with STATUS_NOTIFY_ENUM_DIR.
+func (w *notifyWatch) take(max uint32) (buf []byte, stat Status, changed <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.overflow || w.size > int(max) {
+		w.overflow = false
+		w.events, w.size = nil, 0
+		return nil, STATUS_NOTIFY_ENUM_DIR, nil
+	}
+	if len(w.events) == 0 {
+		return nil, StatusOk, w.changed
+	}
+	buf = encodeNotify(w.events)
+	w.events, w.size = nil, 0
+	return buf, StatusOk, nil
+}
+
+// stop detaches w from its directory watcher.
+func (w *notifyWatch) stop() {
+	gWatchHub.unsubscribe(w)
+}
+
+// dirWatcher watches a directory, and its subtree when asked, until it is closed.
+type dirWatcher interface {
+	Close() error
+}
+
+type watchKey struct {
+	fs   webdav.FileSystem
+	dir  string
+	tree bool
+}
+
+// sharedWatch is the watcher of a directory, every open watching the directory the same way shares it.
+type sharedWatch struct {
+	key     watchKey
+	backend dirWatcher
+	subs    map[*notifyWatch]struct{}
+}
+
+type watchHub struct {
+	mu      sync.Mutex
+	watches map[watchKey]*sharedWatch
+}
+
+var gWatchHub = &watchHub{watches: make(map[watchKey]*sharedWatch)}
+
+// subscribe starts to collect the changes of dir that match filter, or to hand them to onChange.
+func (h *watchHub) subscribe(fsys webdav.FileSystem, dir string, tree bool, filter CompletionFilter, onChange func([]notifyEvent)) (*notifyWatch, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := watchKey{fs: fsys, dir: dir, tree: tree}
+	sw, ok := h.watches[key]
+	if !ok {
+		sw = &sharedWatch{key: key, subs: make(map[*notifyWatch]struct{})}
+		backend, err := newDirWatcher(fsys, dir, tree, func(events []notifyEvent) {
+			h.emit(sw, events)
+		})
+		if err != nil {
+			return nil, err
+		}
+		sw.backend = backend
+		h.watches[key] = sw
+	}
+	w := &notifyWatch{filter: filter, shared: sw, onChange: onChange, changed: make(chan struct{})}
+	sw.subs[w] = struct{}{}
+	return w, nil
+}
+
+func (h *watchHub) emit(sw *sharedWatch, events []notifyEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range sw.subs {
+		w.add(events)
+	}
+}
+
+func (h *watchHub) unsubscribe(w *notifyWatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sw := w.shared
+	delete(sw.subs, w)
+	if len(sw.subs) == 0 && h.watches[sw.key] == sw {
+		delete(h.watches, sw.key)
+		sw.backend.Close()
+	}
+}
+
+// newDirWatcher uses inotify for directories of a webdav.Dir and polls any other file system.
+func newDirWatcher(fsys webdav.FileSystem, dir string, tree bool, emit func([]notifyEvent)) (dirWatcher, error) {
+	if d, ok := diskDir(fsys); ok {
+		w, err := newInotifyWatcher(dirPath(d, dir), tree, emit)
+		if err == nil {
+			return w, nil
+		}
+		if err != errNotifyUnsupported {
+			return nil, err
+		}
+	}
+	return newPollWatcher(fsys, dir, tree, emit)
+}
+
+// dirPath is the path d opens for name, the way webdav.Dir resolves it.
+func dirPath(d webdav.Dir, name string) string {
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// pollEntry is what the polling watcher remembers of a file.
+type pollEntry struct {
+	isDir   bool
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+type pollWatcher struct {
+	done chan struct{}
+}
+
+func newPollWatcher(fsys webdav.FileSystem, dir string, tree bool, emit func([]notifyEvent)) (dirWatcher, error) {
+	last, err := pollSnapshot(fsys, dir, tree)
+	if err != nil {
+		return nil, err
+	}
+	w := &pollWatcher{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(notifyPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+			}
+			next, err := pollSnapshot(fsys, dir, tree)
+			if err != nil {
+				continue
+			}
+			if events := pollDiff(last, next); len(events) > 0 {
+				emit(events)
+			}
+			last = next
+		}
+	}()
+	return w, nil
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+// pollSnapshot lists dir, and every directory below it for a tree watch.
+func pollSnapshot(fsys webdav.FileSystem, dir string, tree bool) (map[string]pollEntry, error) {
+	snap := make(map[string]pollEntry)
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		f, err := fsys.OpenFile(context.Background(), path.Join(dir, rel), os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			if storeEntry(fi.Name()) {
+				continue
+			}
+			name := path.Join(rel, fi.Name())
+			snap[name] = pollEntry{isDir: fi.IsDir(), size: fi.Size(), mode: fi.Mode(), modTime: fi.ModTime()}
+			if tree && fi.IsDir() {
+				//a directory going away while walking is the next scan's business
+				walk(name)
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// pollDiff turns two snapshots into changes, polling can not see renames, they are a remove and an add.
+func pollDiff(last, next map[string]pollEntry) []notifyEvent {
+	var events []notifyEvent
+	for _, name := range sortedNames(last) {
+		if _, ok := next[name]; !ok {
+			events = append(events, notifyEvent{FILE_ACTION_REMOVED, name, nameFilter(last[name].isDir)})
+		}
+	}
+	for _, name := range sortedNames(next) {
+		e, old := next[name], last[name]
+		if _, ok := last[name]; !ok {
+			events = append(events, notifyEvent{FILE_ACTION_ADDED, name, nameFilter(e.isDir)})
+			continue
+		}
+		var filter CompletionFilter
+		if e.mode != old.mode {
+			filter |= FILE_NOTIFY_CHANGE_ATTRIBUTES
+		}
+		if !e.isDir && e.size != old.size {
+			filter |= FILE_NOTIFY_CHANGE_SIZE
+		}
+		if !e.modTime.Equal(old.modTime) {
+			filter |= FILE_NOTIFY_CHANGE_LAST_WRITE
+		}
+		if filter != 0 {
+			events = append(events, notifyEvent{FILE_ACTION_MODIFIED, name, filter})
+		}
+	}
+	return events
+}
+
+func sortedNames(snap map[string]pollEntry) []string {
+	names := make([]string, 0, len(snap))
+	for name := range snap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// watchDir returns the watch of the directory open guid, the first CHANGE_NOTIFY starts it.
+func (s *SessionS) watchDir(guid GUID, fsys webdav.FileSystem, dir string, tree bool, filter CompletionFilter) (*notifyWatch, Status) {
+	s.mu.Lock()
+	w, ok := s.watches[guid]
+	s.mu.Unlock()
+	if ok {
+		return w, StatusOk
+	}
+
+	w, err := gWatchHub.subscribe(fsys, dir, tree, filter, nil)
+	if err != nil {
+		logx.Warnf("watch %v, err: %v", dir, err)
+		return nil, STATUS_NOT_SUPPORTED
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.openedFiles[guid]; !ok {
+		w.stop()
+		return nil, STATUS_FILE_CLOSED
+	}
+	if old, ok := s.watches[guid]; ok {
+		w.stop()
+		return old, StatusOk
+	}
+	s.watches[guid] = w
+	return w, StatusOk
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+package smb
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatcher watches a directory with inotify, a tree watch adds a watch for every directory below it.
+type inotifyWatcher struct {
+	file *os.File
+	fd   int
+	root string
+	tree bool
+	emit func([]notifyEvent)
+	dirs map[int32]string //watch descriptor to the directory relative to root, only the reader goroutine uses it once started
+}
+
+func newInotifyWatcher(root string, tree bool, emit func([]notifyEvent)) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{fd: fd, root: root, tree: tree, emit: emit, dirs: make(map[int32]string)}
+	if err := w.add(""); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	//a non blocking descriptor goes to the runtime poller, Close wakes up the pending Read
+	w.file = os.NewFile(uintptr(fd), "inotify")
+	go w.loop()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+// add watches the directory rel and, for a tree watch, the directories below it.
+func (w *inotifyWatcher) add(rel string) error {
+	dir := filepath.Join(w.root, filepath.FromSlash(rel))
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[int32(wd)] = rel
+	if !w.tree {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			w.add(path.Join(rel, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// remove drops the watches of the directory rel and the directories below it, it was moved away.
+func (w *inotifyWatcher) remove(rel string) {
+	for wd, dir := range w.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) loop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		if events := w.parse(buf[:n]); len(events) > 0 {
+			w.emit(events)
+		}
+	}
+}
+
+// parse turns a read of inotify events into changes. A move within the watched directories is a rename,
+// a move in or out of them is an add or a remove.
+func (w *inotifyWatcher) parse(buf []byte) []notifyEvent {
+	var events []notifyEvent
+	movedFrom := make(map[uint32]int) //cookie to the index of the RENAMED_OLD_NAME event
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameStart := off + syscall.SizeofInotifyEvent
+		off = nameStart + int(raw.Len)
+		if off > len(buf) {
+			break
+		}
+		mask := raw.Mask
+		if mask&syscall.IN_Q_OVERFLOW != 0 {
+			events = append(events, notifyEvent{action: kNotifyOverflow})
+			continue
+		}
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, raw.Wd)
+			continue
+		}
+		dir, ok := w.dirs[raw.Wd]
+		name := strings.TrimRight(string(buf[nameStart:off]), "\x00")
+		if !ok || name == "" {
+			continue
+		}
+		name = path.Join(dir, name)
+		isDir := mask&syscall.IN_ISDIR != 0
+
+		switch {
+		case mask&syscall.IN_CREATE != 0:
+			events = append(events, notifyEvent{FILE_ACTION_ADDED, name, nameFilter(isDir)})
+			if isDir && w.tree {
+				w.add(name)
+			}
+		case mask&syscall.IN_DELETE != 0:
+			events = append(events, notifyEvent{FILE_ACTION_REMOVED, name, nameFilter(isDir)})
+		case mask&syscall.IN_MOVED_FROM != 0:
+			movedFrom[raw.Cookie] = len(events)
+			events = append(events, notifyEvent{FILE_ACTION_RENAMED_OLD_NAME, name, nameFilter(isDir)})
+			if isDir && w.tree {
+				w.remove(name)
+			}
+		case mask&syscall.IN_MOVED_TO != 0:
+			action := FILE_ACTION_ADDED
+			if _, ok := movedFrom[raw.Cookie]; ok {
+				delete(movedFrom, raw.Cookie)
+				action = FILE_ACTION_RENAMED_NEW_NAME
+			}
+			events = append(events, notifyEvent{action, name, nameFilter(isDir)})
+			if isDir && w.tree {
+				w.add(name)
+			}
+		case mask&syscall.IN_MODIFY != 0:
+			events = append(events, notifyEvent{FILE_ACTION_MODIFIED, name, FILE_NOTIFY_CHANGE_SIZE | FILE_NOTIFY_CHANGE_LAST_WRITE})
+		case mask&syscall.IN_ATTRIB != 0:
+			events = append(events, notifyEvent{FILE_ACTION_MODIFIED, name, FILE_NOTIFY_CHANGE_ATTRIBUTES |
+				FILE_NOTIFY_CHANGE_LAST_WRITE | FILE_NOTIFY_CHANGE_LAST_ACCESS | FILE_NOTIFY_CHANGE_EA | FILE_NOTIFY_CHANGE_SECURITY})
+		}
+	}
+	//moved out of the watched directories
+	for _, i := range movedFrom {
+		events[i].action = FILE_ACTION_REMOVED
+	}
+	return events
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package smb
+
+// newInotifyWatcher has no native backend here, the polling watcher is used instead.
+func newInotifyWatcher(root string, tree bool, emit func([]notifyEvent)) (dirWatcher, error) {
+	return nil, errNotifyUnsupported
+}
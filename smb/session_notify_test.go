@@ -0,0 +1,229 @@
+package smb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func Test_NotifyWatch(t *testing.T) {
+	w := &notifyWatch{filter: FILE_NOTIFY_CHANGE_FILE_NAME | FILE_NOTIFY_CHANGE_SIZE, changed: make(chan struct{})}
+	_, stat, changed := w.take(1024)
+	assert.Equal(t, StatusOk, stat)
+	assert.NotNil(t, changed)
+
+	w.add([]notifyEvent{
+		{FILE_ACTION_ADDED, "sub", FILE_NOTIFY_CHANGE_DIR_NAME},
+		{FILE_ACTION_ADDED, "a.txt", FILE_NOTIFY_CHANGE_FILE_NAME},
+		{FILE_ACTION_MODIFIED, "a.txt", FILE_NOTIFY_CHANGE_SIZE},
+		{FILE_ACTION_MODIFIED, "a.txt", FILE_NOTIFY_CHANGE_ATTRIBUTES},
+		{FILE_ACTION_ADDED, "b/c.txt", FILE_NOTIFY_CHANGE_FILE_NAME},
+		{FILE_ACTION_MODIFIED, "a.txt", FILE_NOTIFY_CHANGE_SIZE},
+	})
+	<-changed
+
+	buf, stat, changed := w.take(1024)
+	assert.Equal(t, StatusOk, stat)
+	assert.Nil(t, changed)
+	//a.txt added and modified, b\\c.txt added, the modify of a.txt is only reported once
+	name := encoder.ToUnicode("a.txt")
+	assert.Equal(t, uint32(12+12), binary.LittleEndian.Uint32(buf))
+	assert.Equal(t, FILE_ACTION_ADDED, binary.LittleEndian.Uint32(buf[4:]))
+	assert.Equal(t, uint32(len(name)), binary.LittleEndian.Uint32(buf[8:]))
+	assert.Equal(t, name, buf[12:12+len(name)])
+	assert.Equal(t, FILE_ACTION_MODIFIED, binary.LittleEndian.Uint32(buf[24+4:]))
+	last := buf[48:]
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(last))
+	assert.Equal(t, encoder.ToUnicode("b\\c.txt"), last[12:12+14])
+	assert.Equal(t, 48+28, len(buf))
+
+	//the changes do not fit the output buffer
+	w.add([]notifyEvent{{FILE_ACTION_REMOVED, "a.txt", FILE_NOTIFY_CHANGE_FILE_NAME}})
+	_, stat, _ = w.take(8)
+	assert.Equal(t, STATUS_NOTIFY_ENUM_DIR, stat)
+	_, stat, changed = w.take(1024)
+	assert.Equal(t, StatusOk, stat)
+	assert.NotNil(t, changed)
+
+	//the watcher lost changes
+	w.add([]notifyEvent{{action: kNotifyOverflow}, {FILE_ACTION_REMOVED, "a.txt", FILE_NOTIFY_CHANGE_FILE_NAME}})
+	_, stat, _ = w.take(1024)
+	assert.Equal(t, STATUS_NOTIFY_ENUM_DIR, stat)
+}
+
+func Test_PollDiff(t *testing.T) {
+	fsys := webdav.NewMemFS()
+	ctx := context.Background()
+	assert.Nil(t, fsys.Mkdir(ctx, "/dir", 0777))
+	assert.Nil(t, fsys.Mkdir(ctx, "/dir/sub", 0777))
+	writeFile := func(name, content string) {
+		f, err := fsys.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		assert.Nil(t, err)
+		f.Write([]byte(content))
+		f.Close()
+	}
+	writeFile("/dir/a.txt", "a")
+	writeFile("/dir/sub/b.txt", "b")
+
+	last, err := pollSnapshot(fsys, "/dir", true)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(last))
+	flat, err := pollSnapshot(fsys, "/dir", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(flat))
+
+	writeFile("/dir/a.txt", "aaa")
+	writeFile("/dir/sub/c.txt", "c")
+	assert.Nil(t, fsys.RemoveAll(ctx, "/dir/sub/b.txt"))
+	next, err := pollSnapshot(fsys, "/dir", true)
+	assert.Nil(t, err)
+
+	events := pollDiff(last, next)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, notifyEvent{FILE_ACTION_REMOVED, "sub/b.txt", FILE_NOTIFY_CHANGE_FILE_NAME}, events[0])
+	assert.Equal(t, FILE_ACTION_MODIFIED, events[1].action)
+	assert.Equal(t, "a.txt", events[1].name)
+	assert.NotZero(t, events[1].filter&FILE_NOTIFY_CHANGE_SIZE)
+	assert.Equal(t, notifyEvent{FILE_ACTION_ADDED, "sub/c.txt", FILE_NOTIFY_CHANGE_FILE_NAME}, events[2])
+}
+
+func Test_DirWatcher(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0777))
+	got := make(chan notifyEvent, 64)
+	w, err := newDirWatcher(webdav.Dir("/"), dir, true, func(events []notifyEvent) {
+		for _, e := range events {
+			got <- e
+		}
+	})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	next := func() notifyEvent {
+		select {
+		case e := <-got:
+			return e
+		case <-time.After(3 * notifyPollInterval):
+			t.Fatal("no change notified")
+		}
+		return notifyEvent{}
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "a.txt"), nil, 0666))
+	e := next()
+	assert.Equal(t, FILE_ACTION_ADDED, e.action)
+	assert.Equal(t, "sub/a.txt", e.name)
+	assert.Equal(t, FILE_NOTIFY_CHANGE_FILE_NAME, e.filter)
+
+	if _, polling := w.(*pollWatcher); !polling {
+		assert.Nil(t, os.Rename(filepath.Join(dir, "sub", "a.txt"), filepath.Join(dir, "b.txt")))
+		assert.Equal(t, notifyEvent{FILE_ACTION_RENAMED_OLD_NAME, "sub/a.txt", FILE_NOTIFY_CHANGE_FILE_NAME}, next())
+		assert.Equal(t, notifyEvent{FILE_ACTION_RENAMED_NEW_NAME, "b.txt", FILE_NOTIFY_CHANGE_FILE_NAME}, next())
+	}
+}
+
+func Test_ChangeNotify(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	session := NewSessionServer(true, srv, nil, nil)
+	session.startWriter(bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)))
+	defer session.stopWriter()
+
+	dir := t.TempDir()
+	tree := session.TreeConnect(NewAnchor("share", dir))
+	webfile, err := os.Open(dir)
+	assert.Nil(t, err)
+	defer webfile.Close()
+	guid := makeGUID(tree.id, 1)
+	session.PutFile(guid, webfile, dir)
+
+	req := ChangeNotifyRequest{
+		Header: Header{
+			ProtocolID:   []byte(ProtocolSmb2),
+			HeaderLength: 64,
+			Command:      CommandChangeNotify,
+			MessageID:    7,
+			TreeID:       tree.id,
+			SessionID:    session.sessionID,
+			Signature:    make([]byte, 16),
+		},
+		StructureSize:      32,
+		OutputBufferLength: 1024,
+		FileId:             guid,
+		CompletionFilter:   FILE_NOTIFY_CHANGE_FILE_NAME,
+	}
+	send := func() {
+		req.MessageID++
+		msg, err := encoder.Marshal(&req)
+		assert.Nil(t, err)
+		ctx := NewDataCtx(session, srv, testHandle)
+		ctx.op = session.beginOp(msg, false)
+		go func() {
+			defer session.endOp(ctx.op)
+			respBuf, _, _ := ActionFunc(ctx, msg)
+			session.SendAsync(respBuf)
+		}()
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(cli), bufio.NewWriter(cli))
+	send()
+	interim, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(STATUS_PENDING), binary.LittleEndian.Uint32(interim[8:]))
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0666))
+	final, _, err := session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(StatusOk), binary.LittleEndian.Uint32(final[8:]))
+	var resp ChangeNotifyResponse
+	assert.Nil(t, encoder.Unmarshal(final, &resp))
+	assert.Equal(t, FILE_ACTION_ADDED, binary.LittleEndian.Uint32(resp.OutputBuffer[4:]))
+	assert.Equal(t, encoder.ToUnicode("a.txt"), resp.OutputBuffer[12:22])
+
+	//changes between two requests wait for the next one
+	assert.Nil(t, os.Remove(filepath.Join(dir, "a.txt")))
+	time.Sleep(100 * time.Millisecond)
+	send()
+	final, _, err = session.Recv(rw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(StatusOk), binary.LittleEndian.Uint32(final[8:]))
+	assert.Nil(t, encoder.Unmarshal(final, &resp))
+	assert.Equal(t, FILE_ACTION_REMOVED, binary.LittleEndian.Uint32(resp.OutputBuffer[4:]))
+
+	//requests on the same handle complete in the order they came
+	pending := func() uint64 {
+		send()
+		interim, _, err := session.Recv(rw)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(STATUS_PENDING), binary.LittleEndian.Uint32(interim[8:]))
+		return binary.LittleEndian.Uint64(interim[24:])
+	}
+	first, second := pending(), pending()
+	for i, id := range []uint64{first, second} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), nil, 0666))
+		final, _, err = session.Recv(rw)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(StatusOk), binary.LittleEndian.Uint32(final[8:]))
+		assert.Equal(t, id, binary.LittleEndian.Uint64(final[24:]))
+	}
+
+	//closing the directory completes every pending request
+	first, second = pending(), pending()
+	session.DelFile(guid)
+	for i := 0; i < 2; i++ {
+		final, _, err = session.Recv(rw)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(STATUS_NOTIFY_CLEANUP), binary.LittleEndian.Uint32(final[8:]))
+		assert.Contains(t, []uint64{first, second}, binary.LittleEndian.Uint64(final[24:]))
+	}
+	assert.Equal(t, 0, len(gWatchHub.watches))
+}
@@ -0,0 +1,763 @@
+package smb
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// RequestedOplockLevel
+const (
+	SMB2_OPLOCK_LEVEL_NONE      uint8 = 0x00
+	SMB2_OPLOCK_LEVEL_II        uint8 = 0x01
+	SMB2_OPLOCK_LEVEL_EXCLUSIVE uint8 = 0x08
+	SMB2_OPLOCK_LEVEL_BATCH     uint8 = 0x09
+	SMB2_OPLOCK_LEVEL_LEASE     uint8 = 0xFF
+)
+
+// LeaseState
+const (
+	SMB2_LEASE_NONE           uint32 = 0x00
+	SMB2_LEASE_READ_CACHING   uint32 = 0x01
+	SMB2_LEASE_HANDLE_CACHING uint32 = 0x02
+	SMB2_LEASE_WRITE_CACHING  uint32 = 0x04
+)
+
+const (
+	kLeaseR = SMB2_LEASE_READ_CACHING
+	kLeaseH = SMB2_LEASE_HANDLE_CACHING
+	kLeaseW = SMB2_LEASE_WRITE_CACHING
+)
+
+// oplockBreakTimeout is how long a holder has to acknowledge a break before the server forces it.
+var oplockBreakTimeout = 35 * time.Second
+
+// kDirLeaseFilter are the changes of a child that break a directory lease, the cached enumeration holds
+// names, sizes, times and attributes.
+const kDirLeaseFilter = FILE_NOTIFY_CHANGE_FILE_NAME | FILE_NOTIFY_CHANGE_DIR_NAME | FILE_NOTIFY_CHANGE_ATTRIBUTES |
+	FILE_NOTIFY_CHANGE_SIZE | FILE_NOTIFY_CHANGE_LAST_WRITE
+
+// kAttributeAccess opens only read or change the attributes, they never break an oplock or a lease.
+const kAttributeAccess = FILE_READ_ATTRIBUTES | FILE_WRITE_ATTRIBUTES | SYNCHRONIZE | READ_CONTROL
+
+type leaseKey struct {
+	client GUID
+	key    GUID
+}
+
+// cacheOwner is a lease, or the one open an oplock was granted to. An oplock is kept as the
+// lease state it stands for, Level II is R, exclusive is RW and batch is RWH.
+type cacheOwner struct {
+	lease   *leaseKey //nil for an oplock
+	path    string
+	version uint16 //1 or 2, the RqLs context the lease was requested with
+	epoch   uint16
+	state   uint32
+
+	breaking  bool
+	breakTo   uint32
+	breakDone chan struct{} //closed when the break is acknowledged, times out or the owner goes away
+	timer     *time.Timer
+
+	opens map[GUID]*SessionS //the opens using the owner and their sessions
+
+	//ignore holds the children a directory lease changed itself, until the watcher has reported them
+	ignore map[string]time.Time
+}
+
+// leaseKey scopes the LeaseKey of a client to its ClientGuid.
+func (s *SessionS) leaseKey(key GUID) leaseKey {
+	var client GUID
+	copy(client[:], s.clientGuid)
+	return leaseKey{client: client, key: key}
+}
+
+// oplockLevel is the oplock the state of an oplock owner stands for.
+func oplockLevel(state uint32) uint8 {
+	switch {
+	case state&(kLeaseW|kLeaseH) == kLeaseW|kLeaseH:
+		return SMB2_OPLOCK_LEVEL_BATCH
+	case state&kLeaseW != 0:
+		return SMB2_OPLOCK_LEVEL_EXCLUSIVE
+	case state&kLeaseR != 0:
+		return SMB2_OPLOCK_LEVEL_II
+	}
+	return SMB2_OPLOCK_LEVEL_NONE
+}
+
+func oplockState(level uint8) uint32 {
+	switch level {
+	case SMB2_OPLOCK_LEVEL_BATCH:
+		return kLeaseR | kLeaseW | kLeaseH
+	case SMB2_OPLOCK_LEVEL_EXCLUSIVE:
+		return kLeaseR | kLeaseW
+	case SMB2_OPLOCK_LEVEL_II:
+		return kLeaseR
+	}
+	return SMB2_LEASE_NONE
+}
+
+// validLeaseState keeps the lease states a server grants, R, RH, RW and RWH.
+func validLeaseState(state uint32) uint32 {
+	state &= kLeaseR | kLeaseW | kLeaseH
+	if state&kLeaseR == 0 {
+		return SMB2_LEASE_NONE
+	}
+	return state
+}
+
+// oplockRequest is what a CREATE asks the oplock table for.
+type oplockRequest struct {
+	open       GUID
+	session    *SessionS
+	level      uint8
+	lease      *leaseKey //set with SMB2_OPLOCK_LEVEL_LEASE
+	leaseState uint32
+	version    uint16
+	parent     *leaseKey         //the ParentLeaseKey of a V2 lease, its directory lease is not broken by this open
+	fsys       webdav.FileSystem //watched for local changes once a directory lease is granted
+	isDir      bool
+	overwrite  bool //the data of the file is replaced
+	attrOnly   bool //the open only touches attributes
+}
+
+// oplockGrant is what the CREATE response reports.
+type oplockGrant struct {
+	level    uint8
+	state    uint32
+	epoch    uint16
+	breaking bool
+}
+
+// oplockBreak is a break notification to send once the table is unlocked.
+type oplockBreak struct {
+	session *SessionS
+	open    GUID //an open the break is about, its share tells if the break is encrypted
+	msg     interface{}
+}
+
+type oplockFile struct {
+	opens map[GUID]*cacheOwner //every open of the file, nil when it holds no oplock and no lease
+	watch *notifyWatch         //local changes of a directory with a lease
+}
+
+// oplockTable holds the oplocks and leases of the server, files are keyed by their absolute path.
+type oplockTable struct {
+	mu      sync.Mutex
+	files   map[string]*oplockFile
+	leases  map[leaseKey]*cacheOwner
+	parents map[GUID]leaseKey //the parent lease key of an open
+}
+
+var gOplockTable = newOplockTable()
+
+func newOplockTable() *oplockTable {
+	return &oplockTable{
+		files:   make(map[string]*oplockFile),
+		leases:  make(map[leaseKey]*cacheOwner),
+		parents: make(map[GUID]leaseKey),
+	}
+}
+
+func (t *oplockTable) file(path string) *oplockFile {
+	f, ok := t.files[path]
+	if !ok {
+		f = &oplockFile{opens: make(map[GUID]*cacheOwner)}
+		t.files[path] = f
+	}
+	return f
+}
+
+// owners lists the owners of f but the one of req.
+func (f *oplockFile) owners(self *cacheOwner) []*cacheOwner {
+	var owners []*cacheOwner
+	seen := make(map[*cacheOwner]bool)
+	for _, o := range f.opens {
+		if o != nil && o != self && !seen[o] {
+			seen[o] = true
+			owners = append(owners, o)
+		}
+	}
+	return owners
+}
+
+// breakTo is the state another owner keeps once req opens the file. Write caching is lost to any
+// open, an overwrite drops everything, an oplock below batch has no handle caching to keep.
+func breakTo(o *cacheOwner, req *oplockRequest) uint32 {
+	if req.overwrite {
+		return SMB2_LEASE_NONE
+	}
+	to := o.state &^ kLeaseW
+	if o.lease == nil {
+		to &^= kLeaseH
+	}
+	return to
+}
+
+// acquire registers the open of req on path. The oplocks and leases of other owners that conflict
+// are broken first, wait blocks until a holder acknowledges or times out and fails on cancel.
+func (t *oplockTable) acquire(path string, req *oplockRequest, wait func(<-chan struct{}) bool) (oplockGrant, Status) {
+	for {
+		t.mu.Lock()
+		var self *cacheOwner
+		if req.lease != nil {
+			if self = t.leases[*req.lease]; self != nil && self.path != path {
+				//a lease key caches one file only
+				t.mu.Unlock()
+				return oplockGrant{}, STATUS_INVALID_PARAMETER
+			}
+		}
+		f := t.file(path)
+		var pending <-chan struct{}
+		var notes []oplockBreak
+		if !req.attrOnly {
+			for _, o := range f.owners(self) {
+				if o.breaking {
+					pending = o.breakDone
+					continue
+				}
+				to := breakTo(o, req)
+				if to == o.state {
+					continue
+				}
+				note, ack := t.startBreak(o, to)
+				notes = append(notes, note)
+				if ack {
+					pending = o.breakDone
+				}
+			}
+		}
+		var grant oplockGrant
+		if pending == nil {
+			grant = t.grant(f, path, self, req)
+		}
+		t.mu.Unlock()
+		sendBreaks(notes)
+		if pending == nil {
+			if req.isDir && grant.state != SMB2_LEASE_NONE && req.fsys != nil {
+				t.watchDir(path, req.fsys)
+			}
+			return grant, StatusOk
+		}
+		if !wait(pending) {
+			t.mu.Lock()
+			if len(f.opens) == 0 && t.files[path] == f {
+				delete(t.files, path)
+			}
+			t.mu.Unlock()
+			return oplockGrant{}, STATUS_CANCELLED
+		}
+	}
+}
+
+// grant adds the open of req to f with the caching the other opens of the file allow, t.mu is held.
+func (t *oplockTable) grant(f *oplockFile, path string, self *cacheOwner, req *oplockRequest) oplockGrant {
+	others := false
+	for _, o := range f.opens {
+		if o == nil || o != self {
+			others = true
+			break
+		}
+	}
+
+	var state uint32
+	if req.lease != nil {
+		state = validLeaseState(req.leaseState)
+	} else {
+		state = oplockState(req.level)
+	}
+	if req.isDir {
+		//a directory only takes a V2 lease, it caches the enumeration and the handle
+		if req.lease == nil || req.version < 2 {
+			state = SMB2_LEASE_NONE
+		}
+		state &= kLeaseR | kLeaseH
+	}
+	if req.attrOnly {
+		state = SMB2_LEASE_NONE
+	}
+	if req.parent != nil {
+		t.parents[req.open] = *req.parent
+	}
+	if others {
+		//write caching needs the file to itself, an oplock shared with other opens is Level II
+		state &^= kLeaseW
+		if req.lease == nil {
+			state &^= kLeaseH
+		}
+	}
+
+	if req.lease == nil {
+		var owner *cacheOwner
+		if state != SMB2_LEASE_NONE {
+			owner = &cacheOwner{path: path, state: state, opens: map[GUID]*SessionS{req.open: req.session}}
+		}
+		f.opens[req.open] = owner
+		return oplockGrant{level: oplockLevel(state)}
+	}
+
+	if self == nil {
+		key := *req.lease
+		self = &cacheOwner{lease: &key, path: path, version: req.version, opens: make(map[GUID]*SessionS)}
+		t.leases[key] = self
+	}
+	if !self.breaking && state|self.state != self.state {
+		self.state |= state
+		self.epoch++
+	}
+	self.opens[req.open] = req.session
+	f.opens[req.open] = self
+	return oplockGrant{level: SMB2_OPLOCK_LEVEL_LEASE, state: self.state, epoch: self.epoch, breaking: self.breaking}
+}
+
+// startBreak moves o towards to, t.mu is held. Losing write or handle caching has to be acknowledged.
+func (t *oplockTable) startBreak(o *cacheOwner, to uint32) (oplockBreak, bool) {
+	ack := o.state&(kLeaseW|kLeaseH) != 0
+	var note oplockBreak
+	for guid, session := range o.opens {
+		note.session, note.open = session, guid
+		if o.lease == nil {
+			note.msg = newOplockBreakNotification(guid, oplockLevel(to))
+		}
+		break
+	}
+	if o.lease != nil {
+		o.epoch++
+		note.msg = newLeaseBreakNotification(o, to, ack)
+	}
+	if !ack {
+		o.state = to
+		return note, false
+	}
+	o.breaking = true
+	o.breakTo = to
+	done := make(chan struct{})
+	o.breakDone = done
+	o.timer = time.AfterFunc(oplockBreakTimeout, func() {
+		t.mu.Lock()
+		if !o.breaking || o.breakDone != done {
+			t.mu.Unlock()
+			return
+		}
+		logx.Warnf("oplock break of %v timed out", o.path)
+		t.finishBreak(o, o.breakTo)
+		opens := o.sessions()
+		t.mu.Unlock()
+		journalOpens(opens)
+	})
+	return note, true
+}
+
+// finishBreak ends the break of o with the state the holder kept, t.mu is held.
+func (t *oplockTable) finishBreak(o *cacheOwner, state uint32) {
+	o.state = state
+	o.breaking = false
+	o.timer.Stop()
+	close(o.breakDone)
+}
+
+// sessions copies the opens of o and their sessions, t.mu is held.
+func (o *cacheOwner) sessions() map[GUID]*SessionS {
+	opens := make(map[GUID]*SessionS, len(o.opens))
+	for guid, session := range o.opens {
+		opens[guid] = session
+	}
+	return opens
+}
+
+// cached is the state the owner of open caches once a break in progress is done, ok is false when
+// the table does not know the open.
+func (t *oplockTable) cached(path string, open GUID) (state uint32, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return 0, false
+	}
+	o, ok := f.opens[open]
+	switch {
+	case !ok:
+		return 0, false
+	case o == nil:
+		return SMB2_LEASE_NONE, true
+	case o.breaking:
+		return o.breakTo, true
+	}
+	return o.state, true
+}
+
+// ackOplock takes the acknowledgment of the oplock break of open, it returns the level the open keeps.
+func (t *oplockTable) ackOplock(path string, open GUID, level uint8) (uint8, Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return 0, STATUS_INVALID_OPLOCK_PROTOCOL
+	}
+	o := f.opens[open]
+	if o == nil || o.lease != nil || !o.breaking {
+		return 0, STATUS_INVALID_OPLOCK_PROTOCOL
+	}
+	if level != SMB2_OPLOCK_LEVEL_NONE && level != SMB2_OPLOCK_LEVEL_II {
+		return 0, STATUS_INVALID_PARAMETER
+	}
+	state := oplockState(level)
+	if state|o.breakTo != o.breakTo {
+		//the break went to none, the holder can not keep Level II
+		t.finishBreak(o, SMB2_LEASE_NONE)
+		return 0, STATUS_INVALID_OPLOCK_PROTOCOL
+	}
+	t.finishBreak(o, state)
+	if state == SMB2_LEASE_NONE {
+		f.opens[open] = nil
+	}
+	return level, StatusOk
+}
+
+// ackLease takes the acknowledgment of the break of the lease key, the persistent opens of the lease
+// are journaled with the state it keeps.
+func (t *oplockTable) ackLease(key leaseKey, state uint32) Status {
+	t.mu.Lock()
+	o, ok := t.leases[key]
+	if !ok {
+		t.mu.Unlock()
+		return STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	if !o.breaking {
+		t.mu.Unlock()
+		return STATUS_UNSUCCESSFUL
+	}
+	if state|o.breakTo != o.breakTo {
+		t.mu.Unlock()
+		return STATUS_REQUEST_NOT_ACCEPTED
+	}
+	t.finishBreak(o, state)
+	opens := o.sessions()
+	t.mu.Unlock()
+	journalOpens(opens)
+	return StatusOk
+}
+
+// breakHandles takes the handle caching away from the owners of opens, a CREATE failed on their
+// share mode. It waits for the acknowledgment and reports false when nothing was broken, the break
+// needs no answer or the wait is cancelled.
+func (t *oplockTable) breakHandles(path string, opens []GUID, wait func(<-chan struct{}) bool) bool {
+	t.mu.Lock()
+	var pending <-chan struct{}
+	var notes []oplockBreak
+	if f, ok := t.files[path]; ok {
+		seen := make(map[*cacheOwner]bool)
+		for _, open := range opens {
+			o := f.opens[open]
+			if o == nil || seen[o] {
+				continue
+			}
+			seen[o] = true
+			if o.breaking {
+				pending = o.breakDone
+				continue
+			}
+			if o.state&kLeaseH == 0 {
+				continue
+			}
+			//a batch oplock goes to Level II, a lease keeps what it has but the handle
+			to := o.state &^ kLeaseH
+			if o.lease == nil {
+				to &^= kLeaseW
+			}
+			note, ack := t.startBreak(o, to)
+			notes = append(notes, note)
+			if ack {
+				pending = o.breakDone
+			}
+		}
+	}
+	t.mu.Unlock()
+	sendBreaks(notes)
+	if pending == nil || wait == nil {
+		return false
+	}
+	return wait(pending)
+}
+
+// breakRead drops the read caching of the other owners of path, open is about to change the data.
+// Nobody waits for these breaks, the write goes on.
+func (t *oplockTable) breakRead(path string, open GUID) {
+	t.mu.Lock()
+	var notes []oplockBreak
+	if f, ok := t.files[path]; ok {
+		for _, o := range f.owners(f.opens[open]) {
+			if o.breaking || o.state&kLeaseR == 0 {
+				continue
+			}
+			note, _ := t.startBreak(o, SMB2_LEASE_NONE)
+			notes = append(notes, note)
+		}
+	}
+	t.mu.Unlock()
+	sendBreaks(notes)
+}
+
+// release forgets the open, a lease goes away with its last open and the watch of a directory
+// with its last open.
+func (t *oplockTable) release(path string, open GUID) {
+	t.mu.Lock()
+	w := t.releaseOpen(path, open)
+	t.mu.Unlock()
+	if w != nil {
+		w.stop()
+	}
+}
+
+// releaseOpen is release with t.mu held, it returns the watch to stop once t.mu is unlocked.
+func (t *oplockTable) releaseOpen(path string, open GUID) *notifyWatch {
+	delete(t.parents, open)
+	f, ok := t.files[path]
+	if !ok {
+		return nil
+	}
+	o, ok := f.opens[open]
+	if !ok {
+		return nil
+	}
+	var w *notifyWatch
+	delete(f.opens, open)
+	if len(f.opens) == 0 {
+		delete(t.files, path)
+		w = f.watch
+	}
+	if o == nil {
+		return w
+	}
+	delete(o.opens, open)
+	if len(o.opens) > 0 {
+		return w
+	}
+	if o.breaking {
+		t.finishBreak(o, SMB2_LEASE_NONE)
+	}
+	if o.lease != nil && t.leases[*o.lease] == o {
+		delete(t.leases, *o.lease)
+	}
+	return w
+}
+
+// reclaim moves the durable open to the session that reconnected it and reports what it caches.
+func (t *oplockTable) reclaim(path string, open GUID, session *SessionS) oplockGrant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok || f.opens[open] == nil {
+		return oplockGrant{}
+	}
+	o := f.opens[open]
+	o.opens[open] = session
+	if o.lease == nil {
+		return oplockGrant{level: oplockLevel(o.state)}
+	}
+	return oplockGrant{level: SMB2_OPLOCK_LEVEL_LEASE, state: o.state, epoch: o.epoch, breaking: o.breaking}
+}
+
+// rename moves the oplocks and leases of oldPath and of the files below it to newPath. A lease key
+// keeps caching its file under the new name.
+func (t *oplockTable) rename(oldPath, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	moved := make(map[string]*oplockFile)
+	for path, f := range t.files {
+		if to, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(t.files, path)
+			moved[to] = f
+		}
+	}
+	for path, f := range moved {
+		t.files[path] = f
+		for _, o := range f.opens {
+			if o != nil {
+				o.path = path
+			}
+		}
+	}
+}
+
+// restore grants a journaled persistent open its oplock or lease again, nothing is broken for it.
+func (t *oplockTable) restore(path string, req *oplockRequest) oplockGrant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var self *cacheOwner
+	if req.lease != nil {
+		if self = t.leases[*req.lease]; self != nil && self.path != path {
+			return oplockGrant{}
+		}
+	}
+	return t.grant(t.file(path), path, self, req)
+}
+
+// expectChange tells the directory lease named by the parent lease key of open that its client is
+// about to create, change, rename or delete path. It is called before the change is made, the watcher
+// may report the change before the handler goes on and must not break the lease for it.
+func (t *oplockTable) expectChange(path string, open GUID) {
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, ok := t.parents[open]
+	if !ok {
+		return
+	}
+	o := t.leases[parent]
+	if o == nil || o.path != dir {
+		return
+	}
+	if o.ignore == nil {
+		o.ignore = make(map[string]time.Time)
+	}
+	o.ignore[name] = time.Now().Add(2 * notifyPollInterval)
+}
+
+// childChanged breaks the directory leases of the parent of path, open created, changed, renamed
+// or deleted it. The lease named by the parent lease key of open is kept, its client made the
+// change. Like breakRead nobody waits for the breaks.
+func (t *oplockTable) childChanged(path string, open GUID) {
+	sendBreaks(t.childBreaks(path, open))
+}
+
+// childBreaks starts the breaks of childChanged, the caller sends them.
+func (t *oplockTable) childBreaks(path string, open GUID) []oplockBreak {
+	dir := filepath.Dir(path)
+	t.mu.Lock()
+	var notes []oplockBreak
+	if f, ok := t.files[dir]; ok {
+		parent, hasParent := t.parents[open]
+		for _, o := range f.owners(nil) {
+			if o.lease == nil || (hasParent && *o.lease == parent) {
+				continue
+			}
+			if o.breaking || o.state == SMB2_LEASE_NONE {
+				continue
+			}
+			note, _ := t.startBreak(o, SMB2_LEASE_NONE)
+			notes = append(notes, note)
+		}
+	}
+	t.mu.Unlock()
+	return notes
+}
+
+// dirBreaks starts the breaks of the directory leases of dir for the changes the file system watcher
+// saw, the caller sends them.
+func (t *oplockTable) dirBreaks(dir string, events []notifyEvent) []oplockBreak {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var notes []oplockBreak
+	if f, ok := t.files[dir]; ok {
+		for _, o := range f.owners(nil) {
+			if o.lease == nil || o.breaking || o.state == SMB2_LEASE_NONE || o.ignores(events, now) {
+				continue
+			}
+			note, _ := t.startBreak(o, SMB2_LEASE_NONE)
+			notes = append(notes, note)
+		}
+	}
+	return notes
+}
+
+// ignores tells if every event is a change o made itself, expired entries are dropped, t.mu is held.
+func (o *cacheOwner) ignores(events []notifyEvent, now time.Time) bool {
+	for name, until := range o.ignore {
+		if now.After(until) {
+			delete(o.ignore, name)
+		}
+	}
+	for _, e := range events {
+		if _, ok := o.ignore[e.name]; !ok || e.action == kNotifyOverflow {
+			return false
+		}
+	}
+	return true
+}
+
+// watchDir starts watching the directory path for local changes, unless it is watched already.
+// The watcher is subscribed with t.mu unlocked, its callback starts the breaks right away and sends
+// them asynchronously since the hub lock is held while it runs.
+func (t *oplockTable) watchDir(path string, fsys webdav.FileSystem) {
+	t.mu.Lock()
+	f, ok := t.files[path]
+	watched := ok && f.watch != nil
+	t.mu.Unlock()
+	if !ok || watched {
+		return
+	}
+	w, err := gWatchHub.subscribe(fsys, path, false, kDirLeaseFilter, func(events []notifyEvent) {
+		go sendBreaks(t.dirBreaks(path, events))
+	})
+	if err != nil {
+		logx.Warnf("watch %v for directory lease, err: %v", path, err)
+		return
+	}
+	t.mu.Lock()
+	if t.files[path] != f || f.watch != nil {
+		t.mu.Unlock()
+		w.stop()
+		return
+	}
+	f.watch = w
+	t.mu.Unlock()
+}
+
+func sendBreaks(notes []oplockBreak) {
+	for _, note := range notes {
+		if note.session == nil {
+			continue
+		}
+		buf, err := encoder.Marshal(note.msg)
+		if err != nil {
+			logx.Errorf("oplock break, err: %v", err)
+			continue
+		}
+		note.session.sendNotification(buf, note.session.openTree(note.open))
+	}
+}
+
+// breakHeader is the header of an unsolicited break notification.
+func breakHeader() Header {
+	return Header{
+		ProtocolID:   []byte(ProtocolSmb2),
+		HeaderLength: 64,
+		Command:      CommandOplockBreak,
+		Flags:        SMB2_FLAGS_RESPONSE,
+		MessageID:    0xFFFFFFFFFFFFFFFF,
+		Signature:    make([]byte, 16),
+	}
+}
+
+func newOplockBreakNotification(open GUID, level uint8) *OplockBreakResponse {
+	return &OplockBreakResponse{
+		Header:        breakHeader(),
+		StructureSize: 24,
+		OplockLevel:   level,
+		FileId:        open,
+	}
+}
+
+func newLeaseBreakNotification(o *cacheOwner, to uint32, ack bool) *LeaseBreakNotification {
+	note := &LeaseBreakNotification{
+		Header:            breakHeader(),
+		StructureSize:     44,
+		LeaseKey:          o.lease.key,
+		CurrentLeaseState: o.state,
+		NewLeaseState:     to,
+	}
+	if o.version >= 2 {
+		note.NewEpoch = o.epoch
+	}
+	if ack {
+		note.Flags = SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED
+	}
+	return note
+}
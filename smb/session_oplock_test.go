@@ -0,0 +1,264 @@
+package smb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func Test_OplockTable(t *testing.T) {
+	table := newOplockTable()
+	holder, other := makeGUID(1, 1), makeGUID(1, 2)
+
+	grant, stat := table.acquire("/f", &oplockRequest{open: holder, level: SMB2_OPLOCK_LEVEL_BATCH}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_BATCH, grant.level)
+
+	//an attribute only open leaves the batch oplock alone
+	_, stat = table.acquire("/f", &oplockRequest{open: makeGUID(1, 3), attrOnly: true}, nil)
+	assert.Equal(t, StatusOk, stat)
+	table.release("/f", makeGUID(1, 3))
+
+	//a second open breaks the batch oplock to Level II once the holder acknowledges
+	waits := 0
+	grant, stat = table.acquire("/f", &oplockRequest{open: other, level: SMB2_OPLOCK_LEVEL_BATCH}, func(done <-chan struct{}) bool {
+		waits++
+		level, stat := table.ackOplock("/f", holder, SMB2_OPLOCK_LEVEL_II)
+		assert.Equal(t, StatusOk, stat)
+		assert.Equal(t, SMB2_OPLOCK_LEVEL_II, level)
+		<-done
+		return true
+	})
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, 1, waits)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_II, grant.level)
+	_, stat = table.ackOplock("/f", holder, SMB2_OPLOCK_LEVEL_II)
+	assert.Equal(t, STATUS_INVALID_OPLOCK_PROTOCOL, stat)
+
+	table.release("/f", holder)
+	table.release("/f", other)
+	assert.Equal(t, 0, len(table.files))
+}
+
+func Test_LeaseTable(t *testing.T) {
+	table := newOplockTable()
+	key1 := leaseKey{key: makeGUID(9, 1)}
+	key2 := leaseKey{key: makeGUID(9, 2)}
+	open1, open2, open3 := makeGUID(1, 1), makeGUID(1, 2), makeGUID(1, 3)
+	rwh := kLeaseR | kLeaseW | kLeaseH
+
+	grant, stat := table.acquire("/f", &oplockRequest{open: open1, lease: &key1, leaseState: rwh, version: 2}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_LEASE, grant.level)
+	assert.Equal(t, rwh, grant.state)
+	assert.Equal(t, uint16(1), grant.epoch)
+
+	//the same lease key shares the lease without a break
+	grant, stat = table.acquire("/f", &oplockRequest{open: open2, lease: &key1, leaseState: rwh, version: 2}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, rwh, grant.state)
+
+	//a lease key caches one file
+	_, stat = table.acquire("/g", &oplockRequest{open: open3, lease: &key1, leaseState: rwh}, nil)
+	assert.Equal(t, STATUS_INVALID_PARAMETER, stat)
+
+	//another lease breaks RWH to RH, an ack that keeps more is refused
+	grant, stat = table.acquire("/f", &oplockRequest{open: open3, lease: &key2, leaseState: rwh, version: 2}, func(done <-chan struct{}) bool {
+		assert.Equal(t, STATUS_REQUEST_NOT_ACCEPTED, table.ackLease(key1, rwh))
+		assert.Equal(t, StatusOk, table.ackLease(key1, kLeaseR|kLeaseH))
+		<-done
+		return true
+	})
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, kLeaseR|kLeaseH, grant.state)
+	assert.Equal(t, kLeaseR|kLeaseH, table.leases[key1].state)
+	assert.Equal(t, STATUS_UNSUCCESSFUL, table.ackLease(key1, kLeaseR))
+
+	//an overwrite breaks every lease, a holder that does not answer times out
+	timeout := oplockBreakTimeout
+	oplockBreakTimeout = 50 * time.Millisecond
+	defer func() { oplockBreakTimeout = timeout }()
+	waits := 0
+	_, stat = table.acquire("/f", &oplockRequest{open: makeGUID(1, 4), overwrite: true}, func(done <-chan struct{}) bool {
+		waits++
+		<-done
+		return true
+	})
+	assert.Equal(t, StatusOk, stat)
+	assert.NotZero(t, waits)
+	assert.Equal(t, SMB2_LEASE_NONE, table.leases[key1].state)
+	assert.Equal(t, SMB2_LEASE_NONE, table.leases[key2].state)
+
+	for _, open := range []GUID{open1, open2, open3, makeGUID(1, 4)} {
+		table.release("/f", open)
+	}
+	assert.Equal(t, 0, len(table.files))
+	assert.Equal(t, 0, len(table.leases))
+}
+
+func Test_DirectoryLease(t *testing.T) {
+	table := newOplockTable()
+	dir := t.TempDir()
+	key1 := leaseKey{key: makeGUID(9, 1)}
+	key2 := leaseKey{key: makeGUID(9, 2)}
+	rwh := kLeaseR | kLeaseW | kLeaseH
+	//the watcher breaks leases from its own goroutine
+	lease := func(key leaseKey) (uint32, bool) {
+		table.mu.Lock()
+		defer table.mu.Unlock()
+		return table.leases[key].state, table.leases[key].breaking
+	}
+
+	//a directory takes a V2 lease without write caching
+	grant, stat := table.acquire(dir, &oplockRequest{open: makeGUID(1, 1), lease: &key1, leaseState: rwh, version: 1, isDir: true}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, SMB2_LEASE_NONE, grant.state)
+	table.release(dir, makeGUID(1, 1))
+	grant, stat = table.acquire(dir, &oplockRequest{open: makeGUID(1, 1), lease: &key1, leaseState: rwh, version: 2, isDir: true, fsys: webdav.Dir("/")}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, kLeaseR|kLeaseH, grant.state)
+	_, stat = table.acquire(dir, &oplockRequest{open: makeGUID(1, 2), lease: &key2, leaseState: kLeaseR, version: 2, isDir: true}, nil)
+	assert.Equal(t, StatusOk, stat)
+
+	//the changes reach the watcher of the lease, a test watch sees them once the lease did
+	w, err := gWatchHub.subscribe(webdav.Dir("/"), dir, false, kDirLeaseFilter, nil)
+	assert.Nil(t, err)
+	seen := func(name string) {
+		for {
+			buf, _, changed := w.take(4096)
+			if strings.Contains(string(buf), string(encoder.ToUnicode(name))) {
+				break
+			}
+			if buf != nil {
+				continue
+			}
+			select {
+			case <-changed:
+			case <-time.After(3 * notifyPollInterval):
+				t.Fatalf("no change of %v", name)
+			}
+		}
+		gWatchHub.mu.Lock()
+		gWatchHub.mu.Unlock()
+	}
+
+	//a child created by the client of key1 breaks the lease of key2 only
+	child := filepath.Join(dir, "a.txt")
+	_, stat = table.acquire(child, &oplockRequest{open: makeGUID(1, 3), parent: &key1}, nil)
+	assert.Equal(t, StatusOk, stat)
+	table.expectChange(child, makeGUID(1, 3))
+	assert.Nil(t, os.WriteFile(child, nil, 0666))
+	table.childChanged(child, makeGUID(1, 3))
+	state, _ := lease(key2)
+	assert.Equal(t, SMB2_LEASE_NONE, state)
+
+	//the watcher leaves key1 alone for its own change, a local change breaks it
+	seen("a.txt")
+	state, breaking := lease(key1)
+	assert.Equal(t, kLeaseR|kLeaseH, state)
+	assert.False(t, breaking)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b.txt"), nil, 0666))
+	seen("b.txt")
+	_, breaking = lease(key1)
+	assert.True(t, breaking)
+	w.stop()
+	assert.Equal(t, StatusOk, table.ackLease(key1, SMB2_LEASE_NONE))
+
+	for _, open := range []GUID{makeGUID(1, 1), makeGUID(1, 2)} {
+		table.release(dir, open)
+	}
+	table.release(child, makeGUID(1, 3))
+	assert.Equal(t, 0, len(table.files))
+	assert.Equal(t, 0, len(table.parents))
+	assert.Equal(t, 0, len(gWatchHub.watches))
+}
+
+func Test_CreateContexts(t *testing.T) {
+	buf, err := marshalCreateContexts([]createContext{
+		{tag: SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG, data: []byte{1, 2, 3}},
+		{tag: SMB2_CREATE_RESPONSE_LEASE_TAG, data: make([]byte, kCreateLeaseSize)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(32), binary.LittleEndian.Uint32(buf))
+
+	ctxs, err := parseCreateContexts(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ctxs))
+	assert.Equal(t, []byte{1, 2, 3}, findCreateContext(ctxs, SMB2_CREATE_QUERY_MAXIMAL_ACCESS_RESPONSE_TAG))
+	assert.Equal(t, kCreateLeaseSize, len(findCreateContext(ctxs, SMB2_CREATE_RESPONSE_LEASE_TAG)))
+	assert.Nil(t, findCreateContext(ctxs, SMB2_APPL_CREATE_CONTENT_TAG))
+
+	_, err = parseCreateContexts(buf[:20])
+	assert.NotNil(t, err)
+
+	lease := parseLeaseRequest(findCreateContext(ctxs, SMB2_CREATE_RESPONSE_LEASE_TAG), DialectSmb_3_1_1)
+	assert.Equal(t, uint16(1), lease.version)
+}
+
+func Test_OplockBreak(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	holder := NewSessionServer(true, srv, nil, nil)
+	holder.startWriter(bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)))
+	defer holder.stopWriter()
+
+	path := "/oplockbreak/file"
+	guid := makeGUID(1, 1)
+	holder.PutFile(guid, ipc_file, path)
+	defer holder.DelFile(guid)
+	grant, stat := gOplockTable.acquire(path, &oplockRequest{open: guid, session: holder, level: SMB2_OPLOCK_LEVEL_EXCLUSIVE}, nil)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_EXCLUSIVE, grant.level)
+
+	other := NewSessionServer(true, nil, nil, nil)
+	done := make(chan oplockGrant)
+	go func() {
+		grant, _ := gOplockTable.acquire(path, &oplockRequest{open: makeGUID(2, 1), session: other}, func(done <-chan struct{}) bool {
+			<-done
+			return true
+		})
+		done <- grant
+	}()
+	defer gOplockTable.release(path, makeGUID(2, 1))
+
+	//the holder gets the notification and acknowledges it
+	rw := bufio.NewReadWriter(bufio.NewReader(cli), bufio.NewWriter(cli))
+	buf, _, err := holder.Recv(rw)
+	assert.Nil(t, err)
+	var note OplockBreakResponse
+	assert.Nil(t, encoder.Unmarshal(buf, &note))
+	assert.Equal(t, CommandOplockBreak, note.Command)
+	assert.Equal(t, uint64(0xFFFFFFFFFFFFFFFF), note.MessageID)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_II, note.OplockLevel)
+	assert.Equal(t, guid, note.FileId)
+
+	body, err := encoder.Marshal(&OplockBreakAck{OplockLevel: SMB2_OPLOCK_LEVEL_II, FileId: guid})
+	assert.Nil(t, err)
+	msg, err := encoder.Marshal(&OplockBreakRequest{
+		Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandOplockBreak, Signature: make([]byte, 16)},
+		StructureSize: kOplockBreakAckSize,
+		Body:          body,
+	})
+	assert.Nil(t, err)
+	var req OplockBreakRequest
+	assert.Nil(t, encoder.Unmarshal(msg, &req))
+	assert.Equal(t, OplockBreakBody(body), req.Body)
+
+	resp, err := req.ServerAction(NewDataCtx(holder, srv, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_II, resp.(*OplockBreakResponse).OplockLevel)
+	assert.Equal(t, SMB2_OPLOCK_LEVEL_NONE, (<-done).level)
+
+	resp, _ = req.ServerAction(NewDataCtx(holder, srv, nil))
+	assert.Equal(t, STATUS_INVALID_OPLOCK_PROTOCOL, resp.(ErrResponse).Header.Status)
+}
@@ -0,0 +1,287 @@
+package smb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izouxv/logx"
+)
+
+// SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY is set on shares whose opens can be persistent.
+const SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY uint32 = 0x00000010
+
+// DH2Q Flags
+const SMB2_DHANDLE_FLAG_PERSISTENT uint32 = 0x00000002
+
+// handleLock is a byte range lock of a journaled open.
+type handleLock struct {
+	Offset    uint64
+	Length    uint64
+	Exclusive bool
+}
+
+// handleRecord is the journal entry of a persistent open, enough to open the file again and
+// restore its lease and locks once the server restarts.
+type handleRecord struct {
+	FileId       GUID
+	CreateGuid   GUID
+	ClientGuid   GUID
+	Path         string
+	Share        string
+	User         string
+	Access       AccessMask
+	ShareAccess  ShareAccess
+	OpenFlags    int
+	Oplock       uint8
+	LeaseKey     *GUID `json:",omitempty"`
+	LeaseState   uint32
+	LeaseVersion uint16
+	Timeout      time.Duration
+	Locks        []handleLock
+}
+
+// handleStore journals persistent opens in a directory, one file per open.
+type handleStore struct {
+	dir string
+	mu  sync.Mutex //serializes the writes of a record
+}
+
+func newHandleStore(dir string) *handleStore {
+	return &handleStore{dir: dir}
+}
+
+func (st *handleStore) name(guid GUID) string {
+	return filepath.Join(st.dir, fmt.Sprintf("%x.json", guid[:]))
+}
+
+// save writes rec, a crash leaves the previous version of the record or the new one.
+func (st *handleStore) save(rec *handleRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := os.MkdirAll(st.dir, 0700); err != nil {
+		return err
+	}
+	name := st.name(rec.FileId)
+	if err := os.WriteFile(name+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (st *handleStore) remove(guid GUID) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := os.Remove(st.name(guid)); err != nil && !os.IsNotExist(err) {
+		logx.Warnf("remove persistent handle, err: %v", err)
+	}
+}
+
+// load reads every record of the journal, broken ones are dropped.
+func (st *handleStore) load() ([]*handleRecord, error) {
+	entries, err := os.ReadDir(st.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []*handleRecord
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		name := filepath.Join(st.dir, e.Name())
+		buf, err := os.ReadFile(name)
+		rec := &handleRecord{}
+		if err == nil {
+			err = json.Unmarshal(buf, rec)
+		}
+		if err != nil {
+			logx.Warnf("persistent handle %v, err: %v", e.Name(), err)
+			os.Remove(name)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// record is the journal entry of d with the locks it holds and the oplock or lease it caches now.
+func (d *durableOpen) record() *handleRecord {
+	rec := &handleRecord{
+		FileId:      d.guid,
+		CreateGuid:  d.createGuid,
+		ClientGuid:  d.clientGuid,
+		Path:        d.path,
+		Share:       d.share,
+		User:        d.user,
+		Access:      d.access,
+		ShareAccess: d.shareAccess,
+		OpenFlags:   d.openFlags,
+		Oplock:      d.oplock,
+		LeaseState:  d.leaseState,
+		Timeout:     d.timeout,
+	}
+	if state, ok := gOplockTable.cached(d.path, d.guid); ok {
+		if d.lease != nil {
+			rec.LeaseState = state
+		} else {
+			rec.Oplock = oplockLevel(state)
+		}
+	}
+	if d.lease != nil {
+		key := d.lease.key
+		rec.LeaseKey = &key
+		rec.LeaseVersion = d.leaseVersion
+	}
+	for _, l := range gLockTable.locksOf(d.path, d.guid) {
+		rec.Locks = append(rec.Locks, handleLock{Offset: l.offset, Length: l.length, Exclusive: l.exclusive})
+	}
+	return rec
+}
+
+// journal saves d when it is persistent.
+func (d *durableOpen) journal() {
+	if d.store == nil {
+		return
+	}
+	if err := d.store.save(d.record()); err != nil {
+		logx.Warnf("journal persistent handle of %v, err: %v", d.path, err)
+	}
+}
+
+// journalOpen saves the open guid again when it is persistent, its locks or its lease changed.
+func (s *SessionS) journalOpen(guid GUID) {
+	s.mu.Lock()
+	d := s.durable[guid]
+	s.mu.Unlock()
+	if d != nil {
+		d.journal()
+	}
+}
+
+// journalOpens saves the persistent ones of opens again, connected or waiting for their client, a
+// break of their oplock or lease ended.
+func journalOpens(opens map[GUID]*SessionS) {
+	for guid, session := range opens {
+		if session != nil {
+			session.journalOpen(guid)
+		}
+		gDurableTable.journal(guid)
+	}
+}
+
+// persistentShare tells if the opens of anchor can be persistent for the session.
+func (s *SessionS) persistentShare(anchor *Anchor) bool {
+	return anchor.ContinuousAvailability && s.store != nil && s.dialect >= DialectSmb_3_0
+}
+
+// keepPersistent leaves the journal of the persistent opens alone when the session closes, the server
+// shuts down and its next run gives them back.
+func (s *SessionS) keepPersistent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for guid, d := range s.durable {
+		if d.store != nil {
+			delete(s.durable, guid)
+		}
+	}
+}
+
+// restorePersistent opens the files of the journaled handles again and waits for their clients,
+// as if every connection had dropped. The locks and leases are restored without breaking anything,
+// the opens held them together before the restart.
+func (s *server) restorePersistent() {
+	recs, err := s.store.load()
+	if err != nil {
+		logx.Errorf("load persistent handles, err: %v", err)
+		return
+	}
+	for _, rec := range recs {
+		//new FileIds must not collide with the restored ones
+		for tid := rec.FileId.treeId(); ; {
+			cur := atomic.LoadUint32(&treeId)
+			if cur >= tid || atomic.CompareAndSwapUint32(&treeId, cur, tid) {
+				break
+			}
+		}
+		anchor, handle := s.shareHandle(rec.User, rec.Share)
+		if handle == nil {
+			logx.Warnf("persistent handle of %v, share %v is gone", rec.Path, rec.Share)
+			s.store.remove(rec.FileId)
+			continue
+		}
+		file, err := anchor.streamFS(handle.FileSystem).OpenFile(context.Background(), rec.Path, rec.OpenFlags&^(os.O_CREATE|os.O_TRUNC|os.O_EXCL), 0666)
+		if err != nil {
+			logx.Warnf("persistent handle of %v, err: %v", rec.Path, err)
+			s.store.remove(rec.FileId)
+			continue
+		}
+		d := &durableOpen{
+			guid:        rec.FileId,
+			path:        rec.Path,
+			share:       rec.Share,
+			user:        rec.User,
+			version:     2,
+			createGuid:  rec.CreateGuid,
+			clientGuid:  rec.ClientGuid,
+			timeout:     rec.Timeout,
+			access:      rec.Access,
+			shareAccess: rec.ShareAccess,
+			openFlags:   rec.OpenFlags,
+			oplock:      rec.Oplock,
+			leaseState:  rec.LeaseState,
+			store:       s.store,
+			file:        file,
+		}
+		req := &oplockRequest{open: rec.FileId, level: rec.Oplock}
+		if rec.LeaseKey != nil {
+			d.lease = &leaseKey{client: rec.ClientGuid, key: *rec.LeaseKey}
+			d.leaseVersion = rec.LeaseVersion
+			req.lease, req.leaseState, req.version = d.lease, rec.LeaseState, rec.LeaseVersion
+		}
+		gOplockTable.restore(rec.Path, req)
+		gShareTable.restore(rec.Path, rec.FileId, rec.Access, rec.ShareAccess)
+		var locks []byteRangeLock
+		for _, l := range rec.Locks {
+			locks = append(locks, byteRangeLock{open: rec.FileId, offset: l.Offset, length: l.Length, exclusive: l.Exclusive})
+		}
+		gLockTable.restore(rec.Path, locks)
+		gDurableTable.put(d)
+		logx.Printf("persistent handle of %v restored", rec.Path)
+	}
+}
+
+// shareHandle is the share of user and the handler that serves it, the way a tree connect finds them.
+func (s *server) shareHandle(user, share string) (*Anchor, *Handler) {
+	if s.config.Tree == nil {
+		return nil, nil
+	}
+	anchors, err := s.config.Tree(user)
+	if err != nil {
+		return nil, nil
+	}
+	for _, anchor := range anchors {
+		if !strings.EqualFold(anchor.Name, share) {
+			continue
+		}
+		if anchor.Handle != nil {
+			return anchor, anchor.Handle
+		}
+		if s.config.Handle != nil {
+			return anchor, s.config.Handle(strings.ToUpper(anchor.Name))
+		}
+	}
+	return nil, nil
+}
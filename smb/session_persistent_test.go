@@ -0,0 +1,123 @@
+package smb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PersistentHandle(t *testing.T) {
+	dir, journal := t.TempDir(), t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0666))
+	path := filepath.Join(dir, "a.txt")
+	anchor := NewAnchor("share", dir)
+	anchor.ContinuousAvailability = true
+	store := newHandleStore(journal)
+
+	//a persistent handle needs no handle caching, it is journaled with its locks
+	session, tree := testDurableSession(dir, anchor)
+	session.store = store
+	durable, _ := encoder.Marshal(&SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2{Flags: SMB2_DHANDLE_FLAG_PERSISTENT, CreateGuid: makeGUID(7, 1)})
+	resp, ctxs := testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_NONE),
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG, data: durable})
+	guid := resp.(CreateResponse).FileId
+	var granted SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2
+	assert.Nil(t, encoder.Unmarshal(findCreateContext(ctxs, SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG), &granted))
+	assert.Equal(t, SMB2_DHANDLE_FLAG_PERSISTENT, granted.Flags)
+
+	stat, _ := gLockTable.lock(path, guid, []LockElement{{Offset: 0, Length: 10, Flags: SMB2_LOCKFLAG_EXCLUSIVE_LOCK}})
+	assert.Equal(t, StatusOk, stat)
+	session.journalOpen(guid)
+	recs, err := store.load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recs))
+	assert.Equal(t, []handleLock{{Offset: 0, Length: 10, Exclusive: true}}, recs[0].Locks)
+
+	//the server shuts down, the journal stays
+	session.keepPersistent()
+	session.Close()
+	assert.Equal(t, 0, len(gLockTable.locksOf(path, guid)))
+	recs, _ = store.load()
+	assert.Equal(t, 1, len(recs))
+
+	//the next run opens the file again with its locks and the client reconnects
+	srv := NewServer(&Config{
+		PersistentStore: journal,
+		Tree:            func(string) ([]*Anchor, error) { return []*Anchor{anchor}, nil },
+		Handle:          testHandle,
+	}).(*server)
+	srv.restorePersistent()
+	assert.Equal(t, 1, len(gLockTable.locksOf(path, guid)))
+
+	session, tree = testDurableSession(dir, anchor)
+	session.store = store
+	buf, _ := encoder.Marshal(&SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2{FileId: guid, CreateGuid: makeGUID(7, 1), Flags: SMB2_DHANDLE_FLAG_PERSISTENT})
+	resp, _ = testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_NONE),
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2_TAG, data: buf})
+	assert.Equal(t, guid, resp.(CreateResponse).FileId)
+
+	//closing the handle drops its journal entry
+	webfile, ok := session.DelFile(guid)
+	assert.True(t, ok)
+	webfile.Close()
+	recs, _ = store.load()
+	assert.Equal(t, 0, len(recs))
+	assert.Equal(t, 0, len(gLockTable.locksOf(path, guid)))
+}
+
+func Test_PersistentLeaseJournal(t *testing.T) {
+	dir, journal := t.TempDir(), t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0666))
+	path := filepath.Join(dir, "a.txt")
+	anchor := NewAnchor("share", dir)
+	anchor.ContinuousAvailability = true
+	store := newHandleStore(journal)
+	session, tree := testDurableSession(dir, anchor)
+	session.store = store
+	rwh := kLeaseR | kLeaseW | kLeaseH
+	lease, _ := encoder.Marshal(&SMB2_CREATE_REQUEST_LEASE_V2{LeaseKey: makeGUID(9, 1), LeaseState: rwh})
+	durable, _ := encoder.Marshal(&SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2{Flags: SMB2_DHANDLE_FLAG_PERSISTENT, CreateGuid: makeGUID(7, 1)})
+	resp, _ := testCreate(t, session, tree, testOpenA(SMB2_OPLOCK_LEVEL_LEASE),
+		createContext{tag: SMB2_CREATE_RESPONSE_LEASE_TAG, data: lease},
+		createContext{tag: SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2_TAG, data: durable})
+	guid := resp.(CreateResponse).FileId
+	journaled := func() uint32 {
+		recs, err := store.load()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(recs))
+		return recs[0].LeaseState
+	}
+	assert.Equal(t, rwh, journaled())
+
+	//the acknowledged break is journaled, a restart does not give the lease back
+	gOplockTable.breakHandles(path, []GUID{guid}, nil)
+	body, _ := encoder.Marshal(&LeaseBreakAck{LeaseKey: makeGUID(9, 1), LeaseState: kLeaseR | kLeaseW})
+	ack := OplockBreakRequest{
+		Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandOplockBreak, TreeID: tree.id},
+		StructureSize: kLeaseBreakAckSize,
+		Body:          body,
+	}
+	out, err := ack.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	assert.IsType(t, &LeaseBreakResponse{}, out)
+	assert.Equal(t, kLeaseR|kLeaseW, journaled())
+
+	//so is a break that times out
+	timeout := oplockBreakTimeout
+	oplockBreakTimeout = 50 * time.Millisecond
+	defer func() { oplockBreakTimeout = timeout }()
+	gOplockTable.breakRead(path, makeGUID(1, 9))
+	deadline := time.Now().Add(time.Second)
+	for journaled() != SMB2_LEASE_NONE && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, SMB2_LEASE_NONE, journaled())
+
+	webfile, _ := session.DelFile(guid)
+	webfile.Close()
+}
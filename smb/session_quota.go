@@ -0,0 +1,493 @@
+package smb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// kQuotaOwnerXattr names the user a file is charged to, the user that created it or first made it grow.
+// It is a user attribute in the server's own namespace, no extended attribute clients set reaches it.
+const kQuotaOwnerXattr = kServerXattrPrefix + "quota_owner"
+
+// kNoQuotaLimit is the threshold and the limit of a user without one, FILE_QUOTA_INFORMATION.
+const kNoQuotaLimit = ^uint64(0)
+
+// QuotaFunc gives the threshold and the limit in bytes of userName on a share, a zero limit leaves the
+// user unbounded. The threshold is only reported.
+type QuotaFunc func(userName string) (threshold, limit uint64)
+
+// hasQuota tells if the space of the share or of its users is bounded.
+func (a *Anchor) hasQuota() bool {
+	return a.QuotaLimit != 0 || a.Quota != nil
+}
+
+// userLimit is the threshold and the limit of userName, kNoQuotaLimit when there is none.
+func (a *Anchor) userLimit(userName string) (threshold, limit uint64) {
+	if a.Quota != nil {
+		threshold, limit = a.Quota(userName)
+	}
+	if threshold == 0 {
+		threshold = kNoQuotaLimit
+	}
+	if limit == 0 {
+		limit = kNoQuotaLimit
+	}
+	return threshold, limit
+}
+
+// userUsage is the space the files charged to a user take.
+type userUsage struct {
+	used   uint64
+	change time.Time
+}
+
+// shareQuota is the space the files of a share take, in total and by the user they are charged to.
+type shareQuota struct {
+	anchor *Anchor
+	fsys   webdav.FileSystem
+	scan   sync.Once
+	used   uint64
+	users  map[string]*userUsage
+}
+
+// quotaTable holds the usage of the shares with quotas, keyed by their root. A share is scanned the
+// first time it is charged, the writes, truncations and deletes keep its usage up to date afterwards.
+type quotaTable struct {
+	mu     sync.Mutex
+	shares map[string]*shareQuota
+	files  map[string]*quotaFile //the files whose size is changing
+}
+
+var gQuotaTable = &quotaTable{shares: make(map[string]*shareQuota), files: make(map[string]*quotaFile)}
+
+// quotaFile serializes the size changes of one file, each one reads the size and settles its charge
+// before the next one starts.
+type quotaFile struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockFile waits until the size of the file name is nobody else's to change, it returns the unlock.
+// Files of shares without quotas are not charged and not locked.
+func (t *quotaTable) lockFile(name string) func() {
+	if t.shareOf(name) == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	f := t.files[name]
+	if f == nil {
+		f = &quotaFile{}
+		t.files[name] = f
+	}
+	f.refs++
+	t.mu.Unlock()
+	f.mu.Lock()
+	return func() {
+		f.mu.Unlock()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if f.refs--; f.refs == 0 {
+			delete(t.files, name)
+		}
+	}
+}
+
+// open starts keeping the usage of the share of anchor, fsys serves it.
+func (t *quotaTable) open(anchor *Anchor, fsys webdav.FileSystem) {
+	if !anchor.hasQuota() || fsys == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	root := path.Clean(anchor.RootPath)
+	if q, ok := t.shares[root]; ok {
+		q.anchor = anchor
+		return
+	}
+	t.shares[root] = &shareQuota{anchor: anchor, fsys: fsys, users: make(map[string]*userUsage)}
+}
+
+// shareOf is the share with quotas name belongs to, nil when there is none. Its usage is scanned.
+func (t *quotaTable) shareOf(name string) *shareQuota {
+	//streams are not charged, only the data of the files
+	if _, stream := splitStreamPath(name); name == "" || stream != "" {
+		return nil
+	}
+	t.mu.Lock()
+	var q *shareQuota
+	root := ""
+	for r, s := range t.shares {
+		if (name == r || strings.HasPrefix(name, strings.TrimSuffix(r, "/")+"/")) && len(r) > len(root) {
+			root, q = r, s
+		}
+	}
+	t.mu.Unlock()
+	if q != nil {
+		q.scan.Do(func() { t.scanShare(root, q) })
+	}
+	return q
+}
+
+// scanShare adds up the files below root and the users they are charged to.
+func (t *quotaTable) scanShare(root string, q *shareQuota) {
+	var used uint64
+	users := make(map[string]uint64)
+	var walk func(dir string)
+	walk = func(dir string) {
+		f, err := q.fsys.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+		if err != nil {
+			logx.Warnf("quota of %v, err: %v", dir, err)
+			return
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			logx.Warnf("quota of %v, err: %v", dir, err)
+		}
+		for _, fi := range infos {
+			name := path.Join(dir, fi.Name())
+			if storeEntry(fi.Name()) {
+				continue
+			}
+			if fi.IsDir() {
+				walk(name)
+				continue
+			}
+			used += uint64(fi.Size())
+			if owner := q.owner(name); owner != "" {
+				users[owner] += uint64(fi.Size())
+			}
+		}
+	}
+	walk(root)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	q.used += used
+	for user, n := range users {
+		u := q.user(user)
+		u.used += n
+		u.change = now
+	}
+}
+
+// user is the usage of userName, t.mu is held.
+func (q *shareQuota) user(userName string) *userUsage {
+	u := q.users[userName]
+	if u == nil {
+		u = &userUsage{}
+		q.users[userName] = u
+	}
+	return u
+}
+
+// owner is the user the file name is charged to, empty when nobody is.
+func (q *shareQuota) owner(name string) string {
+	d, ok := diskDir(q.fsys)
+	if !ok {
+		return ""
+	}
+	buf, err := XAttrGet(dirPath(d, name), kQuotaOwnerXattr)
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+// setOwner charges the file name to userName from now on.
+func (q *shareQuota) setOwner(name, userName string) {
+	if d, ok := diskDir(q.fsys); ok {
+		if err := XAttrSet(dirPath(d, name), kQuotaOwnerXattr, []byte(userName)); err != nil {
+			logx.Debugf("quota owner of %v, err: %v", name, err)
+		}
+	}
+}
+
+// created charges the new file name to userName, the user that created it.
+func (t *quotaTable) created(name, userName string) {
+	if q := t.shareOf(name); q != nil {
+		q.setOwner(name, userName)
+	}
+}
+
+// charge adds delta bytes to the file name, userName changed its size. A file nobody is charged for
+// yet is charged to userName. A growth that takes the share or the owner of the file over its limit
+// is refused with STATUS_DISK_FULL and nothing is charged.
+func (t *quotaTable) charge(name, userName string, delta int64) Status {
+	q := t.shareOf(name)
+	if q == nil || delta == 0 {
+		return StatusOk
+	}
+	owner := q.owner(name)
+	if owner == "" && delta > 0 {
+		owner = userName
+		q.setOwner(name, owner)
+	}
+	if delta < 0 {
+		t.discharge(name, owner, uint64(-delta))
+		return StatusOk
+	}
+	_, limit := q.anchor.userLimit(owner)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := q.user(owner)
+	if (q.anchor.QuotaLimit != 0 && q.used+uint64(delta) > q.anchor.QuotaLimit) || u.used+uint64(delta) > limit {
+		return STATUS_DISK_FULL
+	}
+	q.used += uint64(delta)
+	u.used += uint64(delta)
+	u.change = time.Now()
+	return StatusOk
+}
+
+// quotaWrite is a write the share of its file charged for, the other writes of the file wait until
+// it is settled.
+type quotaWrite struct {
+	t        *quotaTable
+	name     string
+	userName string
+	size     int64 //the size of the file before the write
+	charged  int64
+	unlock   func()
+}
+
+// reserveWrite charges userName for the bytes a write of length at offset adds to the open file name.
+// The caller settles the write once it is done, nil is returned when the share has no quota.
+func (t *quotaTable) reserveWrite(name, userName string, webfile webdav.File, offset, length uint64) (*quotaWrite, Status) {
+	if t.shareOf(name) == nil {
+		return nil, StatusOk
+	}
+	unlock := t.lockFile(name)
+	fi, err := webfile.Stat()
+	if err != nil {
+		unlock()
+		return nil, StatusOk
+	}
+	w := &quotaWrite{t: t, name: name, userName: userName, size: fi.Size(), unlock: unlock}
+	if end := offset + length; end > uint64(fi.Size()) {
+		w.charged = int64(end) - fi.Size()
+		if stat := t.charge(name, userName, w.charged); stat != StatusOk {
+			unlock()
+			return nil, stat
+		}
+	}
+	return w, StatusOk
+}
+
+// settle charges what the write really added to webfile, a failed or short write gives back the
+// rest. The next write of the file goes on.
+func (w *quotaWrite) settle(webfile webdav.File) {
+	if w == nil {
+		return
+	}
+	defer w.unlock()
+	fi, err := webfile.Stat()
+	if err != nil {
+		return
+	}
+	var grown int64
+	if fi.Size() > w.size {
+		grown = fi.Size() - w.size
+	}
+	if grown != w.charged {
+		w.t.charge(w.name, w.userName, grown-w.charged)
+	}
+}
+
+// fileUsage is the owner and the size of the file name, read before it is removed.
+func (t *quotaTable) fileUsage(name string) (owner string, size uint64) {
+	q := t.shareOf(name)
+	if q == nil {
+		return "", 0
+	}
+	fi, err := q.fsys.Stat(context.Background(), name)
+	if err != nil || fi.IsDir() {
+		return "", 0
+	}
+	return q.owner(name), uint64(fi.Size())
+}
+
+// discharge takes size bytes of owner off the share of name, the file shrank or went away.
+func (t *quotaTable) discharge(name, owner string, size uint64) {
+	q := t.shareOf(name)
+	if q == nil || size == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q.used -= minUint64(q.used, size)
+	if owner != "" {
+		u := q.user(owner)
+		u.used -= minUint64(u.used, size)
+		u.change = time.Now()
+	}
+}
+
+// view bounds vs by what userName may still store on the share of anchor, the volume as the user sees it.
+func (t *quotaTable) view(anchor *Anchor, userName string, vs VolumeStat) VolumeStat {
+	if !anchor.hasQuota() {
+		return vs
+	}
+	q := t.shareOf(path.Clean(anchor.RootPath))
+	if q == nil {
+		return vs
+	}
+	_, limit := anchor.userLimit(userName)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bound := func(limit, used uint64) {
+		vs.Total = minUint64(vs.Total, limit)
+		vs.Available = minUint64(vs.Available, limit-minUint64(limit, used))
+	}
+	if anchor.QuotaLimit != 0 {
+		bound(anchor.QuotaLimit, q.used)
+	}
+	if limit != kNoQuotaLimit {
+		bound(limit, q.user(userName).used)
+	}
+	return vs
+}
+
+// quotaEntry is the usage and the limits of a user, FILE_QUOTA_INFORMATION.
+type quotaEntry struct {
+	user      string
+	used      uint64
+	change    time.Time
+	threshold uint64
+	limit     uint64
+}
+
+// entries are the users of the share of name sorted by name, userName is always one of them.
+func (t *quotaTable) entries(name, userName string) []quotaEntry {
+	q := t.shareOf(name)
+	if q == nil {
+		return nil
+	}
+	t.mu.Lock()
+	q.user(userName)
+	entries := make([]quotaEntry, 0, len(q.users))
+	for user, u := range q.users {
+		entries = append(entries, quotaEntry{user: user, used: u.used, change: u.change})
+	}
+	t.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].user < entries[j].user })
+	for i := range entries {
+		entries[i].threshold, entries[i].limit = q.anchor.userLimit(entries[i].user)
+	}
+	return entries
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// AccountMap is implemented by an IdMap that knows the SIDs of the users that log on, quota entries
+// name their users with them.
+type AccountMap interface {
+	AccountSID(userName string) SID
+}
+
+// kAccountDomain are the domain sub authorities of the SIDs made up for users no AccountMap knows,
+// "smbapi-srv" in ASCII.
+var kAccountDomain = []uint32{21, 0x736d6261, 0x70692d73, 0x72760000}
+
+// accountSID is the SID of the user userName, a hash of the name in a domain of the server unless the
+// IdMap knows it.
+func (s *SessionS) accountSID(userName string) SID {
+	if m, ok := s.ids().(AccountMap); ok {
+		return m.AccountSID(userName)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(userName)))
+	sub := append(append([]uint32{}, kAccountDomain...), 1000+h.Sum32()%(1<<30))
+	return SID{Authority: 5, SubAuthorities: sub}
+}
+
+// kQueryQuotaInfoSize is the fixed part of SMB2_QUERY_QUOTA_INFO.
+const kQueryQuotaInfoSize = 16
+
+var errQuotaQuery = errors.New("malformed quota query")
+
+// quotaQuery is the SMB2_QUERY_QUOTA_INFO of a QUERY_INFO, MS-SMB2 2.2.37.1.
+type quotaQuery struct {
+	returnSingle bool
+	restartScan  bool
+	sids         []SID //the SidList, the users asked for
+	startSid     *SID
+}
+
+func parseQuotaQuery(buf []byte) (*quotaQuery, error) {
+	if len(buf) < kQueryQuotaInfoSize {
+		return nil, errQuotaQuery
+	}
+	q := &quotaQuery{returnSingle: buf[0] != 0, restartScan: buf[1] != 0}
+	listLength := int(binary.LittleEndian.Uint32(buf[4:]))
+	startLength := int(binary.LittleEndian.Uint32(buf[8:]))
+	startOffset := int(binary.LittleEndian.Uint32(buf[12:]))
+	if listLength > 0 {
+		//FILE_GET_QUOTA_INFORMATION entries
+		list := buf[kQueryQuotaInfoSize:]
+		if listLength > len(list) {
+			return nil, errQuotaQuery
+		}
+		list = list[:listLength]
+		for off := 0; ; {
+			if off+8 > len(list) {
+				return nil, errQuotaQuery
+			}
+			next := int(binary.LittleEndian.Uint32(list[off:]))
+			sidLength := int(binary.LittleEndian.Uint32(list[off+4:]))
+			if off+8+sidLength > len(list) {
+				return nil, errQuotaQuery
+			}
+			sid, err := parseSID(list[off+8 : off+8+sidLength])
+			if err != nil {
+				return nil, err
+			}
+			q.sids = append(q.sids, sid)
+			if next == 0 {
+				break
+			}
+			off += next
+		}
+	} else if startLength > 0 {
+		if startOffset < kQueryQuotaInfoSize || startOffset+startLength > len(buf) {
+			return nil, errQuotaQuery
+		}
+		sid, err := parseSID(buf[startOffset : startOffset+startLength])
+		if err != nil {
+			return nil, err
+		}
+		q.startSid = &sid
+	}
+	return q, nil
+}
+
+// quotaScan is the next entry a quota enumeration of the open guid returns.
+func (s *SessionS) quotaScan(guid GUID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quotaScans[guid]
+}
+
+func (s *SessionS) setQuotaScan(guid GUID, next int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.openedFiles[guid]; ok {
+		s.quotaScans[guid] = next
+	}
+}
@@ -0,0 +1,169 @@
+package smb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func Test_Quota(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "old.txt"), make([]byte, 10), 0666))
+	anchor := NewAnchor("share", dir)
+	anchor.QuotaLimit = 100
+	anchor.Quota = func(userName string) (uint64, uint64) {
+		if userName == "user" {
+			return 20, 30
+		}
+		return 0, 0
+	}
+	session, tree := testDurableSession(dir, anchor)
+	bob, bobTree := testDurableSession(dir, anchor)
+	bob.userName = "bob"
+
+	write := func(session *SessionS, tree *TreeS, fileid GUID, offset uint64, n int) Status {
+		req := WriteRequest{
+			Header:        Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandWrite, TreeID: tree.id},
+			StructureSize: 49,
+			DataLength:    uint32(n),
+			FileOffset:    offset,
+			FileId:        fileid,
+			Data:          make([]byte, n),
+		}
+		resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+		assert.Nil(t, err)
+		if resp, ok := resp.(ErrResponse); ok {
+			return resp.Header.Status
+		}
+		return StatusOk
+	}
+	setInfo := func(fileid GUID, class FileInformationClass, info interface{}) Status {
+		return testSetInfo(t, session, tree, SetInfoRequest{FileInfoClass: class, FileId: fileid}, info)
+	}
+
+	//a user writes up to the limit, rewriting what the file has is free
+	fileid, _ := testFileId(testCreate(t, session, tree, testOpen("a.txt", FILE_READ_DATA|FILE_WRITE_DATA|DELETE, FILE_CREATE, 0)))
+	assert.Equal(t, StatusOk, write(session, tree, fileid, 0, 25))
+	assert.Equal(t, StatusOk, write(session, tree, fileid, 0, 25))
+	assert.Equal(t, STATUS_DISK_FULL, write(session, tree, fileid, 25, 10))
+	assert.Equal(t, STATUS_DISK_FULL, setInfo(fileid, FileEndOfFileInformation, &FileEndOfFileInformationX{EndOfFile: 31}))
+	fi, _ := os.Stat(filepath.Join(dir, "a.txt"))
+	assert.Equal(t, int64(25), fi.Size())
+
+	//the owner is kept where no extended attribute reaches, whatever the share maps them to
+	owner, err := XAttrGet(filepath.Join(dir, "a.txt"), kQuotaOwnerXattr)
+	assert.Nil(t, err)
+	assert.Equal(t, "user", string(owner))
+	eas, err := readEAs(verbatimEAMap{}, filepath.Join(dir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Empty(t, eas)
+	for _, name := range []string{kQuotaOwnerXattr, kXattrUserPrefix + kQuotaOwnerXattr} {
+		assert.Equal(t, STATUS_INVALID_EA_NAME, checkEAs(verbatimEAMap{}, []EA{{Name: name, Value: []byte("bob")}}))
+	}
+
+	//the volume shows what the quota leaves
+	vs := gQuotaTable.view(anchor, "user", VolumeStat{Total: 1 << 30, Free: 1 << 30, Available: 1 << 30})
+	assert.Equal(t, VolumeStat{Total: 30, Free: 1 << 30, Available: 5}, vs)
+
+	//the quota of the user is listed with its usage
+	req := QueryInfoRequest{
+		Header:             Header{ProtocolID: []byte(ProtocolSmb2), HeaderLength: 64, Command: CommandQueryInfo, TreeID: tree.id},
+		StructureSize:      41,
+		Class:              SMB2_0_INFO_QUOTA,
+		OutputBufferLength: 4096,
+		FileId:             fileid,
+		InputBuffer:        []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	resp, err := req.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Nil(t, err)
+	buf := resp.(*QueryInfoResponse).OutputBuffer
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(buf))
+	assert.Equal(t, uint64(25), binary.LittleEndian.Uint64(buf[16:]))
+	assert.Equal(t, uint64(20), binary.LittleEndian.Uint64(buf[24:]))
+	assert.Equal(t, uint64(30), binary.LittleEndian.Uint64(buf[32:]))
+	sid, err := parseSID(buf[40:])
+	assert.Nil(t, err)
+	assert.True(t, sid.Equal(session.accountSID("user")))
+	req.InputBuffer[1] = 0
+	resp, _ = req.ServerAction(NewDataCtx(session, nil, testHandle))
+	assert.Equal(t, STATUS_NO_MORE_ENTRIES, resp.(ErrResponse).Header.Status)
+
+	//a shrinking file gives space back, the share bounds every user together
+	assert.Equal(t, StatusOk, setInfo(fileid, FileEndOfFileInformation, &FileEndOfFileInformationX{EndOfFile: 5}))
+	other, _ := testFileId(testCreate(t, bob, bobTree, testOpen("b.txt", FILE_READ_DATA|FILE_WRITE_DATA|DELETE, FILE_CREATE, 0)))
+	assert.Equal(t, STATUS_DISK_FULL, write(bob, bobTree, other, 0, 90))
+	assert.Equal(t, StatusOk, write(bob, bobTree, other, 0, 80))
+
+	//a directory is not replaced by a rename, the files below it stay charged
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "d"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "d", "c.txt"), []byte("c"), 0666))
+	rename := &FileRenameInformationX{ReplaceIfExists: 1, Reserved: make([]byte, 7), FileName: encoder.ToUnicode("d")}
+	assert.Equal(t, STATUS_ACCESS_DENIED, setInfo(fileid, FileRenameInformation, rename))
+	_, err = os.Stat(filepath.Join(dir, "d", "c.txt"))
+	assert.Nil(t, err)
+
+	//a deleted file leaves the share
+	assert.Equal(t, StatusOk, setInfo(fileid, FileDispositionInformation, &FileDispositionInformationX{DeletePending: 1}))
+	webfile, _ := session.DelFile(fileid)
+	webfile.Close()
+	assert.Equal(t, StatusOk, write(bob, bobTree, other, 80, 10))
+	webfile, _ = bob.DelFile(other)
+	webfile.Close()
+}
+
+// verbatimEAMap keeps an extended attribute under its own name.
+type verbatimEAMap struct{}
+
+func (verbatimEAMap) Key(name string) string         { return name }
+func (verbatimEAMap) Name(key string) (string, bool) { return key, true }
+
+func Test_QuotaWriteSettle(t *testing.T) {
+	dir := t.TempDir()
+	anchor := NewAnchor("share", dir)
+	anchor.QuotaLimit = 1000
+	gQuotaTable.open(anchor, webdav.Dir("/"))
+	path := filepath.Join(dir, "a.txt")
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	available := func() uint64 {
+		return gQuotaTable.view(anchor, "user", VolumeStat{Total: 1 << 30, Free: 1 << 30, Available: 1 << 30}).Available
+	}
+
+	//a second write that extends the file waits until the first one is settled
+	first, stat := gQuotaTable.reserveWrite(path, "user", file, 0, 100)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, uint64(900), available())
+	reserved := make(chan *quotaWrite)
+	go func() {
+		second, _ := gQuotaTable.reserveWrite(path, "user", file, 0, 100)
+		reserved <- second
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("the second write did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = file.WriteAt(make([]byte, 100), 0)
+	assert.Nil(t, err)
+	first.settle(file)
+	second := <-reserved
+	second.settle(file)
+	assert.Equal(t, uint64(900), available())
+
+	//a short write is charged for what it wrote
+	short, stat := gQuotaTable.reserveWrite(path, "user", file, 100, 100)
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, uint64(800), available())
+	_, err = file.WriteAt(make([]byte, 40), 100)
+	assert.Nil(t, err)
+	short.settle(file)
+	assert.Equal(t, uint64(860), available())
+}
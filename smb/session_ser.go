@@ -2,11 +2,13 @@ package smb
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"net"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github/izouxv/smbapi/gss"
@@ -26,24 +28,70 @@ type SessionS struct {
 	session
 
 	fileNum uint64
+	mu      sync.Mutex //guards openedFiles, filePaths, fileTrees, fileModes, quotaScans, eaScans, durable, notify, watches, trees and the async requests
 	//tree
-	openedFiles map[GUID]webdav.File
-	srvsvc      GUID
+	openedFiles   map[GUID]webdav.File
+	filePaths     map[GUID]string
+	fileTrees     map[GUID]uint32 //reclaimed durable opens, their FileId names the tree they were opened on
+	fileModes     map[GUID]fileMode
+	quotaScans    map[GUID]int //the next entry of the quota enumeration of an open
+	eaScans       map[GUID]int //the next entry of the EA enumeration of an open
+	durable       map[GUID]*durableOpen
+	durableMax    time.Duration              //Config.DurableTimeout
+	store         *handleStore               //Config.PersistentStore, nil when persistent handles are off
+	idMap         IdMap                      //Config.IdMap
+	userIds       UserIdsFunc                //Config.UserIds
+	takeOwnership func(userName string) bool //Config.TakeOwnership
+	unixIds       struct {                   //the unix ids of userName, looked up once
+		once sync.Once
+		uid  uint32
+		gids []uint32
+		ok   bool
+	}
+	model    string //Config.Model
+	srvsvc   GUID
+	userName string
 
 	//server level
-	SessionKey      []byte
-	ServerChallenge uint64
-	getPwd          GetPwdFunc
-	getTree         GetAnchorFun
-	anchors         map[string]*Anchor
-	activeAnchorKey string //当前的anchor
-
-	//current anchor key, TODO 每次切换的时候都会新建一个tree. 但是这个treeid不会变. 来回切换anchor多线程怎么处理? 还没理解.
+	SessionKey       []byte
+	SigningKey       []byte
+	signingAlgorithm uint16
+	EncryptionKey    []byte //ServerOut, server to client
+	DecryptionKey    []byte //ServerIn, client to server
+	ApplicationKey   []byte
+
+	//negotiate
+	clientGuid         []byte
+	clientCapabilities uint32
+	clientSecurityMode uint16
+	capabilities       uint32
+	serverSecurityMode uint16
+	cipherId           uint16 //3.1.1 cipher, 0 if none was agreed
+	preauthHash        []byte //3.1.1 preauth integrity hash, SHA-512
+	aaplDone           bool   //guarded by mu, the AAPL context was answered
+	aaplCaps           uint64 //guarded by mu, the AAPL server caps of the connection
+	EncryptData        bool   //every request of the session must be encrypted
+	encryptNonce       uint64
+	noncePrefix        []byte
+	ServerChallenge    uint64
+	getPwd             GetPwdFunc
+	getTree            GetAnchorFun
+	anchors            map[string]*Anchor
+	trees              map[uint32]*TreeS //connected trees, key is Header.TreeID
 
 	//dcerpc for IPC$
 	pdb PDUHeaderStruct
 
-	notify map[GUID]*ChangeNotifyRequest
+	notify  map[GUID][]*pendingNotify //the CHANGE_NOTIFY requests waiting on an open, first come first
+	watches map[GUID]*notifyWatch     //directory opens a CHANGE_NOTIFY watches
+
+	//requests in progress, key is MessageID
+	ops        map[uint64]*asyncOp
+	asyncId    uint64
+	credits    *creditWindow
+	out        chan []byte
+	outDone    chan struct{}
+	outStopped bool //guarded by mu, the writer is gone and notifications are dropped
 }
 
 func NewSessionServer(debug bool, conn net.Conn, getPwd GetPwdFunc, getTree GetAnchorFun) (s *SessionS) {
@@ -58,8 +106,19 @@ func NewSessionServer(debug bool, conn net.Conn, getPwd GetPwdFunc, getTree GetA
 			conn:              conn,
 		},
 		anchors:     make(map[string]*Anchor),
+		trees:       make(map[uint32]*TreeS),
 		openedFiles: make(map[GUID]webdav.File),
-		notify:      make(map[GUID]*ChangeNotifyRequest),
+		filePaths:   make(map[GUID]string),
+		fileTrees:   make(map[GUID]uint32),
+		fileModes:   make(map[GUID]fileMode),
+		quotaScans:  make(map[GUID]int),
+		eaScans:     make(map[GUID]int),
+		durable:     make(map[GUID]*durableOpen),
+		notify:      make(map[GUID][]*pendingNotify),
+		watches:     make(map[GUID]*notifyWatch),
+		ops:         make(map[uint64]*asyncOp),
+		credits:     newCreditWindow(nil),
+		noncePrefix: newNoncePrefix(),
 		getPwd:      getPwd,
 		getTree:     getTree,
 		// latestFileId: NilGUID,
@@ -82,10 +141,31 @@ func (s *SessionS) NegotiateProtocolServer() (err error) {
 		if err != nil {
 			return err
 		}
+		if _, ok := data.(headerI); ok && !s.consumeCredits(reqMsg) {
+			return ErrInvalidMessageId
+		}
+		if cmd == CommandSessionSetup {
+			//the keys derived by the last leg cover its request
+			s.updatePreauthHash(reqMsg)
+		}
 		respBuf, err := ServerAction(ctx, cmd, data)
 		if err != nil {
 			return err
 		}
+		s.grantCredits(respBuf, data)
+		if _, ok := data.(*NegotiateRequest); ok {
+			//the dialect is known now
+			s.updatePreauthHash(reqMsg)
+			s.updatePreauthHash(respBuf)
+		} else if cmd == CommandSessionSetup && Status(binary.LittleEndian.Uint32(respBuf[8:])) != StatusOk {
+			s.updatePreauthHash(respBuf)
+		}
+		//the final SESSION_SETUP response proves the server knows the session key
+		if cmd == CommandSessionSetup && Status(binary.LittleEndian.Uint32(respBuf[8:])) == StatusOk &&
+			s.shouldSign(s.dialect >= DialectSmb_3_0) {
+			setSigned(respBuf)
+			s.signCompound(respBuf)
+		}
 		// logx.Printf("respBuf: \n%v", hex.Dump(respBuf))
 		return s.Send(respBuf, rw)
 	}
@@ -103,7 +183,8 @@ func (s *SessionS) NegotiateProtocolServer() (err error) {
 		return err
 	}
 	if ver == ProtocolSmb {
-		//优先处理smb1
+		//优先处理smb1, 它用掉了MessageID 0
+		s.credits.consume(0, 1)
 		var reqSmb1Negotiate NegotiateSmb1Request
 		if err = simpleReqAction(reqMsg, CommandNegotiate, &reqSmb1Negotiate); err != nil {
 			logx.Errorf("reqNegotiate, err: %v", err)
@@ -145,19 +226,93 @@ func (s *SessionS) NegotiateProtocolServer() (err error) {
 	return nil
 }
 
-func (session *SessionS) SetActiveAnchorKey(activeAnchorKey string) bool {
-	activeAnchorKey = strings.ToUpper(activeAnchorKey)
-	_, ok := session.anchors[activeAnchorKey]
-	if ok {
-		session.activeAnchorKey = activeAnchorKey
+// Close flushes and closes every file the session still holds open.
+func (s *SessionS) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for guid, webfile := range s.openedFiles {
+		s.forgetFile(guid)
+		if webfile == nil {
+			continue
+		}
+		if file, ok := webfile.(*os.File); ok {
+			if fi, serr := file.Stat(); serr == nil && !fi.IsDir() {
+				if serr = file.Sync(); serr != nil && err == nil {
+					err = serr
+				}
+			}
+		}
+		if cerr := webfile.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	return ok
+	for guid := range s.notify {
+		s.cleanupNotify(guid)
+	}
+	return err
 }
-func (session *SessionS) GetAbsPath(path string) string {
-	anchor, _ := session.anchors[session.activeAnchorKey]
-	root := anchor.RootPath
-	fullpath := filepath.Join(root, filepath.ToSlash(path))
-	return fullpath
+
+// TreeS is one TREE_CONNECT of the session, every request resolves its share by Header.TreeID.
+type TreeS struct {
+	id     uint32
+	anchor *Anchor
+}
+
+func (t *TreeS) IsIPC() bool {
+	return strings.EqualFold(t.anchor.Name, NamedPipeShareName)
+}
+
+// GetAbsPath joins path to the root of the share.
+func (t *TreeS) GetAbsPath(path string) string {
+	return filepath.Join(t.anchor.RootPath, filepath.ToSlash(path))
+}
+
+func (session *SessionS) TreeConnect(anchor *Anchor) *TreeS {
+	tree := &TreeS{id: atomic.AddUint32(&treeId, 1), anchor: anchor}
+	session.mu.Lock()
+	session.trees[tree.id] = tree
+	session.mu.Unlock()
+	return tree
+}
+
+// TreeDisconnect forgets the tree and closes the files opened through it.
+func (session *SessionS) TreeDisconnect(tid uint32) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if _, ok := session.trees[tid]; !ok {
+		return false
+	}
+	delete(session.trees, tid)
+	for guid, webfile := range session.openedFiles {
+		if session.fileTree(guid) != tid {
+			continue
+		}
+		session.forgetFile(guid)
+		if webfile != nil {
+			webfile.Close()
+		}
+	}
+	return true
+}
+
+func (session *SessionS) GetTree(tid uint32) *TreeS {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	tree, ok := session.trees[tid]
+	if !ok {
+		return nil
+	}
+	return tree
+}
+
+// GetAbsPath resolves path against the share of tree tid.
+func (session *SessionS) GetAbsPath(tid uint32, path string) string {
+	tree := session.GetTree(tid)
+	if tree == nil {
+		return ""
+	}
+	return tree.GetAbsPath(path)
 }
 func (session *SessionS) SetAnchor(fileNum uint64, items []*Anchor) {
 	for _, item := range items {
@@ -180,11 +335,52 @@ type DataCtx struct {
 
 	//batch message var
 	latestFileId GUID
+	latestTreeId uint32
 	closeAction  func()
+
+	op        *asyncOp //nil when the request can not go async
+	encrypted bool     //the request came in a transform header
 }
 
-func (d *DataCtx) Handle() *Handler {
-	return d.handle(d.session.activeAnchorKey)
+// Handle returns the handler of the share connected as tree tid.
+func (d *DataCtx) Handle(tid uint32) *Handler {
+	tree := d.session.GetTree(d.TreeID(tid))
+	if tree == nil {
+		return nil
+	}
+	if tree.anchor.Handle != nil {
+		return tree.anchor.Handle
+	}
+	return d.handle(strings.ToUpper(tree.anchor.Name))
+}
+
+// Tree returns the tree of the request, related compound requests use the previous one.
+func (d *DataCtx) Tree(tid uint32) *TreeS {
+	tree := d.session.GetTree(d.TreeID(tid))
+	if tree != nil {
+		d.latestTreeId = tree.id
+	}
+	return tree
+}
+
+func (s *DataCtx) TreeID(tid uint32) uint32 {
+	if tid == kRelatedTreeID {
+		tid = s.latestTreeId
+	}
+	return tid
+}
+
+// Done is closed when the request is cancelled or the connection goes away.
+func (d *DataCtx) Done() <-chan struct{} {
+	if d.op == nil {
+		return nil
+	}
+	return d.op.ctx.Done()
+}
+
+// GoAsync sends the interim STATUS_PENDING response now, handlers that block call it before waiting.
+func (d *DataCtx) GoAsync() bool {
+	return d.session.goAsync(d.op)
 }
 
 func (s *DataCtx) IsVer_2_1() bool {
@@ -200,6 +396,8 @@ func (s *DataCtx) FileID(fileid GUID) GUID {
 	return fileid
 }
 
+const kRelatedTreeID = 0xFFFFFFFF
+
 func NewDataCtx(s *SessionS, conn net.Conn, Handle func(string) *Handler) *DataCtx {
 	return &DataCtx{session: s, conn: conn, handle: Handle, latestFileId: NilGUID}
 }
@@ -250,22 +448,48 @@ func ActionFunc(ctx *DataCtx, msgs []byte) ([]byte, Command, Status) {
 
 	for i, data := range datas {
 		cmd := cmds[i]
-		respBuf, err := ServerAction(ctx, cmd, data)
+		last := i == len(datas)-1
+		signed := false
+		if h, ok := data.(headerI); ok {
+			signed = h.GetHeader().Flags&SMB2_FLAGS_SIGNED != 0
+		}
+		if last {
+			//only the last request of a compound may go async
+			respTotal = ctx.session.startLast(ctx.op, respTotal)
+		}
+		var respBuf []byte
+		var err error
+		if stat := ctx.session.checkCreditCharge(data); stat != StatusOk {
+			respBuf, err = errResponse(data, stat)
+		} else {
+			respBuf, err = ServerAction(ctx, cmd, data)
+		}
+		var asyncId uint64
+		if last {
+			respTotal, asyncId = ctx.session.finishLast(ctx.op, respTotal)
+		}
 		if err != nil {
 			return nil, 0, STATUS_INVALID_PARAMETER
 		}
-		respTotal = append(respTotal, respBuf)
-	}
-
-	//change chain offset
-	for i := 0; i < len(respTotal); i++ {
-		resp := respTotal[i]
-		if i != len(respTotal)-1 {
-			binary.LittleEndian.PutUint32(resp[20:], uint32(len(resp)))
+		if respBuf == nil {
+			continue
+		}
+		if asyncId != 0 {
+			//the interim response granted the credits
+			setAsyncId(respBuf, asyncId)
+			binary.LittleEndian.PutUint16(respBuf[14:], 0)
+		} else {
+			ctx.session.grantCredits(respBuf, data)
 		}
+		if ctx.session.shouldSign(signed) && !ctx.session.encryptResponse(ctx.encrypted) {
+			setSigned(respBuf)
+		}
+		respTotal = append(respTotal, respBuf)
 	}
 
-	return bytes.Join(respTotal, []byte{}), cmds[0], StatusOk
+	respAll := joinCompound(respTotal)
+	ctx.session.signCompound(respAll)
+	return respAll, cmds[0], StatusOk
 
 }
 func ActionParserOneMsgFunc(ctx *DataCtx, msg []byte) (dd DataI, ss Status, cc Command) {
@@ -280,6 +504,16 @@ func ActionParserOneMsgFunc(ctx *DataCtx, msg []byte) (dd DataI, ss Status, cc C
 		// return nil, msg, nil
 	}
 
+	if !ctx.encrypted {
+		//decrypting it authenticated an encrypted request
+		if stat := ctx.session.verifyMessage(msg); stat != StatusOk {
+			return newErrRequest(msg, stat), StatusOk, command
+		}
+	}
+	if stat := ctx.session.checkEncryption(msg, ctx.encrypted); stat != StatusOk {
+		return newErrRequest(msg, stat), StatusOk, command
+	}
+
 	Flags := binary.LittleEndian.Uint32(msg[16:])
 	if Flags&^uint32(SMB2_FLAGS_PRIORITY_MASK) != 0 {
 		// binary.LittleEndian.PutUint32(msg[8:], uint32(STATUS_NOT_SUPPORTED))
@@ -306,6 +540,16 @@ func ActionParserOneMsgFunc(ctx *DataCtx, msg []byte) (dd DataI, ss Status, cc C
 
 }
 
+// errResponse answers data with stat without running it.
+func errResponse(data DataI, stat Status) ([]byte, error) {
+	h, ok := data.(headerI)
+	if !ok {
+		return nil, ErrDataParserError
+	}
+	resp, _ := ERR(*h.GetHeader(), stat)
+	return encoder.Marshal(resp)
+}
+
 var signaturBlank = make([]byte, 16)
 
 func ServerAction(ctx *DataCtx, cmd Command, data DataI) (bbb []byte, eee error) {
@@ -328,24 +572,14 @@ func ServerAction(ctx *DataCtx, cmd Command, data DataI) (bbb []byte, eee error)
 	if err != nil {
 		return nil, err
 	}
+	if resp == nil {
+		//no response, e.g. CANCEL
+		return nil, nil
+	}
 	respBuf, err := encoder.Marshal(resp)
 	if err != nil {
 		return nil, err
 	}
 
-	if true {
-		// // copy(respBuf[48:64], signaturBlank)
-		// //sign
-		// if len(ctx.session.SessionKey) > 0 {
-		// 	content := respBuf[64:]
-		// 	sig, err := CalculateSignature(ctx.session.SessionKey, content, ctx.session.dialect)
-		// 	if err != nil {
-		// 		logx.Errorf("err: %v", err)
-		// 		return nil, err
-		// 	}
-		// 	copy(respBuf[48:64], sig[:16])
-		// }
-	}
-
 	return respBuf, nil
 }
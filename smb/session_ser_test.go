@@ -3,6 +3,8 @@ package smb
 import (
 	"github/izouxv/smbapi/util"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_Ser(t *testing.T) {
@@ -32,3 +34,27 @@ func Test_Ser(t *testing.T) {
 	// t.Logf("resp: %v", resp)
 
 }
+
+func Test_Trees(t *testing.T) {
+	session := NewSessionServer(true, nil, nil, nil)
+	session.SetAnchor(0, []*Anchor{NewAnchor("TestDir1", "/a"), NewAnchor("TestDir2", "/b")})
+
+	tree1 := session.TreeConnect(session.GetAnchor("TestDir1"))
+	tree2 := session.TreeConnect(session.GetAnchor("testdir2"))
+	assert.NotEqual(t, tree1.id, tree2.id)
+	assert.Equal(t, "/a/x/y.txt", session.GetAbsPath(tree1.id, "x/y.txt"))
+	assert.Equal(t, "/b/x/y.txt", session.GetAbsPath(tree2.id, "x/y.txt"))
+
+	guid1 := makeGUID(tree1.id, 1)
+	guid2 := makeGUID(tree2.id, 2)
+	session.openedFiles[guid1] = ipc_file
+	session.openedFiles[guid2] = ipc_file
+
+	assert.Equal(t, true, session.TreeDisconnect(tree1.id))
+	assert.Equal(t, false, session.TreeDisconnect(tree1.id))
+	_, ok := session.openedFiles[guid1]
+	assert.Equal(t, false, ok)
+	_, ok = session.openedFiles[guid2]
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "/b/x", session.GetAbsPath(tree2.id, "x"))
+}
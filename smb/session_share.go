@@ -0,0 +1,317 @@
+package smb
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/izouxv/logx"
+	"golang.org/x/net/webdav"
+)
+
+// kShareCheckedAccess are the rights the share mode of other opens governs, MS-FSA 2.1.5.1.2.
+// An open without any of them is not checked and does not constrain anybody.
+const kShareCheckedAccess = FILE_READ_DATA | FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_EXECUTE | DELETE
+
+// mapGenericAccess turns the generic rights of a DesiredAccess into the file rights they stand for.
+func mapGenericAccess(access AccessMask) AccessMask {
+	if access&(GENERIC_ALL|MAXIMUM_ALLOWED) != 0 {
+		access |= AllAccessMask
+	}
+	if access&GENERIC_READ != 0 {
+		access |= FILE_READ_DATA | FILE_READ_ATTRIBUTES | FILE_READ_EA | READ_CONTROL | SYNCHRONIZE
+	}
+	if access&GENERIC_WRITE != 0 {
+		access |= FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_WRITE_ATTRIBUTES | FILE_WRITE_EA | READ_CONTROL | SYNCHRONIZE
+	}
+	if access&GENERIC_EXECUTE != 0 {
+		access |= FILE_EXECUTE | FILE_READ_ATTRIBUTES | READ_CONTROL | SYNCHRONIZE
+	}
+	return access &^ (GENERIC_ALL | GENERIC_READ | GENERIC_WRITE | GENERIC_EXECUTE | MAXIMUM_ALLOWED)
+}
+
+// shareOpen is the access an open was granted and the access it lets other opens have.
+type shareOpen struct {
+	access        AccessMask
+	share         ShareAccess
+	deleteOnClose bool      //FILE_DELETE_ON_CLOSE, closing the open marks the file delete pending
+	session       *SessionS //the session of the open, nil for a restored persistent open
+}
+
+// denies tells if a, already open, and b can not be open together.
+func (a shareOpen) denies(b shareOpen) bool {
+	if a.access&kShareCheckedAccess == 0 || b.access&kShareCheckedAccess == 0 {
+		return false
+	}
+	conflict := func(x, y shareOpen) bool {
+		return (x.access&(FILE_READ_DATA|FILE_EXECUTE) != 0 && y.share&FILE_SHARE_READ == 0) ||
+			(x.access&(FILE_WRITE_DATA|FILE_APPEND_DATA) != 0 && y.share&FILE_SHARE_WRITE == 0) ||
+			(x.access&DELETE != 0 && y.share&FILE_SHARE_DELETE == 0)
+	}
+	return conflict(a, b) || conflict(b, a)
+}
+
+// shareFile is an opened file, it is removed when its last open goes while a delete is pending.
+type shareFile struct {
+	opens         map[GUID]shareOpen
+	deletePending bool
+	fsys          webdav.FileSystem //removes the file, set with the delete
+}
+
+// shareTable holds the share mode of every open of the server, files are keyed by their absolute path.
+type shareTable struct {
+	mu    sync.Mutex
+	files map[string]*shareFile
+}
+
+var gShareTable = &shareTable{files: make(map[string]*shareFile)}
+
+func (t *shareTable) file(path string) *shareFile {
+	f := t.files[path]
+	if f == nil {
+		f = &shareFile{opens: make(map[GUID]shareOpen)}
+		t.files[path] = f
+	}
+	return f
+}
+
+// open adds the open guid of session on path unless it conflicts with the share mode of other opens,
+// it then returns those opens and adds nothing. A file that is about to be deleted can not be opened again.
+func (t *shareTable) open(path string, guid GUID, session *SessionS, access AccessMask, share ShareAccess) ([]GUID, Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	so := shareOpen{access: mapGenericAccess(access), share: share, session: session}
+	f := t.files[path]
+	if f == nil {
+		t.file(path).opens[guid] = so
+		return nil, StatusOk
+	}
+	if f.deletePending {
+		return nil, STATUS_DELETE_PENDING
+	}
+	var conflicts []GUID
+	for other, o := range f.opens {
+		if o.denies(so) {
+			conflicts = append(conflicts, other)
+		}
+	}
+	if len(conflicts) > 0 {
+		return conflicts, STATUS_SHARING_VIOLATION
+	}
+	f.opens[guid] = so
+	return nil, StatusOk
+}
+
+// restore adds a journaled persistent open, it was granted before a restart.
+func (t *shareTable) restore(path string, guid GUID, access AccessMask, share ShareAccess) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file(path).opens[guid] = shareOpen{access: mapGenericAccess(access), share: share}
+}
+
+// reclaim moves the durable open guid of path to the session that reconnected it.
+func (t *shareTable) reclaim(path string, guid GUID, session *SessionS) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.files[path]; ok {
+		if o, ok := f.opens[guid]; ok {
+			o.session = session
+			f.opens[guid] = o
+		}
+	}
+}
+
+// rename moves the files of oldPath and below it to newPath, it returns their opens and sessions.
+func (t *shareTable) rename(oldPath, newPath string) map[GUID]*SessionS {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	moved := make(map[string]*shareFile)
+	for path, f := range t.files {
+		if to, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(t.files, path)
+			moved[to] = f
+		}
+	}
+	opens := make(map[GUID]*SessionS)
+	for path, f := range moved {
+		t.files[path] = f
+		for guid, o := range f.opens {
+			opens[guid] = o.session
+		}
+	}
+	return opens
+}
+
+// renamedPath is path once oldPath became newPath, ok is false when path is not oldPath or below it.
+func renamedPath(path, oldPath, newPath string) (string, bool) {
+	if path == oldPath {
+		return newPath, true
+	}
+	if strings.HasPrefix(path, oldPath+"/") {
+		return newPath + path[len(oldPath):], true
+	}
+	return "", false
+}
+
+// renameOpens moves the opens of oldPath and of the files below it to newPath, the file was renamed.
+// The tables keyed by the path and the sessions follow, a later delete removes the renamed file.
+func renameOpens(oldPath, newPath string) {
+	opens := gShareTable.rename(oldPath, newPath)
+	gLockTable.rename(oldPath, newPath)
+	gOplockTable.rename(oldPath, newPath)
+	for guid, session := range opens {
+		if session != nil {
+			session.renameFile(guid, oldPath, newPath)
+		}
+		gDurableTable.rename(guid, oldPath, newPath)
+	}
+}
+
+// openState is the access the open guid of path was granted and if the file is about to be deleted.
+func (t *shareTable) openState(path string, guid GUID) (access AccessMask, deletePending bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return 0, false
+	}
+	o := f.opens[guid]
+	return o.access, f.deletePending || o.deleteOnClose
+}
+
+// isOpen tells if path has opens.
+func (t *shareTable) isOpen(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.files[path]
+	return ok
+}
+
+// deleteOnClose makes the file go with the open guid, MS-FSA 2.1.5.1.2.1. CREATE checked it has DELETE access.
+func (t *shareTable) deleteOnClose(path string, guid GUID, fsys webdav.FileSystem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return
+	}
+	if o, ok := f.opens[guid]; ok {
+		o.deleteOnClose = true
+		f.opens[guid] = o
+		f.fsys = fsys
+	}
+}
+
+// setDeletePending sets or clears the delete of path through the open guid, FileDispositionInformation.
+// The file is removed once its last open is closed.
+func (t *shareTable) setDeletePending(path string, guid GUID, pending bool, fsys webdav.FileSystem) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[path]
+	if !ok {
+		return STATUS_FILE_CLOSED
+	}
+	o, ok := f.opens[guid]
+	if !ok {
+		return STATUS_FILE_CLOSED
+	}
+	if o.access&DELETE == 0 {
+		return STATUS_ACCESS_DENIED
+	}
+	f.deletePending = pending
+	f.fsys = fsys
+	return StatusOk
+}
+
+// release removes the open guid of path. The last open of a file whose delete is pending removes it,
+// the directory leases of its parent are broken without waiting, the caller may hold a session lock.
+func (t *shareTable) release(path string, guid GUID) {
+	t.mu.Lock()
+	f, ok := t.files[path]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	if f.opens[guid].deleteOnClose {
+		f.deletePending = true
+	}
+	delete(f.opens, guid)
+	remove := false
+	if len(f.opens) == 0 {
+		delete(t.files, path)
+		remove = f.deletePending && f.fsys != nil
+	}
+	t.mu.Unlock()
+	if !remove {
+		return
+	}
+	owner, size := gQuotaTable.fileUsage(path)
+	gOplockTable.expectChange(path, guid)
+	if err := removeDeleted(f.fsys, path); err != nil {
+		logx.Warnf("delete on close of %v, err: %v", path, err)
+		return
+	}
+	gQuotaTable.discharge(path, owner, size)
+	go sendBreaks(gOplockTable.childBreaks(path, guid))
+}
+
+// removeDeleted removes the file or the empty directory path.
+func removeDeleted(fsys webdav.FileSystem, path string) error {
+	if empty, err := dirEmpty(fsys, path); err != nil {
+		return err
+	} else if !empty {
+		return os.ErrExist
+	}
+	if err := fsys.RemoveAll(context.Background(), path); err != nil {
+		return err
+	}
+	if d, ok := diskDir(fsys); ok {
+		removeSidecar(dirPath(d, path))
+	}
+	return nil
+}
+
+// dirEmpty tells if path is not a directory with entries, only empty directories can be deleted.
+func dirEmpty(fsys webdav.FileSystem, path string) (bool, error) {
+	fi, err := fsys.Stat(context.Background(), path)
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() {
+		return true, nil
+	}
+	dir, err := fsys.OpenFile(context.Background(), path, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	//the sidecars of the attributes and streams are no entries, they go away with the directory
+	entries, err := dir.Readdir(3)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for _, entry := range entries {
+		if !storeEntry(entry.Name()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// openShared registers the open guid of session on path in gShareTable. On a conflict the handle
+// caching of the conflicting opens is broken first, a client that only kept the handle open for its
+// cache closes it and the open is tried again. STATUS_SHARING_VIOLATION is returned when the conflict remains.
+func openShared(path string, guid GUID, session *SessionS, access AccessMask, share ShareAccess, wait func(<-chan struct{}) bool) Status {
+	for {
+		conflicts, stat := gShareTable.open(path, guid, session, access, share)
+		if stat != STATUS_SHARING_VIOLATION {
+			return stat
+		}
+		//every round takes handle caching away, it ends once nothing is left to break
+		if !gOplockTable.breakHandles(path, conflicts, wait) {
+			return STATUS_SHARING_VIOLATION
+		}
+	}
+}
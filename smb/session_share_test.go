@@ -0,0 +1,49 @@
+package smb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShareTable(t *testing.T) {
+	path := "/share/doc.docx"
+	writer, reader, other := makeGUID(1, 1), makeGUID(1, 2), makeGUID(1, 3)
+
+	//Office opens for writing and only lets others read
+	open := func(guid GUID, access AccessMask, share ShareAccess) []GUID {
+		conflicts, _ := gShareTable.open(path, guid, nil, access, share)
+		return conflicts
+	}
+	assert.Nil(t, open(writer, GENERIC_READ|GENERIC_WRITE, FILE_SHARE_READ))
+	assert.Equal(t, []GUID{writer}, open(other, FILE_WRITE_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE))
+	//a reader has to let the writer write
+	assert.Equal(t, []GUID{writer}, open(other, FILE_READ_DATA, FILE_SHARE_READ))
+	assert.Nil(t, open(reader, FILE_READ_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE))
+	//attribute only opens are never checked
+	assert.Nil(t, open(other, FILE_READ_ATTRIBUTES, 0))
+	gShareTable.release(path, other)
+
+	//a batch oplock is broken before the sharing violation, its client closes the cached handle
+	_, stat := gOplockTable.acquire(path, &oplockRequest{open: writer, level: SMB2_OPLOCK_LEVEL_BATCH}, nil)
+	assert.Equal(t, StatusOk, stat)
+	waits := 0
+	stat = openShared(path, other, nil, FILE_WRITE_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE, func(done <-chan struct{}) bool {
+		waits++
+		gOplockTable.release(path, writer)
+		gShareTable.release(path, writer)
+		<-done
+		return true
+	})
+	assert.Equal(t, StatusOk, stat)
+	assert.Equal(t, 1, waits)
+
+	//nothing to break, the conflict stays
+	stat = openShared(path, writer, nil, FILE_WRITE_DATA, 0, nil)
+	assert.Equal(t, STATUS_SHARING_VIOLATION, stat)
+
+	gShareTable.release(path, reader)
+	gShareTable.release(path, other)
+	assert.Equal(t, 0, len(gShareTable.files))
+	assert.Equal(t, AllAccessMask, mapGenericAccess(GENERIC_ALL))
+}
@@ -0,0 +1,113 @@
+package smb
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+
+	"github/izouxv/smbapi/smb/encoder"
+
+	"github.com/izouxv/logx"
+)
+
+// signingAlgorithm is the algorithm a dialect signs with unless the client negotiated another one.
+func signingAlgorithm(dialect uint16) uint16 {
+	switch dialect {
+	case DialectSmb_2_0_2, DialectSmb_2_1:
+		return SigningHmacSha256
+	}
+	return SigningAesCmac
+}
+
+// deriveKeys computes the signing, encryption and application keys once the session key is known.
+func (s *SessionS) deriveKeys() {
+	switch s.dialect {
+	case DialectSmb_2_0_2, DialectSmb_2_1:
+		s.SigningKey = s.SessionKey
+	case DialectSmb_3_1_1:
+		size := 16
+		if s.cipherId == SMB2_ENCRYPTION_AES256_CCM || s.cipherId == SMB2_ENCRYPTION_AES256_GCM {
+			size = 32
+		}
+		s.SigningKey = KDF(s.SessionKey, []byte("SMBSigningKey\x00"), s.preauthHash, 16)
+		s.EncryptionKey = KDF(s.SessionKey, []byte("SMBS2CCipherKey\x00"), s.preauthHash, size)
+		s.DecryptionKey = KDF(s.SessionKey, []byte("SMBC2SCipherKey\x00"), s.preauthHash, size)
+		s.ApplicationKey = KDF(s.SessionKey, []byte("SMBAppKey\x00"), s.preauthHash, 16)
+	default:
+		s.SigningKey = KDF(s.SessionKey, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00"), 16)
+		s.EncryptionKey = KDF(s.SessionKey, []byte("SMB2AESCCM\x00"), []byte("ServerOut\x00"), 16)
+		s.DecryptionKey = KDF(s.SessionKey, []byte("SMB2AESCCM\x00"), []byte("ServerIn \x00"), 16)
+		s.ApplicationKey = KDF(s.SessionKey, []byte("SMB2APP\x00"), []byte("SmbRpc\x00"), 16)
+	}
+}
+
+// shouldSign tells if the response to a request, signed or not, is signed.
+func (s *SessionS) shouldSign(signed bool) bool {
+	return len(s.SigningKey) > 0 && (signed || s.IsSigningRequired)
+}
+
+// verifyMessage checks the signature of one request of a compound.
+func (s *SessionS) verifyMessage(msg []byte) Status {
+	if len(s.SigningKey) == 0 {
+		//not authenticated yet
+		return StatusOk
+	}
+	if HeadFlags(binary.LittleEndian.Uint32(msg[16:]))&SMB2_FLAGS_SIGNED == 0 {
+		if s.IsSigningRequired {
+			return STATUS_ACCESS_DENIED
+		}
+		return StatusOk
+	}
+	tmp := append([]byte(nil), msg...)
+	copy(tmp[48:64], signaturBlank)
+	sig, err := CalculateSignature(s.SigningKey, tmp, s.signingAlgorithm)
+	if err != nil || !hmac.Equal(sig, msg[48:64]) {
+		logx.Warnf("bad signature, MessageID: %v", binary.LittleEndian.Uint64(msg[24:]))
+		return STATUS_ACCESS_DENIED
+	}
+	return StatusOk
+}
+
+func setSigned(buf []byte) {
+	flags := binary.LittleEndian.Uint32(buf[16:])
+	binary.LittleEndian.PutUint32(buf[16:], flags|uint32(SMB2_FLAGS_SIGNED))
+}
+
+// signCompound signs every response of buf flagged SMB2_FLAGS_SIGNED, NextCommand must be final.
+func (s *SessionS) signCompound(buf []byte) {
+	for len(buf) >= 64 {
+		msg := buf
+		next := binary.LittleEndian.Uint32(buf[20:])
+		if next != 0 && int(next) <= len(buf) {
+			msg = buf[:next]
+		}
+		if HeadFlags(binary.LittleEndian.Uint32(msg[16:]))&SMB2_FLAGS_SIGNED != 0 {
+			copy(msg[48:64], signaturBlank)
+			sig, err := CalculateSignature(s.SigningKey, msg, s.signingAlgorithm)
+			if err != nil {
+				logx.Errorf("sign, err: %v", err)
+			} else {
+				copy(msg[48:64], sig)
+			}
+		}
+		if len(msg) == len(buf) {
+			break
+		}
+		buf = buf[len(msg):]
+	}
+}
+
+// errRequest answers a request refused before it runs.
+type errRequest struct {
+	Header
+	errStatus Status
+}
+
+func newErrRequest(msg []byte, stat Status) DataI {
+	req := &errRequest{errStatus: stat}
+	encoder.Unmarshal(msg[:64], &req.Header)
+	return req
+}
+
+func (data *errRequest) ServerAction(ctx *DataCtx) (interface{}, error) {
+	return ERR(data.Header, data.errStatus)
+}
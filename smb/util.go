@@ -1,23 +1,243 @@
 package smb
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 )
 
-func CalculateSignature(SessionKey, data []byte, dialect uint16) ([]byte, error) {
+// signing algorithms, the values are the SMB2_SIGNING_CAPABILITIES ids
+const (
+	SigningHmacSha256 uint16 = 0x0000
+	SigningAesCmac    uint16 = 0x0001
+	SigningAesGmac    uint16 = 0x0002
+)
+
+// CalculateSignature signs the message data, its signature field must be zeroed.
+func CalculateSignature(key, data []byte, algorithm uint16) ([]byte, error) {
 	//3.1.4.1 Signing An Outgoing Message
-	if dialect == DialectSmb_2_0_2 || dialect == DialectSmb_2_1 {
-		return ValidMAC(SessionKey, data), nil
+	switch algorithm {
+	case SigningHmacSha256:
+		return ValidMAC(key, data)[:16], nil
+	case SigningAesCmac:
+		return AesCmac(key, data)
+	case SigningAesGmac:
+		return AesGmac(key, data)
 	}
 	return nil, fmt.Errorf("NA")
 }
 
-func ValidMAC(message, key []byte) []byte {
+func ValidMAC(key, message []byte) []byte {
 	mac := hmac.New(sha256.New, key)
 	mac.Write(message)
 	expectedMAC := mac.Sum(nil)
 	return expectedMAC
 	// return hmac.Equal(messageMAC, expectedMAC)
 }
+
+// AesCmac is AES-CMAC of RFC 4493.
+func AesCmac(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	bs := block.BlockSize()
+
+	//subkeys
+	k1 := make([]byte, bs)
+	block.Encrypt(k1, k1)
+	cmacShift(k1)
+	k2 := append([]byte(nil), k1...)
+	cmacShift(k2)
+
+	n := (len(data) + bs - 1) / bs
+	last := make([]byte, bs)
+	if n > 0 && len(data)%bs == 0 {
+		xorBytes(last, data[(n-1)*bs:], k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := data[(n-1)*bs:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBytes(last, last, k2)
+	}
+
+	x := make([]byte, bs)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, x, data[i*bs:(i+1)*bs])
+		block.Encrypt(x, x)
+	}
+	xorBytes(x, x, last)
+	block.Encrypt(x, x)
+	return x, nil
+}
+
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// cmacShift shifts b left by one bit and applies Rb on carry.
+func cmacShift(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] <<= 1
+	if carry != 0 {
+		b[len(b)-1] ^= 0x87
+	}
+}
+
+// AesGmac signs a SMB 3.1.1 message, the nonce is made of its MessageId, sender and CANCEL bits.
+func AesGmac(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 64 {
+		return nil, ErrStructSizeInvalid
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	copy(nonce, data[24:32])
+	var role uint32
+	if HeadFlags(binary.LittleEndian.Uint32(data[16:]))&SMB2_FLAGS_RESPONSE != 0 {
+		role |= 1
+	}
+	if Command(binary.LittleEndian.Uint16(data[12:])) == CommandCancel {
+		role |= 2
+	}
+	binary.LittleEndian.PutUint32(nonce[8:], role)
+	return gcm.Seal(nil, nonce, nil, data), nil
+}
+
+// aesCcm is AES-CCM of NIST SP800-38C, crypto/cipher has no CCM mode.
+type aesCcm struct {
+	block     cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+// NewAesCcm returns AES-CCM with a nonceSize nonce (7 to 13 bytes) and a tagSize tag (4 to 16 bytes, even).
+func NewAesCcm(key []byte, nonceSize, tagSize int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if nonceSize < 7 || nonceSize > 13 || tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("invalid CCM parameters")
+	}
+	return &aesCcm{block: block, nonceSize: nonceSize, tagSize: tagSize}, nil
+}
+
+func (c *aesCcm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *aesCcm) Overhead() int {
+	return c.tagSize
+}
+
+// mac is the CBC-MAC of the formatted nonce, additional data and plaintext.
+func (c *aesCcm) mac(nonce, plaintext, additionalData []byte) []byte {
+	q := 15 - c.nonceSize
+	b := make([]byte, 16)
+	b[0] = byte((c.tagSize-2)/2<<3 | (q - 1))
+	if len(additionalData) > 0 {
+		b[0] |= 0x40
+	}
+	copy(b[1:], nonce)
+	n := uint64(len(plaintext))
+	for i := 15; i > c.nonceSize; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	x := make([]byte, 16)
+	c.block.Encrypt(x, b)
+
+	cbc := func(data []byte) {
+		for len(data) > 0 {
+			m := copy(b, data)
+			for i := m; i < 16; i++ {
+				b[i] = 0
+			}
+			xorBytes(x, x, b)
+			c.block.Encrypt(x, x)
+			data = data[m:]
+		}
+	}
+	if len(additionalData) > 0 {
+		var a []byte
+		if len(additionalData) < 0xFF00 {
+			a = make([]byte, 2)
+			binary.BigEndian.PutUint16(a, uint16(len(additionalData)))
+		} else {
+			a = []byte{0xFF, 0xFE, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(a[2:], uint32(len(additionalData)))
+		}
+		cbc(append(a, additionalData...))
+	}
+	cbc(plaintext)
+	return x[:c.tagSize]
+}
+
+// ctr xors src with the key stream starting at counter 1, s0 is the block of counter 0.
+func (c *aesCcm) ctr(dst, src, nonce []byte) (s0 []byte) {
+	ctr := make([]byte, 16)
+	ctr[0] = byte(14 - c.nonceSize)
+	copy(ctr[1:], nonce)
+	s0 = make([]byte, 16)
+	c.block.Encrypt(s0, ctr)
+	ctr[15] = 1
+	cipher.NewCTR(c.block, ctr).XORKeyStream(dst, src)
+	return s0
+}
+
+func (c *aesCcm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("smb: incorrect nonce length given to CCM")
+	}
+	tag := c.mac(nonce, plaintext, additionalData)
+	ret := make([]byte, len(plaintext)+c.tagSize)
+	s0 := c.ctr(ret, plaintext, nonce)
+	xorBytes(ret[len(plaintext):], tag, s0)
+	return append(dst, ret...)
+}
+
+func (c *aesCcm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize || len(ciphertext) < c.tagSize {
+		return nil, fmt.Errorf("smb: message authentication failed")
+	}
+	n := len(ciphertext) - c.tagSize
+	plaintext := make([]byte, n)
+	s0 := c.ctr(plaintext, ciphertext[:n], nonce)
+	tag := make([]byte, c.tagSize)
+	xorBytes(tag, ciphertext[n:], s0)
+	if !hmac.Equal(tag, c.mac(nonce, plaintext, additionalData)) {
+		return nil, fmt.Errorf("smb: message authentication failed")
+	}
+	return append(dst, plaintext...), nil
+}
+
+// KDF is the SP800-108 counter mode KDF with HMAC-SHA256 used by SMB 3.x, size is the key length in bytes, 16 or 32.
+func KDF(key, label, context []byte, size int) []byte {
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(size*8))
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(label)
+	h.Write([]byte{0})
+	h.Write(context)
+	h.Write(l)
+	return h.Sum(nil)[:size]
+}
@@ -0,0 +1,46 @@
+//go:build darwin
+
+package smb
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// posixACLs tells if the file systems keep POSIX ACLs in system.posix_acl_access.
+const posixACLs = false
+
+// statOf reads what the file system keeps beside os.FileInfo, ok is false for file systems that
+// are not backed by the OS.
+func statOf(fi os.FileInfo) (st fileStat, ok bool) {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return st, false
+	}
+	return fileStat{
+		ino:       sys.Ino,
+		nlink:     uint32(sys.Nlink),
+		uid:       sys.Uid,
+		gid:       sys.Gid,
+		allocated: sys.Blocks * 512,
+		atime:     time.Unix(sys.Atimespec.Unix()),
+		ctime:     time.Unix(sys.Ctimespec.Unix()),
+		btime:     time.Unix(sys.Birthtimespec.Unix()),
+	}, true
+}
+
+// statVolume asks the file system of path for its space.
+func statVolume(path string) (VolumeStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return VolumeStat{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return VolumeStat{
+		Total:     st.Blocks * bsize,
+		Free:      st.Bfree * bsize,
+		Available: st.Bavail * bsize,
+		BlockSize: st.Bsize,
+	}, nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package smb
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// posixACLs tells if the file systems keep POSIX ACLs in system.posix_acl_access.
+const posixACLs = true
+
+// statOf reads what the file system keeps beside os.FileInfo, ok is false for file systems that
+// are not backed by the OS.
+func statOf(fi os.FileInfo) (st fileStat, ok bool) {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return st, false
+	}
+	return fileStat{
+		ino:       sys.Ino,
+		nlink:     uint32(sys.Nlink),
+		uid:       sys.Uid,
+		gid:       sys.Gid,
+		allocated: sys.Blocks * 512,
+		atime:     time.Unix(sys.Atim.Unix()),
+		ctime:     time.Unix(sys.Ctim.Unix()),
+	}, true
+}
+
+// statVolume asks the file system of path for its space.
+func statVolume(path string) (VolumeStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return VolumeStat{}, err
+	}
+	bsize := uint64(st.Frsize)
+	if bsize == 0 {
+		bsize = uint64(st.Bsize)
+	}
+	return VolumeStat{
+		Total:     uint64(st.Blocks) * bsize,
+		Free:      uint64(st.Bfree) * bsize,
+		Available: uint64(st.Bavail) * bsize,
+		BlockSize: uint32(bsize),
+	}, nil
+}
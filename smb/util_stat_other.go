@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package smb
+
+import (
+	"errors"
+	"os"
+)
+
+// posixACLs tells if the file systems keep POSIX ACLs in system.posix_acl_access.
+const posixACLs = false
+
+// statOf has nothing beside os.FileInfo here.
+func statOf(fi os.FileInfo) (st fileStat, ok bool) {
+	return st, false
+}
+
+// statVolume needs Anchor.Volume here.
+func statVolume(path string) (VolumeStat, error) {
+	return VolumeStat{}, errors.New("statfs is not supported")
+}
@@ -0,0 +1,105 @@
+package smb
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func Test_AesCmac(t *testing.T) {
+	//RFC 4493 examples
+	key := mustHex("2b7e151628aed2a6abf7158809cf4f3c")
+	msg := mustHex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	for _, item := range []struct {
+		size int
+		mac  string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	} {
+		mac, err := AesCmac(key, msg[:item.size])
+		assert.Nil(t, err)
+		assert.Equal(t, item.mac, hex.EncodeToString(mac))
+	}
+}
+
+func Test_KDF(t *testing.T) {
+	assert.Equal(t, "ca3928a6664e3cfdc87eef2dff7c78ac", hex.EncodeToString(KDF([]byte("foo"), []byte("bar"), []byte("baz"), 16)))
+}
+
+func Test_VerifySmb3(t *testing.T) {
+	//SESSION_SETUP response of a 3.0 server signed with AES-CMAC
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_3_0
+	session.signingAlgorithm = signingAlgorithm(session.dialect)
+	session.SessionKey = mustHex("726d4c454e63516446695457664e5042")
+	session.deriveKeys()
+
+	pkt := mustHex("fe534d42400001000000000001007f00090000000000000003000000000000000000000000000000020000007bfba3f4041393e756a048c9092c4e52dc7037190900000048000900a1073005a0030a0100")
+	assert.Equal(t, StatusOk, session.verifyMessage(pkt))
+
+	signed := append([]byte(nil), pkt...)
+	session.signCompound(signed)
+	assert.Equal(t, pkt, signed)
+
+	pkt[len(pkt)-1] ^= 1
+	assert.Equal(t, STATUS_ACCESS_DENIED, session.verifyMessage(pkt))
+}
+
+func Test_SignRequired(t *testing.T) {
+	session := NewSessionServer(true, nil, nil, nil)
+	session.dialect = DialectSmb_3_1_1
+	session.signingAlgorithm = SigningAesGmac
+	session.SigningKey = mustHex("000102030405060708090a0b0c0d0e0f")
+
+	msg := make([]byte, 72)
+	copy(msg, ProtocolSmb2)
+	msg[24] = 5 //MessageID
+	assert.Equal(t, StatusOk, session.verifyMessage(msg))
+	session.IsSigningRequired = true
+	assert.Equal(t, STATUS_ACCESS_DENIED, session.verifyMessage(msg))
+
+	setSigned(msg)
+	session.signCompound(msg)
+	assert.Equal(t, StatusOk, session.verifyMessage(msg))
+
+	//the nonce binds the MessageID
+	msg[24] = 6
+	assert.Equal(t, STATUS_ACCESS_DENIED, session.verifyMessage(msg))
+}
+
+func Test_AesCcm(t *testing.T) {
+	//NIST SP800-38C examples
+	key := mustHex("404142434445464748494a4b4c4d4e4f")
+	for _, item := range []struct {
+		nonce, adata, plaintext, ciphertext string
+		tagSize                             int
+	}{
+		{"10111213141516", "0001020304050607", "20212223", "7162015b4dac255d", 4},
+		{"1011121314151617", "000102030405060708090a0b0c0d0e0f", "202122232425262728292a2b2c2d2e2f", "d2a1f0e051ea5f62081a7792073d593d1fc64fbfaccd", 6},
+		{"101112131415161718191a1b", "000102030405060708090a0b0c0d0e0f10111213", "202122232425262728292a2b2c2d2e2f3031323334353637", "e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951", 8},
+	} {
+		nonce := mustHex(item.nonce)
+		ccm, err := NewAesCcm(key, len(nonce), item.tagSize)
+		assert.Nil(t, err)
+		ciphertext := ccm.Seal(nil, nonce, mustHex(item.plaintext), mustHex(item.adata))
+		assert.Equal(t, item.ciphertext, hex.EncodeToString(ciphertext))
+		plaintext, err := ccm.Open(nil, nonce, ciphertext, mustHex(item.adata))
+		assert.Nil(t, err)
+		assert.Equal(t, item.plaintext, hex.EncodeToString(plaintext))
+		ciphertext[0] ^= 1
+		_, err = ccm.Open(nil, nonce, ciphertext, mustHex(item.adata))
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux
+
+package smb
+
+// kXattrUserPrefix is the namespace of the attributes users may set, keys without one go there.
+const kXattrUserPrefix = "user."